@@ -0,0 +1,15 @@
+-- USER_TABLE and USER_INFO are provisioned outside of the services, which only add columns to them.
+-- This creates them as they are provisioned, for the tests against a database, e.g., in CI
+CREATE TABLE IF NOT EXISTS USER_TABLE (
+	user_email VARCHAR(255) NOT NULL,
+	name VARCHAR(255) NOT NULL,
+	password VARCHAR(255) NOT NULL,
+	user_id VARCHAR(255) PRIMARY KEY
+);
+
+CREATE TABLE IF NOT EXISTS USER_INFO (
+	user_id VARCHAR(255) PRIMARY KEY,
+	profile_url TEXT NOT NULL DEFAULT '',
+	name VARCHAR(255) NOT NULL,
+	profile_comment TEXT NOT NULL DEFAULT ''
+);
@@ -3,8 +3,10 @@ module github.com/110billion/sellfie/postmanagerservice
 go 1.17
 
 require (
+	github.com/dgrijalva/jwt-go v3.2.0+incompatible
 	github.com/go-logr/logr v1.2.3
 	github.com/gorilla/mux v1.8.0
+	github.com/lib/pq v1.10.4
 	gopkg.in/robfig/cron.v2 v2.0.0-20150107220207-be2e0b0deed5
 	k8s.io/api v0.24.1
 	k8s.io/apimachinery v0.24.1
@@ -40,8 +40,14 @@ type RouterWrapper interface {
 	Handler() http.HandlerFunc
 	SubPath() string
 	Methods() []string
+
+	Middlewares() []Middleware
+	Use(...Middleware)
 }
 
+// Middleware decorates a handler, e.g., to authenticate the request before it reaches the handler
+type Middleware func(http.HandlerFunc) http.HandlerFunc
+
 // Wrapper wraps router with tree structure
 type Wrapper struct {
 	router *mux.Router
@@ -50,6 +56,8 @@ type Wrapper struct {
 	methods []string
 	handler http.HandlerFunc
 
+	middlewares []Middleware
+
 	children []RouterWrapper
 	parent   RouterWrapper
 }
@@ -103,6 +111,17 @@ func (w *Wrapper) Methods() []string {
 	return w.methods
 }
 
+// Middlewares returns its middlewares
+func (w *Wrapper) Middlewares() []Middleware {
+	return w.middlewares
+}
+
+// Use appends middlewares, which are applied to the handlers of w and of its descendants.
+// Middlewares should be set before the children are added, as they are applied when a handler is registered
+func (w *Wrapper) Use(middlewares ...Middleware) {
+	w.middlewares = append(w.middlewares, middlewares...)
+}
+
 // Add adds child as a child (child node of a tree) of w
 func (w *Wrapper) Add(child RouterWrapper) error {
 	if child == nil || child.(*Wrapper) == nil {
@@ -127,18 +146,32 @@ func (w *Wrapper) Add(child RouterWrapper) error {
 	child.SetRouter(w.router.PathPrefix(child.SubPath()).Subrouter())
 
 	if child.Handler() != nil {
+		handler := chain(child)
 		if len(child.Methods()) > 0 {
-			child.Router().Methods(child.Methods()...).Subrouter().HandleFunc("/", child.Handler())
-			w.router.Methods(child.Methods()...).Subrouter().HandleFunc(child.SubPath(), child.Handler())
+			child.Router().Methods(child.Methods()...).Subrouter().HandleFunc("/", handler)
+			w.router.Methods(child.Methods()...).Subrouter().HandleFunc(child.SubPath(), handler)
 		} else {
-			child.Router().HandleFunc("/", child.Handler())
-			w.router.HandleFunc(child.SubPath(), child.Handler())
+			child.Router().HandleFunc("/", handler)
+			w.router.HandleFunc(child.SubPath(), handler)
 		}
 	}
 
 	return nil
 }
 
+// chain wraps the handler of w with the middlewares of w and of its ancestors.
+// Middlewares of the ancestors run first, in the order they were added
+func chain(w RouterWrapper) http.HandlerFunc {
+	handler := w.Handler()
+	for node := w; node != nil; node = node.Parent() {
+		middlewares := node.Middlewares()
+		for i := len(middlewares) - 1; i >= 0; i-- {
+			handler = middlewares[i](handler)
+		}
+	}
+	return handler
+}
+
 // FullPath builds full path string of the api
 func (w *Wrapper) FullPath() string {
 	if w.parent == nil {
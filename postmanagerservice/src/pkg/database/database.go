@@ -3,6 +3,8 @@ package database
 import (
 	"database/sql"
 	"os"
+
+	_ "github.com/lib/pq"
 )
 
 // Connect opens postgresql DB
@@ -10,9 +12,12 @@ func Connect() (*sql.DB, error) {
 	dataSourceName := "host=" + os.Getenv("DB_HOST") + " port=" + os.Getenv("DB_PORT") + " user=" + os.Getenv("DB_USER") + " password=" + os.Getenv("DB_PWD") + " dbname=" + os.Getenv("DB_NAME") + " sslmode=disable"
 
 	db, err := sql.Open("postgres", dataSourceName)
+	if err != nil {
+		return nil, err
+	}
 
-	if err != nil || db.Ping() != nil {
-		db.Close()
+	if err := db.Ping(); err != nil {
+		_ = db.Close()
 		return nil, err
 	}
 	return db, nil
@@ -0,0 +1,53 @@
+/*
+ Copyright 2021 The 110 billion Authors
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package database
+
+// schema lists the statements creating the tables owned by the post manager.
+// Every statement must be idempotent, as all of them run whenever the server starts
+var schema = []string{
+	// Deletions recorded by the user_id handle before user_uuid cannot be matched to user_uuids here.
+	// Nothing reads them, so the old table is dropped and created again
+	`DO $$
+	BEGIN
+		IF EXISTS (SELECT 1 FROM information_schema.columns WHERE table_schema = current_schema()
+			AND table_name = 'deleted_user' AND column_name = 'user_id') THEN
+			DROP TABLE DELETED_USER;
+		END IF;
+	END $$`,
+	// DELETED_USER records the users deleted by the user manager, by the user_uuid which is never reused.
+	// Postings are not stored yet, so nothing reads it; postings of a user created before deleted_at are to be anonymized
+	`CREATE TABLE IF NOT EXISTS DELETED_USER (
+		user_uuid UUID PRIMARY KEY,
+		deleted_at TIMESTAMPTZ NOT NULL
+	)`,
+}
+
+// Migrate creates the tables owned by the post manager, if they do not exist
+func Migrate() error {
+	db, err := Connect()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	for _, stmt := range schema {
+		if _, err := db.Exec(stmt); err != nil {
+			return err
+		}
+	}
+	return nil
+}
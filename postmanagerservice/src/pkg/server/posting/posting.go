@@ -5,6 +5,7 @@ import (
 	"github.com/110billion/sellfie/postmanagerservice/src/internal/wrapper"
 	"github.com/110billion/sellfie/postmanagerservice/src/pkg/server/posting/delete"
 	"github.com/110billion/sellfie/postmanagerservice/src/pkg/server/posting/upload"
+	"github.com/110billion/sellfie/postmanagerservice/src/pkg/token"
 	"github.com/go-logr/logr"
 )
 
@@ -19,6 +20,7 @@ func NewHandler(parent wrapper.RouterWrapper, logger logr.Logger) (apiserver.API
 
 	// /posting
 	postingWrapper := wrapper.New("/posting", nil, nil)
+	postingWrapper.Use(token.Authenticate)
 	if err := parent.Add(postingWrapper); err != nil {
 		return nil, err
 	}
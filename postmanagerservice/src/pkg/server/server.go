@@ -21,7 +21,9 @@ import (
 	"github.com/110billion/sellfie/postmanagerservice/src/internal/apiserver"
 	"github.com/110billion/sellfie/postmanagerservice/src/internal/utils"
 	"github.com/110billion/sellfie/postmanagerservice/src/internal/wrapper"
+	"github.com/110billion/sellfie/postmanagerservice/src/pkg/database"
 	"github.com/110billion/sellfie/postmanagerservice/src/pkg/server/posting"
+	"github.com/110billion/sellfie/postmanagerservice/src/pkg/server/users"
 	"github.com/gorilla/mux"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"net/http"
@@ -44,12 +46,17 @@ type Server interface {
 
 // UserManagingServer is HTTP server for login API
 type server struct {
-	wrapper     wrapper.RouterWrapper
-	authHandler apiserver.APIHandler
+	wrapper      wrapper.RouterWrapper
+	authHandler  apiserver.APIHandler
+	usersHandler apiserver.APIHandler
 }
 
 // New is a constructor of Server
 func New() (Server, error) {
+	if err := database.Migrate(); err != nil {
+		return nil, err
+	}
+
 	srv := &server{}
 	srv.wrapper = wrapper.New("/", nil, srv.rootHandler)
 
@@ -63,6 +70,13 @@ func New() (Server, error) {
 	}
 	srv.authHandler = authHandler
 
+	// Set usersHandler
+	usersHandler, err := users.NewHandler(srv.wrapper, log)
+	if err != nil {
+		return nil, err
+	}
+	srv.usersHandler = usersHandler
+
 	return srv, nil
 }
 
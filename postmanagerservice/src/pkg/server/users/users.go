@@ -0,0 +1,133 @@
+/*
+ Copyright 2021 The 110 billion Authors
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package users
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/110billion/sellfie/postmanagerservice/src/internal/apiserver"
+	"github.com/110billion/sellfie/postmanagerservice/src/internal/utils"
+	"github.com/110billion/sellfie/postmanagerservice/src/internal/wrapper"
+	"github.com/110billion/sellfie/postmanagerservice/src/pkg/database"
+	"github.com/110billion/sellfie/postmanagerservice/src/pkg/token"
+	"github.com/go-logr/logr"
+	"github.com/gorilla/mux"
+)
+
+// ExportResponse is the data of a user the user manager puts into the export archive of the user
+type ExportResponse struct {
+	Postings  []interface{} `json:"postings"`
+	Donations []interface{} `json:"donations"`
+	Media     []Media       `json:"media"`
+}
+
+// Media is a media file of a posting, which the user manager downloads into the archive
+type Media struct {
+	// Name is the path of the file in the archive, under media/postings
+	Name string `json:"name"`
+	URL  string `json:"url"`
+}
+
+// Response is common struct for responding requests of the user manager
+type Response struct {
+	Ok bool `json:"ok"`
+}
+
+type handler struct {
+	log logr.Logger
+}
+
+// NewHandler instantiates a new api handler for the requests of the user manager about its users
+func NewHandler(parent wrapper.RouterWrapper, logger logr.Logger) (apiserver.APIHandler, error) {
+	handler := &handler{log: logger}
+
+	// /internal
+	internalWrapper := wrapper.New("/internal", nil, nil)
+	if err := parent.Add(internalWrapper); err != nil {
+		return nil, err
+	}
+
+	// /internal/users
+	usersWrapper := wrapper.New("/users", nil, nil)
+	if err := internalWrapper.Add(usersWrapper); err != nil {
+		return nil, err
+	}
+
+	// /internal/users/{user_uuid}
+	userWrapper := wrapper.New("/{user_uuid}", []string{http.MethodDelete}, handler.deleteHandler)
+	userWrapper.Use(token.AuthenticateAction(token.ActionUserDeleted))
+	if err := usersWrapper.Add(userWrapper); err != nil {
+		return nil, err
+	}
+
+	// /internal/users/{user_uuid}/export
+	exportWrapper := wrapper.New("/{user_uuid}/export", []string{http.MethodGet}, handler.exportHandler)
+	exportWrapper.Use(token.AuthenticateAction(token.ActionUserExport))
+	if err := usersWrapper.Add(exportWrapper); err != nil {
+		return nil, err
+	}
+
+	return handler, nil
+}
+
+// deleteHandler records that the user manager deleted the user. The user manager retries until it succeeds, so it is idempotent.
+// Postings and media are not stored by the post manager yet, so nothing is anonymized; whatever stores them must
+// anonymize the ones of the users recorded here, created before deleted_at, or filter them out wherever they are read
+func (h *handler) deleteHandler(w http.ResponseWriter, req *http.Request) {
+	userUUID := mux.Vars(req)["user_uuid"]
+
+	claims, _ := token.ActionFromContext(req.Context())
+	if claims.Subject != userUUID {
+		_ = utils.RespondError(w, http.StatusForbidden, "token is not issued for the user")
+		return
+	}
+
+	// Open DB
+	db, err := database.Connect()
+	if err != nil {
+		h.log.Error(err, "delete user error")
+		_ = utils.RespondError(w, http.StatusInternalServerError, "db connection error")
+		return
+	}
+	defer db.Close()
+
+	deletedAt := time.Unix(claims.IssuedAt, 0)
+	if _, err := db.Exec(`INSERT INTO DELETED_USER (user_uuid, deleted_at) VALUES($1, $2)
+		ON CONFLICT (user_uuid) DO UPDATE SET deleted_at = GREATEST(DELETED_USER.deleted_at, EXCLUDED.deleted_at)`, userUUID, deletedAt); err != nil {
+		h.log.Error(err, "delete user error", "user", userUUID)
+		_ = utils.RespondError(w, http.StatusInternalServerError, "cannot delete user")
+		return
+	}
+	h.log.Info("user is deleted by the user manager", "user", userUUID)
+
+	_ = utils.RespondJSON(w, Response{Ok: true})
+}
+
+// exportHandler responds with the postings, the donations and the media of the user
+func (h *handler) exportHandler(w http.ResponseWriter, req *http.Request) {
+	userUUID := mux.Vars(req)["user_uuid"]
+
+	claims, _ := token.ActionFromContext(req.Context())
+	if claims.Subject != userUUID {
+		_ = utils.RespondError(w, http.StatusForbidden, "token is not issued for the user")
+		return
+	}
+
+	// Postings and donations are not stored by the post manager yet, so there is nothing of the user to export
+	_ = utils.RespondJSON(w, ExportResponse{Postings: []interface{}{}, Donations: []interface{}{}, Media: []Media{}})
+}
@@ -0,0 +1,98 @@
+/*
+ Copyright 2021 The 110 billion Authors
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package token
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/110billion/sellfie/postmanagerservice/src/internal/utils"
+	"github.com/dgrijalva/jwt-go"
+)
+
+const (
+	// ActionUserDeleted is the audience of the tokens the user manager authorizes deleting the data of a deleted user with
+	ActionUserDeleted = "user_deleted"
+	// ActionUserExport is the audience of the tokens the user manager authorizes exporting the data of a user with
+	ActionUserExport = "user_export"
+)
+
+// ActionClaims is the claim set of a token the user manager issues to authorize a single action on a user.
+// The action is the audience (aud) of the token, so that it is neither usable for another action nor as an access token
+type ActionClaims struct {
+	jwt.StandardClaims
+}
+
+// Valid validates the time-based claims and checks that the token identifies a user
+func (c *ActionClaims) Valid() error {
+	if err := c.StandardClaims.Valid(); err != nil {
+		return err
+	}
+	if c.Subject == "" || c.Id == "" {
+		return fmt.Errorf("token does not identify a user")
+	}
+	if c.Issuer != Issuer {
+		return fmt.Errorf("unexpected issuer %q", c.Issuer)
+	}
+	return nil
+}
+
+// ParseActionToken verifies the signature and the claims of the token, which must authorize the action
+func ParseActionToken(action, tokenString string) (*ActionClaims, error) {
+	claims := &ActionClaims{}
+	if _, err := jwt.ParseWithClaims(tokenString, claims, verificationKey); err != nil {
+		return nil, err
+	}
+	if claims.Audience != action {
+		return nil, fmt.Errorf("token is not issued for %s", action)
+	}
+	return claims, nil
+}
+
+type actionContextKey struct{}
+
+// ActionFromContext returns the claims of the action token, stored by AuthenticateAction
+func ActionFromContext(ctx context.Context) (*ActionClaims, bool) {
+	claims, ok := ctx.Value(actionContextKey{}).(*ActionClaims)
+	return claims, ok
+}
+
+// AuthenticateAction returns a wrapper middleware which rejects requests without a valid bearer token authorizing the action.
+// Claims of the token are available to the next handler via ActionFromContext
+func AuthenticateAction(action string) func(http.HandlerFunc) http.HandlerFunc {
+	return func(next http.HandlerFunc) http.HandlerFunc {
+		return func(w http.ResponseWriter, req *http.Request) {
+			header := req.Header.Get("Authorization")
+			if len(header) < len(bearerPrefix) || !strings.EqualFold(header[:len(bearerPrefix)], bearerPrefix) {
+				w.Header().Set("WWW-Authenticate", `Bearer realm="sellfie"`)
+				_ = utils.RespondError(w, http.StatusUnauthorized, "bearer token is required")
+				return
+			}
+
+			claims, err := ParseActionToken(action, strings.TrimSpace(header[len(bearerPrefix):]))
+			if err != nil {
+				w.Header().Set("WWW-Authenticate", `Bearer realm="sellfie", error="invalid_token"`)
+				_ = utils.RespondError(w, http.StatusUnauthorized, "token is invalid or expired")
+				return
+			}
+
+			next(w, req.WithContext(context.WithValue(req.Context(), actionContextKey{}, claims)))
+		}
+	}
+}
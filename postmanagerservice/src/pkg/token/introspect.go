@@ -0,0 +1,144 @@
+/*
+ Copyright 2021 The 110 billion Authors
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package token
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/110billion/sellfie/postmanagerservice/src/internal/utils"
+)
+
+var (
+	introspectClient = &http.Client{Timeout: 5 * time.Second}
+
+	// introspectionCacheTTL is how long the user manager is trusted to tell that a token is not revoked
+	introspectionCacheTTL = utils.DurationFromEnv("TOKEN_INTROSPECTION_CACHE_TTL", 5*time.Second)
+
+	introspections = &introspectionCache{entries: map[string]introspection{}, lastSweep: time.Now()}
+)
+
+// isRevoked asks the user manager at USER_MANAGER_INTROSPECT_URL whether the access token is revoked, e.g., by logging out.
+// Revocations are not checked if the url is not set. The answers are cached, and the token is trusted by its signature
+// if the user manager cannot be reached, so that the post manager keeps working without it
+func isRevoked(ctx context.Context, claims *Claims, tokenString string) bool {
+	url := os.Getenv("USER_MANAGER_INTROSPECT_URL")
+	if url == "" {
+		return false
+	}
+
+	// The user manager gives every token a jti
+	key := claims.Id
+	if key == "" {
+		key = tokenString
+	}
+	if revoked, ok := introspections.get(key); ok {
+		return revoked
+	}
+
+	active, err := introspect(ctx, url, tokenString)
+	if err != nil {
+		log.Error(err, "cannot check token revocation, trusting the signature")
+		return false
+	}
+	introspections.set(key, !active, time.Unix(claims.ExpiresAt, 0))
+	return !active
+}
+
+// introspect asks the user manager whether the access token is active
+func introspect(ctx context.Context, url, tokenString string) (bool, error) {
+	body, err := json.Marshal(map[string]string{"token": tokenString})
+	if err != nil {
+		return false, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := introspectClient.Do(req)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return false, fmt.Errorf("cannot introspect token, status %d", resp.StatusCode)
+	}
+
+	result := struct {
+		Active bool `json:"active"`
+	}{}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return false, err
+	}
+	return result.Active, nil
+}
+
+type introspection struct {
+	revoked bool
+	until   time.Time
+}
+
+// introspectionCache caches the answers of the user manager by the jti of the token, or the token itself without one.
+// Revoked tokens are cached until they expire, while active ones are cached for introspectionCacheTTL
+type introspectionCache struct {
+	lock sync.Mutex
+
+	entries   map[string]introspection
+	lastSweep time.Time
+}
+
+func (c *introspectionCache) get(key string) (bool, bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	entry, ok := c.entries[key]
+	if !ok || time.Now().After(entry.until) {
+		return false, false
+	}
+	return entry.revoked, true
+}
+
+func (c *introspectionCache) set(key string, revoked bool, expiresAt time.Time) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	now := time.Now()
+	until := now.Add(introspectionCacheTTL)
+	if revoked {
+		until = expiresAt
+	}
+	c.entries[key] = introspection{revoked: revoked, until: until}
+
+	// Expired entries are dropped once in a while
+	if now.Sub(c.lastSweep) < time.Minute {
+		return
+	}
+	for k, entry := range c.entries {
+		if now.After(entry.until) {
+			delete(c.entries, k)
+		}
+	}
+	c.lastSweep = now
+}
@@ -0,0 +1,168 @@
+/*
+ Copyright 2021 The 110 billion Authors
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package token
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	defaultJWKSURL = "http://usermanagerservice:3550/.well-known/jwks.json"
+
+	// jwksRefreshInterval is how long the fetched keys are trusted before they are fetched again
+	jwksRefreshInterval = 5 * time.Minute
+	// jwksMinRefreshInterval limits how often an unknown kid triggers fetching the keys
+	jwksMinRefreshInterval = 30 * time.Second
+)
+
+var publicKeys = &keySet{client: &http.Client{Timeout: 10 * time.Second}}
+
+// jsonWebKey is a public key in the JWK form (RFC 7517)
+type jsonWebKey struct {
+	KeyType string `json:"kty"`
+	KeyID   string `json:"kid"`
+	Alg     string `json:"alg"`
+	N       string `json:"n"`
+	E       string `json:"e"`
+	Curve   string `json:"crv"`
+	X       string `json:"x"`
+}
+
+type publicKey struct {
+	alg string
+	key crypto.PublicKey
+}
+
+// keySet caches the public keys the user manager publishes at its JWKS endpoint
+type keySet struct {
+	lock   sync.RWMutex
+	client *http.Client
+
+	keys      map[string]publicKey
+	fetchedAt time.Time
+}
+
+// get returns the public key with the kid, fetching the JWKS if the cache is stale or the kid is unknown
+func (s *keySet) get(id string) (publicKey, error) {
+	s.lock.RLock()
+	key, ok := s.keys[id]
+	age := time.Since(s.fetchedAt)
+	s.lock.RUnlock()
+
+	if (ok && age < jwksRefreshInterval) || (!ok && age < jwksMinRefreshInterval) {
+		if !ok {
+			return publicKey{}, fmt.Errorf("unknown key %q", id)
+		}
+		return key, nil
+	}
+
+	if err := s.fetch(); err != nil {
+		// Keep verifying with the cached key while the user manager is unreachable
+		if ok {
+			return key, nil
+		}
+		return publicKey{}, err
+	}
+
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	key, ok = s.keys[id]
+	if !ok {
+		return publicKey{}, fmt.Errorf("unknown key %q", id)
+	}
+	return key, nil
+}
+
+func (s *keySet) fetch() error {
+	url := os.Getenv("USER_MANAGER_JWKS_URL")
+	if url == "" {
+		url = defaultJWKSURL
+	}
+
+	s.lock.Lock()
+	s.fetchedAt = time.Now()
+	s.lock.Unlock()
+
+	resp, err := s.client.Get(url)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("cannot fetch jwks, status %d", resp.StatusCode)
+	}
+
+	set := struct {
+		Keys []jsonWebKey `json:"keys"`
+	}{}
+	if err := json.NewDecoder(resp.Body).Decode(&set); err != nil {
+		return err
+	}
+
+	keys := map[string]publicKey{}
+	for _, jwk := range set.Keys {
+		key, err := jwk.publicKey()
+		if err != nil {
+			return err
+		}
+		keys[jwk.KeyID] = publicKey{alg: jwk.Alg, key: key}
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.keys = keys
+	return nil
+}
+
+func (k *jsonWebKey) publicKey() (crypto.PublicKey, error) {
+	switch k.KeyType {
+	case "RSA":
+		n, err := base64.RawURLEncoding.DecodeString(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := base64.RawURLEncoding.DecodeString(k.E)
+		if err != nil {
+			return nil, err
+		}
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}, nil
+	case "OKP":
+		if k.Curve != "Ed25519" {
+			return nil, fmt.Errorf("unsupported curve %s", k.Curve)
+		}
+		x, err := base64.RawURLEncoding.DecodeString(k.X)
+		if err != nil {
+			return nil, err
+		}
+		if len(x) != ed25519.PublicKeySize {
+			return nil, fmt.Errorf("invalid ed25519 key %s", k.KeyID)
+		}
+		return ed25519.PublicKey(x), nil
+	default:
+		return nil, fmt.Errorf("unsupported key type %s", k.KeyType)
+	}
+}
@@ -0,0 +1,135 @@
+/*
+ Copyright 2021 The 110 billion Authors
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package token
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/110billion/sellfie/postmanagerservice/src/internal/utils"
+	"github.com/dgrijalva/jwt-go"
+	logf "sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+const (
+	// Issuer is the issuer (iss) of the tokens minted by the user manager
+	Issuer = "sellfie-user-manager"
+
+	bearerPrefix = "Bearer "
+)
+
+var log = logf.Log.WithName("token")
+
+// Claims is the claim set of an access token issued by the user manager. The subject is the user_uuid,
+// which identifies the user for good, and UserID is the handle of the user, which can change and is only displayed
+type Claims struct {
+	UserID string `json:"uid"`
+	Email  string `json:"email"`
+	jwt.StandardClaims
+}
+
+// Valid validates the time-based claims and checks that the token identifies a user
+func (c *Claims) Valid() error {
+	if err := c.StandardClaims.Valid(); err != nil {
+		return err
+	}
+	if c.Subject == "" || c.UserID == "" {
+		return fmt.Errorf("token does not identify a user")
+	}
+	if c.Issuer != Issuer {
+		return fmt.Errorf("unexpected issuer %q", c.Issuer)
+	}
+	// Tokens with an audience authorize a single action, and are not access tokens
+	if c.Audience != "" {
+		return fmt.Errorf("token is not an access token")
+	}
+	return nil
+}
+
+// Parse verifies the signature and the claims of the token and returns its claims
+func Parse(tokenString string) (*Claims, error) {
+	claims := &Claims{}
+	if _, err := jwt.ParseWithClaims(tokenString, claims, verificationKey); err != nil {
+		return nil, err
+	}
+	return claims, nil
+}
+
+// verificationKey looks up the key to verify the token with.
+// Tokens signed with a key pair are verified with the public keys published by the user manager.
+// HS256 tokens are accepted only if the shared secret JWT_SECRET_KEY is configured
+func verificationKey(t *jwt.Token) (interface{}, error) {
+	if t.Method == jwt.SigningMethodHS256 {
+		secret := os.Getenv("JWT_SECRET_KEY")
+		if secret == "" {
+			return nil, fmt.Errorf("unexpected signing method %s", t.Header["alg"])
+		}
+		return []byte(secret), nil
+	}
+
+	id, _ := t.Header["kid"].(string)
+	key, err := publicKeys.get(id)
+	if err != nil {
+		return nil, err
+	}
+	if t.Method.Alg() != key.alg {
+		return nil, fmt.Errorf("unexpected signing method %s", t.Header["alg"])
+	}
+	return key.key, nil
+}
+
+type contextKey struct{}
+
+// FromContext returns the claims of the authenticated user, stored by Authenticate
+func FromContext(ctx context.Context) (*Claims, bool) {
+	claims, ok := ctx.Value(contextKey{}).(*Claims)
+	return claims, ok
+}
+
+// Authenticate is a wrapper middleware which rejects requests without a valid bearer token.
+// Tokens are verified with the public keys of the user manager, which is asked whether they are revoked only if
+// USER_MANAGER_INTROSPECT_URL is set. Claims of the token are available to the next handler via FromContext
+func Authenticate(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		header := req.Header.Get("Authorization")
+		if len(header) < len(bearerPrefix) || !strings.EqualFold(header[:len(bearerPrefix)], bearerPrefix) {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="sellfie"`)
+			_ = utils.RespondError(w, http.StatusUnauthorized, "bearer token is required")
+			return
+		}
+
+		tokenString := strings.TrimSpace(header[len(bearerPrefix):])
+		claims, err := Parse(tokenString)
+		if err != nil {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="sellfie", error="invalid_token"`)
+			_ = utils.RespondError(w, http.StatusUnauthorized, "token is invalid or expired")
+			return
+		}
+
+		// The signature does not tell whether the token is revoked, e.g., by logging out
+		if isRevoked(req.Context(), claims, tokenString) {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="sellfie", error="invalid_token"`)
+			_ = utils.RespondError(w, http.StatusUnauthorized, "token is revoked")
+			return
+		}
+
+		next(w, req.WithContext(context.WithValue(req.Context(), contextKey{}, claims)))
+	}
+}
@@ -53,6 +53,27 @@ func GetUserGroups(header http.Header) ([]string, error) {
 	return nil, fmt.Errorf("no header %s", groupHeader)
 }
 
+// SetUser sets the name and the groups of the authenticated user in the header, replacing any value the client sent
+func SetUser(header http.Header, name string, groups []string) {
+	header.Set(userHeader, name)
+	header.Del(groupHeader)
+	for _, g := range groups {
+		header.Add(groupHeader, g)
+	}
+}
+
+// StripUserHeaders removes the user headers the client sent, so that only authenticating middlewares set them
+func StripUserHeaders(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		for k := range req.Header {
+			if k == userHeader || k == groupHeader || strings.HasPrefix(k, extrasHeader) {
+				req.Header.Del(k)
+			}
+		}
+		next.ServeHTTP(w, req)
+	})
+}
+
 // GetUserExtras extracts user extras from the header
 func GetUserExtras(header http.Header) map[string]authorization.ExtraValue {
 	extras := map[string]authorization.ExtraValue{}
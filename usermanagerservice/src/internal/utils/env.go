@@ -0,0 +1,60 @@
+/*
+ Copyright 2021 The 110 billion Authors
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package utils
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+
+	logf "sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+var log = logf.Log.WithName("utils")
+
+// DurationFromEnv reads a duration (e.g., 15m) from the environment variable key.
+// def is returned if the variable is not set or is not a valid duration
+func DurationFromEnv(key string, def time.Duration) time.Duration {
+	value := os.Getenv(key)
+	if value == "" {
+		return def
+	}
+
+	d, err := time.ParseDuration(value)
+	if err != nil || d <= 0 {
+		log.Error(fmt.Errorf("invalid duration %q", value), "falling back to the default", "env", key, "default", def.String())
+		return def
+	}
+	return d
+}
+
+// IntFromEnv reads a non-negative integer from the environment variable key.
+// def is returned if the variable is not set or is not a valid integer
+func IntFromEnv(key string, def int) int {
+	value := os.Getenv(key)
+	if value == "" {
+		return def
+	}
+
+	n, err := strconv.Atoi(value)
+	if err != nil || n < 0 {
+		log.Error(fmt.Errorf("invalid integer %q", value), "falling back to the default", "env", key, "default", def)
+		return def
+	}
+	return n
+}
@@ -0,0 +1,57 @@
+/*
+ Copyright 2021 The 110 billion Authors
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package utils
+
+import (
+	"net"
+	"net/http"
+	"strings"
+)
+
+// trustedProxyHops is the number of reverse proxies in front of the server, e.g., 1 for an ingress controller.
+// Each of them appends the address of its peer to X-Forwarded-For
+var trustedProxyHops = IntFromEnv("TRUSTED_PROXY_HOPS", 0)
+
+// ClientIP returns the IP address of the client of the request.
+// X-Forwarded-For is honored only as far as the trusted proxies appended it, as the client may send any value in it
+func ClientIP(req *http.Request) string {
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		host = req.RemoteAddr
+	}
+	if trustedProxyHops == 0 {
+		return host
+	}
+
+	var forwarded []string
+	for _, header := range req.Header.Values("X-Forwarded-For") {
+		for _, addr := range strings.Split(header, ",") {
+			if addr = strings.TrimSpace(addr); addr != "" {
+				forwarded = append(forwarded, addr)
+			}
+		}
+	}
+	if len(forwarded) == 0 {
+		return host
+	}
+
+	i := len(forwarded) - trustedProxyHops
+	if i < 0 {
+		i = 0
+	}
+	return forwarded[i]
+}
@@ -40,11 +40,26 @@ func RespondJSON(w http.ResponseWriter, data interface{}) error {
 
 // ErrorResponse is a common struct for responding error for HTTP requests
 type ErrorResponse struct {
+	Message string        `json:"message"`
+	Details []ErrorDetail `json:"details,omitempty"`
+}
+
+// ErrorDetail is a single reason of an error, e.g., a rule a field of the request breaks
+type ErrorDetail struct {
+	Field   string `json:"field,omitempty"`
+	Rule    string `json:"rule"`
 	Message string `json:"message"`
 }
 
 // RespondError responds to a HTTP request with body of ErrorResponse
 func RespondError(w http.ResponseWriter, code int, msg string) error {
+	return RespondErrorDetails(w, code, msg, nil)
+}
+
+// RespondErrorDetails responds to a HTTP request with body of ErrorResponse, listing the details of the error
+func RespondErrorDetails(w http.ResponseWriter, code int, msg string, details []ErrorDetail) error {
+	// Headers set after WriteHeader are not sent
+	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(code)
-	return RespondJSON(w, ErrorResponse{Message: msg})
+	return RespondJSON(w, ErrorResponse{Message: msg, Details: details})
 }
@@ -21,6 +21,8 @@ import (
 	"net/http"
 	"regexp"
 
+	"github.com/110billion/sellfie/usermanagerservice/src/internal/apiserver"
+	"github.com/110billion/sellfie/usermanagerservice/src/internal/utils"
 	"github.com/gorilla/mux"
 )
 
@@ -40,8 +42,17 @@ type RouterWrapper interface {
 	Handler() http.HandlerFunc
 	SubPath() string
 	Methods() []string
+
+	Middlewares() []Middleware
+	Use(...Middleware)
+
+	RequiredRoles() []string
+	Require(...string)
 }
 
+// Middleware decorates a handler, e.g., to authenticate the request before it reaches the handler
+type Middleware func(http.HandlerFunc) http.HandlerFunc
+
 // Wrapper wraps router with tree structure
 type Wrapper struct {
 	router *mux.Router
@@ -50,6 +61,9 @@ type Wrapper struct {
 	methods []string
 	handler http.HandlerFunc
 
+	middlewares []Middleware
+	roles       []string
+
 	children []RouterWrapper
 	parent   RouterWrapper
 }
@@ -103,6 +117,29 @@ func (w *Wrapper) Methods() []string {
 	return w.methods
 }
 
+// Middlewares returns its middlewares
+func (w *Wrapper) Middlewares() []Middleware {
+	return w.middlewares
+}
+
+// Use appends middlewares, which are applied to the handlers of w and of its descendants.
+// Middlewares should be set before the children are added, as they are applied when a handler is registered
+func (w *Wrapper) Use(middlewares ...Middleware) {
+	w.middlewares = append(w.middlewares, middlewares...)
+}
+
+// RequiredRoles returns the roles one of which is required to access w and its descendants
+func (w *Wrapper) RequiredRoles() []string {
+	return w.roles
+}
+
+// Require restricts w and its descendants to the users with any of the roles, i.e., in any of the groups of X-Remote-Group.
+// The header is set by an authenticating middleware, which must be used by w or by its ancestors.
+// As with Use, it should be set before the children are added
+func (w *Wrapper) Require(roles ...string) {
+	w.roles = append(w.roles, roles...)
+}
+
 // Add adds child as a child (child node of a tree) of w
 func (w *Wrapper) Add(child RouterWrapper) error {
 	if child == nil || child.(*Wrapper) == nil {
@@ -127,18 +164,73 @@ func (w *Wrapper) Add(child RouterWrapper) error {
 	child.SetRouter(w.router.PathPrefix(child.SubPath()).Subrouter())
 
 	if child.Handler() != nil {
+		handler := chain(child)
 		if len(child.Methods()) > 0 {
-			child.Router().Methods(child.Methods()...).Subrouter().HandleFunc("/", child.Handler())
-			w.router.Methods(child.Methods()...).Subrouter().HandleFunc(child.SubPath(), child.Handler())
+			child.Router().Methods(child.Methods()...).Subrouter().HandleFunc("/", handler)
+			w.router.Methods(child.Methods()...).Subrouter().HandleFunc(child.SubPath(), handler)
 		} else {
-			child.Router().HandleFunc("/", child.Handler())
-			w.router.HandleFunc(child.SubPath(), child.Handler())
+			child.Router().HandleFunc("/", handler)
+			w.router.HandleFunc(child.SubPath(), handler)
 		}
 	}
 
 	return nil
 }
 
+// chain wraps the handler of w with the middlewares of w and of its ancestors.
+// Middlewares of the ancestors run first, in the order they were added.
+// The roles required by w and by its ancestors are checked after every middleware, right before the handler
+func chain(w RouterWrapper) http.HandlerFunc {
+	handler := authorize(w, w.Handler())
+	for node := w; node != nil; node = node.Parent() {
+		middlewares := node.Middlewares()
+		for i := len(middlewares) - 1; i >= 0; i-- {
+			handler = middlewares[i](handler)
+		}
+	}
+	return handler
+}
+
+// authorize wraps the handler so that it is reached only by the users with the roles required by w and by its ancestors.
+// Each node requiring roles must be satisfied by one of its roles
+func authorize(w RouterWrapper, handler http.HandlerFunc) http.HandlerFunc {
+	var required [][]string
+	for node := w; node != nil; node = node.Parent() {
+		if roles := node.RequiredRoles(); len(roles) > 0 {
+			required = append(required, roles)
+		}
+	}
+	if len(required) == 0 {
+		return handler
+	}
+
+	return func(rw http.ResponseWriter, req *http.Request) {
+		groups, err := apiserver.GetUserGroups(req.Header)
+		if err != nil {
+			_ = utils.RespondError(rw, http.StatusUnauthorized, "authentication is required")
+			return
+		}
+		for _, roles := range required {
+			if !containsAny(groups, roles) {
+				_ = utils.RespondError(rw, http.StatusForbidden, "permission denied")
+				return
+			}
+		}
+		handler(rw, req)
+	}
+}
+
+func containsAny(values, candidates []string) bool {
+	for _, v := range values {
+		for _, c := range candidates {
+			if v == c {
+				return true
+			}
+		}
+	}
+	return false
+}
+
 // FullPath builds full path string of the api
 func (w *Wrapper) FullPath() string {
 	if w.parent == nil {
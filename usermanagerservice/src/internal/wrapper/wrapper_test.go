@@ -0,0 +1,96 @@
+/*
+ Copyright 2021 The 110 billion Authors
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package wrapper
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/110billion/sellfie/usermanagerservice/src/internal/apiserver"
+	"github.com/gorilla/mux"
+)
+
+// testAuthenticate stands in for an authenticating middleware, taking the groups of the user from the X-Test-Groups header.
+// Requests without it are not authenticated
+func testAuthenticate(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		if groups := req.Header.Get("X-Test-Groups"); groups != "" {
+			apiserver.SetUser(req.Header, "test", strings.Split(groups, ","))
+		}
+		next(w, req)
+	}
+}
+
+func TestRequire(t *testing.T) {
+	ok := func(w http.ResponseWriter, req *http.Request) {}
+
+	root := New("/", nil, nil)
+	root.SetRouter(mux.NewRouter())
+	admin := New("/admin", nil, nil)
+	admin.Use(testAuthenticate)
+	admin.Require("admin")
+	if err := root.Add(admin); err != nil {
+		t.Fatal(err)
+	}
+	users := New("/users", []string{http.MethodGet}, ok)
+	if err := admin.Add(users); err != nil {
+		t.Fatal(err)
+	}
+	// Descendants must satisfy the roles required by every ancestor as well as their own
+	audit := New("/audit", []string{http.MethodGet}, ok)
+	audit.Require("auditor")
+	if err := admin.Add(audit); err != nil {
+		t.Fatal(err)
+	}
+	reports := New("/reports", []string{http.MethodGet}, ok)
+	reports.Use(testAuthenticate)
+	reports.Require("admin", "moderator")
+	if err := root.Add(reports); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := map[string]struct {
+		path   string
+		groups string
+		want   int
+	}{
+		"not authenticated":              {path: "/admin/users", want: http.StatusUnauthorized},
+		"without the role":               {path: "/admin/users", groups: "user", want: http.StatusForbidden},
+		"with the role":                  {path: "/admin/users", groups: "admin,user", want: http.StatusOK},
+		"without the role of the child":  {path: "/admin/audit", groups: "admin", want: http.StatusForbidden},
+		"without the role of the parent": {path: "/admin/audit", groups: "auditor", want: http.StatusForbidden},
+		"with both roles":                {path: "/admin/audit", groups: "admin,auditor", want: http.StatusOK},
+		"with any of the roles":          {path: "/reports", groups: "moderator", want: http.StatusOK},
+		"with none of the roles":         {path: "/reports", groups: "user", want: http.StatusForbidden},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, tc.path, nil)
+			if tc.groups != "" {
+				req.Header.Set("X-Test-Groups", tc.groups)
+			}
+			w := httptest.NewRecorder()
+			root.Router().ServeHTTP(w, req)
+			if w.Code != tc.want {
+				t.Errorf("want %d, got %d", tc.want, w.Code)
+			}
+		})
+	}
+}
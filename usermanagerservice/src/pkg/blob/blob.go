@@ -0,0 +1,155 @@
+/*
+ Copyright 2021 The 110 billion Authors
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package blob
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+	"sync"
+)
+
+const (
+	// KindFile stores the blobs in a directory of the local filesystem
+	KindFile = "file"
+
+	defaultDir = "/var/lib/usermanager/blobs"
+	// defaultPrivateDir is the directory of the private file store, which must not be under the served one
+	defaultPrivateDir = "/var/lib/usermanager/private"
+	// ServePath is where the server serves the blobs of a store which is an http.Handler, e.g., a FileStore
+	ServePath = "/blobs/"
+	// ExportsPrefix is the prefix of the keys of export archives, which are stored in the private store and never served
+	ExportsPrefix = "exports/"
+)
+
+var (
+	// ErrInvalidKey is returned for keys which are empty, absolute, or escape the store with ..
+	ErrInvalidKey = errors.New("blob key is not valid")
+	// ErrNotFound is returned if the blob of the key does not exist
+	ErrNotFound = errors.New("blob is not found")
+)
+
+// Store stores blobs by slash-separated keys, e.g., avatars/{user_id}/{version}/256.jpg
+type Store interface {
+	// Put stores the content of r as the blob of the key, replacing the blob if it exists
+	Put(ctx context.Context, key, contentType string, r io.Reader) error
+	// Open returns the content of the blob of the key, or ErrNotFound if it does not exist
+	Open(ctx context.Context, key string) (io.ReadCloser, error)
+	// DeletePrefix deletes the blobs under the prefix, which is a key without its last elements
+	DeletePrefix(ctx context.Context, prefix string) error
+	// URL returns the URL the blob of the key is publicly served at
+	URL(key string) string
+}
+
+var (
+	storeLock sync.RWMutex
+	store     Store = NewFileStore(defaultDir, strings.TrimSuffix(ServePath, "/"))
+	// private stores the blobs which are only handed out by the server, e.g., export archives behind signed links
+	private Store = NewFileStore(defaultPrivateDir, "")
+)
+
+// Init configures the blob store by the environment variables below
+//   - BLOB_STORE: kind of the store. Only file is supported for now. Defaults to file
+//   - BLOB_DIR: directory of the file store. Defaults to /var/lib/usermanager/blobs
+//   - BLOB_BASE_URL: URL the blobs are served at. Defaults to /blobs, where the server serves a file store
+//   - BLOB_PRIVATE_DIR: directory of the private file store, which is never served. Defaults to /var/lib/usermanager/private
+func Init() error {
+	kind := os.Getenv("BLOB_STORE")
+	if kind == "" {
+		kind = KindFile
+	}
+
+	baseURL := os.Getenv("BLOB_BASE_URL")
+	if baseURL == "" {
+		baseURL = strings.TrimSuffix(ServePath, "/")
+	}
+
+	switch kind {
+	case KindFile:
+		dir := os.Getenv("BLOB_DIR")
+		if dir == "" {
+			dir = defaultDir
+		}
+		if err := os.MkdirAll(dir, 0o755); err != nil {
+			return err
+		}
+		privateDir := os.Getenv("BLOB_PRIVATE_DIR")
+		if privateDir == "" {
+			privateDir = defaultPrivateDir
+		}
+		if err := os.MkdirAll(privateDir, 0o700); err != nil {
+			return err
+		}
+		SetStore(NewFileStore(dir, baseURL))
+		SetPrivateStore(NewFileStore(privateDir, ""))
+	default:
+		return fmt.Errorf("unknown blob store %s", kind)
+	}
+	return nil
+}
+
+// SetStore replaces the blob store, e.g., with a FileStore in a temporary directory in tests
+func SetStore(s Store) {
+	storeLock.Lock()
+	defer storeLock.Unlock()
+	store = s
+}
+
+// SetPrivateStore replaces the private blob store, e.g., with a FileStore in a temporary directory in tests
+func SetPrivateStore(s Store) {
+	storeLock.Lock()
+	defer storeLock.Unlock()
+	private = s
+}
+
+// Default returns the blob store
+func Default() Store {
+	storeLock.RLock()
+	defer storeLock.RUnlock()
+	return store
+}
+
+// Private returns the blob store which is never served, for the blobs the server hands out itself, e.g., export archives
+func Private() Store {
+	storeLock.RLock()
+	defer storeLock.RUnlock()
+	return private
+}
+
+// StoreOf returns the store the blobs under the prefix are stored in
+func StoreOf(prefix string) Store {
+	if strings.HasPrefix(prefix, ExportsPrefix) {
+		return Private()
+	}
+	return Default()
+}
+
+// cleanKey returns the key without redundant slashes and dots, or ErrInvalidKey if it is not a valid key
+func cleanKey(key string) (string, error) {
+	if key == "" || strings.HasPrefix(key, "/") || strings.Contains(key, "\\") {
+		return "", ErrInvalidKey
+	}
+	cleaned := path.Clean(key)
+	if cleaned == "." || cleaned == ".." || strings.HasPrefix(cleaned, "../") {
+		return "", ErrInvalidKey
+	}
+	return cleaned, nil
+}
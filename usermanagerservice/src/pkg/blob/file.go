@@ -0,0 +1,124 @@
+/*
+ Copyright 2021 The 110 billion Authors
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package blob
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// FileStore stores the blobs as files under a directory, and serves them
+type FileStore struct {
+	dir     string
+	baseURL string
+	files   http.Handler
+}
+
+// NewFileStore returns the store of the directory, whose blobs are served at the base URL
+func NewFileStore(dir, baseURL string) *FileStore {
+	return &FileStore{
+		dir:     dir,
+		baseURL: strings.TrimSuffix(baseURL, "/"),
+		files:   http.FileServer(http.Dir(dir)),
+	}
+}
+
+// Put writes the blob to a temporary file and renames it, so that a blob is never served half written
+func (s *FileStore) Put(_ context.Context, key, _ string, r io.Reader) error {
+	key, err := cleanKey(key)
+	if err != nil {
+		return err
+	}
+
+	name := filepath.Join(s.dir, filepath.FromSlash(key))
+	if err := os.MkdirAll(filepath.Dir(name), 0o755); err != nil {
+		return err
+	}
+
+	f, err := os.CreateTemp(filepath.Dir(name), ".upload-*")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = os.Remove(f.Name())
+	}()
+
+	if _, err := io.Copy(f, r); err != nil {
+		_ = f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(f.Name(), 0o644); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), name)
+}
+
+// Open opens the file of the blob
+func (s *FileStore) Open(_ context.Context, key string) (io.ReadCloser, error) {
+	key, err := cleanKey(key)
+	if err != nil {
+		return nil, err
+	}
+
+	f, err := os.Open(filepath.Join(s.dir, filepath.FromSlash(key)))
+	if os.IsNotExist(err) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// DeletePrefix removes the directory of the prefix
+func (s *FileStore) DeletePrefix(_ context.Context, prefix string) error {
+	prefix, err := cleanKey(prefix)
+	if err != nil {
+		return err
+	}
+	return os.RemoveAll(filepath.Join(s.dir, filepath.FromSlash(prefix)))
+}
+
+// URL returns the URL of the blob under the base URL
+func (s *FileStore) URL(key string) string {
+	return s.baseURL + "/" + key
+}
+
+// ServeHTTP serves the blobs, without listing the directories
+func (s *FileStore) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if strings.HasSuffix(req.URL.Path, "/") || strings.Contains(req.URL.Path, "/.") {
+		http.NotFound(w, req)
+		return
+	}
+	// Export archives are only downloaded by signed links, even if they are left in a served store
+	if strings.HasPrefix(strings.TrimLeft(path.Clean("/"+req.URL.Path), "/"), ExportsPrefix) {
+		http.NotFound(w, req)
+		return
+	}
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	// The key of a blob changes whenever its content does
+	w.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+	s.files.ServeHTTP(w, req)
+}
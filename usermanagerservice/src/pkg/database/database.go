@@ -3,17 +3,59 @@ package database
 import (
 	"database/sql"
 	"os"
+	"regexp"
+	"strings"
+
+	"github.com/lib/pq"
 )
 
+// uniqueViolation is the SQLSTATE of an insert or update violating a unique constraint
+const uniqueViolation = "23505"
+
+// UniqueKey is a unique key of a table, which inserts and updates are told to have violated
+type UniqueKey struct {
+	Table  string
+	Column string
+	// Index is the name of the unique index the schema creates for the key
+	Index string
+}
+
+// Unique keys of USER_TABLE and USER_INFO
+var (
+	UserEmailKey = UniqueKey{Table: "user_table", Column: "user_email", Index: "user_table_email_key"}
+	UserIDKey    = UniqueKey{Table: "user_table", Column: "user_id", Index: "user_table_id_key"}
+	UserInfoKey  = UniqueKey{Table: "user_info", Column: "user_id", Index: "user_info_id_key"}
+)
+
+// violatedColumns matches the columns in the detail of a unique violation, e.g., Key (user_email)=(a@b.c) already exists.
+var violatedColumns = regexp.MustCompile(`^Key \((.+?)\)=`)
+
 // Connect opens postgresql DB
 func Connect() (*sql.DB, error) {
 	dataSourceName := "host=" + os.Getenv("DB_HOST") + " port=" + os.Getenv("DB_PORT") + " user=" + os.Getenv("DB_USER") + " password=" + os.Getenv("DB_PWD") + " dbname=" + os.Getenv("DB_NAME") + " sslmode=disable"
 
 	db, err := sql.Open("postgres", dataSourceName)
+	if err != nil {
+		return nil, err
+	}
 
-	if err != nil || db.Ping() != nil {
-		db.Close()
+	if err := db.Ping(); err != nil {
+		_ = db.Close()
 		return nil, err
 	}
 	return db, nil
 }
+
+// Violated returns whether err is a unique violation of the key. The key is matched by its table and column,
+// so that a constraint on the same column by another name, e.g., created by an older schema, is recognized as well
+func (k UniqueKey) Violated(err error) bool {
+	pqErr, ok := err.(*pq.Error)
+	if !ok || pqErr.Code != uniqueViolation {
+		return false
+	}
+	if pqErr.Constraint == k.Index {
+		return true
+	}
+	m := violatedColumns.FindStringSubmatch(pqErr.Detail)
+	return m != nil && strings.EqualFold(pqErr.Table, k.Table) && strings.EqualFold(m[1], k.Column)
+}
@@ -0,0 +1,70 @@
+/*
+ Copyright 2021 The 110 billion Authors
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package database
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/lib/pq"
+)
+
+func TestUniqueKeyViolated(t *testing.T) {
+	tests := map[string]struct {
+		err  error
+		key  UniqueKey
+		want bool
+	}{
+		"by index": {
+			err:  &pq.Error{Code: uniqueViolation, Table: "user_table", Constraint: "user_table_email_key"},
+			key:  UserEmailKey,
+			want: true,
+		},
+		"by column of another constraint": {
+			err:  &pq.Error{Code: uniqueViolation, Table: "user_table", Constraint: "user_table_pkey", Detail: "Key (user_id)=(alice) already exists."},
+			key:  UserIDKey,
+			want: true,
+		},
+		"other column": {
+			err: &pq.Error{Code: uniqueViolation, Table: "user_table", Constraint: "user_table_pkey", Detail: "Key (user_id)=(alice) already exists."},
+			key: UserEmailKey,
+		},
+		"other table": {
+			err: &pq.Error{Code: uniqueViolation, Table: "user_info", Constraint: "user_info_pkey", Detail: "Key (user_id)=(alice) already exists."},
+			key: UserIDKey,
+		},
+		"not a unique violation": {
+			err: &pq.Error{Code: "23503", Table: "user_table", Constraint: "user_table_email_key"},
+			key: UserEmailKey,
+		},
+		"not a database error": {
+			err: errors.New("user_table_email_key"),
+			key: UserEmailKey,
+		},
+		"nil": {
+			key: UserEmailKey,
+		},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			if got := tc.key.Violated(tc.err); got != tc.want {
+				t.Errorf("want %v, got %v", tc.want, got)
+			}
+		})
+	}
+}
@@ -0,0 +1,297 @@
+/*
+ Copyright 2021 The 110 billion Authors
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package database
+
+// schema lists the statements creating the tables owned by the user manager.
+// USER_TABLE and USER_INFO are provisioned outside of the service, and only columns are added to them here.
+// Every statement must be idempotent, as all of them run whenever the server starts.
+// Tables created before user_uuid are migrated from the user_id handle right after their CREATE TABLE,
+// so that the indexes following it are created on user_uuid
+var schema = []string{
+	// user_uuid identifies the user for good, and the records of the user in the other tables are keyed by it.
+	// user_id is the handle the user can change, which is only displayed and looked up.
+	// Adding the column generates one for every existing user. gen_random_uuid is built in since PostgreSQL 13
+	`ALTER TABLE USER_TABLE ADD COLUMN IF NOT EXISTS user_uuid UUID NOT NULL DEFAULT gen_random_uuid()`,
+	`CREATE UNIQUE INDEX IF NOT EXISTS user_table_uuid_key ON USER_TABLE (user_uuid)`,
+	// Accounts predating email verification are considered verified
+	`ALTER TABLE USER_TABLE ADD COLUMN IF NOT EXISTS email_verified BOOLEAN NOT NULL DEFAULT TRUE`,
+	`ALTER TABLE USER_TABLE ADD COLUMN IF NOT EXISTS created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()`,
+	`CREATE TABLE IF NOT EXISTS REFRESH_TOKEN (
+		token_hash CHAR(64) PRIMARY KEY,
+		family_id VARCHAR(64) NOT NULL,
+		user_uuid UUID NOT NULL,
+		issued_at TIMESTAMPTZ NOT NULL,
+		expires_at TIMESTAMPTZ NOT NULL,
+		rotated_at TIMESTAMPTZ,
+		revoked_at TIMESTAMPTZ
+	)`,
+	userUUIDMigration("REFRESH_TOKEN", ""),
+	`CREATE INDEX IF NOT EXISTS refresh_token_family_idx ON REFRESH_TOKEN (family_id)`,
+	`CREATE INDEX IF NOT EXISTS refresh_token_user_idx ON REFRESH_TOKEN (user_uuid)`,
+	`CREATE TABLE IF NOT EXISTS REVOKED_TOKEN (
+		jti VARCHAR(64) PRIMARY KEY,
+		expires_at TIMESTAMPTZ NOT NULL
+	)`,
+	`CREATE INDEX IF NOT EXISTS revoked_token_expires_idx ON REVOKED_TOKEN (expires_at)`,
+	`CREATE TABLE IF NOT EXISTS USER_REVOCATION (
+		user_uuid UUID PRIMARY KEY,
+		revoked_before TIMESTAMPTZ NOT NULL
+	)`,
+	userUUIDMigration("USER_REVOCATION", "user_uuid"),
+	`CREATE TABLE IF NOT EXISTS SIGNING_KEY (
+		kid VARCHAR(64) PRIMARY KEY,
+		alg VARCHAR(16) NOT NULL,
+		private_key TEXT NOT NULL,
+		active_at TIMESTAMPTZ NOT NULL,
+		retire_at TIMESTAMPTZ,
+		created_at TIMESTAMPTZ NOT NULL
+	)`,
+	`CREATE TABLE IF NOT EXISTS USER_IDENTITY (
+		provider VARCHAR(64) NOT NULL,
+		subject VARCHAR(255) NOT NULL,
+		user_uuid UUID NOT NULL,
+		email VARCHAR(255) NOT NULL,
+		created_at TIMESTAMPTZ NOT NULL,
+		PRIMARY KEY (provider, subject)
+	)`,
+	userUUIDMigration("USER_IDENTITY", ""),
+	`CREATE INDEX IF NOT EXISTS user_identity_user_idx ON USER_IDENTITY (user_uuid)`,
+	`CREATE UNIQUE INDEX IF NOT EXISTS user_identity_user_provider_idx ON USER_IDENTITY (user_uuid, provider)`,
+	`CREATE TABLE IF NOT EXISTS OAUTH_STATE (
+		state_hash CHAR(64) PRIMARY KEY,
+		provider VARCHAR(64) NOT NULL,
+		code_verifier VARCHAR(128) NOT NULL,
+		nonce VARCHAR(128) NOT NULL,
+		expires_at TIMESTAMPTZ NOT NULL
+	)`,
+	`ALTER TABLE OAUTH_STATE ADD COLUMN IF NOT EXISTS link_user_uuid UUID`,
+	`DO $$
+	BEGIN
+		IF ` + hasColumn("OAUTH_STATE", "link_user_id") + ` THEN
+			UPDATE OAUTH_STATE s SET link_user_uuid = u.user_uuid FROM USER_TABLE u WHERE u.user_id = s.link_user_id;
+			DELETE FROM OAUTH_STATE WHERE link_user_id IS NOT NULL AND link_user_uuid IS NULL;
+			ALTER TABLE OAUTH_STATE DROP COLUMN link_user_id;
+		END IF;
+	END $$`,
+	`CREATE TABLE IF NOT EXISTS EMAIL_VERIFICATION (
+		jti VARCHAR(64) PRIMARY KEY,
+		user_uuid UUID NOT NULL,
+		email VARCHAR(255) NOT NULL,
+		created_at TIMESTAMPTZ NOT NULL,
+		expires_at TIMESTAMPTZ NOT NULL,
+		used_at TIMESTAMPTZ
+	)`,
+	userUUIDMigration("EMAIL_VERIFICATION", ""),
+	`CREATE INDEX IF NOT EXISTS email_verification_user_idx ON EMAIL_VERIFICATION (user_uuid, created_at)`,
+	`CREATE TABLE IF NOT EXISTS VERIFICATION_RESEND (
+		email VARCHAR(255) NOT NULL,
+		requested_at TIMESTAMPTZ NOT NULL
+	)`,
+	`CREATE INDEX IF NOT EXISTS verification_resend_email_idx ON VERIFICATION_RESEND (email, requested_at)`,
+	`CREATE TABLE IF NOT EXISTS PASSWORD_RESET (
+		token_hash CHAR(64) PRIMARY KEY,
+		user_uuid UUID NOT NULL,
+		created_at TIMESTAMPTZ NOT NULL,
+		expires_at TIMESTAMPTZ NOT NULL,
+		used_at TIMESTAMPTZ
+	)`,
+	userUUIDMigration("PASSWORD_RESET", ""),
+	`CREATE INDEX IF NOT EXISTS password_reset_user_idx ON PASSWORD_RESET (user_uuid, created_at)`,
+	`CREATE TABLE IF NOT EXISTS USER_MFA (
+		user_uuid UUID PRIMARY KEY,
+		secret TEXT NOT NULL,
+		enabled BOOLEAN NOT NULL DEFAULT FALSE,
+		last_counter BIGINT NOT NULL DEFAULT 0,
+		created_at TIMESTAMPTZ NOT NULL,
+		enabled_at TIMESTAMPTZ
+	)`,
+	userUUIDMigration("USER_MFA", "user_uuid"),
+	`CREATE TABLE IF NOT EXISTS MFA_RECOVERY_CODE (
+		user_uuid UUID NOT NULL,
+		code_hash CHAR(64) NOT NULL,
+		used_at TIMESTAMPTZ,
+		PRIMARY KEY (user_uuid, code_hash)
+	)`,
+	// Recovery codes hashed with the handle cannot be hashed again with the user_uuid, as only their hashes are kept.
+	// They are dropped, and the users sign in with their authenticator and generate new ones
+	`DO $$
+	BEGIN
+		IF ` + hasColumn("MFA_RECOVERY_CODE", "user_id") + ` THEN
+			DELETE FROM MFA_RECOVERY_CODE;
+		END IF;
+	END $$`,
+	userUUIDMigration("MFA_RECOVERY_CODE", "user_uuid, code_hash"),
+	`CREATE TABLE IF NOT EXISTS MFA_CHALLENGE (
+		jti VARCHAR(64) PRIMARY KEY,
+		user_uuid UUID NOT NULL,
+		attempts INTEGER NOT NULL DEFAULT 0,
+		expires_at TIMESTAMPTZ NOT NULL,
+		used_at TIMESTAMPTZ
+	)`,
+	userUUIDMigration("MFA_CHALLENGE", ""),
+	`CREATE TABLE IF NOT EXISTS LOGIN_FAILURE (
+		failure_key VARCHAR(320) PRIMARY KEY,
+		failures INTEGER NOT NULL,
+		last_failure TIMESTAMPTZ NOT NULL,
+		expires_at TIMESTAMPTZ NOT NULL
+	)`,
+	`CREATE INDEX IF NOT EXISTS login_failure_expires_idx ON LOGIN_FAILURE (expires_at)`,
+	`CREATE TABLE IF NOT EXISTS LOGIN_SESSION (
+		session_id VARCHAR(64) PRIMARY KEY,
+		user_uuid UUID NOT NULL,
+		device_name VARCHAR(255) NOT NULL DEFAULT '',
+		user_agent VARCHAR(512) NOT NULL DEFAULT '',
+		ip VARCHAR(64) NOT NULL DEFAULT '',
+		created_at TIMESTAMPTZ NOT NULL,
+		last_seen_at TIMESTAMPTZ NOT NULL,
+		expires_at TIMESTAMPTZ NOT NULL,
+		revoked_at TIMESTAMPTZ
+	)`,
+	userUUIDMigration("LOGIN_SESSION", ""),
+	`CREATE INDEX IF NOT EXISTS login_session_user_idx ON LOGIN_SESSION (user_uuid)`,
+	`CREATE TABLE IF NOT EXISTS HTTP_SESSION (
+		session_hash CHAR(64) PRIMARY KEY,
+		data BYTEA NOT NULL,
+		expires_at TIMESTAMPTZ NOT NULL
+	)`,
+	`CREATE INDEX IF NOT EXISTS http_session_expires_idx ON HTTP_SESSION (expires_at)`,
+	`ALTER TABLE USER_TABLE ADD COLUMN IF NOT EXISTS role VARCHAR(16) NOT NULL DEFAULT 'user'`,
+	`ALTER TABLE USER_TABLE ADD COLUMN IF NOT EXISTS suspended_at TIMESTAMPTZ`,
+	`ALTER TABLE USER_TABLE ADD COLUMN IF NOT EXISTS suspended_until TIMESTAMPTZ`,
+	`ALTER TABLE USER_TABLE ADD COLUMN IF NOT EXISTS suspension_reason TEXT`,
+	`ALTER TABLE USER_TABLE ADD COLUMN IF NOT EXISTS password_reset_required BOOLEAN NOT NULL DEFAULT FALSE`,
+	`CREATE TABLE IF NOT EXISTS ADMIN_AUDIT (
+		id BIGSERIAL PRIMARY KEY,
+		actor_uuid UUID NOT NULL,
+		action VARCHAR(64) NOT NULL,
+		target_uuid UUID NOT NULL,
+		detail JSONB NOT NULL DEFAULT '{}',
+		ip VARCHAR(64) NOT NULL DEFAULT '',
+		created_at TIMESTAMPTZ NOT NULL
+	)`,
+	// The audit trail is kept for users deleted before user_uuid, whose uuids are unknown.
+	// Their entries get the nil uuid, and the handles are kept in the detail as for the entries recorded since
+	`DO $$
+	BEGIN
+		IF ` + hasColumn("ADMIN_AUDIT", "actor_id") + ` THEN
+			ALTER TABLE ADMIN_AUDIT ADD COLUMN actor_uuid UUID, ADD COLUMN target_uuid UUID;
+			UPDATE ADMIN_AUDIT a SET
+				actor_uuid = COALESCE((SELECT user_uuid FROM USER_TABLE WHERE user_id = a.actor_id), '00000000-0000-0000-0000-000000000000'),
+				target_uuid = COALESCE((SELECT user_uuid FROM USER_TABLE WHERE user_id = a.target_id), '00000000-0000-0000-0000-000000000000'),
+				detail = detail || jsonb_build_object('actor_id', a.actor_id, 'target_id', a.target_id);
+			ALTER TABLE ADMIN_AUDIT DROP COLUMN actor_id, DROP COLUMN target_id;
+			ALTER TABLE ADMIN_AUDIT ALTER COLUMN actor_uuid SET NOT NULL, ALTER COLUMN target_uuid SET NOT NULL;
+		END IF;
+	END $$`,
+	`CREATE INDEX IF NOT EXISTS admin_audit_target_idx ON ADMIN_AUDIT (target_uuid, id)`,
+	`CREATE INDEX IF NOT EXISTS admin_audit_actor_idx ON ADMIN_AUDIT (actor_uuid, id)`,
+	// Signup and social login rely on the unique constraints rather than checking before inserting,
+	// and tell which one is violated by its table and column
+	`CREATE UNIQUE INDEX IF NOT EXISTS ` + UserEmailKey.Index + ` ON USER_TABLE (user_email)`,
+	`CREATE UNIQUE INDEX IF NOT EXISTS ` + UserIDKey.Index + ` ON USER_TABLE (user_id)`,
+	`CREATE UNIQUE INDEX IF NOT EXISTS ` + UserInfoKey.Index + ` ON USER_INFO (user_id)`,
+	// version is the ETag of the profile, which conditional updates are checked against
+	`ALTER TABLE USER_INFO ADD COLUMN IF NOT EXISTS version BIGINT NOT NULL DEFAULT 1`,
+	`ALTER TABLE USER_INFO ADD COLUMN IF NOT EXISTS updated_at TIMESTAMPTZ NOT NULL DEFAULT NOW()`,
+	// avatar_key is the blob prefix of the uploaded avatar profile_url points to, or empty
+	`ALTER TABLE USER_INFO ADD COLUMN IF NOT EXISTS avatar_key TEXT NOT NULL DEFAULT ''`,
+	// deletion_scheduled_at is when a deleted account is purged, unless it is restored before
+	`ALTER TABLE USER_TABLE ADD COLUMN IF NOT EXISTS deletion_scheduled_at TIMESTAMPTZ`,
+	`CREATE INDEX IF NOT EXISTS user_table_deletion_idx ON USER_TABLE (deletion_scheduled_at) WHERE deletion_scheduled_at IS NOT NULL`,
+	`CREATE TABLE IF NOT EXISTS USER_DELETION_OUTBOX (
+		user_uuid UUID PRIMARY KEY,
+		deleted_at TIMESTAMPTZ NOT NULL,
+		attempts INTEGER NOT NULL DEFAULT 0,
+		next_attempt_at TIMESTAMPTZ NOT NULL,
+		last_error TEXT NOT NULL DEFAULT ''
+	)`,
+	// Pending notifications are of users already purged, whose uuids are unknown, so they are dropped.
+	// The post manager only records deletions, as it does not store postings yet
+	`DO $$
+	BEGIN
+		IF ` + hasColumn("USER_DELETION_OUTBOX", "user_id") + ` THEN
+			DELETE FROM USER_DELETION_OUTBOX;
+		END IF;
+	END $$`,
+	userUUIDMigration("USER_DELETION_OUTBOX", "user_uuid"),
+	`CREATE INDEX IF NOT EXISTS user_deletion_outbox_next_idx ON USER_DELETION_OUTBOX (next_attempt_at)`,
+	`CREATE TABLE IF NOT EXISTS EXPORT_JOB (
+		job_id VARCHAR(64) PRIMARY KEY,
+		user_uuid UUID NOT NULL,
+		status VARCHAR(16) NOT NULL,
+		blob_key TEXT NOT NULL DEFAULT '',
+		created_at TIMESTAMPTZ NOT NULL,
+		started_at TIMESTAMPTZ,
+		finished_at TIMESTAMPTZ,
+		expires_at TIMESTAMPTZ
+	)`,
+	userUUIDMigration("EXPORT_JOB", ""),
+	`CREATE INDEX IF NOT EXISTS export_job_user_idx ON EXPORT_JOB (user_uuid, created_at)`,
+	`CREATE INDEX IF NOT EXISTS export_job_status_idx ON EXPORT_JOB (status, created_at)`,
+	`ALTER TABLE USER_TABLE ADD COLUMN IF NOT EXISTS handle_changed_at TIMESTAMPTZ`,
+	// USER_HANDLE_HISTORY keeps the old handles redirecting to their user until they expire
+	`CREATE TABLE IF NOT EXISTS USER_HANDLE_HISTORY (
+		handle VARCHAR(255) PRIMARY KEY,
+		user_uuid UUID NOT NULL,
+		changed_at TIMESTAMPTZ NOT NULL,
+		expires_at TIMESTAMPTZ NOT NULL
+	)`,
+	`CREATE INDEX IF NOT EXISTS user_handle_history_user_idx ON USER_HANDLE_HISTORY (user_uuid)`,
+}
+
+// hasColumn is the condition that the table has the column, for the statements migrating it
+func hasColumn(table, column string) string {
+	return `EXISTS (SELECT 1 FROM information_schema.columns WHERE table_schema = current_schema()
+		AND table_name = lower('` + table + `') AND column_name = '` + column + `')`
+}
+
+// userUUIDMigration moves the table from the user_id handle to the user_uuid of the user, if it still has user_id.
+// Rows of users which do not exist anymore are deleted. The indexes and keys on user_id are dropped with the column,
+// so primaryKey, if any, is added back on user_uuid and the statements following the migration create the indexes again
+func userUUIDMigration(table, primaryKey string) string {
+	addPrimaryKey := ""
+	if primaryKey != "" {
+		addPrimaryKey = `
+			ALTER TABLE ` + table + ` ADD PRIMARY KEY (` + primaryKey + `);`
+	}
+	return `DO $$
+	BEGIN
+		IF ` + hasColumn(table, "user_id") + ` THEN
+			ALTER TABLE ` + table + ` ADD COLUMN user_uuid UUID;
+			UPDATE ` + table + ` t SET user_uuid = u.user_uuid FROM USER_TABLE u WHERE u.user_id = t.user_id;
+			DELETE FROM ` + table + ` WHERE user_uuid IS NULL;
+			ALTER TABLE ` + table + ` DROP COLUMN user_id;
+			ALTER TABLE ` + table + ` ALTER COLUMN user_uuid SET NOT NULL;` + addPrimaryKey + `
+		END IF;
+	END $$`
+}
+
+// Migrate creates the tables owned by the user manager, if they do not exist
+func Migrate() error {
+	db, err := Connect()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	for _, stmt := range schema {
+		if _, err := db.Exec(stmt); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,134 @@
+/*
+ Copyright 2021 The 110 billion Authors
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package deletion
+
+import (
+	"database/sql"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/110billion/sellfie/usermanagerservice/src/internal/utils"
+	"github.com/110billion/sellfie/usermanagerservice/src/pkg/database"
+	"github.com/110billion/sellfie/usermanagerservice/src/pkg/server/auth/token"
+	logf "sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+var (
+	log = logf.Log.WithName("deletion")
+
+	// gracePeriod is how long a deleted account can be restored before it is purged
+	gracePeriod = utils.DurationFromEnv("ACCOUNT_DELETION_GRACE", 30*24*time.Hour)
+	// interval is how often the accounts past their grace period are purged, and the outbox is dispatched
+	interval = utils.DurationFromEnv("ACCOUNT_DELETION_INTERVAL", 5*time.Minute)
+
+	startOnce sync.Once
+)
+
+var (
+	// ErrUserNotFound is returned if the user does not exist
+	ErrUserNotFound = errors.New("user is not found")
+	// ErrNotScheduled is returned on restoring an account whose deletion is not scheduled
+	ErrNotScheduled = errors.New("deletion of the account is not scheduled")
+)
+
+// Init starts purging the accounts past their grace period and telling the other services about them, every interval
+func Init() error {
+	startOnce.Do(func() {
+		go run()
+	})
+	return nil
+}
+
+// Schedule schedules the deletion of the account of userUUID after the grace period, and returns when it is purged.
+// The user is logged out everywhere in the same transaction, and cannot refresh tokens until the account is restored,
+// either by Restore or by logging in again. Scheduling an already scheduled deletion returns the scheduled time
+func Schedule(userUUID string) (time.Time, error) {
+	db, err := database.Connect()
+	if err != nil {
+		return time.Time{}, err
+	}
+	defer db.Close()
+
+	tx, err := db.Begin()
+	if err != nil {
+		return time.Time{}, err
+	}
+	defer func() {
+		_ = tx.Rollback()
+	}()
+
+	var scheduledAt time.Time
+	err = tx.QueryRow("UPDATE USER_TABLE SET deletion_scheduled_at = COALESCE(deletion_scheduled_at, $2) WHERE user_uuid = $1 RETURNING deletion_scheduled_at",
+		userUUID, time.Now().Add(gracePeriod)).Scan(&scheduledAt)
+	if err == sql.ErrNoRows {
+		return time.Time{}, ErrUserNotFound
+	}
+	if err != nil {
+		return time.Time{}, err
+	}
+	if err := token.RevokeAllTx(tx, userUUID); err != nil {
+		return time.Time{}, err
+	}
+
+	return scheduledAt, tx.Commit()
+}
+
+// Restore cancels the scheduled deletion of the account of userUUID
+func Restore(userUUID string) error {
+	db, err := database.Connect()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	result, err := db.Exec("UPDATE USER_TABLE SET deletion_scheduled_at = NULL WHERE user_uuid = $1 AND deletion_scheduled_at IS NOT NULL", userUUID)
+	if err != nil {
+		return err
+	}
+	if n, err := result.RowsAffected(); err != nil || n == 1 {
+		return err
+	}
+
+	var exists bool
+	if err := db.QueryRow("SELECT EXISTS(SELECT 1 FROM USER_TABLE WHERE user_uuid = $1)", userUUID).Scan(&exists); err != nil {
+		return err
+	}
+	if !exists {
+		return ErrUserNotFound
+	}
+	return ErrNotScheduled
+}
+
+// run purges the accounts past their grace period and dispatches the outbox every interval
+func run() {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		n, err := purgeDue()
+		if err != nil {
+			log.Error(err, "cannot purge accounts")
+		} else if n > 0 {
+			log.Info("purged accounts past their grace period", "count", n)
+		}
+
+		if err := dispatch(); err != nil {
+			log.Error(err, "cannot dispatch deletion outbox")
+		}
+	}
+}
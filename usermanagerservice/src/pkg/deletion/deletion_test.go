@@ -0,0 +1,267 @@
+/*
+ Copyright 2021 The 110 billion Authors
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package deletion
+
+import (
+	"context"
+	"database/sql"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/110billion/sellfie/usermanagerservice/src/pkg/database"
+	"github.com/110billion/sellfie/usermanagerservice/src/pkg/postmanager"
+	"github.com/110billion/sellfie/usermanagerservice/src/pkg/server/auth/token"
+)
+
+const testUserUUID = "8c4f3c1e-0a5b-4d0c-9e57-3f1f7b0d2a61"
+
+func TestBackoff(t *testing.T) {
+	tests := map[int]time.Duration{
+		1:  minBackoff,
+		2:  2 * minBackoff,
+		5:  16 * minBackoff,
+		20: maxBackoff,
+	}
+	for attempts, want := range tests {
+		if got := backoff(attempts); got != want {
+			t.Errorf("after %d attempts: want %v, got %v", attempts, want, got)
+		}
+	}
+}
+
+// TestNotify tells a stand-in post manager that a user is deleted, with a token for the user and the action only
+func TestNotify(t *testing.T) {
+	status := http.StatusNoContent
+	var gotMethod, gotPath string
+	var gotClaims *token.ActionClaims
+	postManager := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		gotMethod, gotPath = req.Method, req.URL.Path
+		bearer, _ := token.FromRequest(req)
+		gotClaims, _ = token.ParseActionToken(postmanager.ActionUserDeleted, bearer)
+		w.WriteHeader(status)
+	}))
+	defer postManager.Close()
+	usePostManager(t, postManager.URL)
+
+	if err := notify(context.Background(), testUserUUID); err != nil {
+		t.Fatal(err)
+	}
+	if gotMethod != http.MethodDelete || gotPath != "/internal/users/"+testUserUUID {
+		t.Fatalf("want DELETE /internal/users/%s, got %s %s", testUserUUID, gotMethod, gotPath)
+	}
+	if gotClaims == nil || gotClaims.Subject != testUserUUID {
+		t.Fatalf("want a %s token of the user, got %+v", postmanager.ActionUserDeleted, gotClaims)
+	}
+
+	status = http.StatusServiceUnavailable
+	if err := notify(context.Background(), testUserUUID); err == nil {
+		t.Fatal("want an error if the post manager fails")
+	}
+}
+
+// TestScheduleRestore schedules the deletion of an account and restores it, against the database at DB_HOST
+func TestScheduleRestore(t *testing.T) {
+	userUUID, _ := createTestUser(t)
+	db := connect(t)
+
+	scheduledAt, err := Schedule(userUUID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d := time.Until(scheduledAt) - gracePeriod; d > time.Minute || d < -time.Minute {
+		t.Fatalf("want the account purged after %v, got %v", gracePeriod, scheduledAt)
+	}
+	var revoked bool
+	if err := db.QueryRow("SELECT EXISTS(SELECT 1 FROM USER_REVOCATION WHERE user_uuid = $1)", userUUID).Scan(&revoked); err != nil {
+		t.Fatal(err)
+	}
+	if !revoked {
+		t.Fatal("want the user logged out everywhere")
+	}
+
+	// Deleting again keeps the first grace period
+	again, err := Schedule(userUUID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !again.Equal(scheduledAt) {
+		t.Fatalf("want the deletion kept at %v, got %v", scheduledAt, again)
+	}
+
+	if err := Restore(userUUID); err != nil {
+		t.Fatal(err)
+	}
+	if err := Restore(userUUID); err != ErrNotScheduled {
+		t.Fatalf("want %v, got %v", ErrNotScheduled, err)
+	}
+	if err := Restore(testUserUUID); err != ErrUserNotFound {
+		t.Fatalf("want %v for a missing user, got %v", ErrUserNotFound, err)
+	}
+	if _, err := Schedule(testUserUUID); err != ErrUserNotFound {
+		t.Fatalf("want %v for a missing user, got %v", ErrUserNotFound, err)
+	}
+}
+
+// TestLoginRestores checks the grace period behaviour of the tokens, against the database at DB_HOST.
+// Refreshing the tokens of an account whose deletion is scheduled is refused, and logging in restores it
+func TestLoginRestores(t *testing.T) {
+	userUUID, _ := createTestUser(t)
+	db := connect(t)
+	// Access tokens are signed with the shared secret, so that no signing key is created
+	t.Setenv("JWT_SIGNING_ALG", token.AlgHS256)
+	t.Setenv("JWT_SECRET_KEY", "deletion-test-secret")
+
+	pair, _, err := token.Issue(userUUID, token.Client{UserAgent: "deletion-test"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Scheduling revokes the refresh tokens, so a session racing with it is stood in for by scheduling by hand
+	if _, err := db.Exec("UPDATE USER_TABLE SET deletion_scheduled_at = $2 WHERE user_uuid = $1", userUUID, time.Now().Add(gracePeriod)); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := token.Refresh(pair.RefreshToken, token.Client{UserAgent: "deletion-test"}); err != token.ErrAccountDeletionScheduled {
+		t.Fatalf("want %v, got %v", token.ErrAccountDeletionScheduled, err)
+	}
+
+	if _, _, err := token.Issue(userUUID, token.Client{UserAgent: "deletion-test"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := Restore(userUUID); err != ErrNotScheduled {
+		t.Fatalf("want the account restored by logging in, got %v", err)
+	}
+}
+
+// TestPurge purges an account past its grace period and tells a stand-in post manager, against the database at DB_HOST
+func TestPurge(t *testing.T) {
+	userUUID, id := createTestUser(t)
+	db := connect(t)
+
+	delivered := false
+	postManager := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		delivered = strings.HasSuffix(req.URL.Path, "/"+userUUID)
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer postManager.Close()
+	usePostManager(t, postManager.URL)
+
+	if _, err := Schedule(userUUID); err != nil {
+		t.Fatal(err)
+	}
+	// Accounts within the grace period are kept
+	if purged, err := purge(db, userUUID); err != nil || purged {
+		t.Fatalf("want the account kept, got %v, %v", purged, err)
+	}
+
+	if _, err := db.Exec("UPDATE USER_TABLE SET deletion_scheduled_at = NOW() - INTERVAL '1 second' WHERE user_uuid = $1", userUUID); err != nil {
+		t.Fatal(err)
+	}
+	if purged, err := purge(db, userUUID); err != nil || !purged {
+		t.Fatalf("want the account purged, got %v, %v", purged, err)
+	}
+	for _, query := range []string{
+		"SELECT EXISTS(SELECT 1 FROM USER_TABLE WHERE user_uuid = $1)",
+		"SELECT EXISTS(SELECT 1 FROM USER_INFO WHERE user_id = $2)",
+	} {
+		var exists bool
+		if err := db.QueryRow(query, userUUID, id).Scan(&exists); err != nil {
+			t.Fatal(err)
+		}
+		if exists {
+			t.Fatalf("want the user deleted, but %s", query)
+		}
+	}
+
+	var queued bool
+	if err := db.QueryRow("SELECT EXISTS(SELECT 1 FROM USER_DELETION_OUTBOX WHERE user_uuid = $1)", userUUID).Scan(&queued); err != nil {
+		t.Fatal(err)
+	}
+	if !queued {
+		t.Fatal("want the post manager to be told")
+	}
+	if err := dispatch(); err != nil {
+		t.Fatal(err)
+	}
+	if !delivered {
+		t.Fatal("want the post manager told")
+	}
+	if err := db.QueryRow("SELECT EXISTS(SELECT 1 FROM USER_DELETION_OUTBOX WHERE user_uuid = $1)", userUUID).Scan(&queued); err != nil {
+		t.Fatal(err)
+	}
+	if queued {
+		t.Fatal("want the delivered notification dequeued")
+	}
+}
+
+// createTestUser creates a user with a profile in the database at DB_HOST, deleted with the records of the user after the test,
+// and returns the user_uuid and the handle of the user. The test is skipped without the database
+func createTestUser(t *testing.T) (string, string) {
+	if os.Getenv("DB_HOST") == "" {
+		t.Skip("DB_HOST is not set")
+	}
+	if err := database.Migrate(); err != nil {
+		t.Fatal(err)
+	}
+	db := connect(t)
+
+	id := "deletion_" + strconv.FormatInt(time.Now().UnixNano()%1e12, 36)
+	var userUUID string
+	if err := db.QueryRow("INSERT INTO USER_TABLE (user_email, name, password, user_id) VALUES($1, 'Deletion', '', $2) RETURNING user_uuid",
+		id+"@example.com", id).Scan(&userUUID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Exec("INSERT INTO USER_INFO VALUES($1, '', 'Deletion')", id); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() {
+		for _, stmt := range []string{
+			"DELETE FROM USER_DELETION_OUTBOX WHERE user_uuid = $1",
+			"DELETE FROM REFRESH_TOKEN WHERE user_uuid = $1",
+			"DELETE FROM LOGIN_SESSION WHERE user_uuid = $1",
+			"DELETE FROM USER_REVOCATION WHERE user_uuid = $1",
+			"DELETE FROM USER_INFO WHERE user_id = (SELECT user_id FROM USER_TABLE WHERE user_uuid = $1)",
+			"DELETE FROM USER_TABLE WHERE user_uuid = $1",
+		} {
+			if _, err := db.Exec(stmt, userUUID); err != nil {
+				t.Error(err)
+			}
+		}
+	})
+	return userUUID, id
+}
+
+// connect connects to the database, which is closed after the test
+func connect(t *testing.T) *sql.DB {
+	db, err := database.Connect()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = db.Close() })
+	return db
+}
+
+// usePostManager points the post manager client at url, with tokens signed with the shared secret
+func usePostManager(t *testing.T, url string) {
+	t.Setenv("POSTMANAGER_URL", url)
+	t.Setenv("JWT_SIGNING_ALG", token.AlgHS256)
+	t.Setenv("JWT_SECRET_KEY", "deletion-test-secret")
+}
@@ -0,0 +1,122 @@
+/*
+ Copyright 2021 The 110 billion Authors
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package deletion
+
+import (
+	"context"
+	"database/sql"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/110billion/sellfie/usermanagerservice/src/pkg/database"
+	"github.com/110billion/sellfie/usermanagerservice/src/pkg/postmanager"
+)
+
+const (
+	// minBackoff and maxBackoff bound the delay before retrying a failed notification, which doubles on every attempt
+	minBackoff = time.Minute
+	maxBackoff = 6 * time.Hour
+
+	dispatchBatchSize = 100
+)
+
+// enqueue queues telling the other services that the user is deleted, in the transaction deleting the user.
+// The outbox is dispatched until every notification is delivered, so that a failure of the other services does not lose it
+func enqueue(tx *sql.Tx, userUUID string) error {
+	_, err := tx.Exec(`INSERT INTO USER_DELETION_OUTBOX (user_uuid, deleted_at, attempts, next_attempt_at, last_error) VALUES($1, NOW(), 0, NOW(), '')
+		ON CONFLICT (user_uuid) DO UPDATE SET deleted_at = EXCLUDED.deleted_at, attempts = 0, next_attempt_at = EXCLUDED.next_attempt_at, last_error = ''`, userUUID)
+	return err
+}
+
+// dispatch delivers the queued notifications which are due. Failed ones are retried with an exponential backoff
+func dispatch() error {
+	db, err := database.Connect()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	for i := 0; i < dispatchBatchSize; i++ {
+		delivered, err := dispatchOne(db)
+		if err != nil {
+			return err
+		}
+		if !delivered {
+			return nil
+		}
+	}
+	return nil
+}
+
+// dispatchOne delivers a due notification, and returns false if none is due.
+// The row is locked while it is delivered, so that replicas do not deliver it at the same time
+func dispatchOne(db *sql.DB) (bool, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return false, err
+	}
+	defer func() {
+		_ = tx.Rollback()
+	}()
+
+	var userUUID string
+	var attempts int
+	err = tx.QueryRow(`SELECT user_uuid, attempts FROM USER_DELETION_OUTBOX WHERE next_attempt_at <= NOW()
+		ORDER BY next_attempt_at LIMIT 1 FOR UPDATE SKIP LOCKED`).Scan(&userUUID, &attempts)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	if notifyErr := notify(context.Background(), userUUID); notifyErr != nil {
+		attempts++
+		log.Error(notifyErr, "cannot tell post manager that the user is deleted, retrying later", "user", userUUID, "attempts", attempts)
+		if _, err := tx.Exec("UPDATE USER_DELETION_OUTBOX SET attempts = $2, next_attempt_at = $3, last_error = $4 WHERE user_uuid = $1",
+			userUUID, attempts, time.Now().Add(backoff(attempts)), notifyErr.Error()); err != nil {
+			return false, err
+		}
+	} else if _, err := tx.Exec("DELETE FROM USER_DELETION_OUTBOX WHERE user_uuid = $1", userUUID); err != nil {
+		return false, err
+	}
+	return true, tx.Commit()
+}
+
+// notify tells the post manager to remove or anonymize the postings and the media of the user.
+// The post manager does not store postings yet, so it only records the deletion
+func notify(ctx context.Context, userUUID string) error {
+	resp, err := postmanager.Do(ctx, http.MethodDelete, postmanager.ActionUserDeleted, userUUID, "")
+	if err != nil {
+		return err
+	}
+	_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 4<<10))
+	return resp.Body.Close()
+}
+
+// backoff returns the delay before the attempt after the failed attempts
+func backoff(attempts int) time.Duration {
+	delay := minBackoff
+	for i := 1; i < attempts && delay < maxBackoff; i++ {
+		delay *= 2
+	}
+	if delay > maxBackoff {
+		return maxBackoff
+	}
+	return delay
+}
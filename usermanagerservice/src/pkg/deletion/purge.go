@@ -0,0 +1,167 @@
+/*
+ Copyright 2021 The 110 billion Authors
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package deletion
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/110billion/sellfie/usermanagerservice/src/pkg/blob"
+	"github.com/110billion/sellfie/usermanagerservice/src/pkg/database"
+	"github.com/110billion/sellfie/usermanagerservice/src/pkg/lockout"
+	"github.com/110billion/sellfie/usermanagerservice/src/pkg/server/auth/token"
+)
+
+// purgeBatchSize is how many accounts are purged at most in a round
+const purgeBatchSize = 100
+
+// DeleteUser deletes every record of the user in the transaction, but the audit trail and the token revocations,
+// and queues telling the other services to delete the data of the user once the transaction commits.
+// It returns the blob prefixes of the avatar and the export archives of the user, to be deleted after the commit
+func DeleteUser(tx *sql.Tx, userUUID string) ([]string, error) {
+	rows, err := tx.Query(`SELECT i.avatar_key FROM USER_INFO i JOIN USER_TABLE u ON u.user_id = i.user_id WHERE u.user_uuid = $1 AND i.avatar_key <> ''
+		UNION ALL SELECT blob_key FROM EXPORT_JOB WHERE user_uuid = $1 AND blob_key <> ''`, userUUID)
+	if err != nil {
+		return nil, err
+	}
+	var blobs []string
+	for rows.Next() {
+		var key string
+		if err := rows.Scan(&key); err != nil {
+			_ = rows.Close()
+			return nil, err
+		}
+		blobs = append(blobs, key)
+	}
+	_ = rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	// The public profile is keyed by the handle, so it is deleted before the account
+	for _, stmt := range []string{
+		"DELETE FROM USER_IDENTITY WHERE user_uuid = $1",
+		"DELETE FROM OAUTH_STATE WHERE link_user_uuid = $1",
+		"DELETE FROM REFRESH_TOKEN WHERE user_uuid = $1",
+		"DELETE FROM LOGIN_SESSION WHERE user_uuid = $1",
+		"DELETE FROM EMAIL_VERIFICATION WHERE user_uuid = $1",
+		"DELETE FROM PASSWORD_RESET WHERE user_uuid = $1",
+		"DELETE FROM MFA_CHALLENGE WHERE user_uuid = $1",
+		"DELETE FROM MFA_RECOVERY_CODE WHERE user_uuid = $1",
+		"DELETE FROM USER_MFA WHERE user_uuid = $1",
+		"DELETE FROM EXPORT_JOB WHERE user_uuid = $1",
+		"DELETE FROM USER_HANDLE_HISTORY WHERE user_uuid = $1",
+		"DELETE FROM USER_INFO WHERE user_id = (SELECT user_id FROM USER_TABLE WHERE user_uuid = $1)",
+		"DELETE FROM USER_TABLE WHERE user_uuid = $1",
+	} {
+		if _, err := tx.Exec(stmt, userUUID); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := enqueue(tx, userUUID); err != nil {
+		return nil, err
+	}
+	return blobs, nil
+}
+
+// Cleanup deletes what the user leaves outside the database once DeleteUser is committed
+func Cleanup(ctx context.Context, email string, blobs []string) {
+	if err := lockout.Unlock(email); err != nil {
+		log.Error(err, "cannot clear lockout of deleted user")
+	}
+	for _, prefix := range blobs {
+		if err := blob.StoreOf(prefix).DeletePrefix(ctx, prefix); err != nil {
+			log.Error(err, "cannot delete blobs of deleted user", "prefix", prefix)
+		}
+	}
+}
+
+// purgeDue purges the accounts past their grace period, and returns how many are purged
+func purgeDue() (int, error) {
+	db, err := database.Connect()
+	if err != nil {
+		return 0, err
+	}
+	defer db.Close()
+
+	rows, err := db.Query("SELECT user_uuid FROM USER_TABLE WHERE deletion_scheduled_at <= NOW() ORDER BY deletion_scheduled_at LIMIT $1", purgeBatchSize)
+	if err != nil {
+		return 0, err
+	}
+	var userUUIDs []string
+	for rows.Next() {
+		var userUUID string
+		if err := rows.Scan(&userUUID); err != nil {
+			_ = rows.Close()
+			return 0, err
+		}
+		userUUIDs = append(userUUIDs, userUUID)
+	}
+	_ = rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	n := 0
+	for _, userUUID := range userUUIDs {
+		purged, err := purge(db, userUUID)
+		if err != nil {
+			log.Error(err, "cannot purge account", "user", userUUID)
+			continue
+		}
+		if purged {
+			n++
+		}
+	}
+	return n, nil
+}
+
+// purge deletes the account if it is still past its grace period, i.e., it is not restored nor purged by another replica meanwhile
+func purge(db *sql.DB, userUUID string) (bool, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return false, err
+	}
+	defer func() {
+		_ = tx.Rollback()
+	}()
+
+	var email string
+	err = tx.QueryRow("SELECT user_email FROM USER_TABLE WHERE user_uuid = $1 AND deletion_scheduled_at <= NOW() FOR UPDATE SKIP LOCKED", userUUID).Scan(&email)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	blobs, err := DeleteUser(tx, userUUID)
+	if err != nil {
+		return false, err
+	}
+	// Access tokens issued during the grace period would outlive the account until they expire
+	if err := token.RevokeAccessTokensTx(tx, userUUID); err != nil {
+		return false, err
+	}
+	if err := tx.Commit(); err != nil {
+		return false, err
+	}
+
+	Cleanup(context.Background(), email, blobs)
+	return true, nil
+}
@@ -0,0 +1,292 @@
+/*
+ Copyright 2021 The 110 billion Authors
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package export
+
+import (
+	"archive/zip"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"path"
+	"time"
+
+	"github.com/110billion/sellfie/usermanagerservice/src/pkg/blob"
+	"github.com/110billion/sellfie/usermanagerservice/src/pkg/database"
+	"github.com/110billion/sellfie/usermanagerservice/src/pkg/postmanager"
+	"github.com/110billion/sellfie/usermanagerservice/src/pkg/server/auth/mfa"
+	"github.com/110billion/sellfie/usermanagerservice/src/pkg/server/auth/token"
+)
+
+const (
+	// formatVersion is the version of the layout of the archive, bumped on breaking changes
+	formatVersion = 1
+
+	// avatarFile is the largest size the avatar upload stores under the avatar prefix
+	avatarFile = "512.jpg"
+
+	// maxMediaBytes bounds a media file of the post manager, copied into the archive
+	maxMediaBytes = 100 << 20
+)
+
+var mediaClient = &http.Client{Timeout: 5 * time.Minute}
+
+// Manifest describes the archive, and is stored as manifest.json at its root
+type Manifest struct {
+	FormatVersion int            `json:"format_version"`
+	UserID        string         `json:"user_id"`
+	GeneratedAt   time.Time      `json:"generated_at"`
+	Files         []ManifestFile `json:"files"`
+}
+
+// ManifestFile is a file of the archive
+type ManifestFile struct {
+	Name        string `json:"name"`
+	Description string `json:"description"`
+}
+
+// Account is the account of the user, stored in profile.json.
+// ID is the current handle of the user, and UUID identifies the user for good
+type Account struct {
+	ID            string    `json:"id"`
+	UUID          string    `json:"uuid"`
+	Email         string    `json:"email"`
+	EmailVerified bool      `json:"email_verified"`
+	Role          string    `json:"role"`
+	MFAEnabled    bool      `json:"mfa_enabled"`
+	CreatedAt     time.Time `json:"created_at"`
+	Profile       struct {
+		Name      string    `json:"name"`
+		ImageURL  string    `json:"image_url"`
+		Comment   string    `json:"comment"`
+		UpdatedAt time.Time `json:"updated_at"`
+	} `json:"profile"`
+}
+
+// Identity is an external identity linked to the account, stored in identities.json
+type Identity struct {
+	Provider  string    `json:"provider"`
+	Email     string    `json:"email"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// postManagerExport is the data of the user the post manager exports
+type postManagerExport struct {
+	Postings  json.RawMessage `json:"postings"`
+	Donations json.RawMessage `json:"donations"`
+	Media     []struct {
+		// Name is the path of the file under media/postings
+		Name string `json:"name"`
+		URL  string `json:"url"`
+	} `json:"media"`
+}
+
+// archiveWriter writes the files of the archive, listing them in the manifest
+type archiveWriter struct {
+	zip      *zip.Writer
+	manifest Manifest
+}
+
+func (a *archiveWriter) create(name, description string) (io.Writer, error) {
+	a.manifest.Files = append(a.manifest.Files, ManifestFile{Name: name, Description: description})
+	return a.zip.CreateHeader(&zip.FileHeader{Name: name, Method: zip.Deflate, Modified: a.manifest.GeneratedAt})
+}
+
+func (a *archiveWriter) writeJSON(name, description string, v interface{}) error {
+	w, err := a.create(name, description)
+	if err != nil {
+		return err
+	}
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(v)
+}
+
+// writeArchive writes the ZIP archive of the data of the user kept by the user manager and the post manager
+func writeArchive(ctx context.Context, w io.Writer, userUUID string) error {
+	account, avatarKey, err := getAccount(userUUID)
+	if err != nil {
+		return err
+	}
+
+	a := &archiveWriter{
+		zip:      zip.NewWriter(w),
+		manifest: Manifest{FormatVersion: formatVersion, UserID: account.ID, GeneratedAt: time.Now().UTC()},
+	}
+	if err := a.writeJSON("profile.json", "account and public profile", account); err != nil {
+		return err
+	}
+
+	identities, err := listIdentities(userUUID)
+	if err != nil {
+		return err
+	}
+	if err := a.writeJSON("identities.json", "external identities linked to the account", identities); err != nil {
+		return err
+	}
+
+	sessions, err := token.ListSessions(userUUID, "")
+	if err != nil {
+		return err
+	}
+	if err := a.writeJSON("sessions.json", "devices logged in to the account", sessions); err != nil {
+		return err
+	}
+
+	if avatarKey != "" {
+		if err := a.copyBlob(ctx, "media/avatar.jpg", "profile image", avatarKey+"/"+avatarFile); err != nil {
+			return err
+		}
+	}
+
+	posts, err := fetchPostManagerExport(ctx, userUUID)
+	if err != nil {
+		return err
+	}
+	if err := a.writeJSON("postings.json", "postings", posts.Postings); err != nil {
+		return err
+	}
+	if err := a.writeJSON("donations.json", "donations made and received", posts.Donations); err != nil {
+		return err
+	}
+	for _, m := range posts.Media {
+		if err := a.copyURL(ctx, "media/postings/"+path.Clean("/" + m.Name)[1:], "media of postings", m.URL); err != nil {
+			return err
+		}
+	}
+
+	if err := a.writeJSON("manifest.json", "description of the archive", &a.manifest); err != nil {
+		return err
+	}
+	return a.zip.Close()
+}
+
+// copyBlob copies the blob into the archive. A missing blob is skipped
+func (a *archiveWriter) copyBlob(ctx context.Context, name, description, key string) error {
+	r, err := blob.Default().Open(ctx, key)
+	if err == blob.ErrNotFound {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	w, err := a.create(name, description)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(w, r)
+	return err
+}
+
+// copyURL downloads the media file into the archive
+func (a *archiveWriter) copyURL(ctx context.Context, name, description, url string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := mediaClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("media %s responded with status %d", url, resp.StatusCode)
+	}
+
+	w, err := a.create(name, description)
+	if err != nil {
+		return err
+	}
+	n, err := io.Copy(w, io.LimitReader(resp.Body, maxMediaBytes+1))
+	if err != nil {
+		return err
+	}
+	if n > maxMediaBytes {
+		return fmt.Errorf("media %s is larger than %d bytes", url, maxMediaBytes)
+	}
+	return nil
+}
+
+// getAccount returns the account of the user, and the blob prefix of the avatar
+func getAccount(userUUID string) (*Account, string, error) {
+	db, err := database.Connect()
+	if err != nil {
+		return nil, "", err
+	}
+	defer db.Close()
+
+	account := &Account{UUID: userUUID}
+	var avatarKey sql.NullString
+	var name, url, comment sql.NullString
+	var updatedAt sql.NullTime
+	if err := db.QueryRow(`SELECT u.user_id, u.user_email, u.email_verified, u.role, u.created_at,
+		i.name, i.profile_url, i.profile_comment, i.updated_at, i.avatar_key
+		FROM USER_TABLE u LEFT JOIN USER_INFO i ON i.user_id = u.user_id WHERE u.user_uuid = $1`, userUUID).
+		Scan(&account.ID, &account.Email, &account.EmailVerified, &account.Role, &account.CreatedAt, &name, &url, &comment, &updatedAt, &avatarKey); err != nil {
+		return nil, "", err
+	}
+	account.Profile.Name, account.Profile.ImageURL, account.Profile.Comment = name.String, url.String, comment.String
+	account.Profile.UpdatedAt = updatedAt.Time
+
+	if account.MFAEnabled, err = mfa.Enabled(userUUID); err != nil {
+		return nil, "", err
+	}
+	return account, avatarKey.String, nil
+}
+
+func listIdentities(userUUID string) ([]Identity, error) {
+	db, err := database.Connect()
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+
+	rows, err := db.Query("SELECT provider, email, created_at FROM USER_IDENTITY WHERE user_uuid = $1 ORDER BY created_at", userUUID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	identities := []Identity{}
+	for rows.Next() {
+		identity := Identity{}
+		if err := rows.Scan(&identity.Provider, &identity.Email, &identity.CreatedAt); err != nil {
+			return nil, err
+		}
+		identities = append(identities, identity)
+	}
+	return identities, rows.Err()
+}
+
+// fetchPostManagerExport fetches the postings, the donations and the list of media of the user from the post manager
+func fetchPostManagerExport(ctx context.Context, userUUID string) (*postManagerExport, error) {
+	resp, err := postmanager.Do(ctx, http.MethodGet, postmanager.ActionUserExport, userUUID, "/export")
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	export := &postManagerExport{}
+	if err := json.NewDecoder(resp.Body).Decode(export); err != nil {
+		return nil, err
+	}
+	return export, nil
+}
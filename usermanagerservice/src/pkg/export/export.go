@@ -0,0 +1,201 @@
+/*
+ Copyright 2021 The 110 billion Authors
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package export
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"io"
+	"net/url"
+	"os"
+	"time"
+
+	"github.com/110billion/sellfie/usermanagerservice/src/internal/utils"
+	"github.com/110billion/sellfie/usermanagerservice/src/pkg/blob"
+	"github.com/110billion/sellfie/usermanagerservice/src/pkg/database"
+	"github.com/110billion/sellfie/usermanagerservice/src/pkg/server/auth/token"
+	logf "sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+// Statuses of an export job
+const (
+	StatusPending = "pending"
+	StatusRunning = "running"
+	StatusDone    = "done"
+	StatusFailed  = "failed"
+	// StatusExpired is the status of a done job whose archive is deleted
+	StatusExpired = "expired"
+)
+
+// actionDownload is the prefix of the audience of the tokens of the download links, followed by the job id
+const actionDownload = "export_download:"
+
+var (
+	log = logf.Log.WithName("export")
+
+	// archiveTTL is how long an archive is kept after it is built
+	archiveTTL = utils.DurationFromEnv("EXPORT_ARCHIVE_TTL", 7*24*time.Hour)
+	// linkTTL is how long a download link is valid
+	linkTTL = utils.DurationFromEnv("EXPORT_LINK_TTL", 15*time.Minute)
+)
+
+var (
+	// ErrUserNotFound is returned on exporting the data of a user who does not exist
+	ErrUserNotFound = errors.New("user is not found")
+	// ErrJobNotFound is returned if the user does not have the job
+	ErrJobNotFound = errors.New("export job is not found")
+	// ErrNotReady is returned on downloading the archive of a job which is not done, or whose archive expired
+	ErrNotReady = errors.New("export archive is not available")
+	// ErrInvalidLink is returned if the download link is invalid or expired
+	ErrInvalidLink = errors.New("download link is invalid or expired")
+)
+
+// Job is an export of the data of a user, built asynchronously
+type Job struct {
+	ID         string     `json:"id"`
+	Status     string     `json:"status"`
+	CreatedAt  time.Time  `json:"created_at"`
+	FinishedAt *time.Time `json:"finished_at,omitempty"`
+	// ExpiresAt is when the archive of a done job is deleted
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+
+	userUUID string
+	blobKey  string
+}
+
+// Create queues an export of the data of the user identified by userUUID.
+// If an export of the user is already queued or running, it is returned instead
+func Create(userUUID string) (*Job, error) {
+	db, err := database.Connect()
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = tx.Rollback()
+	}()
+
+	// Locking the account serializes the exports of the user
+	var locked string
+	err = tx.QueryRow("SELECT user_uuid FROM USER_TABLE WHERE user_uuid = $1 FOR UPDATE", userUUID).Scan(&locked)
+	if err == sql.ErrNoRows {
+		return nil, ErrUserNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	job, err := scanJob(tx.QueryRow(`SELECT job_id, user_uuid, status, created_at, finished_at, expires_at, blob_key FROM EXPORT_JOB
+		WHERE user_uuid = $1 AND status IN ($2, $3) ORDER BY created_at DESC LIMIT 1`, userUUID, StatusPending, StatusRunning))
+	if err == nil {
+		return job, nil
+	}
+	if err != ErrJobNotFound {
+		return nil, err
+	}
+
+	id, err := randomID()
+	if err != nil {
+		return nil, err
+	}
+	job, err = scanJob(tx.QueryRow(`INSERT INTO EXPORT_JOB (job_id, user_uuid, status, created_at) VALUES($1, $2, $3, NOW())
+		RETURNING job_id, user_uuid, status, created_at, finished_at, expires_at, blob_key`, id, userUUID, StatusPending))
+	if err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	wakeWorker()
+	return job, nil
+}
+
+// Get returns the export job of the user identified by userUUID
+func Get(userUUID, jobID string) (*Job, error) {
+	db, err := database.Connect()
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+
+	return scanJob(db.QueryRow(`SELECT job_id, user_uuid, status, created_at, finished_at, expires_at, blob_key FROM EXPORT_JOB
+		WHERE job_id = $1 AND user_uuid = $2`, jobID, userUUID))
+}
+
+// DownloadURL returns a link to download the archive of the done job, which expires after linkTTL.
+// The link is signed, so that it can be opened without the access token, e.g., by a browser
+func DownloadURL(job *Job) (string, error) {
+	if job.Status != StatusDone {
+		return "", ErrNotReady
+	}
+
+	signed, _, err := token.IssueActionToken(actionDownload+job.ID, job.userUUID, "", linkTTL)
+	if err != nil {
+		return "", err
+	}
+	return os.Getenv("EXPORT_BASE_URL") + "/exports/" + url.PathEscape(job.ID) + "/download?token=" + url.QueryEscape(signed), nil
+}
+
+// OpenArchive verifies the token of the download link of the job, and opens its archive
+func OpenArchive(ctx context.Context, jobID, tokenString string) (io.ReadCloser, error) {
+	claims, err := token.ParseActionToken(actionDownload+jobID, tokenString)
+	if err != nil {
+		return nil, ErrInvalidLink
+	}
+
+	job, err := Get(claims.Subject, jobID)
+	if err == ErrJobNotFound {
+		return nil, ErrInvalidLink
+	}
+	if err != nil {
+		return nil, err
+	}
+	if job.Status != StatusDone {
+		return nil, ErrNotReady
+	}
+
+	archive, err := blob.Private().Open(ctx, job.blobKey+"/"+archiveName)
+	if err == blob.ErrNotFound {
+		return nil, ErrNotReady
+	}
+	return archive, err
+}
+
+func scanJob(row *sql.Row) (*Job, error) {
+	job := &Job{}
+	var finishedAt, expiresAt sql.NullTime
+	if err := row.Scan(&job.ID, &job.userUUID, &job.Status, &job.CreatedAt, &finishedAt, &expiresAt, &job.blobKey); err != nil {
+		if err == sql.ErrNoRows {
+			return nil, ErrJobNotFound
+		}
+		return nil, err
+	}
+	if finishedAt.Valid {
+		job.FinishedAt = &finishedAt.Time
+	}
+	if expiresAt.Valid {
+		job.ExpiresAt = &expiresAt.Time
+	}
+	return job, nil
+}
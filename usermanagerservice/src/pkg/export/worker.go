@@ -0,0 +1,212 @@
+/*
+ Copyright 2021 The 110 billion Authors
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package export
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/110billion/sellfie/usermanagerservice/src/internal/utils"
+	"github.com/110billion/sellfie/usermanagerservice/src/pkg/blob"
+	"github.com/110billion/sellfie/usermanagerservice/src/pkg/database"
+)
+
+const (
+	// jobTimeout is how long a job runs at most. Running jobs older than it are taken over,
+	// as the replica running them is assumed to be gone
+	jobTimeout = 30 * time.Minute
+
+	archiveName        = "sellfie-export.zip"
+	archiveContentType = "application/zip"
+)
+
+var (
+	// pollInterval is how often the worker looks for queued jobs and expired archives.
+	// Jobs queued by the replica are started right away
+	pollInterval = utils.DurationFromEnv("EXPORT_POLL_INTERVAL", time.Minute)
+
+	wake      = make(chan struct{}, 1)
+	startOnce sync.Once
+)
+
+// Init starts the worker building the queued exports and deleting the expired archives
+func Init() error {
+	startOnce.Do(func() {
+		go work()
+	})
+	return nil
+}
+
+// wakeWorker starts the worker of the replica right away, unless it is already woken
+func wakeWorker() {
+	select {
+	case wake <- struct{}{}:
+	default:
+	}
+}
+
+func work() {
+	ticker := time.NewTicker(pollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-wake:
+		}
+
+		for {
+			ran, err := runNext()
+			if err != nil {
+				log.Error(err, "cannot run export job")
+			}
+			if !ran || err != nil {
+				break
+			}
+		}
+		if err := expire(); err != nil {
+			log.Error(err, "cannot expire export archives")
+		}
+	}
+}
+
+// runNext claims a queued job, or a job timed out on another replica, and builds its archive.
+// It returns false if there is no job to run
+func runNext() (bool, error) {
+	db, err := database.Connect()
+	if err != nil {
+		return false, err
+	}
+	defer db.Close()
+
+	var jobID, userUUID string
+	err = db.QueryRow(`UPDATE EXPORT_JOB SET status = $1, started_at = NOW() WHERE job_id = (
+		SELECT job_id FROM EXPORT_JOB WHERE status = $2 OR (status = $1 AND started_at < $3)
+		ORDER BY created_at LIMIT 1 FOR UPDATE SKIP LOCKED) RETURNING job_id, user_uuid`,
+		StatusRunning, StatusPending, time.Now().Add(-jobTimeout)).Scan(&jobID, &userUUID)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), jobTimeout)
+	defer cancel()
+
+	key, err := buildArchive(ctx, userUUID)
+	if err != nil {
+		log.Error(err, "cannot build export archive", "job", jobID, "user", userUUID)
+		_, updateErr := db.Exec("UPDATE EXPORT_JOB SET status = $2, finished_at = NOW() WHERE job_id = $1", jobID, StatusFailed)
+		return true, updateErr
+	}
+
+	// The job may be taken over while it runs too long, in which case the archive of the other replica wins
+	result, err := db.Exec("UPDATE EXPORT_JOB SET status = $2, blob_key = $3, finished_at = NOW(), expires_at = $4 WHERE job_id = $1 AND status = $5",
+		jobID, StatusDone, key, time.Now().Add(archiveTTL), StatusRunning)
+	if err != nil {
+		deleteArchive(key)
+		return true, err
+	}
+	if n, err := result.RowsAffected(); err != nil || n != 1 {
+		deleteArchive(key)
+		return true, err
+	}
+	log.Info("export archive is built", "job", jobID, "user", userUUID)
+	return true, nil
+}
+
+// buildArchive builds the archive of the data of the user in a temporary file, stores it and returns its blob prefix
+func buildArchive(ctx context.Context, userUUID string) (string, error) {
+	f, err := os.CreateTemp("", "sellfie-export-*.zip")
+	if err != nil {
+		return "", err
+	}
+	defer func() {
+		_ = f.Close()
+		_ = os.Remove(f.Name())
+	}()
+
+	if err := writeArchive(ctx, f, userUUID); err != nil {
+		return "", err
+	}
+	if _, err := f.Seek(0, 0); err != nil {
+		return "", err
+	}
+
+	key, err := randomID()
+	if err != nil {
+		return "", err
+	}
+	key = blob.ExportsPrefix + key
+	if err := blob.Private().Put(ctx, key+"/"+archiveName, archiveContentType, f); err != nil {
+		deleteArchive(key)
+		return "", err
+	}
+	return key, nil
+}
+
+// expire deletes the archives past their expiry
+func expire() error {
+	db, err := database.Connect()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	rows, err := db.Query(`WITH expired AS (
+			SELECT job_id, blob_key FROM EXPORT_JOB WHERE status = $2 AND expires_at <= NOW() FOR UPDATE SKIP LOCKED
+		)
+		UPDATE EXPORT_JOB j SET status = $1, blob_key = '' FROM expired WHERE j.job_id = expired.job_id RETURNING expired.blob_key`,
+		StatusExpired, StatusDone)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var key string
+		if err := rows.Scan(&key); err != nil {
+			return err
+		}
+		deleteArchive(key)
+	}
+	return rows.Err()
+}
+
+// deleteArchive deletes the archive stored under the prefix. A failure leaves unreferenced blobs, and is only logged
+func deleteArchive(key string) {
+	if key == "" {
+		return
+	}
+	if err := blob.Private().DeletePrefix(context.Background(), key); err != nil {
+		log.Error(err, "cannot delete export archive", "prefix", key)
+	}
+}
+
+func randomID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
@@ -0,0 +1,220 @@
+/*
+ Copyright 2021 The 110 billion Authors
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package handle
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"regexp"
+	"time"
+
+	"github.com/110billion/sellfie/usermanagerservice/src/internal/utils"
+	"github.com/110billion/sellfie/usermanagerservice/src/pkg/database"
+	"github.com/110billion/sellfie/usermanagerservice/src/pkg/server/auth/token"
+	logf "sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+var (
+	log = logf.Log.WithName("handle")
+
+	// historyPeriod is how long an old handle redirects to the current one, and cannot be taken by another user
+	historyPeriod = utils.DurationFromEnv("HANDLE_HISTORY_PERIOD", 90*24*time.Hour)
+	// cooldown is how long the user waits to change the handle again
+	cooldown = utils.DurationFromEnv("HANDLE_CHANGE_COOLDOWN", 30*24*time.Hour)
+
+	// pattern is the form of a handle, which is also a path segment of the api
+	pattern = regexp.MustCompile(`^[a-z0-9_]{3,20}$`)
+
+	// reserved are the handles nobody can take, as they may be confused with the service or its paths
+	reserved = map[string]bool{
+		"admin": true, "administrator": true, "api": true, "auth": true, "blobs": true, "exports": true,
+		"help": true, "internal": true, "login": true, "logout": true, "me": true, "moderator": true,
+		"null": true, "root": true, "sellfie": true, "settings": true, "signup": true, "staff": true,
+		"support": true, "system": true, "undefined": true, "users": true,
+	}
+)
+
+var (
+	// ErrUserNotFound is returned if the user does not exist
+	ErrUserNotFound = errors.New("user is not found")
+	// ErrInvalid is returned if the handle is not in the form of a handle
+	ErrInvalid = errors.New("handle must be 3 to 20 lower case letters, digits or underscores")
+	// ErrTaken is returned if the handle is reserved, belongs to another user or still redirects to another user
+	ErrTaken = errors.New("handle is not available")
+	// ErrUnchanged is returned on changing the handle to the current one
+	ErrUnchanged = errors.New("handle is unchanged")
+	// ErrNotFound is returned if the handle is neither current nor redirects to a user
+	ErrNotFound = errors.New("handle is not found")
+)
+
+// CooldownError is returned if the handle is changed again within the cooldown
+type CooldownError struct {
+	RetryAfter time.Duration
+}
+
+func (e *CooldownError) Error() string {
+	return fmt.Sprintf("handle is changed too often, retry after %s", e.RetryAfter.Round(time.Second))
+}
+
+// Changed is the result of changing a handle
+type Changed struct {
+	Handle   string `json:"handle"`
+	Previous string `json:"previous_handle"`
+	// ChangeableAt is when the handle can be changed again
+	ChangeableAt time.Time `json:"changeable_at"`
+}
+
+type queryer interface {
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+// Validate checks that the handle is in the form of a handle
+func Validate(h string) error {
+	if !pattern.MatchString(h) {
+		return ErrInvalid
+	}
+	return nil
+}
+
+// Available returns whether the user of userUUID, or a new user if userUUID is empty, can take the handle.
+// The handle must not be reserved, be the handle of a user nor redirect to another user
+func Available(q queryer, h, userUUID string) (bool, error) {
+	if reserved[h] {
+		return false, nil
+	}
+
+	var taken bool
+	if err := q.QueryRow(`SELECT EXISTS(SELECT 1 FROM USER_TABLE WHERE user_id = $1)
+		OR EXISTS(SELECT 1 FROM USER_HANDLE_HISTORY WHERE handle = $1 AND expires_at > NOW() AND user_uuid::text <> $2)`, h, userUUID).
+		Scan(&taken); err != nil {
+		return false, err
+	}
+	return !taken, nil
+}
+
+// Change changes the handle of the user identified by userUUID to h, and keeps the old handle redirecting to the user for HANDLE_HISTORY_PERIOD.
+// Records of the user are keyed by user_uuid and are left as they are. The access tokens of the user are revoked
+// in the same transaction, as they carry the old handle; the clients refresh them to get the new one
+func Change(userUUID, h string) (*Changed, error) {
+	if err := Validate(h); err != nil {
+		return nil, err
+	}
+
+	db, err := database.Connect()
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = tx.Rollback()
+	}()
+
+	var id string
+	var changedAt sql.NullTime
+	err = tx.QueryRow("SELECT user_id, handle_changed_at FROM USER_TABLE WHERE user_uuid = $1 FOR UPDATE", userUUID).Scan(&id, &changedAt)
+	if err == sql.ErrNoRows {
+		return nil, ErrUserNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	if h == id {
+		return nil, ErrUnchanged
+	}
+	if changedAt.Valid && time.Since(changedAt.Time) < cooldown {
+		return nil, &CooldownError{RetryAfter: cooldown - time.Since(changedAt.Time)}
+	}
+
+	available, err := Available(tx, h, userUUID)
+	if err != nil {
+		return nil, err
+	}
+	if !available {
+		return nil, ErrTaken
+	}
+
+	now := time.Now()
+	// A concurrent signup or change to the same handle is told by the unique constraint, not by checking beforehand
+	if _, err := tx.Exec("UPDATE USER_TABLE SET user_id = $2, handle_changed_at = $3 WHERE user_uuid = $1", userUUID, h, now); err != nil {
+		if database.UserIDKey.Violated(err) {
+			return nil, ErrTaken
+		}
+		return nil, err
+	}
+	// The public profile is provisioned outside of the service and is keyed by the handle
+	if _, err := tx.Exec("UPDATE USER_INFO SET user_id = $2 WHERE user_id = $1", id, h); err != nil {
+		return nil, err
+	}
+
+	// Taking back an old handle stops it redirecting
+	if _, err := tx.Exec("DELETE FROM USER_HANDLE_HISTORY WHERE handle = $1", h); err != nil {
+		return nil, err
+	}
+	if _, err := tx.Exec(`INSERT INTO USER_HANDLE_HISTORY (handle, user_uuid, changed_at, expires_at) VALUES($1, $2, $3, $4)
+		ON CONFLICT (handle) DO UPDATE SET user_uuid = EXCLUDED.user_uuid, changed_at = EXCLUDED.changed_at, expires_at = EXCLUDED.expires_at`,
+		id, userUUID, now, now.Add(historyPeriod)); err != nil {
+		return nil, err
+	}
+
+	if err := token.RevokeAccessTokensTx(tx, userUUID); err != nil {
+		return nil, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return &Changed{Handle: h, Previous: id, ChangeableAt: now.Add(cooldown)}, nil
+}
+
+// Owns returns whether h is the current handle of the user identified by userUUID
+func Owns(h, userUUID string) (bool, error) {
+	db, err := database.Connect()
+	if err != nil {
+		return false, err
+	}
+	defer db.Close()
+
+	var owns bool
+	if err := db.QueryRow("SELECT EXISTS(SELECT 1 FROM USER_TABLE WHERE user_id = $1 AND user_uuid = $2)", h, userUUID).Scan(&owns); err != nil {
+		return false, err
+	}
+	return owns, nil
+}
+
+// Resolve returns the current handle of the user the old handle redirects to.
+// A current handle does not redirect, even if it is an old handle of another user
+func Resolve(h string) (string, error) {
+	db, err := database.Connect()
+	if err != nil {
+		return "", err
+	}
+	defer db.Close()
+
+	var current string
+	err = db.QueryRow(`SELECT u.user_id FROM USER_HANDLE_HISTORY h JOIN USER_TABLE u ON u.user_uuid = h.user_uuid
+		WHERE h.handle = $1 AND h.expires_at > NOW() AND NOT EXISTS(SELECT 1 FROM USER_TABLE WHERE user_id = $1)`, h).Scan(&current)
+	if err == sql.ErrNoRows {
+		return "", ErrNotFound
+	}
+	return current, err
+}
@@ -0,0 +1,194 @@
+/*
+ Copyright 2021 The 110 billion Authors
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package handle
+
+import (
+	"database/sql"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/110billion/sellfie/usermanagerservice/src/pkg/database"
+	"github.com/gorilla/mux"
+)
+
+func TestValidate(t *testing.T) {
+	tests := map[string]error{
+		"jane_doe":              nil,
+		"abc":                   nil,
+		"a1234567890123456789":  nil,
+		"ab":                    ErrInvalid,
+		"a12345678901234567890": ErrInvalid,
+		"Jane":                  ErrInvalid,
+		"jane.doe":              ErrInvalid,
+		"jane/doe":              ErrInvalid,
+		"":                      ErrInvalid,
+	}
+	for h, want := range tests {
+		if got := Validate(h); got != want {
+			t.Errorf("%q: want %v, got %v", h, want, got)
+		}
+	}
+}
+
+// TestAvailableReserved checks that reserved handles are refused before the database is queried
+func TestAvailableReserved(t *testing.T) {
+	for _, h := range []string{"admin", "me", "users", "signup"} {
+		available, err := Available(nil, h, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if available {
+			t.Errorf("%q is available", h)
+		}
+	}
+}
+
+// TestChange changes the handle of a user, against the database at DB_HOST.
+// The old handle redirects to the new one and is kept from other users, and the user_uuid stays the same
+func TestChange(t *testing.T) {
+	suffix := strconv.FormatInt(time.Now().UnixNano()%1e12, 36)
+	userUUID := createTestUser(t, "h"+suffix)
+	otherUUID := createTestUser(t, "o"+suffix)
+	db, err := database.Connect()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	for h, want := range map[string]error{
+		"h" + suffix: ErrUnchanged,
+		"o" + suffix: ErrTaken,
+		"admin":      ErrTaken,
+		"Not valid":  ErrInvalid,
+	} {
+		if _, err := Change(userUUID, h); err != want {
+			t.Errorf("changing to %q: want %v, got %v", h, want, err)
+		}
+	}
+
+	changed, err := Change(userUUID, "n"+suffix)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if changed.Previous != "h"+suffix || changed.Handle != "n"+suffix {
+		t.Fatalf("want h%s changed to n%s, got %+v", suffix, suffix, changed)
+	}
+	for query, want := range map[string]string{
+		"SELECT user_id FROM USER_TABLE WHERE user_uuid = $1":                                                 "n" + suffix,
+		"SELECT i.user_id FROM USER_INFO i JOIN USER_TABLE u ON u.user_id = i.user_id WHERE u.user_uuid = $1": "n" + suffix,
+	} {
+		var got string
+		if err := db.QueryRow(query, userUUID).Scan(&got); err != nil {
+			t.Fatal(err)
+		}
+		if got != want {
+			t.Fatalf("want %s, got %s by %s", want, got, query)
+		}
+	}
+	var revoked bool
+	if err := db.QueryRow("SELECT EXISTS(SELECT 1 FROM USER_REVOCATION WHERE user_uuid = $1)", userUUID).Scan(&revoked); err != nil {
+		t.Fatal(err)
+	}
+	if !revoked {
+		t.Fatal("want the access tokens carrying the old handle revoked")
+	}
+
+	if current, err := Resolve("h" + suffix); err != nil || current != "n"+suffix {
+		t.Fatalf("want the old handle resolved to n%s, got %q, %v", suffix, current, err)
+	}
+	if _, err := Resolve("n" + suffix); err != ErrNotFound {
+		t.Fatalf("want a current handle not redirected, got %v", err)
+	}
+	checkAvailable(t, db, "h"+suffix, otherUUID, false)
+	checkAvailable(t, db, "h"+suffix, userUUID, true)
+
+	var cooldownErr *CooldownError
+	if _, err := Change(userUUID, "h"+suffix); !errors.As(err, &cooldownErr) {
+		t.Fatalf("want a cooldown error, got %v", err)
+	}
+
+	router := mux.NewRouter()
+	router.HandleFunc("/users/{user_id}/profile", Redirect("user_id")(func(w http.ResponseWriter, req *http.Request) {}))
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/users/h"+suffix+"/profile?fields=name", nil))
+	if w.Code != http.StatusTemporaryRedirect || w.Header().Get("Location") != "/users/n"+suffix+"/profile?fields=name" {
+		t.Fatalf("want a redirect to the new handle, got %d to %q", w.Code, w.Header().Get("Location"))
+	}
+}
+
+func checkAvailable(t *testing.T, db *sql.DB, h, userUUID string, want bool) {
+	t.Helper()
+	available, err := Available(db, h, userUUID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if available != want {
+		t.Fatalf("want %q available %v to %s, got %v", h, want, userUUID, available)
+	}
+}
+
+// createTestUser creates a user of the handle with a profile in the database at DB_HOST, deleted with the records of the user after the test,
+// and returns the user_uuid of the user. The test is skipped without the database
+func createTestUser(t *testing.T, id string) string {
+	if os.Getenv("DB_HOST") == "" {
+		t.Skip("DB_HOST is not set")
+	}
+	if err := database.Migrate(); err != nil {
+		t.Fatal(err)
+	}
+
+	db, err := database.Connect()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	var userUUID string
+	if err := db.QueryRow("INSERT INTO USER_TABLE (user_email, name, password, user_id) VALUES($1, 'Handle', '', $2) RETURNING user_uuid",
+		id+"@example.com", id).Scan(&userUUID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Exec("INSERT INTO USER_INFO VALUES($1, '', 'Handle')", id); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() {
+		db, err := database.Connect()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer db.Close()
+
+		for _, stmt := range []string{
+			"DELETE FROM USER_HANDLE_HISTORY WHERE user_uuid = $1",
+			"DELETE FROM USER_REVOCATION WHERE user_uuid = $1",
+			"DELETE FROM USER_INFO WHERE user_id = (SELECT user_id FROM USER_TABLE WHERE user_uuid = $1)",
+			"DELETE FROM USER_TABLE WHERE user_uuid = $1",
+		} {
+			if _, err := db.Exec(stmt, userUUID); err != nil {
+				t.Error(err)
+			}
+		}
+	})
+	return userUUID
+}
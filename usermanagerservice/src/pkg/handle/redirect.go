@@ -0,0 +1,66 @@
+/*
+ Copyright 2021 The 110 billion Authors
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package handle
+
+import (
+	"net/http"
+
+	"github.com/gorilla/mux"
+)
+
+// Redirect returns a wrapper middleware redirecting requests naming an old handle in the path variable to the same path with the current handle.
+// The redirect is temporary, as the old handle can be taken by another user once it expires
+func Redirect(variable string) func(http.HandlerFunc) http.HandlerFunc {
+	return func(next http.HandlerFunc) http.HandlerFunc {
+		return func(w http.ResponseWriter, req *http.Request) {
+			vars := mux.Vars(req)
+			route := mux.CurrentRoute(req)
+			if vars[variable] == "" || route == nil {
+				next(w, req)
+				return
+			}
+
+			current, err := Resolve(vars[variable])
+			if err != nil {
+				// The handler tells a handle that is not found, and fails the same if the database is unavailable
+				if err != ErrNotFound {
+					log.Error(err, "cannot resolve handle", "handle", vars[variable])
+				}
+				next(w, req)
+				return
+			}
+
+			pairs := make([]string, 0, 2*len(vars))
+			for k, v := range vars {
+				if k == variable {
+					v = current
+				}
+				pairs = append(pairs, k, v)
+			}
+			u, err := route.URLPath(pairs...)
+			if err != nil {
+				log.Error(err, "cannot build redirect", "handle", vars[variable])
+				next(w, req)
+				return
+			}
+			u.RawQuery = req.URL.RawQuery
+
+			// 307 keeps the method and the body of the request
+			http.Redirect(w, req, u.String(), http.StatusTemporaryRedirect)
+		}
+	}
+}
@@ -0,0 +1,235 @@
+/*
+ Copyright 2021 The 110 billion Authors
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package lockout
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/110billion/sellfie/usermanagerservice/src/internal/utils"
+)
+
+const (
+	// StorePostgres keeps the failures in Postgres, shared by every replica
+	StorePostgres = "postgres"
+	// StoreMemory keeps the failures in memory, for a single replica and tests
+	StoreMemory = "memory"
+)
+
+// Policy decides how long a key waits after its failures.
+// After FreeAttempts failures, the wait doubles from BaseDelay with every failure up to MaxDelay.
+// After LockoutThreshold failures, the key is locked for LockoutDuration
+type Policy struct {
+	FreeAttempts     int
+	BaseDelay        time.Duration
+	MaxDelay         time.Duration
+	LockoutThreshold int
+	LockoutDuration  time.Duration
+	// Window is how long a failure is remembered
+	Window time.Duration
+}
+
+// Wait returns how long the key of the record waits at now until it may try again, or zero if it may try now
+func (p *Policy) Wait(e Entry, now time.Time) time.Duration {
+	if e.Failures == 0 || now.Sub(e.LastFailure) >= p.Window {
+		return 0
+	}
+
+	var delay time.Duration
+	switch {
+	case p.LockoutThreshold > 0 && e.Failures >= p.LockoutThreshold:
+		delay = p.LockoutDuration
+	case e.Failures > p.FreeAttempts:
+		delay = p.BaseDelay
+		for i := p.FreeAttempts + 1; i < e.Failures && delay < p.MaxDelay; i++ {
+			delay *= 2
+		}
+		if delay > p.MaxDelay {
+			delay = p.MaxDelay
+		}
+	default:
+		return 0
+	}
+
+	if wait := e.LastFailure.Add(delay).Sub(now); wait > 0 {
+		return wait
+	}
+	return 0
+}
+
+// Limiter throttles the keys failing under the policy
+type Limiter struct {
+	Policy Policy
+	Store  Store
+}
+
+// Check returns how long the key waits until it may try again, or zero if it may try now
+func (l *Limiter) Check(key string) (time.Duration, error) {
+	e, err := l.Store.Get(key)
+	if err != nil {
+		return 0, err
+	}
+	return l.Policy.Wait(e, time.Now()), nil
+}
+
+// Fail records a failure of the key
+func (l *Limiter) Fail(key string) error {
+	_, err := l.Store.Fail(key, time.Now(), l.Policy.Window)
+	return err
+}
+
+// Reset forgets the failures of the key
+func (l *Limiter) Reset(key string) error {
+	return l.Store.Reset(key)
+}
+
+var (
+	limiterLock sync.RWMutex
+	// accounts throttles the logins of an email, whether it is registered or not
+	accounts = &Limiter{Store: NewMemoryStore(), Policy: Policy{
+		FreeAttempts:     utils.IntFromEnv("LOGIN_FREE_ATTEMPTS", 3),
+		BaseDelay:        time.Second,
+		MaxDelay:         time.Minute,
+		LockoutThreshold: utils.IntFromEnv("LOCKOUT_THRESHOLD", 10),
+		LockoutDuration:  utils.DurationFromEnv("LOCKOUT_DURATION", 30*time.Minute),
+		Window:           24 * time.Hour,
+	}}
+	// ips throttles the logins from an IP address, which may try many accounts
+	ips = &Limiter{Store: NewMemoryStore(), Policy: Policy{
+		FreeAttempts:     utils.IntFromEnv("LOGIN_IP_FREE_ATTEMPTS", 20),
+		BaseDelay:        time.Second,
+		MaxDelay:         5 * time.Minute,
+		LockoutThreshold: utils.IntFromEnv("LOCKOUT_IP_THRESHOLD", 100),
+		LockoutDuration:  utils.DurationFromEnv("LOCKOUT_IP_DURATION", time.Hour),
+		Window:           time.Hour,
+	}}
+	// codes throttles the second factor codes of a user, across challenges and endpoints.
+	// A correct password does not forget them, so that the codes cannot be guessed by logging in again
+	codes = &Limiter{Store: NewMemoryStore(), Policy: Policy{
+		FreeAttempts:     utils.IntFromEnv("MFA_FREE_ATTEMPTS", 3),
+		BaseDelay:        time.Second,
+		MaxDelay:         time.Minute,
+		LockoutThreshold: utils.IntFromEnv("MFA_LOCKOUT_THRESHOLD", 10),
+		LockoutDuration:  utils.DurationFromEnv("MFA_LOCKOUT_DURATION", 30*time.Minute),
+		Window:           24 * time.Hour,
+	}}
+)
+
+// Init selects the store of the login failures by LOCKOUT_STORE, i.e., postgres or memory. Defaults to postgres
+func Init() error {
+	kind := os.Getenv("LOCKOUT_STORE")
+	if kind == "" {
+		kind = StorePostgres
+	}
+
+	switch kind {
+	case StorePostgres:
+		SetStore(&PostgresStore{})
+	case StoreMemory:
+		SetStore(NewMemoryStore())
+	default:
+		return fmt.Errorf("unknown lockout store %s", kind)
+	}
+	return nil
+}
+
+// SetStore replaces the store of the login failures, e.g., with a MemoryStore in tests
+func SetStore(s Store) {
+	limiterLock.Lock()
+	defer limiterLock.Unlock()
+	accounts.Store = s
+	ips.Store = s
+	codes.Store = s
+}
+
+// CheckLogin returns how long a login of the email from the IP address waits until it may be tried, or zero if it may be tried now
+func CheckLogin(email, ip string) (time.Duration, error) {
+	limiterLock.RLock()
+	defer limiterLock.RUnlock()
+
+	accountWait, err := accounts.Check(accountKey(email))
+	if err != nil {
+		return 0, err
+	}
+	ipWait, err := ips.Check(ipKey(ip))
+	if err != nil {
+		return 0, err
+	}
+	if ipWait > accountWait {
+		return ipWait, nil
+	}
+	return accountWait, nil
+}
+
+// FailLogin records a failed login of the email from the IP address
+func FailLogin(email, ip string) error {
+	limiterLock.RLock()
+	defer limiterLock.RUnlock()
+
+	if err := accounts.Fail(accountKey(email)); err != nil {
+		return err
+	}
+	return ips.Fail(ipKey(ip))
+}
+
+// Unlock forgets the failed logins of the email, on a successful login or a password reset.
+// The failures of the IP address are kept, as it may still be guessing other accounts
+func Unlock(email string) error {
+	limiterLock.RLock()
+	defer limiterLock.RUnlock()
+
+	return accounts.Reset(accountKey(email))
+}
+
+// CheckCode returns how long the user waits until a second factor code may be tried, or zero if it may be tried now
+func CheckCode(id string) (time.Duration, error) {
+	limiterLock.RLock()
+	defer limiterLock.RUnlock()
+
+	return codes.Check(codeKey(id))
+}
+
+// FailCode records a wrong second factor code of the user
+func FailCode(id string) error {
+	limiterLock.RLock()
+	defer limiterLock.RUnlock()
+
+	return codes.Fail(codeKey(id))
+}
+
+// UnlockCode forgets the wrong second factor codes of the user, on a correct code
+func UnlockCode(id string) error {
+	limiterLock.RLock()
+	defer limiterLock.RUnlock()
+
+	return codes.Reset(codeKey(id))
+}
+
+func accountKey(email string) string {
+	return "account:" + strings.ToLower(strings.TrimSpace(email))
+}
+
+func ipKey(ip string) string {
+	return "ip:" + ip
+}
+
+func codeKey(id string) string {
+	return "mfa:" + id
+}
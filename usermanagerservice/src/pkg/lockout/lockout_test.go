@@ -0,0 +1,126 @@
+/*
+ Copyright 2021 The 110 billion Authors
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package lockout
+
+import (
+	"testing"
+	"time"
+)
+
+func TestPolicyWait(t *testing.T) {
+	p := Policy{
+		FreeAttempts:     3,
+		BaseDelay:        time.Second,
+		MaxDelay:         10 * time.Second,
+		LockoutThreshold: 10,
+		LockoutDuration:  30 * time.Minute,
+		Window:           time.Hour,
+	}
+	now := time.Now()
+	tests := map[string]struct {
+		entry Entry
+		want  time.Duration
+	}{
+		"no failure":             {},
+		"free attempts":          {entry: Entry{Failures: 3, LastFailure: now}},
+		"first delay":            {entry: Entry{Failures: 4, LastFailure: now}, want: time.Second},
+		"doubled delay":          {entry: Entry{Failures: 6, LastFailure: now}, want: 4 * time.Second},
+		"max delay":              {entry: Entry{Failures: 9, LastFailure: now}, want: 10 * time.Second},
+		"locked out":             {entry: Entry{Failures: 10, LastFailure: now}, want: 30 * time.Minute},
+		"partly waited":          {entry: Entry{Failures: 10, LastFailure: now.Add(-10 * time.Minute)}, want: 20 * time.Minute},
+		"delay passed":           {entry: Entry{Failures: 4, LastFailure: now.Add(-2 * time.Second)}},
+		"failures out of window": {entry: Entry{Failures: 10, LastFailure: now.Add(-time.Hour)}},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			if got := p.Wait(tc.entry, now); got != tc.want {
+				t.Errorf("want %v, got %v", tc.want, got)
+			}
+		})
+	}
+}
+
+func TestMemoryStore(t *testing.T) {
+	s := NewMemoryStore()
+	now := time.Now()
+
+	for i := 1; i <= 3; i++ {
+		e, err := s.Fail("key", now, time.Hour)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if e.Failures != i || !e.LastFailure.Equal(now) {
+			t.Fatalf("want %d failures at %v, got %+v", i, now, e)
+		}
+	}
+
+	// Failures of another key past the window sweep the expired record
+	if _, err := s.Fail("other", now.Add(2*time.Hour), time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if e, _ := s.Get("key"); e.Failures != 0 {
+		t.Fatalf("want the expired record forgotten, got %+v", e)
+	}
+
+	if err := s.Reset("other"); err != nil {
+		t.Fatal(err)
+	}
+	if e, _ := s.Get("other"); e.Failures != 0 {
+		t.Fatalf("want the reset record forgotten, got %+v", e)
+	}
+}
+
+// TestLogin fails logins of an account from an IP address until they are throttled,
+// and checks that unlocking the account keeps the IP address throttled
+func TestLogin(t *testing.T) {
+	SetStore(NewMemoryStore())
+	t.Cleanup(func() { SetStore(NewMemoryStore()) })
+
+	const email, ip = "Jane@Example.com", "192.0.2.1"
+	for i := 0; i < accounts.Policy.FreeAttempts+1; i++ {
+		if wait, err := CheckLogin(email, ip); err != nil || wait != 0 {
+			t.Fatalf("attempt %d waits %v, %v", i+1, wait, err)
+		}
+		if err := FailLogin(email, ip); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Emails are throttled regardless of their case, so that a guess is not retried as another email
+	if wait, err := CheckLogin("jane@example.com ", "192.0.2.2"); err != nil || wait <= 0 {
+		t.Fatalf("want the account throttled, got %v, %v", wait, err)
+	}
+	if wait, err := CheckLogin("john@example.com", "192.0.2.2"); err != nil || wait != 0 {
+		t.Fatalf("want another account from another address not throttled, got %v, %v", wait, err)
+	}
+
+	if err := Unlock(email); err != nil {
+		t.Fatal(err)
+	}
+	if wait, err := CheckLogin(email, "192.0.2.2"); err != nil || wait != 0 {
+		t.Fatalf("want the account unlocked, got %v, %v", wait, err)
+	}
+	for i := 0; i < ips.Policy.FreeAttempts; i++ {
+		if err := FailLogin("john@example.com", ip); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if wait, err := CheckLogin("alice@example.com", ip); err != nil || wait <= 0 {
+		t.Fatalf("want the address throttled for every account, got %v, %v", wait, err)
+	}
+}
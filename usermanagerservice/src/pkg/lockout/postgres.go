@@ -0,0 +1,77 @@
+/*
+ Copyright 2021 The 110 billion Authors
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package lockout
+
+import (
+	"database/sql"
+	"time"
+
+	"github.com/110billion/sellfie/usermanagerservice/src/pkg/database"
+)
+
+// PostgresStore is a Store in the LOGIN_FAILURE table, shared by every replica
+type PostgresStore struct{}
+
+// Get returns the record of the key
+func (s *PostgresStore) Get(key string) (Entry, error) {
+	db, err := database.Connect()
+	if err != nil {
+		return Entry{}, err
+	}
+	defer db.Close()
+
+	e := Entry{}
+	err = db.QueryRow("SELECT failures, last_failure FROM LOGIN_FAILURE WHERE failure_key = $1", key).Scan(&e.Failures, &e.LastFailure)
+	if err == sql.ErrNoRows {
+		return Entry{}, nil
+	}
+	return e, err
+}
+
+// Fail records a failure of the key
+func (s *PostgresStore) Fail(key string, now time.Time, window time.Duration) (Entry, error) {
+	db, err := database.Connect()
+	if err != nil {
+		return Entry{}, err
+	}
+	defer db.Close()
+
+	if _, err := db.Exec("DELETE FROM LOGIN_FAILURE WHERE expires_at < $1", now); err != nil {
+		return Entry{}, err
+	}
+
+	// A record which expired in the meantime starts over
+	e := Entry{}
+	err = db.QueryRow(`INSERT INTO LOGIN_FAILURE (failure_key, failures, last_failure, expires_at) VALUES($1, 1, $2, $3)
+		ON CONFLICT (failure_key) DO UPDATE SET
+			failures = CASE WHEN LOGIN_FAILURE.expires_at < EXCLUDED.last_failure THEN 1 ELSE LOGIN_FAILURE.failures + 1 END,
+			last_failure = EXCLUDED.last_failure, expires_at = EXCLUDED.expires_at
+		RETURNING failures, last_failure`, key, now, now.Add(window)).Scan(&e.Failures, &e.LastFailure)
+	return e, err
+}
+
+// Reset forgets the failures of the key
+func (s *PostgresStore) Reset(key string) error {
+	db, err := database.Connect()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	_, err = db.Exec("DELETE FROM LOGIN_FAILURE WHERE failure_key = $1", key)
+	return err
+}
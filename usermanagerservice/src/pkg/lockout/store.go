@@ -0,0 +1,94 @@
+/*
+ Copyright 2021 The 110 billion Authors
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package lockout
+
+import (
+	"sync"
+	"time"
+)
+
+// Entry is the failure record of a key
+type Entry struct {
+	// Failures is the number of consecutive failures within the window
+	Failures int
+	// LastFailure is the time of the latest failure
+	LastFailure time.Time
+}
+
+// Store keeps the failure records of keys, e.g., of an account or of an IP address
+type Store interface {
+	// Get returns the record of the key, or a zero Entry if it has none
+	Get(key string) (Entry, error)
+	// Fail records a failure of the key at now and returns the updated record.
+	// Failures before now-window are forgotten
+	Fail(key string, now time.Time, window time.Duration) (Entry, error)
+	// Reset forgets the failures of the key
+	Reset(key string) error
+}
+
+// MemoryStore is a Store in memory, for a single replica and tests
+type MemoryStore struct {
+	lock    sync.Mutex
+	entries map[string]memoryEntry
+}
+
+type memoryEntry struct {
+	Entry
+	expiresAt time.Time
+}
+
+// NewMemoryStore returns an empty MemoryStore
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{entries: map[string]memoryEntry{}}
+}
+
+// Get returns the record of the key
+func (s *MemoryStore) Get(key string) (Entry, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	return s.entries[key].Entry, nil
+}
+
+// Fail records a failure of the key
+func (s *MemoryStore) Fail(key string, now time.Time, window time.Duration) (Entry, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	// Expired records are swept on the way, so that the map does not grow without bound
+	for k, e := range s.entries {
+		if e.expiresAt.Before(now) {
+			delete(s.entries, k)
+		}
+	}
+
+	e := s.entries[key]
+	e.Failures++
+	e.LastFailure = now
+	e.expiresAt = now.Add(window)
+	s.entries[key] = e
+	return e.Entry, nil
+}
+
+// Reset forgets the failures of the key
+func (s *MemoryStore) Reset(key string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	delete(s.entries, key)
+	return nil
+}
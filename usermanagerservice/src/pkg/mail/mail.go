@@ -0,0 +1,125 @@
+/*
+ Copyright 2021 The 110 billion Authors
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package mail
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	logf "sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+const (
+	// SenderSMTP sends mails through the SMTP server at SMTP_ADDR
+	SenderSMTP = "smtp"
+	// SenderOutbox writes mails to files in MAIL_OUTBOX_DIR instead of sending them, for local development and tests
+	SenderOutbox = "outbox"
+
+	// asyncSendTimeout bounds a mail sent in the background by SendAsync
+	asyncSendTimeout = time.Minute
+)
+
+var (
+	log = logf.Log.WithName("mail")
+
+	senderLock sync.RWMutex
+	sender     Sender = &OutboxSender{Dir: defaultOutboxDir()}
+)
+
+// Message is a plain text mail
+type Message struct {
+	To      string
+	Subject string
+	Body    string
+}
+
+// Sender delivers mails
+type Sender interface {
+	Send(ctx context.Context, msg *Message) error
+}
+
+// Init configures the sender of the user manager by the environment variables below
+//   - MAIL_SENDER: smtp or outbox. Defaults to outbox
+//   - MAIL_FROM: sender address
+//   - SMTP_ADDR, SMTP_USERNAME, SMTP_PASSWORD: SMTP server (host:port) and its credentials, for smtp
+//   - MAIL_OUTBOX_DIR: directory the mails are written to, for outbox
+func Init() error {
+	kind := os.Getenv("MAIL_SENDER")
+	if kind == "" {
+		kind = SenderOutbox
+	}
+
+	switch kind {
+	case SenderSMTP:
+		addr := os.Getenv("SMTP_ADDR")
+		if addr == "" {
+			return fmt.Errorf("SMTP_ADDR is required for the smtp mail sender")
+		}
+		SetSender(&SMTPSender{
+			Addr:     addr,
+			From:     os.Getenv("MAIL_FROM"),
+			Username: os.Getenv("SMTP_USERNAME"),
+			Password: os.Getenv("SMTP_PASSWORD"),
+		})
+	case SenderOutbox:
+		dir := os.Getenv("MAIL_OUTBOX_DIR")
+		if dir == "" {
+			dir = defaultOutboxDir()
+		}
+		log.Info("mails are written to the outbox instead of being sent", "dir", dir)
+		SetSender(&OutboxSender{Dir: dir, From: os.Getenv("MAIL_FROM")})
+	default:
+		return fmt.Errorf("unknown mail sender %s", kind)
+	}
+	return nil
+}
+
+// SetSender replaces the sender of the user manager, e.g., with a fake in tests
+func SetSender(s Sender) {
+	senderLock.Lock()
+	defer senderLock.Unlock()
+	sender = s
+}
+
+// Send sends the mail with the sender of the user manager
+func Send(ctx context.Context, msg *Message) error {
+	senderLock.RLock()
+	s := sender
+	senderLock.RUnlock()
+
+	return s.Send(ctx, msg)
+}
+
+// SendAsync sends the mail in the background and only logs if it fails, so that the time of a response does not
+// tell whether a mail is sent, e.g., to a registered email
+func SendAsync(msg *Message) {
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), asyncSendTimeout)
+		defer cancel()
+		if err := Send(ctx, msg); err != nil {
+			log.Error(err, "cannot send mail", "subject", msg.Subject)
+		}
+	}()
+}
+
+func defaultOutboxDir() string {
+	return filepath.Join(os.TempDir(), "sellfie-outbox")
+}
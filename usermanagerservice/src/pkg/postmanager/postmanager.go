@@ -0,0 +1,76 @@
+/*
+ Copyright 2021 The 110 billion Authors
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package postmanager
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/110billion/sellfie/usermanagerservice/src/pkg/server/auth/token"
+)
+
+const (
+	// ActionUserDeleted is the audience of the tokens authorizing the post manager to delete the data of a deleted user
+	ActionUserDeleted = "user_deleted"
+	// ActionUserExport is the audience of the tokens authorizing the post manager to export the data of a user
+	ActionUserExport = "user_export"
+
+	defaultURL = "http://postmanagerservice:3550"
+
+	// tokenLifetime is how long the token of a request is valid, which is long enough for retries of the transport
+	tokenLifetime = 5 * time.Minute
+	timeout       = 30 * time.Second
+)
+
+var client = &http.Client{Timeout: timeout}
+
+// Do sends a request to the post manager about the user identified by userUUID, at the path under /internal/users/{user_uuid}.
+// The request is authorized by an action token the post manager verifies with the published keys.
+// A response other than 2xx is returned as an error, and its body is closed
+func Do(ctx context.Context, method, action, userUUID, path string) (*http.Response, error) {
+	signed, _, err := token.IssueActionToken(action, userUUID, "", tokenLifetime)
+	if err != nil {
+		return nil, err
+	}
+
+	base := os.Getenv("POSTMANAGER_URL")
+	if base == "" {
+		base = defaultURL
+	}
+	req, err := http.NewRequestWithContext(ctx, method, strings.TrimSuffix(base, "/")+"/internal/users/"+url.PathEscape(userUUID)+path, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+signed)
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 4<<10))
+		_ = resp.Body.Close()
+		return nil, fmt.Errorf("post manager responded with status %d", resp.StatusCode)
+	}
+	return resp, nil
+}
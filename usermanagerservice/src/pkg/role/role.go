@@ -0,0 +1,118 @@
+/*
+ Copyright 2021 The 110 billion Authors
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package role
+
+import (
+	"database/sql"
+	"errors"
+
+	"github.com/110billion/sellfie/usermanagerservice/src/pkg/database"
+)
+
+// Roles of the users. Each role has the permissions of the roles below it
+const (
+	User      = "user"
+	Moderator = "moderator"
+	Admin     = "admin"
+)
+
+// ranks orders the roles, the higher the more privileged
+var ranks = map[string]int{User: 1, Moderator: 2, Admin: 3}
+
+var (
+	// ErrUnknownRole is returned if a role is not one of User, Moderator and Admin
+	ErrUnknownRole = errors.New("unknown role")
+	// ErrUserNotFound is returned if the user does not exist
+	ErrUserNotFound = errors.New("user is not found")
+	// ErrLastAdmin is returned if the role of the only admin is lowered, which would leave no one to grant roles
+	ErrLastAdmin = errors.New("the last admin cannot be demoted")
+)
+
+// Valid returns whether r is a role
+func Valid(r string) bool {
+	_, ok := ranks[r]
+	return ok
+}
+
+// Implied returns r and the roles below it, e.g., admin, moderator and user for admin.
+// Unknown roles, e.g., of tokens issued before the roles, imply user only
+func Implied(r string) []string {
+	rank, ok := ranks[r]
+	if !ok {
+		return []string{User}
+	}
+
+	roles := []string{r}
+	for _, other := range []string{Admin, Moderator, User} {
+		if ranks[other] < rank {
+			roles = append(roles, other)
+		}
+	}
+	return roles
+}
+
+// Get returns the role of the user identified by userUUID
+func Get(userUUID string) (string, error) {
+	db, err := database.Connect()
+	if err != nil {
+		return "", err
+	}
+	defer db.Close()
+
+	var r string
+	err = db.QueryRow("SELECT role FROM USER_TABLE WHERE user_uuid = $1", userUUID).Scan(&r)
+	if err == sql.ErrNoRows {
+		return "", ErrUserNotFound
+	}
+	return r, err
+}
+
+// Set sets the role of the user identified by userUUID in the transaction and returns the previous one.
+// Tokens carry the role they are issued with, so the caller revokes the tokens of the user if the role is lowered
+func Set(tx *sql.Tx, userUUID, r string) (string, error) {
+	if !Valid(r) {
+		return "", ErrUnknownRole
+	}
+
+	var previous string
+	err := tx.QueryRow("SELECT role FROM USER_TABLE WHERE user_uuid = $1 FOR UPDATE", userUUID).Scan(&previous)
+	if err == sql.ErrNoRows {
+		return "", ErrUserNotFound
+	}
+	if err != nil {
+		return "", err
+	}
+
+	if previous == Admin && r != Admin {
+		// The admins are locked, so that two admins cannot demote each other at once
+		var admins int
+		if err := tx.QueryRow("SELECT COUNT(*) FROM (SELECT 1 FROM USER_TABLE WHERE role = $1 FOR UPDATE) AS admins", Admin).Scan(&admins); err != nil {
+			return "", err
+		}
+		if admins <= 1 {
+			return "", ErrLastAdmin
+		}
+	}
+
+	_, err = tx.Exec("UPDATE USER_TABLE SET role = $1 WHERE user_uuid = $2", r, userUUID)
+	return previous, err
+}
+
+// Lowered returns whether the role to is less privileged than the role from
+func Lowered(from, to string) bool {
+	return ranks[to] < ranks[from]
+}
@@ -0,0 +1,57 @@
+/*
+ Copyright 2021 The 110 billion Authors
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package role
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestImplied(t *testing.T) {
+	tests := map[string][]string{
+		Admin:     {Admin, Moderator, User},
+		Moderator: {Moderator, User},
+		User:      {User},
+		// Tokens issued before the roles have none
+		"":     {User},
+		"root": {User},
+	}
+
+	for r, want := range tests {
+		if got := Implied(r); !reflect.DeepEqual(got, want) {
+			t.Errorf("%q implies %v, want %v", r, got, want)
+		}
+	}
+}
+
+func TestLowered(t *testing.T) {
+	tests := []struct {
+		from, to string
+		want     bool
+	}{
+		{from: Admin, to: Moderator, want: true},
+		{from: Moderator, to: User, want: true},
+		{from: User, to: Admin},
+		{from: Admin, to: Admin},
+	}
+
+	for _, tc := range tests {
+		if got := Lowered(tc.from, tc.to); got != tc.want {
+			t.Errorf("%s to %s: want lowered %v, got %v", tc.from, tc.to, tc.want, got)
+		}
+	}
+}
@@ -0,0 +1,410 @@
+/*
+ Copyright 2021 The 110 billion Authors
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package admin
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/110billion/sellfie/usermanagerservice/src/internal/apiserver"
+	"github.com/110billion/sellfie/usermanagerservice/src/internal/utils"
+	"github.com/110billion/sellfie/usermanagerservice/src/internal/wrapper"
+	"github.com/110billion/sellfie/usermanagerservice/src/pkg/deletion"
+	"github.com/110billion/sellfie/usermanagerservice/src/pkg/role"
+	"github.com/110billion/sellfie/usermanagerservice/src/pkg/server/auth/mfa"
+	"github.com/110billion/sellfie/usermanagerservice/src/pkg/server/auth/password"
+	"github.com/110billion/sellfie/usermanagerservice/src/pkg/server/auth/token"
+	"github.com/go-logr/logr"
+	"github.com/gorilla/mux"
+)
+
+const (
+	defaultPageSize = 20
+	maxPageSize     = 100
+)
+
+// UsersResponse is the response listing the users
+type UsersResponse struct {
+	Ok    bool   `json:"ok"`
+	Users []User `json:"users"`
+	Total int    `json:"total"`
+}
+
+// UserResponse is the response of the details of a user
+type UserResponse struct {
+	Ok   bool         `json:"ok"`
+	User *UserDetails `json:"user"`
+}
+
+// RoleResponse is the response of setting the role of a user
+type RoleResponse struct {
+	Ok   bool   `json:"ok"`
+	ID   string `json:"id"`
+	Role string `json:"role"`
+}
+
+// Response is common struct for responding actions on a user
+type Response struct {
+	Ok bool   `json:"ok"`
+	ID string `json:"id"`
+}
+
+type handler struct {
+	log logr.Logger
+}
+
+type roleReqBody struct {
+	Role string `json:"role"`
+}
+
+type suspendReqBody struct {
+	Reason string `json:"reason"`
+	// Until is when the suspension expires, in RFC 3339. The account is suspended until it is unsuspended if it is not set
+	Until *time.Time `json:"until"`
+}
+
+// NewHandler instantiates a new admin api handler. Every api under /admin requires the admin role,
+// and every action on a user is recorded in the audit trail
+func NewHandler(parent wrapper.RouterWrapper, logger logr.Logger) (apiserver.APIHandler, error) {
+	handler := &handler{log: logger}
+
+	// /admin
+	adminWrapper := wrapper.New("/admin", nil, nil)
+	adminWrapper.Use(token.Authenticate)
+	adminWrapper.Require(role.Admin)
+	if err := parent.Add(adminWrapper); err != nil {
+		return nil, err
+	}
+
+	// /admin/audit
+	auditWrapper := wrapper.New("/audit", []string{http.MethodGet}, handler.auditHandler)
+	if err := adminWrapper.Add(auditWrapper); err != nil {
+		return nil, err
+	}
+
+	// /admin/users
+	usersWrapper := wrapper.New("/users", []string{http.MethodGet}, handler.listHandler)
+	if err := adminWrapper.Add(usersWrapper); err != nil {
+		return nil, err
+	}
+
+	// /admin/users/{user_id}
+	userWrapper := wrapper.New("/{user_id}", []string{http.MethodGet, http.MethodDelete}, handler.userHandler)
+	if err := usersWrapper.Add(userWrapper); err != nil {
+		return nil, err
+	}
+
+	for _, child := range []*wrapper.Wrapper{
+		// /admin/users/{user_id}/role
+		wrapper.New("/role", []string{http.MethodPut}, handler.roleHandler),
+		// /admin/users/{user_id}/suspend
+		wrapper.New("/suspend", []string{http.MethodPost}, handler.suspendHandler),
+		// /admin/users/{user_id}/unsuspend
+		wrapper.New("/unsuspend", []string{http.MethodPost}, handler.unsuspendHandler),
+		// /admin/users/{user_id}/password-reset
+		wrapper.New("/password-reset", []string{http.MethodPost}, handler.passwordResetHandler),
+		// /admin/users/{user_id}/sessions
+		wrapper.New("/sessions", []string{http.MethodDelete}, handler.sessionsHandler),
+		// /admin/users/{user_id}/mfa
+		wrapper.New("/mfa", []string{http.MethodDelete}, handler.mfaHandler),
+	} {
+		if err := userWrapper.Add(child); err != nil {
+			return nil, err
+		}
+	}
+
+	return handler, nil
+}
+
+// listHandler lists the users matching the q parameter, paginated by the limit and offset parameters
+func (h *handler) listHandler(w http.ResponseWriter, req *http.Request) {
+	limit, offset, ok := pagination(w, req)
+	if !ok {
+		return
+	}
+
+	users, total, err := listUsers(strings.TrimSpace(req.URL.Query().Get("q")), limit, offset)
+	if err != nil {
+		h.log.Error(err, "list users error")
+		_ = utils.RespondError(w, http.StatusInternalServerError, "cannot list users")
+		return
+	}
+
+	_ = utils.RespondJSON(w, UsersResponse{Ok: true, Users: users, Total: total})
+}
+
+// userHandler responds with the details of the user, or deletes the user on DELETE
+func (h *handler) userHandler(w http.ResponseWriter, req *http.Request) {
+	id := mux.Vars(req)["user_id"]
+
+	if req.Method == http.MethodDelete {
+		h.deleteHandler(w, req, id)
+		return
+	}
+
+	user, err := getUser(id)
+	if err == ErrUserNotFound {
+		_ = utils.RespondError(w, http.StatusNotFound, err.Error())
+		return
+	}
+	if err != nil {
+		h.log.Error(err, "get user error", "id", id)
+		_ = utils.RespondError(w, http.StatusInternalServerError, "cannot get user")
+		return
+	}
+
+	_ = utils.RespondJSON(w, UserResponse{Ok: true, User: user})
+}
+
+// deleteHandler deletes the user with every record of the user but the audit trail. It cannot be undone
+func (h *handler) deleteHandler(w http.ResponseWriter, req *http.Request, id string) {
+	claims, _ := token.FromContext(req.Context())
+
+	var email string
+	var blobs []string
+	err := h.audited(req, ActionDelete, id, func(tx *sql.Tx, userUUID string) (map[string]interface{}, error) {
+		if userUUID == claims.Subject {
+			return nil, ErrDeleteSelf
+		}
+		var err error
+		if email, blobs, err = deleteUser(tx, userUUID); err != nil {
+			return nil, err
+		}
+		return map[string]interface{}{"email": email}, nil
+	})
+	switch err {
+	case nil:
+	case ErrUserNotFound:
+		_ = utils.RespondError(w, http.StatusNotFound, err.Error())
+		return
+	case ErrDeleteAdmin, ErrDeleteSelf:
+		_ = utils.RespondError(w, http.StatusConflict, err.Error())
+		return
+	default:
+		h.log.Error(err, "delete user error", "id", id)
+		_ = utils.RespondError(w, http.StatusInternalServerError, "cannot delete user")
+		return
+	}
+	deletion.Cleanup(req.Context(), email, blobs)
+
+	_ = utils.RespondJSON(w, Response{Ok: true, ID: id})
+}
+
+// suspendHandler suspends the account, logging the user out everywhere
+func (h *handler) suspendHandler(w http.ResponseWriter, req *http.Request) {
+	id := mux.Vars(req)["user_id"]
+
+	// Decode request body
+	suspendReq := &suspendReqBody{}
+	decoder := json.NewDecoder(req.Body)
+	if err := decoder.Decode(suspendReq); err != nil || strings.TrimSpace(suspendReq.Reason) == "" {
+		_ = utils.RespondError(w, http.StatusBadRequest, "request body is not in json form or is malformed")
+		return
+	}
+	if suspendReq.Until != nil && !suspendReq.Until.After(time.Now()) {
+		_ = utils.RespondError(w, http.StatusBadRequest, "until must be in the future")
+		return
+	}
+	claims, _ := token.FromContext(req.Context())
+
+	err := h.audited(req, ActionSuspend, id, func(tx *sql.Tx, userUUID string) (map[string]interface{}, error) {
+		if userUUID == claims.Subject {
+			return nil, ErrSuspendSelf
+		}
+		if err := suspend(tx, userUUID, suspendReq.Reason, suspendReq.Until); err != nil {
+			return nil, err
+		}
+		detail := map[string]interface{}{"reason": suspendReq.Reason}
+		if suspendReq.Until != nil {
+			detail["until"] = suspendReq.Until
+		}
+		return detail, nil
+	})
+	switch err {
+	case nil:
+	case ErrUserNotFound:
+		_ = utils.RespondError(w, http.StatusNotFound, err.Error())
+		return
+	case ErrSuspendSelf:
+		_ = utils.RespondError(w, http.StatusConflict, err.Error())
+		return
+	default:
+		h.log.Error(err, "suspend user error", "id", id)
+		_ = utils.RespondError(w, http.StatusInternalServerError, "cannot suspend user")
+		return
+	}
+
+	_ = utils.RespondJSON(w, Response{Ok: true, ID: id})
+}
+
+func (h *handler) unsuspendHandler(w http.ResponseWriter, req *http.Request) {
+	id := mux.Vars(req)["user_id"]
+
+	err := h.audited(req, ActionUnsuspend, id, func(tx *sql.Tx, userUUID string) (map[string]interface{}, error) {
+		return nil, unsuspend(tx, userUUID)
+	})
+	if err == ErrUserNotFound {
+		_ = utils.RespondError(w, http.StatusNotFound, err.Error())
+		return
+	} else if err != nil {
+		h.log.Error(err, "unsuspend user error", "id", id)
+		_ = utils.RespondError(w, http.StatusInternalServerError, "cannot unsuspend user")
+		return
+	}
+
+	_ = utils.RespondJSON(w, Response{Ok: true, ID: id})
+}
+
+// passwordResetHandler requires the user to reset the password, which is mailed a reset link
+func (h *handler) passwordResetHandler(w http.ResponseWriter, req *http.Request) {
+	id := mux.Vars(req)["user_id"]
+
+	var resetUUID, email string
+	err := h.audited(req, ActionForceReset, id, func(tx *sql.Tx, userUUID string) (map[string]interface{}, error) {
+		var err error
+		resetUUID = userUUID
+		_, email, err = password.ForceReset(tx, userUUID)
+		return nil, err
+	})
+	if err == ErrUserNotFound {
+		_ = utils.RespondError(w, http.StatusNotFound, err.Error())
+		return
+	} else if err != nil {
+		h.log.Error(err, "force password reset error", "id", id)
+		_ = utils.RespondError(w, http.StatusInternalServerError, "cannot force password reset")
+		return
+	}
+
+	if err := password.MailResetLink(req.Context(), resetUUID, id, email); err != nil {
+		h.log.Error(err, "force password reset error", "id", id)
+		_ = utils.RespondError(w, http.StatusInternalServerError, "password reset is required, but the reset link cannot be sent")
+		return
+	}
+
+	_ = utils.RespondJSON(w, Response{Ok: true, ID: id})
+}
+
+// sessionsHandler revokes every session and token of the user
+func (h *handler) sessionsHandler(w http.ResponseWriter, req *http.Request) {
+	id := mux.Vars(req)["user_id"]
+
+	err := h.audited(req, ActionRevokeSession, id, func(tx *sql.Tx, userUUID string) (map[string]interface{}, error) {
+		return nil, token.RevokeAllTx(tx, userUUID)
+	})
+	if err == ErrUserNotFound {
+		_ = utils.RespondError(w, http.StatusNotFound, err.Error())
+		return
+	} else if err != nil {
+		h.log.Error(err, "revoke sessions error", "id", id)
+		_ = utils.RespondError(w, http.StatusInternalServerError, "cannot revoke sessions")
+		return
+	}
+
+	_ = utils.RespondJSON(w, Response{Ok: true, ID: id})
+}
+
+// mfaHandler disables the two-factor authentication of the user, who lost the authenticator and the recovery codes
+func (h *handler) mfaHandler(w http.ResponseWriter, req *http.Request) {
+	id := mux.Vars(req)["user_id"]
+
+	err := h.audited(req, ActionDisableMFA, id, func(tx *sql.Tx, userUUID string) (map[string]interface{}, error) {
+		return nil, mfa.Disable(tx, userUUID)
+	})
+	if err == ErrUserNotFound {
+		_ = utils.RespondError(w, http.StatusNotFound, err.Error())
+		return
+	} else if err != nil {
+		h.log.Error(err, "disable two-factor authentication error", "id", id)
+		_ = utils.RespondError(w, http.StatusInternalServerError, "cannot disable two-factor authentication")
+		return
+	}
+
+	_ = utils.RespondJSON(w, Response{Ok: true, ID: id})
+}
+
+func (h *handler) roleHandler(w http.ResponseWriter, req *http.Request) {
+	id := mux.Vars(req)["user_id"]
+
+	// Decode request body
+	roleReq := &roleReqBody{}
+	decoder := json.NewDecoder(req.Body)
+	if err := decoder.Decode(roleReq); err != nil || roleReq.Role == "" {
+		_ = utils.RespondError(w, http.StatusBadRequest, "request body is not in json form or is malformed")
+		return
+	}
+
+	err := h.audited(req, ActionSetRole, id, func(tx *sql.Tx, userUUID string) (map[string]interface{}, error) {
+		previous, err := role.Set(tx, userUUID, roleReq.Role)
+		if err != nil {
+			return nil, err
+		}
+		// The tokens carry the previous role, which must not be used anymore
+		if role.Lowered(previous, roleReq.Role) {
+			if err := token.RevokeAllTx(tx, userUUID); err != nil {
+				return nil, err
+			}
+		}
+		return map[string]interface{}{"role": roleReq.Role, "previous": previous}, nil
+	})
+	switch err {
+	case nil:
+	case role.ErrUnknownRole:
+		_ = utils.RespondError(w, http.StatusBadRequest, err.Error())
+		return
+	case role.ErrUserNotFound:
+		_ = utils.RespondError(w, http.StatusNotFound, err.Error())
+		return
+	case role.ErrLastAdmin:
+		_ = utils.RespondError(w, http.StatusConflict, err.Error())
+		return
+	default:
+		h.log.Error(err, "set role error", "id", id)
+		_ = utils.RespondError(w, http.StatusInternalServerError, "cannot set role")
+		return
+	}
+
+	_ = utils.RespondJSON(w, RoleResponse{Ok: true, ID: id, Role: roleReq.Role})
+}
+
+// pagination parses the limit and offset parameters, responding with an error if they are not valid
+func pagination(w http.ResponseWriter, req *http.Request) (limit, offset int, ok bool) {
+	limit, offset = defaultPageSize, 0
+
+	query := req.URL.Query()
+	if v := query.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > maxPageSize {
+			_ = utils.RespondError(w, http.StatusBadRequest, fmt.Sprintf("limit must be between 1 and %d", maxPageSize))
+			return 0, 0, false
+		}
+		limit = n
+	}
+	if v := query.Get("offset"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			_ = utils.RespondError(w, http.StatusBadRequest, "offset must not be negative")
+			return 0, 0, false
+		}
+		offset = n
+	}
+	return limit, offset, true
+}
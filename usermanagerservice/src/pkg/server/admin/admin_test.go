@@ -0,0 +1,154 @@
+/*
+ Copyright 2021 The 110 billion Authors
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package admin
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/110billion/sellfie/usermanagerservice/src/internal/wrapper"
+	"github.com/110billion/sellfie/usermanagerservice/src/pkg/database"
+	"github.com/110billion/sellfie/usermanagerservice/src/pkg/role"
+	"github.com/110billion/sellfie/usermanagerservice/src/pkg/server/auth/token"
+	"github.com/go-logr/logr"
+	"github.com/gorilla/mux"
+)
+
+// TestRequireAdmin calls the admin apis with the tokens of users of each role, against the database at DB_HOST.
+// Only admins are let in, and the tokens of a demoted admin stop working
+func TestRequireAdmin(t *testing.T) {
+	if os.Getenv("DB_HOST") == "" {
+		t.Skip("DB_HOST is not set")
+	}
+	if err := database.Migrate(); err != nil {
+		t.Fatal(err)
+	}
+	// Access tokens are signed with the shared secret, so that no signing key is created
+	t.Setenv("JWT_SIGNING_ALG", token.AlgHS256)
+	t.Setenv("JWT_SECRET_KEY", "admin-test-secret")
+
+	root := wrapper.New("/", nil, nil)
+	root.SetRouter(mux.NewRouter())
+	if _, err := NewHandler(root, logr.Discard()); err != nil {
+		t.Fatal(err)
+	}
+	call := func(method, path, accessToken, body string) int {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		if accessToken != "" {
+			req.Header.Set("Authorization", "Bearer "+accessToken)
+		}
+		w := httptest.NewRecorder()
+		root.Router().ServeHTTP(w, req)
+		return w.Code
+	}
+
+	suffix := strconv.FormatInt(time.Now().UnixNano()%1e12, 36)
+	adminUUID, adminToken := createTestUser(t, "admin_"+suffix, role.Admin)
+	// A second admin, so that the other one may be demoted
+	createTestUser(t, "admin2_"+suffix, role.Admin)
+	_, moderatorToken := createTestUser(t, "moderator_"+suffix, role.Moderator)
+	_, userToken := createTestUser(t, "user_"+suffix, role.User)
+	targetPath := "/admin/users/user_" + suffix
+
+	tests := map[string]struct {
+		accessToken string
+		want        int
+	}{
+		"without a token": {want: http.StatusUnauthorized},
+		"user":            {accessToken: userToken, want: http.StatusForbidden},
+		"moderator":       {accessToken: moderatorToken, want: http.StatusForbidden},
+		"admin":           {accessToken: adminToken, want: http.StatusOK},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			if got := call(http.MethodGet, targetPath, tc.accessToken, ""); got != tc.want {
+				t.Errorf("want %d, got %d", tc.want, got)
+			}
+		})
+	}
+
+	if got := call(http.MethodPut, targetPath+"/role", moderatorToken, `{"role": "admin"}`); got != http.StatusForbidden {
+		t.Fatalf("want a moderator forbidden to grant roles, got %d", got)
+	}
+	if got := call(http.MethodPut, "/admin/users/admin_"+suffix+"/role", adminToken, `{"role": "user"}`); got != http.StatusOK {
+		t.Fatalf("want the admin demoted, got %d", got)
+	}
+	if got := call(http.MethodGet, targetPath, adminToken, ""); got != http.StatusUnauthorized {
+		t.Fatalf("want the token of the demoted admin revoked, got %d", got)
+	}
+
+	db, err := database.Connect()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	var audited int
+	if err := db.QueryRow("SELECT COUNT(*) FROM ADMIN_AUDIT WHERE actor_uuid = $1 AND target_uuid = $1 AND action = $2", adminUUID, ActionSetRole).
+		Scan(&audited); err != nil {
+		t.Fatal(err)
+	}
+	if audited != 1 {
+		t.Fatalf("want the demotion audited once, got %d entries", audited)
+	}
+}
+
+// createTestUser creates a user of the role with the handle, deleted with the records of the user after the test,
+// and returns the user_uuid and an access token of the user
+func createTestUser(t *testing.T, id, userRole string) (string, string) {
+	db, err := database.Connect()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	var userUUID string
+	if err := db.QueryRow("INSERT INTO USER_TABLE (user_email, name, password, user_id, role) VALUES($1, 'Admin', '', $2, $3) RETURNING user_uuid",
+		id+"@example.com", id, userRole).Scan(&userUUID); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		db, err := database.Connect()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer db.Close()
+
+		for _, stmt := range []string{
+			"DELETE FROM ADMIN_AUDIT WHERE actor_uuid = $1 OR target_uuid = $1",
+			"DELETE FROM REFRESH_TOKEN WHERE user_uuid = $1",
+			"DELETE FROM LOGIN_SESSION WHERE user_uuid = $1",
+			"DELETE FROM USER_REVOCATION WHERE user_uuid = $1",
+			"DELETE FROM USER_TABLE WHERE user_uuid = $1",
+		} {
+			if _, err := db.Exec(stmt, userUUID); err != nil {
+				t.Error(err)
+			}
+		}
+	})
+
+	pair, _, err := token.Issue(userUUID, token.Client{UserAgent: "admin-test"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return userUUID, pair.Token
+}
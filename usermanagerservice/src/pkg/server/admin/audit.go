@@ -0,0 +1,182 @@
+/*
+ Copyright 2021 The 110 billion Authors
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package admin
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/110billion/sellfie/usermanagerservice/src/internal/utils"
+	"github.com/110billion/sellfie/usermanagerservice/src/pkg/database"
+	"github.com/110billion/sellfie/usermanagerservice/src/pkg/server/auth/token"
+)
+
+// Actions recorded in the audit trail
+const (
+	ActionSetRole       = "set_role"
+	ActionSuspend       = "suspend"
+	ActionUnsuspend     = "unsuspend"
+	ActionForceReset    = "force_password_reset"
+	ActionRevokeSession = "revoke_sessions"
+	ActionDisableMFA    = "disable_mfa"
+	ActionDelete        = "delete"
+)
+
+// AuditEntry is an action an admin took on a user.
+// The admin and the user are identified by user_uuid, and their handles at the time are kept in the detail
+type AuditEntry struct {
+	ID         int64                  `json:"id"`
+	ActorUUID  string                 `json:"actor_uuid"`
+	Action     string                 `json:"action"`
+	TargetUUID string                 `json:"target_uuid"`
+	Detail     map[string]interface{} `json:"detail"`
+	IP         string                 `json:"ip"`
+	CreatedAt  time.Time              `json:"created_at"`
+}
+
+// AuditResponse is the response listing the audit trail
+type AuditResponse struct {
+	Ok      bool         `json:"ok"`
+	Entries []AuditEntry `json:"entries"`
+	Total   int          `json:"total"`
+}
+
+// audited takes the action of the admin of the request on the user of the handle, and appends it to the audit trail in the same transaction.
+// The user is locked and f takes the action on the user_uuid of the user in the transaction, returning the detail of the entry.
+// ErrUserNotFound is returned if the user does not exist. The action is rolled back if it cannot be recorded
+func (h *handler) audited(req *http.Request, action, id string, f func(tx *sql.Tx, userUUID string) (map[string]interface{}, error)) error {
+	db, err := database.Connect()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = tx.Rollback()
+	}()
+
+	var userUUID string
+	err = tx.QueryRow("SELECT user_uuid FROM USER_TABLE WHERE user_id = $1 FOR UPDATE", id).Scan(&userUUID)
+	if err == sql.ErrNoRows {
+		return ErrUserNotFound
+	}
+	if err != nil {
+		return err
+	}
+
+	detail, err := f(tx, userUUID)
+	if err != nil {
+		return err
+	}
+	if detail == nil {
+		detail = map[string]interface{}{}
+	}
+
+	claims, _ := token.FromContext(req.Context())
+	detail["actor_id"] = claims.UserID
+	detail["target_id"] = id
+	entry := AuditEntry{ActorUUID: claims.Subject, Action: action, TargetUUID: userUUID, Detail: detail, IP: utils.ClientIP(req)}
+	if err := insertAuditEntry(tx, entry); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	h.log.Info("admin action", "actor", entry.ActorUUID, "action", entry.Action, "target", entry.TargetUUID)
+	return nil
+}
+
+func insertAuditEntry(tx *sql.Tx, entry AuditEntry) error {
+	detail, err := json.Marshal(entry.Detail)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec("INSERT INTO ADMIN_AUDIT (actor_uuid, action, target_uuid, detail, ip, created_at) VALUES($1, $2, $3, $4, $5, NOW())",
+		entry.ActorUUID, entry.Action, entry.TargetUUID, string(detail), entry.IP)
+	return err
+}
+
+// listAuditEntries returns the audit entries, the latest first, filtered by the user_uuid of the target and of the actor if they are not empty
+func listAuditEntries(targetUUID, actorUUID string, limit, offset int) ([]AuditEntry, int, error) {
+	db, err := database.Connect()
+	if err != nil {
+		return nil, 0, err
+	}
+	defer db.Close()
+
+	const filter = "WHERE ($1::uuid IS NULL OR target_uuid = $1) AND ($2::uuid IS NULL OR actor_uuid = $2)"
+	target := sql.NullString{String: targetUUID, Valid: targetUUID != ""}
+	actor := sql.NullString{String: actorUUID, Valid: actorUUID != ""}
+
+	var total int
+	if err := db.QueryRow("SELECT COUNT(*) FROM ADMIN_AUDIT "+filter, target, actor).Scan(&total); err != nil {
+		return nil, 0, err
+	}
+
+	rows, err := db.Query("SELECT id, actor_uuid, action, target_uuid, detail, ip, created_at FROM ADMIN_AUDIT "+filter+
+		" ORDER BY id DESC LIMIT $3 OFFSET $4", target, actor, limit, offset)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+
+	entries := []AuditEntry{}
+	for rows.Next() {
+		e := AuditEntry{}
+		var detail []byte
+		if err := rows.Scan(&e.ID, &e.ActorUUID, &e.Action, &e.TargetUUID, &detail, &e.IP, &e.CreatedAt); err != nil {
+			return nil, 0, err
+		}
+		if err := json.Unmarshal(detail, &e.Detail); err != nil {
+			return nil, 0, err
+		}
+		entries = append(entries, e)
+	}
+	return entries, total, rows.Err()
+}
+
+func (h *handler) auditHandler(w http.ResponseWriter, req *http.Request) {
+	limit, offset, ok := pagination(w, req)
+	if !ok {
+		return
+	}
+
+	// The trail is filtered by user_uuid, which stays the same when the users change their handles
+	query := req.URL.Query()
+	target, actor := query.Get("target"), query.Get("actor")
+	if (target != "" && !utils.IsUUID(target)) || (actor != "" && !utils.IsUUID(actor)) {
+		_ = utils.RespondError(w, http.StatusBadRequest, "target and actor must be user uuids")
+		return
+	}
+
+	entries, total, err := listAuditEntries(target, actor, limit, offset)
+	if err != nil {
+		h.log.Error(err, "list audit entries error")
+		_ = utils.RespondError(w, http.StatusInternalServerError, "cannot list audit entries")
+		return
+	}
+
+	_ = utils.RespondJSON(w, AuditResponse{Ok: true, Entries: entries, Total: total})
+}
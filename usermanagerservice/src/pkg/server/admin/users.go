@@ -0,0 +1,224 @@
+/*
+ Copyright 2021 The 110 billion Authors
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package admin
+
+import (
+	"database/sql"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/110billion/sellfie/usermanagerservice/src/pkg/database"
+	"github.com/110billion/sellfie/usermanagerservice/src/pkg/deletion"
+	"github.com/110billion/sellfie/usermanagerservice/src/pkg/role"
+	"github.com/110billion/sellfie/usermanagerservice/src/pkg/server/auth/mfa"
+	"github.com/110billion/sellfie/usermanagerservice/src/pkg/server/auth/token"
+)
+
+// suspendedCondition holds for the accounts whose suspension has not expired
+const suspendedCondition = "suspended_at IS NOT NULL AND (suspended_until IS NULL OR suspended_until > NOW())"
+
+var (
+	// ErrUserNotFound is returned if the user does not exist
+	ErrUserNotFound = errors.New("user is not found")
+	// ErrDeleteAdmin is returned if an admin is deleted. Admins are demoted first, which keeps at least one admin
+	ErrDeleteAdmin = errors.New("admins cannot be deleted, demote the user first")
+	// ErrDeleteSelf is returned if an admin deletes the account of the admin
+	ErrDeleteSelf = errors.New("admins cannot delete themselves")
+	// ErrSuspendSelf is returned if an admin suspends the account of the admin
+	ErrSuspendSelf = errors.New("admins cannot suspend themselves")
+)
+
+// User is a user in the user list. ID is the current handle of the user, and UUID identifies the user for good
+type User struct {
+	ID            string    `json:"id"`
+	UUID          string    `json:"uuid"`
+	Email         string    `json:"email"`
+	Name          string    `json:"name"`
+	Role          string    `json:"role"`
+	EmailVerified bool      `json:"email_verified"`
+	Suspended     bool      `json:"suspended"`
+	CreatedAt     time.Time `json:"created_at"`
+}
+
+// Suspension is the suspension of an account
+type Suspension struct {
+	Reason      string    `json:"reason"`
+	SuspendedAt time.Time `json:"suspended_at"`
+	// Until is when the suspension expires, or nil if it lasts until the account is unsuspended
+	Until *time.Time `json:"until,omitempty"`
+}
+
+// UserDetails is a user with the state of the account
+type UserDetails struct {
+	User
+	Suspension            *Suspension `json:"suspension,omitempty"`
+	HasPassword           bool        `json:"has_password"`
+	PasswordResetRequired bool        `json:"password_reset_required"`
+	MFAEnabled            bool        `json:"mfa_enabled"`
+	Providers             []string    `json:"providers"`
+	ActiveSessions        int         `json:"active_sessions"`
+	LastLoginAt           *time.Time  `json:"last_login_at,omitempty"`
+}
+
+// listUsers returns the users whose id, email or name contain the query, the latest first, and the number of such users
+func listUsers(query string, limit, offset int) ([]User, int, error) {
+	db, err := database.Connect()
+	if err != nil {
+		return nil, 0, err
+	}
+	defer db.Close()
+
+	const filter = "WHERE ($1 = '' OR user_id ILIKE $2 OR user_email ILIKE $2 OR name ILIKE $2)"
+	pattern := "%" + escapeLike(query) + "%"
+
+	var total int
+	if err := db.QueryRow("SELECT COUNT(*) FROM USER_TABLE "+filter, query, pattern).Scan(&total); err != nil {
+		return nil, 0, err
+	}
+
+	rows, err := db.Query("SELECT user_id, user_uuid, user_email, name, role, email_verified, "+suspendedCondition+", created_at FROM USER_TABLE "+filter+
+		" ORDER BY created_at DESC, user_id LIMIT $3 OFFSET $4", query, pattern, limit, offset)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+
+	users := []User{}
+	for rows.Next() {
+		u := User{}
+		if err := rows.Scan(&u.ID, &u.UUID, &u.Email, &u.Name, &u.Role, &u.EmailVerified, &u.Suspended, &u.CreatedAt); err != nil {
+			return nil, 0, err
+		}
+		users = append(users, u)
+	}
+	return users, total, rows.Err()
+}
+
+// getUser returns the details of the user
+func getUser(id string) (*UserDetails, error) {
+	db, err := database.Connect()
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+
+	u := &UserDetails{Providers: []string{}}
+	var suspendedAt, suspendedUntil sql.NullTime
+	var suspensionReason sql.NullString
+	err = db.QueryRow(`SELECT user_id, user_uuid, user_email, name, role, email_verified, `+suspendedCondition+`, created_at,
+		suspended_at, suspended_until, suspension_reason, password <> '', password_reset_required FROM USER_TABLE WHERE user_id = $1`, id).
+		Scan(&u.ID, &u.UUID, &u.Email, &u.Name, &u.Role, &u.EmailVerified, &u.Suspended, &u.CreatedAt,
+			&suspendedAt, &suspendedUntil, &suspensionReason, &u.HasPassword, &u.PasswordResetRequired)
+	if err == sql.ErrNoRows {
+		return nil, ErrUserNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	if u.Suspended {
+		u.Suspension = &Suspension{Reason: suspensionReason.String, SuspendedAt: suspendedAt.Time}
+		if suspendedUntil.Valid {
+			u.Suspension.Until = &suspendedUntil.Time
+		}
+	}
+
+	rows, err := db.Query("SELECT provider FROM USER_IDENTITY WHERE user_uuid = $1 ORDER BY provider", u.UUID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var provider string
+		if err := rows.Scan(&provider); err != nil {
+			return nil, err
+		}
+		u.Providers = append(u.Providers, provider)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	var lastLoginAt sql.NullTime
+	if err := db.QueryRow("SELECT COUNT(*) FILTER (WHERE revoked_at IS NULL AND expires_at > NOW()), MAX(created_at) FROM LOGIN_SESSION WHERE user_uuid = $1", u.UUID).
+		Scan(&u.ActiveSessions, &lastLoginAt); err != nil {
+		return nil, err
+	}
+	if lastLoginAt.Valid {
+		u.LastLoginAt = &lastLoginAt.Time
+	}
+
+	if u.MFAEnabled, err = mfa.Enabled(u.UUID); err != nil {
+		return nil, err
+	}
+	return u, nil
+}
+
+// suspend suspends the account for the reason, until the time or indefinitely if it is nil, and logs the user out everywhere
+func suspend(tx *sql.Tx, userUUID, reason string, until *time.Time) error {
+	if err := updateUser(tx, userUUID, "UPDATE USER_TABLE SET suspended_at = NOW(), suspended_until = $2, suspension_reason = $3 WHERE user_uuid = $1", until, reason); err != nil {
+		return err
+	}
+	return token.RevokeAllTx(tx, userUUID)
+}
+
+// unsuspend lifts the suspension of the account
+func unsuspend(tx *sql.Tx, userUUID string) error {
+	return updateUser(tx, userUUID, "UPDATE USER_TABLE SET suspended_at = NULL, suspended_until = NULL, suspension_reason = NULL WHERE user_uuid = $1")
+}
+
+// updateUser runs the update statement of the user, whose user_uuid is $1, and returns ErrUserNotFound if it does not exist
+func updateUser(tx *sql.Tx, userUUID, query string, args ...interface{}) error {
+	result, err := tx.Exec(query, append([]interface{}{userUUID}, args...)...)
+	if err != nil {
+		return err
+	}
+	if n, err := result.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return ErrUserNotFound
+	}
+	return nil
+}
+
+// deleteUser deletes the user and every record of the user but the audit trail, and revokes the tokens of the user.
+// The email of the user and the blob prefixes to be cleaned up are returned
+func deleteUser(tx *sql.Tx, userUUID string) (string, []string, error) {
+	var email, userRole string
+	err := tx.QueryRow("SELECT user_email, role FROM USER_TABLE WHERE user_uuid = $1 FOR UPDATE", userUUID).Scan(&email, &userRole)
+	if err == sql.ErrNoRows {
+		return "", nil, ErrUserNotFound
+	}
+	if err != nil {
+		return "", nil, err
+	}
+	if userRole == role.Admin {
+		return "", nil, ErrDeleteAdmin
+	}
+
+	blobs, err := deletion.DeleteUser(tx, userUUID)
+	if err != nil {
+		return "", nil, err
+	}
+	// The access tokens of the user outlive the user until they expire
+	return email, blobs, token.RevokeAccessTokensTx(tx, userUUID)
+}
+
+// escapeLike escapes the wildcards of a LIKE pattern
+func escapeLike(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(s)
+}
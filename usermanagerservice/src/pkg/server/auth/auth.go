@@ -20,19 +20,29 @@ import (
 	"github.com/110billion/sellfie/usermanagerservice/src/internal/apiserver"
 	"github.com/110billion/sellfie/usermanagerservice/src/internal/wrapper"
 	"github.com/110billion/sellfie/usermanagerservice/src/pkg/server/auth/login"
+	"github.com/110billion/sellfie/usermanagerservice/src/pkg/server/auth/logout"
+	"github.com/110billion/sellfie/usermanagerservice/src/pkg/server/auth/mfa"
+	"github.com/110billion/sellfie/usermanagerservice/src/pkg/server/auth/password"
 	"github.com/110billion/sellfie/usermanagerservice/src/pkg/server/auth/signup"
-	"github.com/110billion/sellfie/usermanagerservice/src/pkg/server/auth/social/facebook"
-	"github.com/110billion/sellfie/usermanagerservice/src/pkg/server/auth/social/google"
+	"github.com/110billion/sellfie/usermanagerservice/src/pkg/server/auth/social"
+	"github.com/110billion/sellfie/usermanagerservice/src/pkg/server/auth/token"
 	"github.com/110billion/sellfie/usermanagerservice/src/pkg/server/auth/userinfo"
+	"github.com/110billion/sellfie/usermanagerservice/src/pkg/server/auth/verify"
 	"github.com/go-logr/logr"
 )
 
 type handler struct {
-	googleHandler   apiserver.APIHandler
-	facebookHandler apiserver.APIHandler
+	socialHandler   apiserver.APIHandler
+	identityHandler apiserver.APIHandler
 	signUpHandler   apiserver.APIHandler
 	loginHandler    apiserver.APIHandler
+	logoutHandler   apiserver.APIHandler
+	tokenHandler    apiserver.APIHandler
 	userInfoHandler apiserver.APIHandler
+	verifyHandler   apiserver.APIHandler
+	passwordHandler apiserver.APIHandler
+	mfaHandler      apiserver.APIHandler
+	sessionHandler  apiserver.APIHandler
 }
 
 // NewHandler instantiates a new apis handler
@@ -59,6 +69,20 @@ func NewHandler(parent wrapper.RouterWrapper, logger logr.Logger) (apiserver.API
 	}
 	handler.loginHandler = loginHandler
 
+	// /auth/logout
+	logoutHandler, err := logout.NewHandler(authWrapper, logger)
+	if err != nil {
+		return nil, err
+	}
+	handler.logoutHandler = logoutHandler
+
+	// /auth/token
+	tokenHandler, err := token.NewHandler(authWrapper, logger)
+	if err != nil {
+		return nil, err
+	}
+	handler.tokenHandler = tokenHandler
+
 	// /auth/userinfo
 	userInfoHandler, err := userinfo.NewHandler(authWrapper, logger)
 	if err != nil {
@@ -66,19 +90,47 @@ func NewHandler(parent wrapper.RouterWrapper, logger logr.Logger) (apiserver.API
 	}
 	handler.userInfoHandler = userInfoHandler
 
-	// /auth/google
-	googleHandler, err := google.NewHandler(authWrapper, logger)
+	// /auth/verify
+	verifyHandler, err := verify.NewHandler(authWrapper, logger)
+	if err != nil {
+		return nil, err
+	}
+	handler.verifyHandler = verifyHandler
+
+	// /auth/password
+	passwordHandler, err := password.NewHandler(authWrapper, logger)
+	if err != nil {
+		return nil, err
+	}
+	handler.passwordHandler = passwordHandler
+
+	// /auth/mfa
+	mfaHandler, err := mfa.NewHandler(authWrapper, logger)
+	if err != nil {
+		return nil, err
+	}
+	handler.mfaHandler = mfaHandler
+
+	// /auth/sessions
+	sessionHandler, err := token.NewSessionHandler(authWrapper, logger)
+	if err != nil {
+		return nil, err
+	}
+	handler.sessionHandler = sessionHandler
+
+	// /auth/identities
+	identityHandler, err := social.NewIdentityHandler(authWrapper, logger)
 	if err != nil {
 		return nil, err
 	}
-	handler.googleHandler = googleHandler
+	handler.identityHandler = identityHandler
 
-	// /auth/facebook
-	facebookHandler, err := facebook.NewHandler(authWrapper, logger)
+	// /auth/{provider}
+	socialHandler, err := social.NewHandler(authWrapper, logger)
 	if err != nil {
 		return nil, err
 	}
-	handler.facebookHandler = facebookHandler
+	handler.socialHandler = socialHandler
 
 	return handler, nil
 }
@@ -23,18 +23,25 @@ import (
 	"github.com/110billion/sellfie/usermanagerservice/src/internal/utils"
 	"github.com/110billion/sellfie/usermanagerservice/src/internal/wrapper"
 	"github.com/110billion/sellfie/usermanagerservice/src/pkg/database"
+	"github.com/110billion/sellfie/usermanagerservice/src/pkg/lockout"
+	"github.com/110billion/sellfie/usermanagerservice/src/pkg/server/auth/mfa"
 	"github.com/110billion/sellfie/usermanagerservice/src/pkg/server/auth/token"
+	"github.com/110billion/sellfie/usermanagerservice/src/pkg/server/auth/verify"
 	"github.com/go-logr/logr"
 	"golang.org/x/crypto/bcrypt"
 	"net/http"
+	"strconv"
+	"time"
 )
 
-// Response is common struct for responding login request
-type Response struct {
-	Ok    bool   `json:"ok"`
-	ID    string `json:"id"`
-	Token string `json:"token"`
-}
+const (
+	// errInvalidCredentials is the message of every failed login, not disclosing whether the email is registered
+	errInvalidCredentials = "invalid email or password"
+	errTooManyAttempts    = "too many failed login attempts, retry later or reset the password"
+)
+
+// dummyHash is compared with the password of a login of an unknown email
+var dummyHash, _ = bcrypt.GenerateFromPassword([]byte("sellfie"), bcrypt.DefaultCost)
 
 type handler struct {
 	log logr.Logger
@@ -45,6 +52,11 @@ type logInReqBody struct {
 	Password string `json:"password"`
 }
 
+type mfaReqBody struct {
+	ChallengeToken string `json:"challenge_token"`
+	Code           string `json:"code"`
+}
+
 // NewHandler instantiates a new login api handler
 func NewHandler(parent wrapper.RouterWrapper, logger logr.Logger) (apiserver.APIHandler, error) {
 	handler := &handler{log: logger}
@@ -55,6 +67,12 @@ func NewHandler(parent wrapper.RouterWrapper, logger logr.Logger) (apiserver.API
 		return nil, err
 	}
 
+	// /login/mfa
+	mfaWrapper := wrapper.New("/mfa", []string{http.MethodPost}, handler.mfaHandler)
+	if err := logInWrapper.Add(mfaWrapper); err != nil {
+		return nil, err
+	}
+
 	return handler, nil
 }
 
@@ -73,35 +91,144 @@ func (h *handler) logInHandler(w http.ResponseWriter, req *http.Request) {
 		return
 	}
 
+	// Guessing is slowed down per email and per IP address, whether the email is registered or not
+	ip := utils.ClientIP(req)
+	wait, err := lockout.CheckLogin(logInReq.Email, ip)
+	if err != nil {
+		h.log.Error(err, "login error")
+		_ = utils.RespondError(w, http.StatusInternalServerError, "cannot check login attempts")
+		return
+	}
+	if wait > 0 {
+		w.Header().Set("Retry-After", strconv.Itoa(int(wait.Seconds())+1))
+		_ = utils.RespondError(w, http.StatusTooManyRequests, errTooManyAttempts)
+		return
+	}
+
 	// Open DB
 	db, err := database.Connect()
 	if err != nil {
 		h.log.Error(err, "login error")
-		_ = utils.RespondError(w, http.StatusBadRequest, "db connection error")
+		_ = utils.RespondError(w, http.StatusInternalServerError, "db connection error")
 		return
 	}
 	defer db.Close()
 
-	var email, password, id string
-	if err = db.QueryRow("SELECT user_email, password, user_id FROM USER_TABLE WHERE user_email = $1", logInReq.Email).Scan(&email, &password, &id); err == sql.ErrNoRows {
+	var email, password, id, userUUID string
+	var emailVerified, suspended, resetRequired bool
+	var createdAt time.Time
+	err = db.QueryRow(`SELECT user_email, password, user_id, user_uuid, email_verified, created_at,
+		suspended_at IS NOT NULL AND (suspended_until IS NULL OR suspended_until > NOW()), password_reset_required
+		FROM USER_TABLE WHERE user_email = $1`, logInReq.Email).
+		Scan(&email, &password, &id, &userUUID, &emailVerified, &createdAt, &suspended, &resetRequired)
+	if err != nil && err != sql.ErrNoRows {
+		h.log.Error(err, "login error")
+		_ = utils.RespondError(w, http.StatusInternalServerError, "cannot get account")
+		return
+	}
+
+	// Unknown emails are compared against a dummy hash, so that they take as long as wrong passwords
+	// Accounts signed up with a social identity only do not have a password
+	known := err == nil && password != ""
+	hash := []byte(password)
+	if !known {
+		hash = dummyHash
+	}
+	if err := bcrypt.CompareHashAndPassword(hash, []byte(logInReq.Password)); err != nil || !known {
+		if err := lockout.FailLogin(logInReq.Email, ip); err != nil {
+			h.log.Error(err, "login error")
+		}
+		_ = utils.RespondError(w, http.StatusUnauthorized, errInvalidCredentials)
+		return
+	}
+
+	if err := lockout.Unlock(logInReq.Email); err != nil {
 		h.log.Error(err, "login error")
-		_ = utils.RespondError(w, http.StatusBadRequest, "email not registered")
+	}
+
+	// Checked after the password, so that they are not disclosed to whoever tries an email
+	if suspended {
+		_ = utils.RespondError(w, http.StatusForbidden, token.ErrAccountSuspended.Error())
+		return
+	}
+	if resetRequired {
+		_ = utils.RespondError(w, http.StatusForbidden, "password must be reset, check the reset mail")
+		return
+	}
+
+	if !verify.LoginAllowed(emailVerified, createdAt) {
+		_ = utils.RespondError(w, http.StatusForbidden, "email is not verified")
 		return
 	}
 
-	err = bcrypt.CompareHashAndPassword([]byte(password), []byte(logInReq.Password))
+	// Users with two-factor authentication get a challenge instead, which is exchanged for tokens at /login/mfa
+	mfaEnabled, err := mfa.Enabled(userUUID)
 	if err != nil {
 		h.log.Error(err, "login error")
-		_ = utils.RespondError(w, http.StatusBadRequest, "password doesn't match")
+		_ = utils.RespondError(w, http.StatusInternalServerError, "cannot check two-factor authentication")
+		return
+	}
+	if mfaEnabled {
+		challengeToken, err := mfa.NewChallenge(userUUID, email)
+		if err != nil {
+			h.log.Error(err, "login error")
+			_ = utils.RespondError(w, http.StatusInternalServerError, "cannot issue challenge")
+			return
+		}
+		_ = utils.RespondJSON(w, mfa.ChallengeResponse{Ok: true, ID: id, MFARequired: true, ChallengeToken: challengeToken})
 		return
 	}
 
-	jwtToken, err := token.GetJwtToken(logInReq.Email)
+	pair, _, err := token.Issue(userUUID, token.ClientFromRequest(req))
+	if err == token.ErrAccountSuspended {
+		_ = utils.RespondError(w, http.StatusForbidden, err.Error())
+		return
+	}
 	if err != nil {
 		h.log.Error(err, "login error")
 		_ = utils.RespondError(w, http.StatusBadRequest, "jwt token error")
 		return
 	}
 
-	_ = utils.RespondJSON(w, Response{Ok: true, Token: jwtToken, ID: id})
+	_ = utils.RespondJSON(w, token.Response{Ok: true, ID: id, Pair: *pair})
+}
+
+func (h *handler) mfaHandler(w http.ResponseWriter, req *http.Request) {
+	// Decode request body
+	mfaReq := &mfaReqBody{}
+	decoder := json.NewDecoder(req.Body)
+	if err := decoder.Decode(mfaReq); err != nil || mfaReq.ChallengeToken == "" || mfaReq.Code == "" {
+		_ = utils.RespondError(w, http.StatusBadRequest, "request body is not in json form or is malformed")
+		return
+	}
+
+	userUUID, err := mfa.VerifyChallenge(mfaReq.ChallengeToken, mfaReq.Code)
+	if throttled, ok := err.(*mfa.ThrottledError); ok {
+		w.Header().Set("Retry-After", strconv.Itoa(int(throttled.RetryAfter.Seconds())+1))
+		_ = utils.RespondError(w, http.StatusTooManyRequests, err.Error())
+		return
+	}
+	switch err {
+	case nil:
+	case mfa.ErrInvalidChallenge, mfa.ErrInvalidCode, mfa.ErrNotEnabled:
+		_ = utils.RespondError(w, http.StatusUnauthorized, err.Error())
+		return
+	default:
+		h.log.Error(err, "login error")
+		_ = utils.RespondError(w, http.StatusInternalServerError, "cannot verify code")
+		return
+	}
+
+	pair, id, err := token.Issue(userUUID, token.ClientFromRequest(req))
+	if err == token.ErrAccountSuspended {
+		_ = utils.RespondError(w, http.StatusForbidden, err.Error())
+		return
+	}
+	if err != nil {
+		h.log.Error(err, "login error")
+		_ = utils.RespondError(w, http.StatusInternalServerError, "jwt token error")
+		return
+	}
+
+	_ = utils.RespondJSON(w, token.Response{Ok: true, ID: id, Pair: *pair})
 }
@@ -0,0 +1,108 @@
+/*
+ Copyright 2021 The 110 billion Authors
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package logout
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+
+	"github.com/110billion/sellfie/usermanagerservice/src/internal/apiserver"
+	"github.com/110billion/sellfie/usermanagerservice/src/internal/utils"
+	"github.com/110billion/sellfie/usermanagerservice/src/internal/wrapper"
+	"github.com/110billion/sellfie/usermanagerservice/src/pkg/server/auth/token"
+	"github.com/go-logr/logr"
+)
+
+// Response is common struct for responding logout request
+type Response struct {
+	Ok bool `json:"ok"`
+}
+
+type handler struct {
+	log logr.Logger
+}
+
+type logOutReqBody struct {
+	// RefreshToken is revoked together with the access token, if given.
+	// The session of the access token is revoked anyway, with its refresh tokens
+	RefreshToken string `json:"refresh_token"`
+	// All revokes every token issued to the user, i.e., logs out everywhere
+	All bool `json:"all"`
+}
+
+// NewHandler instantiates a new logout api handler
+func NewHandler(parent wrapper.RouterWrapper, logger logr.Logger) (apiserver.APIHandler, error) {
+	handler := &handler{log: logger}
+
+	// /logout
+	logOutWrapper := wrapper.New("/logout", []string{http.MethodPost}, handler.logOutHandler)
+	logOutWrapper.Use(token.Authenticate)
+	if err := parent.Add(logOutWrapper); err != nil {
+		return nil, err
+	}
+
+	return handler, nil
+}
+
+func (h *handler) logOutHandler(w http.ResponseWriter, req *http.Request) {
+	claims, _ := token.FromContext(req.Context())
+
+	// Decode request body, which is optional
+	logOutReq := &logOutReqBody{}
+	decoder := json.NewDecoder(req.Body)
+	if err := decoder.Decode(logOutReq); err != nil && err != io.EOF {
+		_ = utils.RespondError(w, http.StatusBadRequest, "request body is not in json form or is malformed")
+		return
+	}
+
+	if logOutReq.All {
+		if err := token.RevokeAll(claims.Subject); err != nil {
+			h.log.Error(err, "logout error")
+			_ = utils.RespondError(w, http.StatusInternalServerError, "cannot revoke tokens")
+			return
+		}
+		_ = utils.RespondJSON(w, Response{Ok: true})
+		return
+	}
+
+	if err := token.Revoke(claims); err != nil {
+		h.log.Error(err, "logout error")
+		_ = utils.RespondError(w, http.StatusInternalServerError, "cannot revoke token")
+		return
+	}
+
+	// The refresh tokens of the session must not outlive the logout, even if the client does not send them.
+	// Tokens issued by GetJwtToken do not have a session
+	if claims.SessionID != "" {
+		if err := token.RevokeSession(claims.Subject, claims.SessionID); err != nil && err != token.ErrSessionNotFound {
+			h.log.Error(err, "logout error")
+			_ = utils.RespondError(w, http.StatusInternalServerError, "cannot revoke session")
+			return
+		}
+	}
+
+	if logOutReq.RefreshToken != "" {
+		if err := token.RevokeRefreshToken(logOutReq.RefreshToken, claims.Subject); err != nil {
+			h.log.Error(err, "logout error")
+			_ = utils.RespondError(w, http.StatusInternalServerError, "cannot revoke refresh token")
+			return
+		}
+	}
+
+	_ = utils.RespondJSON(w, Response{Ok: true})
+}
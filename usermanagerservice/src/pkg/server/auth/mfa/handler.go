@@ -0,0 +1,227 @@
+/*
+ Copyright 2021 The 110 billion Authors
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package mfa
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+
+	"github.com/110billion/sellfie/usermanagerservice/src/internal/apiserver"
+	"github.com/110billion/sellfie/usermanagerservice/src/internal/utils"
+	"github.com/110billion/sellfie/usermanagerservice/src/internal/wrapper"
+	"github.com/110billion/sellfie/usermanagerservice/src/pkg/server/auth/token"
+	"github.com/go-logr/logr"
+)
+
+// ChallengeResponse is the response of the first login step of users with two-factor authentication.
+// The challenge token is exchanged for tokens with a code at /auth/login/mfa
+type ChallengeResponse struct {
+	Ok             bool   `json:"ok"`
+	ID             string `json:"id"`
+	MFARequired    bool   `json:"mfa_required"`
+	ChallengeToken string `json:"challenge_token"`
+}
+
+// StatusResponse is the response of the two-factor authentication state
+type StatusResponse struct {
+	Ok bool `json:"ok"`
+	Status
+}
+
+// EnrollResponse is the response of starting an enrollment
+type EnrollResponse struct {
+	Ok         bool   `json:"ok"`
+	Secret     string `json:"secret"`
+	OtpauthURI string `json:"otpauth_uri"`
+}
+
+// RecoveryCodesResponse is the response carrying new recovery codes
+type RecoveryCodesResponse struct {
+	Ok            bool     `json:"ok"`
+	RecoveryCodes []string `json:"recovery_codes"`
+}
+
+// Response is common struct for responding the other two-factor authentication requests
+type Response struct {
+	Ok bool `json:"ok"`
+}
+
+type handler struct {
+	log logr.Logger
+}
+
+type codeReqBody struct {
+	Code string `json:"code"`
+}
+
+// NewHandler instantiates a new two-factor authentication api handler
+func NewHandler(parent wrapper.RouterWrapper, logger logr.Logger) (apiserver.APIHandler, error) {
+	handler := &handler{log: logger}
+
+	// /mfa
+	mfaWrapper := wrapper.New("/mfa", []string{http.MethodGet}, handler.statusHandler)
+	mfaWrapper.Use(token.Authenticate)
+	if err := parent.Add(mfaWrapper); err != nil {
+		return nil, err
+	}
+
+	// /mfa/totp
+	totpWrapper := wrapper.New("/totp", []string{http.MethodPost}, handler.enrollHandler)
+	if err := mfaWrapper.Add(totpWrapper); err != nil {
+		return nil, err
+	}
+
+	// /mfa/totp/confirm
+	confirmWrapper := wrapper.New("/confirm", []string{http.MethodPost}, handler.confirmHandler)
+	if err := totpWrapper.Add(confirmWrapper); err != nil {
+		return nil, err
+	}
+
+	// /mfa/recovery-codes
+	recoveryCodesWrapper := wrapper.New("/recovery-codes", []string{http.MethodPost}, handler.recoveryCodesHandler)
+	if err := mfaWrapper.Add(recoveryCodesWrapper); err != nil {
+		return nil, err
+	}
+
+	// /mfa/disable
+	disableWrapper := wrapper.New("/disable", []string{http.MethodPost}, handler.disableHandler)
+	if err := mfaWrapper.Add(disableWrapper); err != nil {
+		return nil, err
+	}
+
+	return handler, nil
+}
+
+func (h *handler) statusHandler(w http.ResponseWriter, req *http.Request) {
+	claims, _ := token.FromContext(req.Context())
+
+	status, err := GetStatus(claims.Subject)
+	if err != nil {
+		h.log.Error(err, "mfa status error")
+		_ = utils.RespondError(w, http.StatusInternalServerError, "cannot get two-factor authentication status")
+		return
+	}
+
+	_ = utils.RespondJSON(w, StatusResponse{Ok: true, Status: *status})
+}
+
+func (h *handler) enrollHandler(w http.ResponseWriter, req *http.Request) {
+	claims, _ := token.FromContext(req.Context())
+
+	// A stolen token must not be enough to put a second factor on the account, locking its owner out
+	if !claims.RecentlyAuthenticated() {
+		_ = utils.RespondError(w, http.StatusUnauthorized, "log in again to enable two-factor authentication")
+		return
+	}
+
+	secret, uri, err := Enroll(claims.Subject, claims.Email)
+	if err == ErrAlreadyEnabled {
+		_ = utils.RespondError(w, http.StatusConflict, err.Error())
+		return
+	}
+	if err != nil {
+		h.log.Error(err, "mfa enroll error")
+		_ = utils.RespondError(w, http.StatusInternalServerError, "cannot enroll two-factor authentication")
+		return
+	}
+
+	_ = utils.RespondJSON(w, EnrollResponse{Ok: true, Secret: secret, OtpauthURI: uri})
+}
+
+func (h *handler) confirmHandler(w http.ResponseWriter, req *http.Request) {
+	claims, _ := token.FromContext(req.Context())
+
+	code, ok := decodeCode(w, req)
+	if !ok {
+		return
+	}
+
+	codes, err := Confirm(claims.Subject, code)
+	if !h.respondCodeError(w, err, "mfa confirm error") {
+		return
+	}
+
+	_ = utils.RespondJSON(w, RecoveryCodesResponse{Ok: true, RecoveryCodes: codes})
+}
+
+func (h *handler) recoveryCodesHandler(w http.ResponseWriter, req *http.Request) {
+	claims, _ := token.FromContext(req.Context())
+
+	code, ok := decodeCode(w, req)
+	if !ok {
+		return
+	}
+
+	codes, err := RegenerateRecoveryCodes(claims.Subject, code)
+	if !h.respondCodeError(w, err, "mfa recovery codes error") {
+		return
+	}
+
+	_ = utils.RespondJSON(w, RecoveryCodesResponse{Ok: true, RecoveryCodes: codes})
+}
+
+func (h *handler) disableHandler(w http.ResponseWriter, req *http.Request) {
+	claims, _ := token.FromContext(req.Context())
+
+	code, ok := decodeCode(w, req)
+	if !ok {
+		return
+	}
+
+	err := DisableWithCode(claims.Subject, code)
+	if !h.respondCodeError(w, err, "mfa disable error") {
+		return
+	}
+
+	_ = utils.RespondJSON(w, Response{Ok: true})
+}
+
+// decodeCode decodes the code of the request body, responding an error if it is malformed
+func decodeCode(w http.ResponseWriter, req *http.Request) (string, bool) {
+	codeReq := &codeReqBody{}
+	decoder := json.NewDecoder(req.Body)
+	if err := decoder.Decode(codeReq); err != nil || codeReq.Code == "" {
+		_ = utils.RespondError(w, http.StatusBadRequest, "request body is not in json form or is malformed")
+		return "", false
+	}
+	return codeReq.Code, true
+}
+
+// respondCodeError responds the error of checking a code, if any. It returns whether err is nil
+func (h *handler) respondCodeError(w http.ResponseWriter, err error, msg string) bool {
+	if throttled, ok := err.(*ThrottledError); ok {
+		w.Header().Set("Retry-After", strconv.Itoa(int(throttled.RetryAfter.Seconds())+1))
+		_ = utils.RespondError(w, http.StatusTooManyRequests, err.Error())
+		return false
+	}
+
+	switch err {
+	case nil:
+		return true
+	case ErrInvalidCode:
+		_ = utils.RespondError(w, http.StatusUnauthorized, err.Error())
+	case ErrNotEnrolled, ErrNotEnabled:
+		_ = utils.RespondError(w, http.StatusNotFound, err.Error())
+	case ErrAlreadyEnabled:
+		_ = utils.RespondError(w, http.StatusConflict, err.Error())
+	default:
+		h.log.Error(err, msg)
+		_ = utils.RespondError(w, http.StatusInternalServerError, "cannot process two-factor authentication")
+	}
+	return false
+}
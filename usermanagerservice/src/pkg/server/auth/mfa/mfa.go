@@ -0,0 +1,408 @@
+/*
+ Copyright 2021 The 110 billion Authors
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package mfa
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math/big"
+	"strings"
+	"time"
+
+	"github.com/110billion/sellfie/usermanagerservice/src/internal/utils"
+	"github.com/110billion/sellfie/usermanagerservice/src/pkg/database"
+	"github.com/110billion/sellfie/usermanagerservice/src/pkg/lockout"
+	"github.com/110billion/sellfie/usermanagerservice/src/pkg/server/auth/token"
+	logf "sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+const (
+	// ActionMFAChallenge is the action of the challenge tokens, which are exchanged for tokens with a code
+	ActionMFAChallenge = "mfa_challenge"
+
+	recoveryCodeCount = 10
+	// recoveryCodeAlphabet leaves out characters which are easily confused, e.g., 0 and o
+	recoveryCodeAlphabet = "abcdefghjkmnpqrstuvwxyz23456789"
+	// maxChallengeAttempts is how many wrong codes a challenge takes before it is void
+	maxChallengeAttempts = 5
+)
+
+var (
+	log = logf.Log.WithName("mfa")
+
+	challengeLifetime = utils.DurationFromEnv("MFA_CHALLENGE_TTL", 5*time.Minute)
+
+	// ErrNotEnrolled is returned on confirming an enrollment which is not started
+	ErrNotEnrolled = errors.New("two-factor authentication is not enrolled")
+	// ErrNotEnabled is returned if a code is checked for a user without two-factor authentication
+	ErrNotEnabled = errors.New("two-factor authentication is not enabled")
+	// ErrAlreadyEnabled is returned on enrolling a user who already has two-factor authentication
+	ErrAlreadyEnabled = errors.New("two-factor authentication is already enabled")
+	// ErrInvalidCode is returned if a code is neither the current TOTP code nor an unused recovery code
+	ErrInvalidCode = errors.New("code is invalid")
+	// ErrInvalidChallenge is returned if a challenge token is invalid, expired, already used or out of attempts
+	ErrInvalidChallenge = errors.New("challenge is invalid or expired, log in again")
+)
+
+// ThrottledError is returned if the user tried too many wrong codes
+type ThrottledError struct {
+	RetryAfter time.Duration
+}
+
+func (e *ThrottledError) Error() string {
+	return fmt.Sprintf("too many wrong codes, retry after %s", e.RetryAfter.Round(time.Second))
+}
+
+// Status is the two-factor authentication state of a user
+type Status struct {
+	Enabled           bool `json:"enabled"`
+	RecoveryCodesLeft int  `json:"recovery_codes_left"`
+}
+
+// Enabled returns whether the user has two-factor authentication enabled
+func Enabled(userUUID string) (bool, error) {
+	status, err := GetStatus(userUUID)
+	if err != nil {
+		return false, err
+	}
+	return status.Enabled, nil
+}
+
+// GetStatus returns the two-factor authentication state of the user
+func GetStatus(userUUID string) (*Status, error) {
+	db, err := database.Connect()
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+
+	status := &Status{}
+	if err := db.QueryRow(`SELECT EXISTS(SELECT 1 FROM USER_MFA WHERE user_uuid = $1 AND enabled),
+		(SELECT COUNT(*) FROM MFA_RECOVERY_CODE WHERE user_uuid = $1 AND used_at IS NULL)`, userUUID).
+		Scan(&status.Enabled, &status.RecoveryCodesLeft); err != nil {
+		return nil, err
+	}
+	return status, nil
+}
+
+// Enroll starts enrolling the user in TOTP with a new secret, replacing an unconfirmed one.
+// The secret and its otpauth URI are returned, for the user to add to an authenticator app
+func Enroll(userUUID, account string) (string, string, error) {
+	secret, err := newSecret()
+	if err != nil {
+		return "", "", err
+	}
+	stored, err := encryptSecret(secret)
+	if err != nil {
+		return "", "", err
+	}
+
+	db, err := database.Connect()
+	if err != nil {
+		return "", "", err
+	}
+	defer db.Close()
+
+	// Enabled secrets are never replaced, as it would bypass the code required to disable them
+	result, err := db.Exec(`INSERT INTO USER_MFA (user_uuid, secret, enabled, last_counter, created_at) VALUES($1, $2, FALSE, 0, NOW())
+		ON CONFLICT (user_uuid) DO UPDATE SET secret = EXCLUDED.secret, last_counter = 0, created_at = NOW() WHERE NOT USER_MFA.enabled`, userUUID, stored)
+	if err != nil {
+		return "", "", err
+	}
+	if n, err := result.RowsAffected(); err != nil {
+		return "", "", err
+	} else if n == 0 {
+		return "", "", ErrAlreadyEnabled
+	}
+
+	return secret, otpauthURI(secret, account), nil
+}
+
+// Confirm enables two-factor authentication once the user proves to have enrolled the secret with a code.
+// The recovery codes are returned, which are never shown again
+func Confirm(userUUID, code string) ([]string, error) {
+	return withCodeTx(userUUID, func(tx *sql.Tx) ([]string, error) {
+		var stored string
+		var enabled bool
+		var lastCounter int64
+		err := tx.QueryRow("SELECT secret, enabled, last_counter FROM USER_MFA WHERE user_uuid = $1 FOR UPDATE", userUUID).Scan(&stored, &enabled, &lastCounter)
+		if err == sql.ErrNoRows {
+			return nil, ErrNotEnrolled
+		}
+		if err != nil {
+			return nil, err
+		}
+		if enabled {
+			return nil, ErrAlreadyEnabled
+		}
+
+		secret, err := decryptSecret(stored)
+		if err != nil {
+			return nil, err
+		}
+		counter, ok := matchTOTP(secret, code, time.Now(), lastCounter)
+		if !ok {
+			return nil, ErrInvalidCode
+		}
+
+		if _, err := tx.Exec("UPDATE USER_MFA SET enabled = TRUE, enabled_at = NOW(), last_counter = $1 WHERE user_uuid = $2", counter, userUUID); err != nil {
+			return nil, err
+		}
+		return replaceRecoveryCodes(tx, userUUID)
+	})
+}
+
+// RegenerateRecoveryCodes replaces the recovery codes of the user, who proves to have the second factor with a code
+func RegenerateRecoveryCodes(userUUID, code string) ([]string, error) {
+	return withCodeTx(userUUID, func(tx *sql.Tx) ([]string, error) {
+		if err := checkCode(tx, userUUID, code); err != nil {
+			return nil, err
+		}
+		return replaceRecoveryCodes(tx, userUUID)
+	})
+}
+
+// DisableWithCode disables two-factor authentication of the user, who proves to have the second factor with a code
+func DisableWithCode(userUUID, code string) error {
+	_, err := withCodeTx(userUUID, func(tx *sql.Tx) ([]string, error) {
+		if err := checkCode(tx, userUUID, code); err != nil {
+			return nil, err
+		}
+		return nil, deleteMFA(tx, userUUID)
+	})
+	return err
+}
+
+// Disable disables two-factor authentication of the user in the transaction without a code,
+// for administrators to recover users who lost both the authenticator and the recovery codes
+func Disable(tx *sql.Tx, userUUID string) error {
+	return deleteMFA(tx, userUUID)
+}
+
+// NewChallenge issues a challenge token for the user, who passed the first login step
+func NewChallenge(userUUID, email string) (string, error) {
+	challengeToken, claims, err := token.IssueActionToken(ActionMFAChallenge, userUUID, email, challengeLifetime)
+	if err != nil {
+		return "", err
+	}
+
+	db, err := database.Connect()
+	if err != nil {
+		return "", err
+	}
+	defer db.Close()
+
+	if _, err := db.Exec("DELETE FROM MFA_CHALLENGE WHERE expires_at < NOW()"); err != nil {
+		return "", err
+	}
+	if _, err := db.Exec("INSERT INTO MFA_CHALLENGE (jti, user_uuid, attempts, expires_at) VALUES($1, $2, 0, $3)",
+		claims.Id, userUUID, time.Unix(claims.ExpiresAt, 0)); err != nil {
+		return "", err
+	}
+	return challengeToken, nil
+}
+
+// VerifyChallenge checks the code for the challenge and consumes it. The user_uuid of the user is returned.
+// A challenge is void after maxChallengeAttempts wrong codes, and wrong codes of every challenge count for the user
+func VerifyChallenge(challengeToken, code string) (string, error) {
+	claims, err := token.ParseActionToken(ActionMFAChallenge, challengeToken)
+	if err != nil {
+		return "", ErrInvalidChallenge
+	}
+
+	_, err = withCodeTx(claims.Subject, func(tx *sql.Tx) ([]string, error) {
+		var attempts int
+		var usedAt sql.NullTime
+		err := tx.QueryRow("SELECT attempts, used_at FROM MFA_CHALLENGE WHERE jti = $1 AND user_uuid = $2 FOR UPDATE", claims.Id, claims.Subject).
+			Scan(&attempts, &usedAt)
+		if err == sql.ErrNoRows || (err == nil && (usedAt.Valid || attempts >= maxChallengeAttempts)) {
+			return nil, ErrInvalidChallenge
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		if err := checkCode(tx, claims.Subject, code); err != nil {
+			if err != ErrInvalidCode {
+				return nil, err
+			}
+			// The failed attempt is committed, while the error is still returned
+			if _, err := tx.Exec("UPDATE MFA_CHALLENGE SET attempts = attempts + 1 WHERE jti = $1", claims.Id); err != nil {
+				return nil, err
+			}
+			if err := tx.Commit(); err != nil {
+				return nil, err
+			}
+			return nil, ErrInvalidCode
+		}
+
+		_, err = tx.Exec("UPDATE MFA_CHALLENGE SET used_at = NOW() WHERE jti = $1", claims.Id)
+		return nil, err
+	})
+	if err != nil {
+		return "", err
+	}
+	return claims.Subject, nil
+}
+
+// checkCode checks the TOTP code or the recovery code of the user, consuming it
+func checkCode(tx *sql.Tx, userUUID, code string) error {
+	var stored string
+	var enabled bool
+	var lastCounter int64
+	err := tx.QueryRow("SELECT secret, enabled, last_counter FROM USER_MFA WHERE user_uuid = $1 FOR UPDATE", userUUID).Scan(&stored, &enabled, &lastCounter)
+	if err == sql.ErrNoRows || (err == nil && !enabled) {
+		return ErrNotEnabled
+	}
+	if err != nil {
+		return err
+	}
+
+	secret, err := decryptSecret(stored)
+	if err != nil {
+		return err
+	}
+	if counter, ok := matchTOTP(secret, strings.TrimSpace(code), time.Now(), lastCounter); ok {
+		_, err := tx.Exec("UPDATE USER_MFA SET last_counter = $1 WHERE user_uuid = $2", counter, userUUID)
+		return err
+	}
+
+	result, err := tx.Exec("UPDATE MFA_RECOVERY_CODE SET used_at = NOW() WHERE user_uuid = $1 AND code_hash = $2 AND used_at IS NULL",
+		userUUID, hashRecoveryCode(userUUID, code))
+	if err != nil {
+		return err
+	}
+	if n, err := result.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return ErrInvalidCode
+	}
+	return nil
+}
+
+// replaceRecoveryCodes generates new recovery codes for the user, voiding the old ones. Only their hashes are stored
+func replaceRecoveryCodes(tx *sql.Tx, userUUID string) ([]string, error) {
+	if _, err := tx.Exec("DELETE FROM MFA_RECOVERY_CODE WHERE user_uuid = $1", userUUID); err != nil {
+		return nil, err
+	}
+
+	codes := make([]string, 0, recoveryCodeCount)
+	for i := 0; i < recoveryCodeCount; i++ {
+		code, err := newRecoveryCode()
+		if err != nil {
+			return nil, err
+		}
+		if _, err := tx.Exec("INSERT INTO MFA_RECOVERY_CODE (user_uuid, code_hash) VALUES($1, $2)", userUUID, hashRecoveryCode(userUUID, code)); err != nil {
+			return nil, err
+		}
+		codes = append(codes, code)
+	}
+	return codes, nil
+}
+
+func deleteMFA(tx *sql.Tx, userUUID string) error {
+	if _, err := tx.Exec("DELETE FROM MFA_RECOVERY_CODE WHERE user_uuid = $1", userUUID); err != nil {
+		return err
+	}
+	_, err := tx.Exec("DELETE FROM USER_MFA WHERE user_uuid = $1", userUUID)
+	return err
+}
+
+// withCodeTx runs f, which checks a code of the user, in a transaction under the lockout of second factor codes.
+// A *ThrottledError is returned without running f if the user tried too many wrong codes.
+// f returning ErrInvalidCode counts as a wrong code, while a correct code forgets the wrong ones
+func withCodeTx(userUUID string, f func(tx *sql.Tx) ([]string, error)) ([]string, error) {
+	wait, err := lockout.CheckCode(userUUID)
+	if err != nil {
+		return nil, err
+	}
+	if wait > 0 {
+		return nil, &ThrottledError{RetryAfter: wait}
+	}
+
+	result, err := withTx(f)
+	switch err {
+	case nil:
+		// The code is accepted anyway if it fails, in which case the wrong codes just run out
+		if err := lockout.UnlockCode(userUUID); err != nil {
+			log.Error(err, "cannot forget wrong codes", "user", userUUID)
+		}
+	case ErrInvalidCode:
+		if err := lockout.FailCode(userUUID); err != nil {
+			return nil, err
+		}
+	}
+	return result, err
+}
+
+// withTx runs f in a transaction, which is committed if f succeeds
+func withTx(f func(tx *sql.Tx) ([]string, error)) ([]string, error) {
+	db, err := database.Connect()
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = tx.Rollback()
+	}()
+
+	result, err := f(tx)
+	if err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// newRecoveryCode returns a random code formatted as xxxxx-xxxxx
+func newRecoveryCode() (string, error) {
+	b := strings.Builder{}
+	for i := 0; i < 10; i++ {
+		if i == 5 {
+			b.WriteByte('-')
+		}
+		n, err := rand.Int(rand.Reader, big.NewInt(int64(len(recoveryCodeAlphabet))))
+		if err != nil {
+			return "", err
+		}
+		b.WriteByte(recoveryCodeAlphabet[n.Int64()])
+	}
+	return b.String(), nil
+}
+
+// hashRecoveryCode hashes the code of the user, ignoring case, spaces and hyphens
+func hashRecoveryCode(userUUID, code string) string {
+	normalized := strings.Map(func(r rune) rune {
+		if r == '-' || r == ' ' {
+			return -1
+		}
+		return r
+	}, strings.ToLower(code))
+	sum := sha256.Sum256([]byte(userUUID + ":" + normalized))
+	return hex.EncodeToString(sum[:])
+}
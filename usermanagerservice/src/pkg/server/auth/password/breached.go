@@ -0,0 +1,184 @@
+/*
+ Copyright 2021 The 110 billion Authors
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package password
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	logf "sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+// prefixLength is the length of the hash prefixes the breached password corpus is split by, in hex digits
+const prefixLength = 5
+
+var (
+	log = logf.Log.WithName("password")
+
+	corpusLock sync.RWMutex
+	corpus     breachedCorpus
+)
+
+// breachedCorpus tells if the SHA-1 hash of a password is of a breached password
+type breachedCorpus interface {
+	contains(hash [sha1.Size]byte) (bool, error)
+}
+
+// Init loads the breached password corpus at BREACHED_PASSWORDS_PATH, which is either
+//   - a file of upper-case hex SHA-1 hashes, one per line, optionally followed by :{count}, or
+//   - a directory of range files named by the first 5 hex digits of the hashes, e.g., 5BAA6 or 5BAA6.txt,
+//     each of them listing the rest of the hashes in the same form, which is looked up on demand
+//
+// Passwords are not checked against breaches if the variable is not set
+func Init() error {
+	path := os.Getenv("BREACHED_PASSWORDS_PATH")
+	if path == "" {
+		log.Info("BREACHED_PASSWORDS_PATH is not set, passwords are not checked against breaches")
+		return nil
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+
+	var c breachedCorpus
+	if info.IsDir() {
+		c = rangeDirectory(path)
+	} else {
+		hashes, err := loadHashes(path)
+		if err != nil {
+			return err
+		}
+		log.Info("loaded breached password corpus", "path", path, "hashes", len(hashes))
+		c = hashes
+	}
+
+	corpusLock.Lock()
+	defer corpusLock.Unlock()
+	corpus = c
+	return nil
+}
+
+// isBreached reports if the password is in the breached password corpus
+func isBreached(password string) (bool, error) {
+	corpusLock.RLock()
+	defer corpusLock.RUnlock()
+
+	if corpus == nil {
+		return false, nil
+	}
+	return corpus.contains(sha1.Sum([]byte(password)))
+}
+
+// sortedHashes is a corpus loaded in memory
+type sortedHashes [][sha1.Size]byte
+
+func (s sortedHashes) contains(hash [sha1.Size]byte) (bool, error) {
+	i := sort.Search(len(s), func(i int) bool {
+		return bytes.Compare(s[i][:], hash[:]) >= 0
+	})
+	return i < len(s) && s[i] == hash, nil
+}
+
+// loadHashes reads the file of hashes into memory
+func loadHashes(path string) (sortedHashes, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var hashes sortedHashes
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		h, ok, err := parseHashLine(scanner.Text(), "")
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %v", path, line, err)
+		}
+		if ok {
+			hashes = append(hashes, h)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	sort.Slice(hashes, func(i, j int) bool {
+		return bytes.Compare(hashes[i][:], hashes[j][:]) < 0
+	})
+	return hashes, nil
+}
+
+// rangeDirectory is a corpus split into range files by the hash prefixes
+type rangeDirectory string
+
+func (d rangeDirectory) contains(hash [sha1.Size]byte) (bool, error) {
+	hexHash := strings.ToUpper(hex.EncodeToString(hash[:]))
+	prefix := hexHash[:prefixLength]
+
+	f, err := os.Open(filepath.Join(string(d), prefix))
+	if os.IsNotExist(err) {
+		f, err = os.Open(filepath.Join(string(d), prefix+".txt"))
+	}
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		h, ok, err := parseHashLine(scanner.Text(), prefix)
+		if err != nil {
+			return false, fmt.Errorf("range file %s: %v", prefix, err)
+		}
+		if ok && h == hash {
+			return true, nil
+		}
+	}
+	return false, scanner.Err()
+}
+
+// parseHashLine parses a line of {hash}[:{count}], whose hash is the rest of the prefix.
+// ok is false for blank lines
+func parseHashLine(line, prefix string) (hash [sha1.Size]byte, ok bool, err error) {
+	line = strings.TrimSpace(line)
+	if line == "" {
+		return hash, false, nil
+	}
+	if i := strings.IndexByte(line, ':'); i >= 0 {
+		line = line[:i]
+	}
+
+	b, err := hex.DecodeString(prefix + line)
+	if err != nil || len(b) != sha1.Size {
+		return hash, false, fmt.Errorf("%q is not a SHA-1 hash", line)
+	}
+	copy(hash[:], b)
+	return hash, true, nil
+}
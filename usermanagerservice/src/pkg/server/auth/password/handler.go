@@ -0,0 +1,161 @@
+/*
+ Copyright 2021 The 110 billion Authors
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package password
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+
+	"github.com/110billion/sellfie/usermanagerservice/src/internal/apiserver"
+	"github.com/110billion/sellfie/usermanagerservice/src/internal/utils"
+	"github.com/110billion/sellfie/usermanagerservice/src/internal/wrapper"
+	"github.com/110billion/sellfie/usermanagerservice/src/pkg/server/auth/token"
+	"github.com/go-logr/logr"
+)
+
+// Response is common struct for responding password requests
+type Response struct {
+	Ok bool `json:"ok"`
+}
+
+type handler struct {
+	log logr.Logger
+}
+
+type forgotReqBody struct {
+	Email string `json:"email"`
+}
+
+type resetReqBody struct {
+	Token    string `json:"token"`
+	Password string `json:"password"`
+}
+
+type changeReqBody struct {
+	CurrentPassword string `json:"current_password"`
+	Password        string `json:"password"`
+}
+
+// NewHandler instantiates a new password api handler
+func NewHandler(parent wrapper.RouterWrapper, logger logr.Logger) (apiserver.APIHandler, error) {
+	handler := &handler{log: logger}
+
+	// /password
+	passwordWrapper := wrapper.New("/password", nil, nil)
+	if err := parent.Add(passwordWrapper); err != nil {
+		return nil, err
+	}
+
+	// /password/forgot
+	forgotWrapper := wrapper.New("/forgot", []string{http.MethodPost}, handler.forgotHandler)
+	if err := passwordWrapper.Add(forgotWrapper); err != nil {
+		return nil, err
+	}
+
+	// /password/reset
+	resetWrapper := wrapper.New("/reset", []string{http.MethodPost}, handler.resetHandler)
+	if err := passwordWrapper.Add(resetWrapper); err != nil {
+		return nil, err
+	}
+
+	// /password/change
+	changeWrapper := wrapper.New("/change", []string{http.MethodPost}, handler.changeHandler)
+	changeWrapper.Use(token.Authenticate)
+	if err := passwordWrapper.Add(changeWrapper); err != nil {
+		return nil, err
+	}
+
+	return handler, nil
+}
+
+func (h *handler) forgotHandler(w http.ResponseWriter, req *http.Request) {
+	// Decode request body
+	forgotReq := &forgotReqBody{}
+	decoder := json.NewDecoder(req.Body)
+	if err := decoder.Decode(forgotReq); err != nil || forgotReq.Email == "" {
+		_ = utils.RespondError(w, http.StatusBadRequest, "request body is not in json form or is malformed")
+		return
+	}
+
+	// The response is the same whether the email is registered or not
+	if err := RequestReset(forgotReq.Email); err != nil {
+		h.log.Error(err, "forgot password error")
+	}
+	_ = utils.RespondJSON(w, Response{Ok: true})
+}
+
+func (h *handler) resetHandler(w http.ResponseWriter, req *http.Request) {
+	// Decode request body
+	resetReq := &resetReqBody{}
+	decoder := json.NewDecoder(req.Body)
+	if err := decoder.Decode(resetReq); err != nil || resetReq.Token == "" || resetReq.Password == "" {
+		_ = utils.RespondError(w, http.StatusBadRequest, "request body is not in json form or is malformed")
+		return
+	}
+
+	_, err := Reset(resetReq.Token, resetReq.Password)
+	if err == ErrInvalidResetToken {
+		_ = utils.RespondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if policyErr, ok := err.(*PolicyError); ok {
+		_ = utils.RespondErrorDetails(w, http.StatusBadRequest, "password is not strong enough", policyErr.Violations)
+		return
+	}
+	if err != nil {
+		h.log.Error(err, "reset password error")
+		_ = utils.RespondError(w, http.StatusInternalServerError, "cannot reset password")
+		return
+	}
+
+	_ = utils.RespondJSON(w, Response{Ok: true})
+}
+
+func (h *handler) changeHandler(w http.ResponseWriter, req *http.Request) {
+	claims, _ := token.FromContext(req.Context())
+
+	// Decode request body
+	changeReq := &changeReqBody{}
+	decoder := json.NewDecoder(req.Body)
+	if err := decoder.Decode(changeReq); err != nil || changeReq.CurrentPassword == "" || changeReq.Password == "" {
+		_ = utils.RespondError(w, http.StatusBadRequest, "request body is not in json form or is malformed")
+		return
+	}
+
+	err := Change(claims.Subject, changeReq.CurrentPassword, changeReq.Password, utils.ClientIP(req))
+	if err == ErrPasswordMismatch {
+		_ = utils.RespondError(w, http.StatusUnauthorized, err.Error())
+		return
+	}
+	if throttled, ok := err.(*ThrottledError); ok {
+		w.Header().Set("Retry-After", strconv.Itoa(int(throttled.RetryAfter.Seconds())+1))
+		_ = utils.RespondError(w, http.StatusTooManyRequests, "too many failed attempts, retry later")
+		return
+	}
+	if policyErr, ok := err.(*PolicyError); ok {
+		_ = utils.RespondErrorDetails(w, http.StatusBadRequest, "password is not strong enough", policyErr.Violations)
+		return
+	}
+	if err != nil {
+		h.log.Error(err, "change password error")
+		_ = utils.RespondError(w, http.StatusInternalServerError, "cannot change password")
+		return
+	}
+
+	_ = utils.RespondJSON(w, Response{Ok: true})
+}
@@ -0,0 +1,303 @@
+/*
+ Copyright 2021 The 110 billion Authors
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package password
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"time"
+
+	"github.com/110billion/sellfie/usermanagerservice/src/internal/utils"
+	"github.com/110billion/sellfie/usermanagerservice/src/pkg/database"
+	"github.com/110billion/sellfie/usermanagerservice/src/pkg/lockout"
+	"github.com/110billion/sellfie/usermanagerservice/src/pkg/mail"
+	"github.com/110billion/sellfie/usermanagerservice/src/pkg/server/auth/token"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const defaultResetURL = "https://heychangju.shop/password/reset"
+
+var (
+	resetTokenLifetime = utils.DurationFromEnv("PASSWORD_RESET_TTL", 30*time.Minute)
+	// resetInterval is how long a user waits before another reset mail is sent
+	resetInterval = utils.DurationFromEnv("PASSWORD_RESET_INTERVAL", time.Minute)
+
+	// ErrInvalidResetToken is returned if a reset token is unknown, expired or already used
+	ErrInvalidResetToken = errors.New("reset token is invalid, expired or already used")
+	// ErrPasswordMismatch is returned if the current password given to change the password is wrong
+	ErrPasswordMismatch = errors.New("password doesn't match")
+)
+
+// ThrottledError is returned if the current password was guessed wrong too often
+type ThrottledError struct {
+	RetryAfter time.Duration
+}
+
+func (e *ThrottledError) Error() string {
+	return fmt.Sprintf("too many failed attempts, retry after %s", e.RetryAfter.Round(time.Second))
+}
+
+// RequestReset mails a reset link to the account of the email in the background.
+// Nothing is sent, without an error, if no account has the email or a link was sent moments ago,
+// so that neither the response nor its time discloses whether the email is registered
+func RequestReset(email string) error {
+	db, err := database.Connect()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	var userUUID, id string
+	err = db.QueryRow("SELECT user_uuid, user_id FROM USER_TABLE WHERE user_email = $1", email).Scan(&userUUID, &id)
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	var recent bool
+	if err := db.QueryRow("SELECT EXISTS(SELECT 1 FROM PASSWORD_RESET WHERE user_uuid = $1 AND created_at > $2)", userUUID, time.Now().Add(-resetInterval)).
+		Scan(&recent); err != nil {
+		return err
+	}
+	if recent {
+		return nil
+	}
+
+	msg, err := newResetLink(db, userUUID, id, email,
+		"If you did not ask to reset your password, ignore this mail. Your password is not changed.")
+	if err != nil {
+		return err
+	}
+	mail.SendAsync(msg)
+	return nil
+}
+
+// ForceReset requires the user to reset the password in the transaction, e.g., when it is known to be compromised.
+// The user cannot log in with the password anymore and is logged out everywhere. The handle and the email of the user are returned,
+// which are mailed a reset link by MailResetLink once the transaction commits
+func ForceReset(tx *sql.Tx, userUUID string) (string, string, error) {
+	var id, email string
+	if err := tx.QueryRow("UPDATE USER_TABLE SET password_reset_required = TRUE WHERE user_uuid = $1 RETURNING user_id, user_email", userUUID).
+		Scan(&id, &email); err != nil {
+		return "", "", err
+	}
+	return id, email, token.RevokeAllTx(tx, userUUID)
+}
+
+// MailResetLink mails a reset link to the user whose password reset is forced, regardless of how recently one was sent
+func MailResetLink(ctx context.Context, userUUID, id, email string) error {
+	db, err := database.Connect()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	msg, err := newResetLink(db, userUUID, id, email,
+		"For the security of your account, you cannot log in with your current password until you set a new one.")
+	if err != nil {
+		return err
+	}
+	return mail.Send(ctx, msg)
+}
+
+// newResetLink stores a new reset token of the user and returns the mail of the link with it to the email, ending with the note.
+// userUUID identifies the user, and id is the handle the mail greets the user by
+func newResetLink(db *sql.DB, userUUID, id, email, note string) (*mail.Message, error) {
+	resetToken, err := randomToken()
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := db.Exec("DELETE FROM PASSWORD_RESET WHERE expires_at < NOW()"); err != nil {
+		return nil, err
+	}
+	// Only the hash of the token is stored
+	now := time.Now()
+	if _, err := db.Exec("INSERT INTO PASSWORD_RESET (token_hash, user_uuid, created_at, expires_at) VALUES($1, $2, $3, $4)",
+		hashToken(resetToken), userUUID, now, now.Add(resetTokenLifetime)); err != nil {
+		return nil, err
+	}
+
+	link := os.Getenv("PASSWORD_RESET_URL")
+	if link == "" {
+		link = defaultResetURL
+	}
+	link += "?token=" + url.QueryEscape(resetToken)
+
+	return &mail.Message{
+		To:      email,
+		Subject: "Reset your Sellfie password",
+		Body: fmt.Sprintf("Hello %s,\n\nOpen the link below to set a new password. The link expires in %s.\n\n%s\n\n%s\n",
+			id, resetTokenLifetime, link, note),
+	}, nil
+}
+
+// Reset consumes the reset token and sets the password of its user. The handle of the user is returned.
+// A *PolicyError is returned, leaving the token unused, if the password breaks the password policy.
+// Every token issued to the user is revoked, logging the user out everywhere, and failed logins of the email are forgotten
+func Reset(resetToken, newPassword string) (string, error) {
+	db, err := database.Connect()
+	if err != nil {
+		return "", err
+	}
+	defer db.Close()
+
+	tx, err := db.Begin()
+	if err != nil {
+		return "", err
+	}
+	defer func() {
+		_ = tx.Rollback()
+	}()
+
+	var userUUID string
+	err = tx.QueryRow("UPDATE PASSWORD_RESET SET used_at = NOW() WHERE token_hash = $1 AND used_at IS NULL AND expires_at > NOW() RETURNING user_uuid",
+		hashToken(resetToken)).Scan(&userUUID)
+	if err == sql.ErrNoRows {
+		return "", ErrInvalidResetToken
+	}
+	if err != nil {
+		return "", err
+	}
+
+	var id, email string
+	if err := tx.QueryRow("SELECT user_id, user_email FROM USER_TABLE WHERE user_uuid = $1 FOR UPDATE", userUUID).Scan(&id, &email); err != nil {
+		return "", err
+	}
+	if err := Validate(newPassword, email, id); err != nil {
+		return "", err
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(newPassword), bcrypt.DefaultCost)
+	if err != nil {
+		return "", err
+	}
+
+	// The reset link is delivered to the email, which proves that the user owns it
+	if _, err := tx.Exec("UPDATE USER_TABLE SET password = $1, email_verified = TRUE, password_reset_required = FALSE WHERE user_uuid = $2", hash, userUUID); err != nil {
+		return "", err
+	}
+	// The other links of the user are of no use anymore
+	if _, err := tx.Exec("UPDATE PASSWORD_RESET SET used_at = NOW() WHERE user_uuid = $1 AND used_at IS NULL", userUUID); err != nil {
+		return "", err
+	}
+	if err := token.RevokeAllTx(tx, userUUID); err != nil {
+		return "", err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return "", err
+	}
+	// The owner of the email may log in again right away, even if the account is locked out.
+	// The password is reset anyway if it fails, in which case the lockout just runs out
+	if err := lockout.Unlock(email); err != nil {
+		log.Error(err, "cannot unlock the account after its password is reset", "id", id)
+	}
+	return id, nil
+}
+
+// Change sets the password of the user, who must know the current one.
+// Wrong current passwords count as failed logins from the IP address, and a *ThrottledError is returned after too many of them.
+// A *PolicyError is returned if the new password breaks the password policy.
+// Every token issued to the user is revoked, including the one of the request, so that the user logs in with the new password
+func Change(userUUID, currentPassword, newPassword, ip string) error {
+	db, err := database.Connect()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	var current, email, id string
+	if err := db.QueryRow("SELECT password, user_email, user_id FROM USER_TABLE WHERE user_uuid = $1", userUUID).Scan(&current, &email, &id); err != nil {
+		return err
+	}
+	// Accounts created by social login do not have a password. Their users set one by resetting it
+	if current == "" {
+		return ErrPasswordMismatch
+	}
+
+	// A stolen token must not be enough to guess the password, which would take the account over
+	wait, err := lockout.CheckLogin(email, ip)
+	if err != nil {
+		return err
+	}
+	if wait > 0 {
+		return &ThrottledError{RetryAfter: wait}
+	}
+	if bcrypt.CompareHashAndPassword([]byte(current), []byte(currentPassword)) != nil {
+		if err := lockout.FailLogin(email, ip); err != nil {
+			return err
+		}
+		return ErrPasswordMismatch
+	}
+	if err := lockout.Unlock(email); err != nil {
+		log.Error(err, "cannot forget the failed logins after the password matches", "id", id)
+	}
+	if err := Validate(newPassword, email, id); err != nil {
+		return err
+	}
+
+	hash, err := bcrypt.GenerateFromPassword([]byte(newPassword), bcrypt.DefaultCost)
+	if err != nil {
+		return err
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = tx.Rollback()
+	}()
+
+	// The password is compared again, so that concurrent changes do not overwrite each other
+	result, err := tx.Exec("UPDATE USER_TABLE SET password = $1 WHERE user_uuid = $2 AND password = $3", hash, userUUID, current)
+	if err != nil {
+		return err
+	}
+	if n, err := result.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return ErrPasswordMismatch
+	}
+	if err := token.RevokeAllTx(tx, userUUID); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func randomToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+func hashToken(t string) string {
+	sum := sha256.Sum256([]byte(t))
+	return hex.EncodeToString(sum[:])
+}
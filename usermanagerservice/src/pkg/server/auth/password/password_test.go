@@ -0,0 +1,221 @@
+/*
+ Copyright 2021 The 110 billion Authors
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package password
+
+import (
+	"database/sql"
+	"errors"
+	"net/url"
+	"os"
+	"regexp"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/110billion/sellfie/usermanagerservice/src/pkg/database"
+	"github.com/110billion/sellfie/usermanagerservice/src/pkg/lockout"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	testCurrentPassword = "correct-horse-battery-staple-42"
+	testNewPassword     = "purple-elephant-juggles-moon-77"
+)
+
+var resetTokenPattern = regexp.MustCompile(`token=(\S+)`)
+
+// TestReset resets the password with a mailed link, against the database at DB_HOST
+func TestReset(t *testing.T) {
+	userUUID, id, email := createTestUser(t)
+	db, err := database.Connect()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	msg, err := newResetLink(db, userUUID, id, email, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	match := resetTokenPattern.FindStringSubmatch(msg.Body)
+	if match == nil {
+		t.Fatalf("no reset link in %q", msg.Body)
+	}
+	resetToken, err := url.QueryUnescape(match[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The token is kept for another try if the password is refused
+	var policyErr *PolicyError
+	if _, err := Reset(resetToken, "short"); !errors.As(err, &policyErr) {
+		t.Fatalf("want a policy error, got %v", err)
+	}
+
+	got, err := Reset(resetToken, testNewPassword)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != id {
+		t.Fatalf("want id %s, got %s", id, got)
+	}
+	checkPassword(t, db, userUUID, testNewPassword)
+	checkRevoked(t, db, userUUID)
+
+	if _, err := Reset(resetToken, testNewPassword); err != ErrInvalidResetToken {
+		t.Fatalf("want %v on reusing the token, got %v", ErrInvalidResetToken, err)
+	}
+}
+
+// TestResetExpired refuses a reset token which expired, against the database at DB_HOST
+func TestResetExpired(t *testing.T) {
+	userUUID, id, email := createTestUser(t)
+	db, err := database.Connect()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	msg, err := newResetLink(db, userUUID, id, email, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resetToken, err := url.QueryUnescape(resetTokenPattern.FindStringSubmatch(msg.Body)[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Exec("UPDATE PASSWORD_RESET SET expires_at = NOW() - INTERVAL '1 second' WHERE user_uuid = $1", userUUID); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := Reset(resetToken, testNewPassword); err != ErrInvalidResetToken {
+		t.Fatalf("want %v, got %v", ErrInvalidResetToken, err)
+	}
+	checkPassword(t, db, userUUID, testCurrentPassword)
+}
+
+// TestChange changes the password with the current one, against the database at DB_HOST.
+// Wrong current passwords are throttled as failed logins
+func TestChange(t *testing.T) {
+	userUUID, _, _ := createTestUser(t)
+	db, err := database.Connect()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	lockout.SetStore(lockout.NewMemoryStore())
+	const ip = "192.0.2.1"
+	var throttled *ThrottledError
+	for i := 0; i < 10 && throttled == nil; i++ {
+		err := Change(userUUID, "wrong-password", testNewPassword, ip)
+		if !errors.As(err, &throttled) && err != ErrPasswordMismatch {
+			t.Fatalf("want %v, got %v", ErrPasswordMismatch, err)
+		}
+	}
+	if throttled == nil || throttled.RetryAfter <= 0 {
+		t.Fatal("wrong current passwords are not throttled")
+	}
+	// Even the right password waits
+	if err := Change(userUUID, testCurrentPassword, testNewPassword, ip); !errors.As(err, &throttled) {
+		t.Fatalf("want a throttled error, got %v", err)
+	}
+	checkPassword(t, db, userUUID, testCurrentPassword)
+
+	lockout.SetStore(lockout.NewMemoryStore())
+	var policyErr *PolicyError
+	if err := Change(userUUID, testCurrentPassword, "short", ip); !errors.As(err, &policyErr) {
+		t.Fatalf("want a policy error, got %v", err)
+	}
+	if err := Change(userUUID, testCurrentPassword, testNewPassword, ip); err != nil {
+		t.Fatal(err)
+	}
+	checkPassword(t, db, userUUID, testNewPassword)
+	checkRevoked(t, db, userUUID)
+}
+
+// createTestUser creates a user with testCurrentPassword in the database at DB_HOST, deleted with the records of the user after the test,
+// and returns the user_uuid, the handle and the email of the user. The test is skipped without the database
+func createTestUser(t *testing.T) (string, string, string) {
+	if os.Getenv("DB_HOST") == "" {
+		t.Skip("DB_HOST is not set")
+	}
+	if err := database.Migrate(); err != nil {
+		t.Fatal(err)
+	}
+
+	db, err := database.Connect()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	hash, err := bcrypt.GenerateFromPassword([]byte(testCurrentPassword), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id := "password_" + strconv.FormatInt(time.Now().UnixNano()%1e12, 36)
+	email := id + "@example.com"
+	var userUUID string
+	if err := db.QueryRow("INSERT INTO USER_TABLE (user_email, name, password, user_id) VALUES($1, 'Password', $2, $3) RETURNING user_uuid",
+		email, string(hash), id).Scan(&userUUID); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() {
+		db, err := database.Connect()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer db.Close()
+
+		for _, stmt := range []string{
+			"DELETE FROM PASSWORD_RESET WHERE user_uuid = $1",
+			"DELETE FROM USER_REVOCATION WHERE user_uuid = $1",
+			"DELETE FROM USER_TABLE WHERE user_uuid = $1",
+		} {
+			if _, err := db.Exec(stmt, userUUID); err != nil {
+				t.Error(err)
+			}
+		}
+	})
+	return userUUID, id, email
+}
+
+func checkPassword(t *testing.T, db *sql.DB, userUUID, want string) {
+	t.Helper()
+	var hash string
+	if err := db.QueryRow("SELECT password FROM USER_TABLE WHERE user_uuid = $1", userUUID).Scan(&hash); err != nil {
+		t.Fatal(err)
+	}
+	if bcrypt.CompareHashAndPassword([]byte(hash), []byte(want)) != nil {
+		t.Fatalf("the password is not %q", want)
+	}
+}
+
+// checkRevoked checks that the tokens issued to the user so far are revoked
+func checkRevoked(t *testing.T, db *sql.DB, userUUID string) {
+	t.Helper()
+	var revoked bool
+	if err := db.QueryRow("SELECT EXISTS(SELECT 1 FROM USER_REVOCATION WHERE user_uuid = $1)", userUUID).Scan(&revoked); err != nil {
+		t.Fatal(err)
+	}
+	if !revoked {
+		t.Fatal("the tokens of the user are not revoked")
+	}
+}
@@ -0,0 +1,156 @@
+/*
+ Copyright 2021 The 110 billion Authors
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package password
+
+import (
+	"fmt"
+	"math"
+	"strings"
+	"unicode"
+
+	"github.com/110billion/sellfie/usermanagerservice/src/internal/utils"
+)
+
+// Rules of the password policy, reported in the details of a rejected password
+const (
+	RuleMinLength     = "min_length"
+	RuleMaxLength     = "max_length"
+	RuleEntropy       = "entropy"
+	RuleContainsEmail = "contains_email"
+	RuleContainsID    = "contains_id"
+	RuleBreached      = "breached"
+)
+
+// maxLength is the limit of bcrypt, which ignores or refuses the bytes after it
+const maxLength = 72
+
+var (
+	minLength = utils.IntFromEnv("PASSWORD_MIN_LENGTH", 10)
+	// minEntropy is the least estimated entropy of a password, in bits
+	minEntropy = utils.IntFromEnv("PASSWORD_MIN_ENTROPY", 40)
+)
+
+// PolicyError is returned if a password breaks the rules of the password policy
+type PolicyError struct {
+	Violations []utils.ErrorDetail
+}
+
+// Error lists the rules the password breaks
+func (e *PolicyError) Error() string {
+	rules := make([]string, 0, len(e.Violations))
+	for _, v := range e.Violations {
+		rules = append(rules, v.Rule)
+	}
+	return "password breaks the rules " + strings.Join(rules, ", ")
+}
+
+// Validate checks the password of the user of the email and id against the password policy.
+// A *PolicyError lists every rule the password breaks. Other errors are failures of the breached password check
+func Validate(password, email, id string) error {
+	var violations []utils.ErrorDetail
+	violate := func(rule, format string, args ...interface{}) {
+		violations = append(violations, utils.ErrorDetail{Field: "password", Rule: rule, Message: fmt.Sprintf(format, args...)})
+	}
+
+	if len([]rune(password)) < minLength {
+		violate(RuleMinLength, "password must be at least %d characters long", minLength)
+	}
+	if len(password) > maxLength {
+		violate(RuleMaxLength, "password must be at most %d bytes long", maxLength)
+	}
+	if estimateEntropy(password) < float64(minEntropy) {
+		violate(RuleEntropy, "password is too easy to guess, use a longer one or more kinds of characters")
+	}
+
+	lower := strings.ToLower(password)
+	if containsIdentifier(lower, email) || containsIdentifier(lower, strings.SplitN(email, "@", 2)[0]) {
+		violate(RuleContainsEmail, "password must not contain the email")
+	}
+	if containsIdentifier(lower, id) {
+		violate(RuleContainsID, "password must not contain the id")
+	}
+
+	breached, err := isBreached(password)
+	if err != nil {
+		return err
+	}
+	if breached {
+		violate(RuleBreached, "password appeared in a data breach, choose another one")
+	}
+
+	if len(violations) > 0 {
+		return &PolicyError{Violations: violations}
+	}
+	return nil
+}
+
+// containsIdentifier reports if the lower-cased password contains the identifier.
+// Identifiers shorter than 3 characters are too likely to appear by chance
+func containsIdentifier(lowerPassword, identifier string) bool {
+	identifier = strings.ToLower(strings.TrimSpace(identifier))
+	return len([]rune(identifier)) >= 3 && strings.Contains(lowerPassword, identifier)
+}
+
+// estimateEntropy roughly estimates the entropy of the password in bits,
+// as if its characters were drawn at random from the kinds of characters it has.
+// Repeated and sequential characters, e.g., aaa, abab or 1234, count for little
+func estimateEntropy(password string) float64 {
+	var hasLower, hasUpper, hasDigit, hasSymbol, hasOther bool
+	runes := []rune(password)
+	for _, r := range runes {
+		switch {
+		case r >= 'a' && r <= 'z':
+			hasLower = true
+		case r >= 'A' && r <= 'Z':
+			hasUpper = true
+		case r >= '0' && r <= '9':
+			hasDigit = true
+		case r < unicode.MaxASCII:
+			hasSymbol = true
+		default:
+			hasOther = true
+		}
+	}
+
+	pool := 0
+	for _, kind := range []struct {
+		has  bool
+		size int
+	}{{hasLower, 26}, {hasUpper, 26}, {hasDigit, 10}, {hasSymbol, 33}, {hasOther, 100}} {
+		if kind.has {
+			pool += kind.size
+		}
+	}
+	if pool == 0 {
+		return 0
+	}
+
+	var length float64
+	seen := map[rune]bool{}
+	for i, r := range runes {
+		switch {
+		case i > 0 && (r == runes[i-1] || r == runes[i-1]+1 || r == runes[i-1]-1):
+			length += 0.25
+		case seen[r]:
+			length += 0.5
+		default:
+			length++
+		}
+		seen[r] = true
+	}
+	return length * math.Log2(float64(pool))
+}
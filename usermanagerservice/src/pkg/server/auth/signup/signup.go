@@ -17,18 +17,35 @@
 package signup
 
 import (
-	"database/sql"
 	"encoding/json"
+	"errors"
 	"github.com/110billion/sellfie/usermanagerservice/src/internal/apiserver"
 	"github.com/110billion/sellfie/usermanagerservice/src/internal/utils"
 	"github.com/110billion/sellfie/usermanagerservice/src/internal/wrapper"
 	"github.com/110billion/sellfie/usermanagerservice/src/pkg/database"
+	"github.com/110billion/sellfie/usermanagerservice/src/pkg/handle"
+	"github.com/110billion/sellfie/usermanagerservice/src/pkg/server/auth/password"
+	"github.com/110billion/sellfie/usermanagerservice/src/pkg/server/auth/verify"
 	"github.com/go-logr/logr"
 	_ "github.com/lib/pq"
 	"golang.org/x/crypto/bcrypt"
 	"net/http"
 )
 
+var (
+	// ErrEmailTaken is returned if the email belongs to another account
+	ErrEmailTaken = errors.New("already existing email")
+	// ErrIDTaken is returned if the id belongs to another account
+	ErrIDTaken = errors.New("already existing id")
+)
+
+// Response is common struct for responding signup request
+type Response struct {
+	Ok bool `json:"ok"`
+	// EmailVerified is false until the user opens the link of the verification mail
+	EmailVerified bool `json:"email_verified"`
+}
+
 type handler struct {
 	log logr.Logger
 }
@@ -38,7 +55,6 @@ type signUpReqBody struct {
 	Name     string `json:"name"`
 	Id       string `json:"id"`
 	Password string `json:"password"`
-	Salt     string `json:"salt"`
 }
 
 // NewHandler instantiates a new signup api handler
@@ -69,49 +85,87 @@ func (h *handler) signUpHandler(w http.ResponseWriter, req *http.Request) {
 		return
 	}
 
-	// Open DB
-	db, err := database.Connect()
-	if err != nil {
+	if err := password.Validate(signUpReq.Password, signUpReq.Email, signUpReq.Id); err != nil {
+		if policyErr, ok := err.(*password.PolicyError); ok {
+			_ = utils.RespondErrorDetails(w, http.StatusBadRequest, "password is not strong enough", policyErr.Violations)
+			return
+		}
 		h.log.Error(err, "signup error")
-		_ = utils.RespondError(w, http.StatusBadRequest, "db connection error")
+		_ = utils.RespondError(w, http.StatusInternalServerError, "cannot check password")
 		return
 	}
-	defer db.Close()
 
-	var email string
-	if err = db.QueryRow("SELECT user_email FROM USER_TABLE WHERE user_email = $1", signUpReq.Email).Scan(&email); err != sql.ErrNoRows {
+	hash, err := bcrypt.GenerateFromPassword([]byte(signUpReq.Password), bcrypt.DefaultCost)
+	if err != nil {
 		h.log.Error(err, "signup error")
-		_ = utils.RespondError(w, http.StatusBadRequest, "already existing email")
+		_ = utils.RespondError(w, http.StatusInternalServerError, "user registration error")
 		return
 	}
 
-	var id string
-	if err = db.QueryRow("SELECT user_id FROM USER_TABLE WHERE user_id = $1", signUpReq.Id).Scan(&id); err != sql.ErrNoRows {
+	userUUID, err := createUser(signUpReq, hash)
+	switch err {
+	case nil:
+	case ErrEmailTaken, ErrIDTaken:
+		_ = utils.RespondError(w, http.StatusConflict, err.Error())
+		return
+	default:
 		h.log.Error(err, "signup error")
-		_ = utils.RespondError(w, http.StatusBadRequest, "already existing id")
+		_ = utils.RespondError(w, http.StatusInternalServerError, "user registration error")
 		return
 	}
 
-	password, _ := bcrypt.GenerateFromPassword([]byte(signUpReq.Password), bcrypt.DefaultCost)
+	// The account is created even if the mail is not sent, as the user can ask it to be sent again
+	if err := verify.SendVerification(req.Context(), userUUID, signUpReq.Id, signUpReq.Email); err != nil {
+		h.log.Error(err, "signup error", "id", signUpReq.Id)
+	}
+	_ = utils.RespondJSON(w, Response{Ok: true, EmailVerified: false})
+}
 
-	// Insert User
-	result, err := db.Exec("INSERT INTO USER_TABLE VALUES($1, $2, $3, $4)", signUpReq.Email, signUpReq.Name, password, signUpReq.Id)
+// createUser inserts the user, whose email is not verified yet, and its info in a transaction, and returns the user_uuid of the user.
+// Concurrent signups with the same email or id are told apart by the unique constraints, not by checking beforehand
+func createUser(signUpReq *signUpReqBody, hash []byte) (string, error) {
+	db, err := database.Connect()
 	if err != nil {
-		h.log.Error(err, "signup error")
-		_ = utils.RespondError(w, http.StatusBadRequest, "user registration error")
-		return
+		return "", err
 	}
+	defer db.Close()
 
-	// Insert UserInfo
-	result, err = db.Exec("INSERT INTO USER_INFO VALUES($1, '',$2)", signUpReq.Id, signUpReq.Name)
+	tx, err := db.Begin()
 	if err != nil {
-		h.log.Error(err, "signup error")
-		_ = utils.RespondError(w, http.StatusBadRequest, "user registration error")
-		return
+		return "", err
+	}
+	defer func() {
+		_ = tx.Rollback()
+	}()
+
+	// Reserved handles and old handles still redirecting to another user are taken as well
+	available, err := handle.Available(tx, signUpReq.Id, "")
+	if err != nil {
+		return "", err
 	}
+	if !available {
+		return "", ErrIDTaken
+	}
+
+	var userUUID string
+	if err := tx.QueryRow("INSERT INTO USER_TABLE (user_email, name, password, user_id, email_verified) VALUES($1, $2, $3, $4, FALSE) RETURNING user_uuid",
+		signUpReq.Email, signUpReq.Name, hash, signUpReq.Id).Scan(&userUUID); err != nil {
+		return "", constraintError(err)
+	}
+	if _, err := tx.Exec("INSERT INTO USER_INFO VALUES($1, '',$2)", signUpReq.Id, signUpReq.Name); err != nil {
+		return "", constraintError(err)
+	}
+
+	return userUUID, constraintError(tx.Commit())
+}
 
-	n, err := result.RowsAffected()
-	if n == 1 {
-		_ = utils.RespondJSON(w, struct{}{})
+// constraintError maps the violation of a unique constraint to the error telling what is taken
+func constraintError(err error) error {
+	switch {
+	case database.UserEmailKey.Violated(err):
+		return ErrEmailTaken
+	case database.UserIDKey.Violated(err), database.UserInfoKey.Violated(err):
+		return ErrIDTaken
 	}
+	return err
 }
@@ -0,0 +1,159 @@
+/*
+ Copyright 2021 The 110 billion Authors
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package signup
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/110billion/sellfie/usermanagerservice/src/pkg/database"
+	"github.com/110billion/sellfie/usermanagerservice/src/pkg/mail"
+	"github.com/go-logr/logr"
+	"github.com/lib/pq"
+)
+
+const (
+	concurrentSignUps = 8
+	testPassword      = "correct-horse-battery-staple-42"
+)
+
+// TestSignUpConcurrent signs up at once with the same id or the same email, against the database at DB_HOST.
+// Exactly one of the signups succeeds, and the others are told the id or the email is taken
+func TestSignUpConcurrent(t *testing.T) {
+	if os.Getenv("DB_HOST") == "" {
+		t.Skip("DB_HOST is not set")
+	}
+	if err := database.Migrate(); err != nil {
+		t.Fatal(err)
+	}
+	mail.SetSender(&mail.OutboxSender{Dir: t.TempDir()})
+
+	suffix := strconv.FormatInt(time.Now().UnixNano()%1e9, 36)
+	tests := map[string]func(i int) signUpReqBody{
+		"same id": func(i int) signUpReqBody {
+			return signUpReqBody{Email: fmt.Sprintf("id%d_%s@example.com", i, suffix), Name: "Signup", Id: "id_" + suffix, Password: testPassword}
+		},
+		"same email": func(i int) signUpReqBody {
+			return signUpReqBody{Email: "email_" + suffix + "@example.com", Name: "Signup", Id: fmt.Sprintf("email%d_%s", i, suffix), Password: testPassword}
+		},
+	}
+
+	h := &handler{log: logr.Discard()}
+	for name, body := range tests {
+		t.Run(name, func(t *testing.T) {
+			bodies := make([]signUpReqBody, concurrentSignUps)
+			for i := range bodies {
+				bodies[i] = body(i)
+			}
+			t.Cleanup(func() { deleteUsers(t, bodies) })
+
+			codes := make([]int, concurrentSignUps)
+			start := make(chan struct{})
+			wg := sync.WaitGroup{}
+			for i := range bodies {
+				wg.Add(1)
+				go func(i int) {
+					defer wg.Done()
+					b, _ := json.Marshal(bodies[i])
+					req := httptest.NewRequest(http.MethodPost, "/signup", bytes.NewReader(b))
+					w := httptest.NewRecorder()
+					<-start
+					h.signUpHandler(w, req)
+					codes[i] = w.Code
+				}(i)
+			}
+			close(start)
+			wg.Wait()
+
+			created, conflicts := 0, 0
+			for _, code := range codes {
+				switch code {
+				case http.StatusOK:
+					created++
+				case http.StatusConflict:
+					conflicts++
+				}
+			}
+			if created != 1 || conflicts != concurrentSignUps-1 {
+				t.Fatalf("want 1 signup and %d conflicts, got %v", concurrentSignUps-1, codes)
+			}
+		})
+	}
+}
+
+func TestConstraintError(t *testing.T) {
+	otherViolation := &pq.Error{Code: "23505", Table: "email_verification", Constraint: "email_verification_pkey", Detail: "Key (jti)=(a) already exists."}
+	other := errors.New("connection refused")
+	tests := map[string]struct {
+		err  error
+		want error
+	}{
+		"email taken": {
+			err:  &pq.Error{Code: "23505", Table: "user_table", Constraint: "user_table_email_key"},
+			want: ErrEmailTaken,
+		},
+		"id taken": {
+			err:  &pq.Error{Code: "23505", Table: "user_table", Constraint: "user_table_pkey", Detail: "Key (user_id)=(jane) already exists."},
+			want: ErrIDTaken,
+		},
+		"profile taken": {
+			err:  &pq.Error{Code: "23505", Table: "user_info", Constraint: "user_info_pkey", Detail: "Key (user_id)=(jane) already exists."},
+			want: ErrIDTaken,
+		},
+		"other violation": {err: otherViolation, want: otherViolation},
+		"other error":     {err: other, want: other},
+		"no error":        {},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			if got := constraintError(tc.err); got != tc.want {
+				t.Fatalf("want %v, got %v", tc.want, got)
+			}
+		})
+	}
+}
+
+func deleteUsers(t *testing.T, bodies []signUpReqBody) {
+	db, err := database.Connect()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer db.Close()
+
+	for _, b := range bodies {
+		for _, stmt := range []string{
+			"DELETE FROM EMAIL_VERIFICATION WHERE user_uuid = (SELECT user_uuid FROM USER_TABLE WHERE user_id = $1)",
+			"DELETE FROM USER_INFO WHERE user_id = $1",
+			"DELETE FROM USER_TABLE WHERE user_id = $1",
+		} {
+			if _, err := db.Exec(stmt, b.Id); err != nil {
+				t.Error(err)
+			}
+		}
+	}
+}
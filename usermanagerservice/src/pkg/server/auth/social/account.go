@@ -0,0 +1,327 @@
+/*
+ Copyright 2021 The 110 billion Authors
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package social
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"errors"
+	"fmt"
+	"math/big"
+	"strings"
+	"time"
+
+	"github.com/110billion/sellfie/usermanagerservice/src/pkg/database"
+	"github.com/110billion/sellfie/usermanagerservice/src/pkg/handle"
+)
+
+const (
+	maxUserIDLength = 20
+	// userIDAttempts is how many random suffixes are tried until an unused user id is found
+	userIDAttempts = 10
+)
+
+var (
+	// ErrEmailRegistered is returned if the email of a new external identity already belongs to an account.
+	// The identity should be linked to the account by its owner instead
+	ErrEmailRegistered = errors.New("email is already registered, log in and link the account instead")
+	// ErrNoEmail is returned if the provider does not share the email of the user
+	ErrNoEmail = errors.New("provider does not share the email")
+	// ErrEmailNotVerified is returned if the provider does not vouch for the email of the user
+	ErrEmailNotVerified = errors.New("email is not verified by the provider")
+	// ErrIdentityLinked is returned if the external identity to link is already linked to another account
+	ErrIdentityLinked = errors.New("identity is linked to another account")
+	// ErrProviderLinked is returned if the account already has an identity of the provider
+	ErrProviderLinked = errors.New("an identity of the provider is already linked")
+	// ErrIdentityNotLinked is returned if the account does not have an identity of the provider
+	ErrIdentityNotLinked = errors.New("no identity of the provider is linked")
+	// ErrLastLoginMethod is returned on unlinking the only identity of an account without a password,
+	// which would leave the account without a way to log in
+	ErrLastLoginMethod = errors.New("cannot unlink the last login method, set a password or link another identity first")
+
+	// errUserIDTaken is returned if the user id of a new account is taken by a concurrent signup since it was found unused
+	errUserIDTaken = errors.New("user id is taken")
+)
+
+// Account is a sellfie account an external identity is signed in to.
+// ID is the handle of the account, and UUID identifies it
+type Account struct {
+	ID    string
+	UUID  string
+	Email string
+}
+
+// upsertAccount returns the account the external identity is linked to, creating the account on the first login
+func upsertAccount(provider string, user *User) (*Account, error) {
+	db, err := database.Connect()
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+
+	for i := 0; ; i++ {
+		account, err := upsertAccountTx(db, provider, user)
+		// The account is created again with another user id
+		if err == errUserIDTaken && i < userIDAttempts {
+			continue
+		}
+		return account, err
+	}
+}
+
+// upsertAccountTx returns the account the external identity is linked to, creating the account in a transaction on the first login
+func upsertAccountTx(db *sql.DB, provider string, user *User) (*Account, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = tx.Rollback()
+	}()
+
+	account := &Account{}
+	err = tx.QueryRow(`SELECT u.user_id, u.user_uuid, u.user_email FROM USER_IDENTITY i JOIN USER_TABLE u ON u.user_uuid = i.user_uuid
+		WHERE i.provider = $1 AND i.subject = $2`, provider, user.ID).Scan(&account.ID, &account.UUID, &account.Email)
+	if err == nil {
+		return account, nil
+	}
+	if err != sql.ErrNoRows {
+		return nil, err
+	}
+
+	if user.Email == "" {
+		return nil, ErrNoEmail
+	}
+
+	var registered bool
+	if err := tx.QueryRow("SELECT EXISTS(SELECT 1 FROM USER_TABLE WHERE user_email = $1)", user.Email).Scan(&registered); err != nil {
+		return nil, err
+	}
+	if registered {
+		return nil, ErrEmailRegistered
+	}
+
+	id, err := newUserID(tx, user)
+	if err != nil {
+		return nil, err
+	}
+
+	name := user.Name
+	if name == "" {
+		name = id
+	}
+
+	// Accounts created by social login do not have a password.
+	// The email is verified only if the provider vouches for it, as it is trusted, e.g., to reset the password
+	var userUUID string
+	if err := tx.QueryRow("INSERT INTO USER_TABLE (user_email, name, password, user_id, email_verified) VALUES($1, $2, '', $3, $4) RETURNING user_uuid",
+		user.Email, name, id, user.EmailVerified).Scan(&userUUID); err != nil {
+		// The email or the user id is taken by a concurrent signup since it was checked
+		switch {
+		case database.UserEmailKey.Violated(err):
+			return nil, ErrEmailRegistered
+		case database.UserIDKey.Violated(err):
+			return nil, errUserIDTaken
+		}
+		return nil, err
+	}
+	if _, err := tx.Exec("INSERT INTO USER_INFO VALUES($1, '',$2)", id, name); err != nil {
+		if database.UserInfoKey.Violated(err) {
+			return nil, errUserIDTaken
+		}
+		return nil, err
+	}
+	if _, err := tx.Exec("INSERT INTO USER_IDENTITY (provider, subject, user_uuid, email, created_at) VALUES($1, $2, $3, $4, NOW())",
+		provider, user.ID, userUUID, user.Email); err != nil {
+		return nil, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return &Account{ID: id, UUID: userUUID, Email: user.Email}, nil
+}
+
+// Identity is an external identity linked to an account
+type Identity struct {
+	Provider  string    `json:"provider"`
+	Email     string    `json:"email"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// listIdentities returns the identities linked to the account, and whether the account has a password
+func listIdentities(userUUID string) ([]Identity, bool, error) {
+	db, err := database.Connect()
+	if err != nil {
+		return nil, false, err
+	}
+	defer db.Close()
+
+	var password string
+	if err := db.QueryRow("SELECT password FROM USER_TABLE WHERE user_uuid = $1", userUUID).Scan(&password); err != nil {
+		return nil, false, err
+	}
+
+	rows, err := db.Query("SELECT provider, email, created_at FROM USER_IDENTITY WHERE user_uuid = $1 ORDER BY created_at", userUUID)
+	if err != nil {
+		return nil, false, err
+	}
+	defer rows.Close()
+
+	identities := []Identity{}
+	for rows.Next() {
+		identity := Identity{}
+		if err := rows.Scan(&identity.Provider, &identity.Email, &identity.CreatedAt); err != nil {
+			return nil, false, err
+		}
+		identities = append(identities, identity)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, false, err
+	}
+	return identities, password != "", nil
+}
+
+// linkIdentity links the external identity to the account. Linking an identity already linked to the account is a no-op
+func linkIdentity(provider, userUUID string, user *User) error {
+	db, err := database.Connect()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = tx.Rollback()
+	}()
+
+	// Locking the account serializes linking and unlinking its identities
+	var locked string
+	if err := tx.QueryRow("SELECT user_uuid FROM USER_TABLE WHERE user_uuid = $1 FOR UPDATE", userUUID).Scan(&locked); err != nil {
+		return err
+	}
+
+	var linkedUserUUID string
+	err = tx.QueryRow("SELECT user_uuid FROM USER_IDENTITY WHERE provider = $1 AND subject = $2", provider, user.ID).Scan(&linkedUserUUID)
+	if err == nil {
+		if linkedUserUUID != userUUID {
+			return ErrIdentityLinked
+		}
+		return nil
+	}
+	if err != sql.ErrNoRows {
+		return err
+	}
+
+	var linked bool
+	if err := tx.QueryRow("SELECT EXISTS(SELECT 1 FROM USER_IDENTITY WHERE user_uuid = $1 AND provider = $2)", userUUID, provider).Scan(&linked); err != nil {
+		return err
+	}
+	if linked {
+		return ErrProviderLinked
+	}
+
+	if _, err := tx.Exec("INSERT INTO USER_IDENTITY (provider, subject, user_uuid, email, created_at) VALUES($1, $2, $3, $4, NOW())",
+		provider, user.ID, userUUID, user.Email); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// unlinkIdentity unlinks the identity of the provider from the account.
+// The account must keep a way to log in, i.e., a password or another identity
+func unlinkIdentity(provider, userUUID string) error {
+	db, err := database.Connect()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = tx.Rollback()
+	}()
+
+	var password string
+	if err := tx.QueryRow("SELECT password FROM USER_TABLE WHERE user_uuid = $1 FOR UPDATE", userUUID).Scan(&password); err != nil {
+		return err
+	}
+
+	var linked, others int
+	if err := tx.QueryRow("SELECT COUNT(*) FILTER (WHERE provider = $2), COUNT(*) FILTER (WHERE provider <> $2) FROM USER_IDENTITY WHERE user_uuid = $1",
+		userUUID, provider).Scan(&linked, &others); err != nil {
+		return err
+	}
+	if linked == 0 {
+		return ErrIdentityNotLinked
+	}
+	if password == "" && others == 0 {
+		return ErrLastLoginMethod
+	}
+
+	if _, err := tx.Exec("DELETE FROM USER_IDENTITY WHERE user_uuid = $1 AND provider = $2", userUUID, provider); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// newUserID derives an unused user id from the email, appending a random number if the id is taken
+func newUserID(tx *sql.Tx, user *User) (string, error) {
+	base := sanitizeUserID(strings.SplitN(user.Email, "@", 2)[0])
+	// Handles are at least 3 characters long
+	if len(base) < 3 {
+		base = "user" + base
+	}
+
+	candidate := base
+	for i := 0; i < userIDAttempts; i++ {
+		available, err := handle.Available(tx, candidate, "")
+		if err != nil {
+			return "", err
+		}
+		if available {
+			return candidate, nil
+		}
+
+		n, err := rand.Int(rand.Reader, big.NewInt(10000))
+		if err != nil {
+			return "", err
+		}
+		candidate = fmt.Sprintf("%s%04d", base, n.Int64())
+	}
+	return "", fmt.Errorf("cannot find an unused user id for %s", base)
+}
+
+// sanitizeUserID keeps lower case letters, digits and underscores of s
+func sanitizeUserID(s string) string {
+	b := strings.Builder{}
+	for _, r := range strings.ToLower(s) {
+		if (r >= 'a' && r <= 'z') || (r >= '0' && r <= '9') || r == '_' {
+			b.WriteRune(r)
+		}
+		if b.Len() == maxUserIDLength-4 {
+			break
+		}
+	}
+	return b.String()
+}
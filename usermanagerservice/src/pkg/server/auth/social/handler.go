@@ -0,0 +1,62 @@
+/*
+ Copyright 2021 The 110 billion Authors
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package social
+
+import (
+	"net/http"
+
+	"github.com/110billion/sellfie/usermanagerservice/src/internal/apiserver"
+	"github.com/110billion/sellfie/usermanagerservice/src/internal/wrapper"
+	"github.com/go-logr/logr"
+)
+
+type handler struct {
+	log logr.Logger
+}
+
+// NewHandler instantiates a new social login api handler, mounting the routes of every registered provider
+func NewHandler(parent wrapper.RouterWrapper, logger logr.Logger) (apiserver.APIHandler, error) {
+	handler := &handler{log: logger}
+
+	for _, provider := range Providers() {
+		p := provider
+
+		// /{provider}
+		providerWrapper := wrapper.New("/"+p.Name(), nil, nil)
+		if err := parent.Add(providerWrapper); err != nil {
+			return nil, err
+		}
+
+		// /{provider}/login
+		loginWrapper := wrapper.New("/login", nil, func(w http.ResponseWriter, r *http.Request) {
+			Login(w, r, p)
+		})
+		if err := providerWrapper.Add(loginWrapper); err != nil {
+			return nil, err
+		}
+
+		// /{provider}/callback
+		callbackWrapper := wrapper.New("/callback", nil, func(w http.ResponseWriter, r *http.Request) {
+			Callback(w, r, p)
+		})
+		if err := providerWrapper.Add(callbackWrapper); err != nil {
+			return nil, err
+		}
+	}
+
+	return handler, nil
+}
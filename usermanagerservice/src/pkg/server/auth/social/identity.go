@@ -0,0 +1,206 @@
+/*
+ Copyright 2021 The 110 billion Authors
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package social
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"strconv"
+
+	"github.com/110billion/sellfie/usermanagerservice/src/internal/apiserver"
+	"github.com/110billion/sellfie/usermanagerservice/src/internal/utils"
+	"github.com/110billion/sellfie/usermanagerservice/src/internal/wrapper"
+	"github.com/110billion/sellfie/usermanagerservice/src/pkg/database"
+	"github.com/110billion/sellfie/usermanagerservice/src/pkg/lockout"
+	"github.com/110billion/sellfie/usermanagerservice/src/pkg/server/auth/token"
+	"github.com/go-logr/logr"
+	"github.com/gorilla/mux"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// IdentitiesResponse is the response listing the identities linked to the account
+type IdentitiesResponse struct {
+	Ok          bool       `json:"ok"`
+	Identities  []Identity `json:"identities"`
+	HasPassword bool       `json:"has_password"`
+}
+
+// LinkResponse is the response of linking and unlinking an identity.
+// URL is the login page of the provider to continue linking at
+type LinkResponse struct {
+	Ok       bool   `json:"ok"`
+	Provider string `json:"provider"`
+	URL      string `json:"url,omitempty"`
+}
+
+type identityHandler struct {
+	log logr.Logger
+}
+
+type linkReqBody struct {
+	// Password re-authenticates the user. It is required if the account has a password
+	Password string `json:"password"`
+}
+
+// NewIdentityHandler instantiates a new api handler listing, linking and unlinking the external identities of the account
+func NewIdentityHandler(parent wrapper.RouterWrapper, logger logr.Logger) (apiserver.APIHandler, error) {
+	handler := &identityHandler{log: logger}
+
+	// /identities
+	identitiesWrapper := wrapper.New("/identities", []string{http.MethodGet}, handler.listHandler)
+	identitiesWrapper.Use(token.Authenticate)
+	if err := parent.Add(identitiesWrapper); err != nil {
+		return nil, err
+	}
+
+	// /identities/{provider}
+	providerWrapper := wrapper.New("/{provider}", []string{http.MethodPost, http.MethodDelete}, handler.identityHandler)
+	if err := identitiesWrapper.Add(providerWrapper); err != nil {
+		return nil, err
+	}
+
+	return handler, nil
+}
+
+func (h *identityHandler) listHandler(w http.ResponseWriter, req *http.Request) {
+	claims, _ := token.FromContext(req.Context())
+
+	identities, hasPassword, err := listIdentities(claims.Subject)
+	if err != nil {
+		h.log.Error(err, "list identities error")
+		_ = utils.RespondError(w, http.StatusInternalServerError, "cannot list identities")
+		return
+	}
+
+	_ = utils.RespondJSON(w, IdentitiesResponse{Ok: true, Identities: identities, HasPassword: hasPassword})
+}
+
+func (h *identityHandler) identityHandler(w http.ResponseWriter, req *http.Request) {
+	provider, ok := GetProvider(mux.Vars(req)["provider"])
+	if !ok {
+		_ = utils.RespondError(w, http.StatusNotFound, "provider is not supported")
+		return
+	}
+
+	if req.Method == http.MethodDelete {
+		h.unlinkHandler(w, req, provider)
+		return
+	}
+	h.linkHandler(w, req, provider)
+}
+
+// linkHandler re-authenticates the user and starts a login at the provider, which links the identity on the callback.
+// The login page URL is returned, as the request is authenticated by the access token rather than by a cookie
+func (h *identityHandler) linkHandler(w http.ResponseWriter, req *http.Request, provider Provider) {
+	claims, _ := token.FromContext(req.Context())
+
+	// Decode request body, which is optional for accounts without a password
+	linkReq := &linkReqBody{}
+	decoder := json.NewDecoder(req.Body)
+	if err := decoder.Decode(linkReq); err != nil && err != io.EOF {
+		_ = utils.RespondError(w, http.StatusBadRequest, "request body is not in json form or is malformed")
+		return
+	}
+
+	// Open DB
+	db, err := database.Connect()
+	if err != nil {
+		h.log.Error(err, "link identity error")
+		_ = utils.RespondError(w, http.StatusInternalServerError, "db connection error")
+		return
+	}
+	defer db.Close()
+
+	var password, email string
+	if err := db.QueryRow("SELECT password, user_email FROM USER_TABLE WHERE user_uuid = $1", claims.Subject).Scan(&password, &email); err != nil {
+		h.log.Error(err, "link identity error")
+		_ = utils.RespondError(w, http.StatusInternalServerError, "cannot get account")
+		return
+	}
+
+	// Linking grants another way into the account, so the user must prove to be its owner again
+	if password != "" {
+		if linkReq.Password == "" {
+			_ = utils.RespondError(w, http.StatusUnauthorized, "password is required to link an identity")
+			return
+		}
+
+		// A stolen token must not be enough to guess the password, so the guesses count as failed logins
+		ip := utils.ClientIP(req)
+		wait, err := lockout.CheckLogin(email, ip)
+		if err != nil {
+			h.log.Error(err, "link identity error")
+			_ = utils.RespondError(w, http.StatusInternalServerError, "cannot check login attempts")
+			return
+		}
+		if wait > 0 {
+			w.Header().Set("Retry-After", strconv.Itoa(int(wait.Seconds())+1))
+			_ = utils.RespondError(w, http.StatusTooManyRequests, "too many failed attempts, retry later")
+			return
+		}
+		if err := bcrypt.CompareHashAndPassword([]byte(password), []byte(linkReq.Password)); err != nil {
+			if err := lockout.FailLogin(email, ip); err != nil {
+				h.log.Error(err, "link identity error")
+			}
+			_ = utils.RespondError(w, http.StatusUnauthorized, "password doesn't match")
+			return
+		}
+		if err := lockout.Unlock(email); err != nil {
+			h.log.Error(err, "link identity error")
+		}
+	} else if !claims.RecentlyAuthenticated() {
+		_ = utils.RespondError(w, http.StatusUnauthorized, "log in again to link an identity")
+		return
+	}
+
+	oauthConfig, err := provider.OAuthConfig(providerContext(req.Context(), provider))
+	if err != nil {
+		h.log.Error(err, "cannot configure provider", "provider", provider.Name())
+		_ = utils.RespondError(w, http.StatusBadGateway, "provider is not available")
+		return
+	}
+
+	loginURL, err := authCodeURL(w, req, provider, oauthConfig, claims.Subject)
+	if err != nil {
+		h.log.Error(err, "link identity error", "provider", provider.Name())
+		_ = utils.RespondError(w, http.StatusInternalServerError, "cannot start linking")
+		return
+	}
+
+	_ = utils.RespondJSON(w, LinkResponse{Ok: true, Provider: provider.Name(), URL: loginURL})
+}
+
+func (h *identityHandler) unlinkHandler(w http.ResponseWriter, req *http.Request, provider Provider) {
+	claims, _ := token.FromContext(req.Context())
+
+	switch err := unlinkIdentity(provider.Name(), claims.Subject); err {
+	case nil:
+	case ErrIdentityNotLinked:
+		_ = utils.RespondError(w, http.StatusNotFound, err.Error())
+		return
+	case ErrLastLoginMethod:
+		_ = utils.RespondError(w, http.StatusConflict, err.Error())
+		return
+	default:
+		h.log.Error(err, "unlink identity error", "provider", provider.Name())
+		_ = utils.RespondError(w, http.StatusInternalServerError, "cannot unlink identity")
+		return
+	}
+
+	_ = utils.RespondJSON(w, LinkResponse{Ok: true, Provider: provider.Name()})
+}
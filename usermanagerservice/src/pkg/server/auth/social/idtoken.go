@@ -0,0 +1,317 @@
+/*
+ Copyright 2021 The 110 billion Authors
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package social
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+)
+
+const (
+	// jwksCacheDuration is how long the keys of a provider are trusted before they are fetched again,
+	// unless the JWKS response says otherwise with Cache-Control: max-age
+	jwksCacheDuration = time.Hour
+	// jwksMinCacheDuration and jwksMaxCacheDuration bound the max-age of the JWKS response
+	jwksMinCacheDuration = time.Minute
+	jwksMaxCacheDuration = 24 * time.Hour
+	// jwksMinRefreshInterval limits how often an unknown kid triggers fetching the keys
+	jwksMinRefreshInterval = 30 * time.Second
+
+	// idTokenLeeway is the clock skew tolerated between the provider and the user manager
+	idTokenLeeway = time.Minute
+)
+
+// IDTokenVerifier is implemented by providers issuing OpenID Connect ID tokens.
+// Such providers must return an ID token, which is verified on the callback
+type IDTokenVerifier interface {
+	VerifyIDToken(ctx context.Context, rawIDToken, nonce string) (*IDToken, error)
+}
+
+// IDToken is the verified claims of an ID token
+type IDToken struct {
+	Subject       string
+	Email         string
+	EmailVerified bool
+	Name          string
+	Claims        map[string]interface{}
+}
+
+// remoteKeySet caches the JWKS of a provider
+type remoteKeySet struct {
+	url    string
+	client *http.Client
+
+	lock      sync.Mutex
+	keys      map[string]crypto.PublicKey
+	fetchedAt time.Time
+	maxAge    time.Duration
+}
+
+// newRemoteKeySet returns the key set at the url, fetched with the client or http.DefaultClient if it is nil
+func newRemoteKeySet(client *http.Client, url string) *remoteKeySet {
+	if client == nil {
+		client = http.DefaultClient
+	}
+	return &remoteKeySet{url: url, client: client, maxAge: jwksCacheDuration}
+}
+
+// get returns the key with the kid, fetching the keys if the cache is stale or the kid is unknown
+func (s *remoteKeySet) get(ctx context.Context, id string) (crypto.PublicKey, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	key, ok := s.keys[id]
+	age := time.Since(s.fetchedAt)
+	if (ok && age < s.maxAge) || (!ok && age < jwksMinRefreshInterval) {
+		if !ok {
+			return nil, fmt.Errorf("unknown key %q", id)
+		}
+		return key, nil
+	}
+
+	keys, maxAge, err := fetchJWKS(ctx, s.client, s.url)
+	s.fetchedAt = time.Now()
+	if err != nil {
+		if ok {
+			return key, nil
+		}
+		return nil, err
+	}
+	s.keys = keys
+	s.maxAge = maxAge
+
+	if key, ok = s.keys[id]; !ok {
+		return nil, fmt.Errorf("unknown key %q", id)
+	}
+	return key, nil
+}
+
+// fetchJWKS fetches the keys at the url, and how long they may be cached
+func fetchJWKS(ctx context.Context, client *http.Client, url string) (map[string]crypto.PublicKey, time.Duration, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, 0, err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, 0, fmt.Errorf("jwks endpoint responded with status %d", resp.StatusCode)
+	}
+
+	set := struct {
+		Keys []struct {
+			KeyType string `json:"kty"`
+			KeyID   string `json:"kid"`
+			Use     string `json:"use"`
+			N       string `json:"n"`
+			E       string `json:"e"`
+			Curve   string `json:"crv"`
+			X       string `json:"x"`
+			Y       string `json:"y"`
+		} `json:"keys"`
+	}{}
+	if err := json.NewDecoder(resp.Body).Decode(&set); err != nil {
+		return nil, 0, err
+	}
+
+	keys := map[string]crypto.PublicKey{}
+	for _, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		switch k.KeyType {
+		case "RSA":
+			n, errN := base64.RawURLEncoding.DecodeString(k.N)
+			e, errE := base64.RawURLEncoding.DecodeString(k.E)
+			if errN != nil || errE != nil {
+				continue
+			}
+			keys[k.KeyID] = &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+		case "EC":
+			if k.Curve != "P-256" {
+				continue
+			}
+			x, errX := base64.RawURLEncoding.DecodeString(k.X)
+			y, errY := base64.RawURLEncoding.DecodeString(k.Y)
+			if errX != nil || errY != nil {
+				continue
+			}
+			keys[k.KeyID] = &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		}
+	}
+	return keys, cacheMaxAge(resp.Header), nil
+}
+
+// cacheMaxAge returns the max-age of the Cache-Control header within the bounds of the JWKS cache,
+// or jwksCacheDuration if the header does not have one
+func cacheMaxAge(header http.Header) time.Duration {
+	for _, directive := range strings.Split(header.Get("Cache-Control"), ",") {
+		directive = strings.ToLower(strings.TrimSpace(directive))
+		if directive == "no-cache" || directive == "no-store" {
+			return jwksMinCacheDuration
+		}
+		if !strings.HasPrefix(directive, "max-age=") {
+			continue
+		}
+		seconds, err := strconv.Atoi(strings.TrimPrefix(directive, "max-age="))
+		if err != nil {
+			continue
+		}
+		maxAge := time.Duration(seconds) * time.Second
+		if maxAge < jwksMinCacheDuration {
+			return jwksMinCacheDuration
+		}
+		if maxAge > jwksMaxCacheDuration {
+			return jwksMaxCacheDuration
+		}
+		return maxAge
+	}
+	return jwksCacheDuration
+}
+
+// verifyIDToken verifies the signature of the ID token with the keys, and its iss, aud, azp, exp, iat and nonce claims.
+// If algorithms is not empty, the token must be signed with one of them
+func verifyIDToken(ctx context.Context, keys *remoteKeySet, rawIDToken string, issuers []string, clientID, nonce string, algorithms []string) (*IDToken, error) {
+	// Time-based claims are checked below, with the leeway for clock skew
+	parser := &jwt.Parser{UseJSONNumber: true, SkipClaimsValidation: true}
+	claims := jwt.MapClaims{}
+	_, err := parser.ParseWithClaims(rawIDToken, claims, func(t *jwt.Token) (interface{}, error) {
+		switch t.Method.(type) {
+		case *jwt.SigningMethodRSA, *jwt.SigningMethodECDSA:
+		default:
+			return nil, fmt.Errorf("unexpected signing method %s", t.Header["alg"])
+		}
+		if len(algorithms) > 0 && !contains(algorithms, t.Method.Alg()) {
+			return nil, fmt.Errorf("signing method %s is not supported by the provider", t.Method.Alg())
+		}
+		id, _ := t.Header["kid"].(string)
+		return keys.get(ctx, id)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	iss, _ := claims["iss"].(string)
+	if !contains(issuers, iss) {
+		return nil, fmt.Errorf("unexpected issuer %q", iss)
+	}
+
+	var audiences []string
+	switch aud := claims["aud"].(type) {
+	case string:
+		audiences = []string{aud}
+	case []interface{}:
+		for _, a := range aud {
+			if s, ok := a.(string); ok {
+				audiences = append(audiences, s)
+			}
+		}
+	}
+	if !contains(audiences, clientID) {
+		return nil, fmt.Errorf("id token is not issued for the client")
+	}
+	// A token for several audiences must name the client it is issued to
+	azp, hasAZP := claims["azp"].(string)
+	if (len(audiences) > 1 && !hasAZP) || (hasAZP && azp != clientID) {
+		return nil, fmt.Errorf("id token is not authorized for the client")
+	}
+
+	now := time.Now()
+	exp, ok := timeClaim(claims, "exp")
+	if !ok {
+		return nil, fmt.Errorf("id token does not expire")
+	}
+	if now.After(exp.Add(idTokenLeeway)) {
+		return nil, fmt.Errorf("id token is expired")
+	}
+	if iat, ok := timeClaim(claims, "iat"); ok && iat.After(now.Add(idTokenLeeway)) {
+		return nil, fmt.Errorf("id token is issued in the future")
+	}
+	if nbf, ok := timeClaim(claims, "nbf"); ok && nbf.After(now.Add(idTokenLeeway)) {
+		return nil, fmt.Errorf("id token is not valid yet")
+	}
+
+	if tokenNonce, _ := claims["nonce"].(string); nonce == "" || tokenNonce != nonce {
+		return nil, fmt.Errorf("nonce does not match")
+	}
+
+	idToken := &IDToken{Claims: claims}
+	idToken.Subject, _ = claims["sub"].(string)
+	idToken.Email, _ = claims["email"].(string)
+	idToken.Name, _ = claims["name"].(string)
+	idToken.EmailVerified, _ = boolClaim(claims, "email_verified")
+	if idToken.Subject == "" {
+		return nil, fmt.Errorf("id token does not have a subject")
+	}
+	return idToken, nil
+}
+
+// timeClaim returns the NumericDate claim of the key
+func timeClaim(claims map[string]interface{}, key string) (time.Time, bool) {
+	var seconds float64
+	switch v := claims[key].(type) {
+	case json.Number:
+		f, err := v.Float64()
+		if err != nil {
+			return time.Time{}, false
+		}
+		seconds = f
+	case float64:
+		seconds = v
+	default:
+		return time.Time{}, false
+	}
+	return time.Unix(int64(seconds), 0), true
+}
+
+// boolClaim returns the boolean claim of the key. Some providers send booleans as strings
+func boolClaim(claims map[string]interface{}, key string) (value bool, ok bool) {
+	switch v := claims[key].(type) {
+	case bool:
+		return v, true
+	case string:
+		return v == "true", true
+	default:
+		return false, false
+	}
+}
+
+func contains(values []string, s string) bool {
+	for _, v := range values {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,120 @@
+/*
+ Copyright 2021 The 110 billion Authors
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package social
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/facebook"
+	"golang.org/x/oauth2/github"
+	"golang.org/x/oauth2/google"
+)
+
+// kind describes how to talk to a type of provider. Providers of the same kind differ only in their client configuration
+type kind struct {
+	endpoint    oauth2.Endpoint
+	scopes      []string
+	userInfoURL string
+	mapping     ClaimMapping
+
+	// issuers and jwksURL are set for providers issuing OpenID Connect ID tokens
+	issuers []string
+	jwksURL string
+
+	complete func(ctx context.Context, client *http.Client, user *User) error
+}
+
+// kinds are the providers which can be enabled by their name, without further configuration than the client credentials.
+// Generic OpenID Connect providers are configured with KindOIDC instead
+var kinds = map[string]kind{
+	"google": {
+		endpoint:    google.Endpoint,
+		scopes:      []string{"openid", "https://www.googleapis.com/auth/userinfo.email", "https://www.googleapis.com/auth/userinfo.profile"},
+		userInfoURL: "https://www.googleapis.com/oauth2/v3/userinfo",
+		mapping:     ClaimMapping{ID: "sub", Name: "name", Email: "email", EmailVerified: "email_verified"},
+		issuers:     []string{"https://accounts.google.com", "accounts.google.com"},
+		jwksURL:     "https://www.googleapis.com/oauth2/v3/certs",
+	},
+	"facebook": {
+		endpoint:    facebook.Endpoint,
+		scopes:      []string{"email", "public_profile"},
+		userInfoURL: "https://graph.facebook.com/me?fields=id,name,email",
+		mapping:     ClaimMapping{ID: "id", Name: "name", Email: "email"},
+	},
+	"github": {
+		endpoint:    github.Endpoint,
+		scopes:      []string{"read:user", "user:email"},
+		userInfoURL: "https://api.github.com/user",
+		mapping:     ClaimMapping{ID: "id", Name: "login", Email: "email"},
+		complete:    completeGitHubEmail,
+	},
+	"kakao": {
+		endpoint: oauth2.Endpoint{
+			AuthURL:   "https://kauth.kakao.com/oauth/authorize",
+			TokenURL:  "https://kauth.kakao.com/oauth/token",
+			AuthStyle: oauth2.AuthStyleInParams,
+		},
+		userInfoURL: "https://kapi.kakao.com/v2/user/me",
+		mapping: ClaimMapping{ID: "id", Name: "kakao_account.profile.nickname", Email: "kakao_account.email",
+			EmailVerified: "kakao_account.is_email_verified"},
+	},
+	"naver": {
+		endpoint: oauth2.Endpoint{
+			AuthURL:   "https://nid.naver.com/oauth2.0/authorize",
+			TokenURL:  "https://nid.naver.com/oauth2.0/token",
+			AuthStyle: oauth2.AuthStyleInParams,
+		},
+		userInfoURL: "https://openapi.naver.com/v1/nid/me",
+		mapping:     ClaimMapping{ID: "response.id", Name: "response.name", Email: "response.email"},
+	},
+}
+
+// completeGitHubEmail looks the emails of the user up, as GitHub returns only the public email in the user info
+// without telling whether it is verified. The primary verified email is used if the user does not have a public one
+func completeGitHubEmail(_ context.Context, client *http.Client, user *User) error {
+	resp, err := client.Get("https://api.github.com/user/emails")
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	var emails []struct {
+		Email    string `json:"email"`
+		Primary  bool   `json:"primary"`
+		Verified bool   `json:"verified"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&emails); err != nil {
+		return err
+	}
+
+	for _, e := range emails {
+		if user.Email != "" && strings.EqualFold(e.Email, user.Email) {
+			user.EmailVerified = e.Verified
+			return nil
+		}
+		if user.Email == "" && e.Primary && e.Verified {
+			user.Email = e.Email
+			user.EmailVerified = true
+			return nil
+		}
+	}
+	return nil
+}
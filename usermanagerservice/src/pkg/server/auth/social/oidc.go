@@ -0,0 +1,263 @@
+/*
+ Copyright 2021 The 110 billion Authors
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package social
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/oauth2"
+)
+
+// KindOIDC is the kind of generic OpenID Connect providers, whose endpoints are discovered from the issuer
+const KindOIDC = "oidc"
+
+const (
+	// discoveryCacheDuration is how long the provider metadata is used before it is discovered again
+	discoveryCacheDuration = 24 * time.Hour
+	// discoveryRetryInterval limits how often a failed discovery is retried while the stale metadata is used
+	discoveryRetryInterval = time.Minute
+)
+
+// OIDCConfig configures a generic OpenID Connect provider
+type OIDCConfig struct {
+	// Name of the provider
+	Name string
+	// Issuer is the issuer identifier. The provider metadata is discovered at {Issuer}/.well-known/openid-configuration
+	Issuer string
+	// OAuth is the client configuration. Its endpoint is discovered
+	OAuth oauth2.Config
+	// Mapping maps the claims of the ID token and the user info into User.
+	// Name and email default to name and email, while the ID is always sub, which the ID token is verified against
+	Mapping ClaimMapping
+	// RequireVerifiedEmail rejects emails without email_verified=true.
+	// Emails with email_verified=false are always rejected
+	RequireVerifiedEmail bool
+	// HTTPClient is used for the discovery, JWKS, token and user info requests. Defaults to http.DefaultClient
+	HTTPClient *http.Client
+}
+
+// discovery is the part of the OpenID Provider Metadata the user manager uses
+type discovery struct {
+	Issuer                           string   `json:"issuer"`
+	AuthorizationEndpoint            string   `json:"authorization_endpoint"`
+	TokenEndpoint                    string   `json:"token_endpoint"`
+	UserInfoEndpoint                 string   `json:"userinfo_endpoint"`
+	JWKSURI                          string   `json:"jwks_uri"`
+	IDTokenSigningAlgValuesSupported []string `json:"id_token_signing_alg_values_supported"`
+}
+
+// oidcProvider is a generic OpenID Connect provider.
+// Its endpoints are discovered from {issuer}/.well-known/openid-configuration when they are first needed,
+// and discovered again once a day
+type oidcProvider struct {
+	name                 string
+	issuer               string
+	client               oauth2.Config
+	mapping              ClaimMapping
+	requireVerifiedEmail bool
+	httpClient           *http.Client
+
+	lock         sync.Mutex
+	metadata     *discovery
+	discoveredAt time.Time
+	keys         *remoteKeySet
+}
+
+// NewOIDCProvider returns the OpenID Connect provider of the configuration
+func NewOIDCProvider(config OIDCConfig) Provider {
+	mapping := config.Mapping
+	mapping.ID = "sub"
+	mapping.Name = firstNonEmpty(mapping.Name, "name")
+	mapping.Email = firstNonEmpty(mapping.Email, "email")
+	mapping.EmailVerified = firstNonEmpty(mapping.EmailVerified, "email_verified")
+
+	httpClient := config.HTTPClient
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+
+	return &oidcProvider{
+		name:                 config.Name,
+		issuer:               config.Issuer,
+		client:               config.OAuth,
+		mapping:              mapping,
+		requireVerifiedEmail: config.RequireVerifiedEmail,
+		httpClient:           httpClient,
+	}
+}
+
+// Name returns the name of the provider
+func (p *oidcProvider) Name() string {
+	return p.name
+}
+
+// HTTPClient returns the client the OAuth 2.0 requests to the provider are sent with
+func (p *oidcProvider) HTTPClient() *http.Client {
+	return p.httpClient
+}
+
+// OAuthConfig returns the OAuth 2.0 client configuration with the discovered endpoints
+func (p *oidcProvider) OAuthConfig(ctx context.Context) (*oauth2.Config, error) {
+	metadata, _, err := p.discover(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	config := p.client
+	config.Endpoint = oauth2.Endpoint{
+		AuthURL:  metadata.AuthorizationEndpoint,
+		TokenURL: metadata.TokenEndpoint,
+	}
+	return &config, nil
+}
+
+// User maps the claims of the ID token into User.
+// The user info endpoint is requested only if the ID token lacks the name or the email
+func (p *oidcProvider) User(ctx context.Context, token *oauth2.Token, idToken *IDToken) (*User, error) {
+	if idToken == nil {
+		return nil, fmt.Errorf("provider %s did not return an id token", p.name)
+	}
+
+	claims := idToken.Claims
+	if claim(claims, p.mapping.Name) == "" || claim(claims, p.mapping.Email) == "" {
+		info, err := p.userInfo(ctx, token)
+		if err != nil {
+			return nil, err
+		}
+		if info != nil {
+			// The user info must be of the user the ID token is issued to
+			if sub := claim(info, "sub"); sub != idToken.Subject {
+				return nil, fmt.Errorf("user info of %q does not match the id token of %q", sub, idToken.Subject)
+			}
+			claims = mergeClaims(idToken.Claims, info)
+		}
+	}
+
+	user, err := mapUser(claims, p.mapping)
+	if err != nil {
+		return nil, err
+	}
+	if user.Email != "" {
+		verified, ok := boolClaim(claims, "email_verified")
+		if (ok && !verified) || (!ok && p.requireVerifiedEmail) {
+			return nil, ErrEmailNotVerified
+		}
+	}
+	return user, nil
+}
+
+// userInfo fetches the claims from the user info endpoint, or returns nil if the provider does not have one
+func (p *oidcProvider) userInfo(ctx context.Context, token *oauth2.Token) (map[string]interface{}, error) {
+	metadata, _, err := p.discover(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if metadata.UserInfoEndpoint == "" {
+		return nil, nil
+	}
+
+	config, err := p.OAuthConfig(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return fetchClaims(config.Client(providerContext(ctx, p), token), metadata.UserInfoEndpoint)
+}
+
+// VerifyIDToken verifies the ID token with the keys at the discovered jwks_uri
+func (p *oidcProvider) VerifyIDToken(ctx context.Context, rawIDToken, nonce string) (*IDToken, error) {
+	metadata, keys, err := p.discover(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return verifyIDToken(ctx, keys, rawIDToken, []string{p.issuer}, p.client.ClientID, nonce, metadata.IDTokenSigningAlgValuesSupported)
+}
+
+// discover returns the provider metadata and its key set, discovering them if they are not discovered yet or stale.
+// If the discovery fails, stale metadata is still used, and the discovery is retried at most once a minute
+func (p *oidcProvider) discover(ctx context.Context) (*discovery, *remoteKeySet, error) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	age := time.Since(p.discoveredAt)
+	if p.metadata != nil && age < discoveryCacheDuration {
+		return p.metadata, p.keys, nil
+	}
+
+	metadata, err := p.fetchDiscovery(ctx)
+	if err != nil {
+		if p.metadata != nil {
+			log.Error(err, "cannot discover provider metadata, using the stale one", "provider", p.name)
+			p.discoveredAt = time.Now().Add(discoveryRetryInterval - discoveryCacheDuration)
+			return p.metadata, p.keys, nil
+		}
+		return nil, nil, err
+	}
+
+	// The cached keys are kept unless the keys moved
+	if p.keys == nil || p.metadata.JWKSURI != metadata.JWKSURI {
+		p.keys = newRemoteKeySet(p.httpClient, metadata.JWKSURI)
+	}
+	p.metadata = metadata
+	p.discoveredAt = time.Now()
+	return p.metadata, p.keys, nil
+}
+
+// fetchDiscovery fetches and validates the provider metadata
+func (p *oidcProvider) fetchDiscovery(ctx context.Context) (*discovery, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, strings.TrimSuffix(p.issuer, "/")+"/.well-known/openid-configuration", nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := p.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("discovery of %s responded with status %d", p.issuer, resp.StatusCode)
+	}
+
+	metadata := &discovery{}
+	if err := json.NewDecoder(resp.Body).Decode(metadata); err != nil {
+		return nil, err
+	}
+	if metadata.Issuer != p.issuer {
+		return nil, fmt.Errorf("discovered issuer %s does not match %s", metadata.Issuer, p.issuer)
+	}
+	if metadata.AuthorizationEndpoint == "" || metadata.TokenEndpoint == "" || metadata.JWKSURI == "" {
+		return nil, fmt.Errorf("discovery of %s does not have the authorization, token and jwks endpoints", p.issuer)
+	}
+	return metadata, nil
+}
+
+// mergeClaims returns the claims of the ID token, complemented by the user info claims it does not have
+func mergeClaims(idTokenClaims, userInfo map[string]interface{}) map[string]interface{} {
+	claims := make(map[string]interface{}, len(idTokenClaims)+len(userInfo))
+	for k, v := range userInfo {
+		claims[k] = v
+	}
+	for k, v := range idTokenClaims {
+		claims[k] = v
+	}
+	return claims
+}
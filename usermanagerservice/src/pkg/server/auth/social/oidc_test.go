@@ -0,0 +1,360 @@
+/*
+ Copyright 2021 The 110 billion Authors
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package social
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"golang.org/x/oauth2"
+)
+
+const (
+	testClientID = "sellfie-client"
+	testNonce    = "nonce-1"
+	testSubject  = "248289761001"
+)
+
+// testIdP is a stand-in OpenID Provider serving the discovery and the JWKS, and signing ID tokens with its keys
+type testIdP struct {
+	server *httptest.Server
+
+	lock sync.Mutex
+	keys map[string]*rsa.PrivateKey
+}
+
+func newTestIdP(t *testing.T) *testIdP {
+	idp := &testIdP{keys: map[string]*rsa.PrivateKey{}}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		_ = json.NewEncoder(w).Encode(discovery{
+			Issuer:                           idp.server.URL,
+			AuthorizationEndpoint:            idp.server.URL + "/authorize",
+			TokenEndpoint:                    idp.server.URL + "/token",
+			JWKSURI:                          idp.server.URL + "/jwks",
+			IDTokenSigningAlgValuesSupported: []string{"RS256"},
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		idp.lock.Lock()
+		defer idp.lock.Unlock()
+
+		keys := []map[string]string{}
+		for kid, key := range idp.keys {
+			keys = append(keys, map[string]string{
+				"kty": "RSA",
+				"kid": kid,
+				"use": "sig",
+				"alg": "RS256",
+				"n":   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+				"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+			})
+		}
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{"keys": keys})
+	})
+
+	idp.server = httptest.NewServer(mux)
+	t.Cleanup(idp.server.Close)
+	return idp
+}
+
+// addKey generates a key and publishes it in the JWKS
+func (idp *testIdP) addKey(t *testing.T, kid string) *rsa.PrivateKey {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	idp.lock.Lock()
+	defer idp.lock.Unlock()
+	idp.keys[kid] = key
+	return key
+}
+
+// removeKey stops publishing the key in the JWKS
+func (idp *testIdP) removeKey(kid string) {
+	idp.lock.Lock()
+	defer idp.lock.Unlock()
+	delete(idp.keys, kid)
+}
+
+// claims returns the claims of a valid ID token for the client, modified by the overrides
+func (idp *testIdP) claims(overrides jwt.MapClaims) jwt.MapClaims {
+	now := time.Now()
+	claims := jwt.MapClaims{
+		"iss":            idp.server.URL,
+		"aud":            testClientID,
+		"sub":            testSubject,
+		"nonce":          testNonce,
+		"iat":            now.Unix(),
+		"exp":            now.Add(5 * time.Minute).Unix(),
+		"email":          "jane@example.com",
+		"email_verified": true,
+		"name":           "Jane",
+	}
+	for k, v := range overrides {
+		claims[k] = v
+	}
+	return claims
+}
+
+func sign(t *testing.T, key *rsa.PrivateKey, kid string, claims jwt.MapClaims) string {
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+	token.Header["kid"] = kid
+	signed, err := token.SignedString(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signed
+}
+
+func newTestProvider(idp *testIdP) Provider {
+	return NewOIDCProvider(OIDCConfig{
+		Name:       "test",
+		Issuer:     idp.server.URL,
+		OAuth:      oauth2.Config{ClientID: testClientID},
+		HTTPClient: idp.server.Client(),
+	})
+}
+
+func TestOIDCVerifyIDToken(t *testing.T) {
+	idp := newTestIdP(t)
+	key := idp.addKey(t, "key-1")
+	forged, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		token   string
+		wantErr bool
+	}{
+		{name: "valid", token: sign(t, key, "key-1", idp.claims(nil))},
+		{name: "bad signature", token: sign(t, forged, "key-1", idp.claims(nil)), wantErr: true},
+		{name: "wrong audience", token: sign(t, key, "key-1", idp.claims(jwt.MapClaims{"aud": "another-client"})), wantErr: true},
+		{name: "expired", token: sign(t, key, "key-1", idp.claims(jwt.MapClaims{"exp": time.Now().Add(-idTokenLeeway - time.Minute).Unix()})), wantErr: true},
+		{name: "wrong issuer", token: sign(t, key, "key-1", idp.claims(jwt.MapClaims{"iss": "https://evil.example.com"})), wantErr: true},
+		{name: "wrong nonce", token: sign(t, key, "key-1", idp.claims(jwt.MapClaims{"nonce": "replayed"})), wantErr: true},
+	}
+
+	provider := newTestProvider(idp)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			idToken, err := provider.(IDTokenVerifier).VerifyIDToken(context.Background(), tt.token, testNonce)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatal("expected the id token to be rejected")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if idToken.Subject != testSubject || idToken.Email != "jane@example.com" || !idToken.EmailVerified {
+				t.Fatalf("unexpected claims %+v", idToken)
+			}
+		})
+	}
+}
+
+func TestOIDCKeyRotation(t *testing.T) {
+	idp := newTestIdP(t)
+	oldKey := idp.addKey(t, "key-1")
+	provider := newTestProvider(idp)
+	verifier := provider.(IDTokenVerifier)
+	ctx := context.Background()
+
+	if _, err := verifier.VerifyIDToken(ctx, sign(t, oldKey, "key-1", idp.claims(nil)), testNonce); err != nil {
+		t.Fatalf("token of the current key is rejected: %v", err)
+	}
+
+	// The provider rotates its keys: the new key is published and the old one is retired
+	newKey := idp.addKey(t, "key-2")
+	idp.removeKey("key-1")
+
+	// An unknown kid is fetched again at most every jwksMinRefreshInterval, which is over
+	keys := provider.(*oidcProvider).keys
+	keys.lock.Lock()
+	keys.fetchedAt = time.Now().Add(-jwksMinRefreshInterval)
+	keys.lock.Unlock()
+
+	if _, err := verifier.VerifyIDToken(ctx, sign(t, newKey, "key-2", idp.claims(nil)), testNonce); err != nil {
+		t.Fatalf("token of the rotated key is rejected: %v", err)
+	}
+	if _, err := verifier.VerifyIDToken(ctx, sign(t, oldKey, "key-1", idp.claims(nil)), testNonce); err == nil {
+		t.Fatal("token of the retired key is accepted")
+	}
+}
+
+func TestOIDCUser(t *testing.T) {
+	idp := newTestIdP(t)
+	key := idp.addKey(t, "key-1")
+	provider := newTestProvider(idp)
+	ctx := context.Background()
+
+	idToken, err := provider.(IDTokenVerifier).VerifyIDToken(ctx, sign(t, key, "key-1", idp.claims(nil)), testNonce)
+	if err != nil {
+		t.Fatal(err)
+	}
+	user, err := provider.User(ctx, &oauth2.Token{AccessToken: "access"}, idToken)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Accounts are keyed on the subject of the ID token, which Callback checks the user against
+	if user.ID != idToken.Subject || user.Email != "jane@example.com" || user.Name != "Jane" || !user.EmailVerified {
+		t.Fatalf("unexpected user %+v", user)
+	}
+
+	idToken, err = provider.(IDTokenVerifier).VerifyIDToken(ctx, sign(t, key, "key-1", idp.claims(jwt.MapClaims{"email_verified": false})), testNonce)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := provider.User(ctx, &oauth2.Token{AccessToken: "access"}, idToken); err != ErrEmailNotVerified {
+		t.Fatalf("expected %v, got %v", ErrEmailNotVerified, err)
+	}
+}
+
+func TestMapUserEmailVerified(t *testing.T) {
+	tests := map[string]struct {
+		kind string
+		info string
+		want bool
+	}{
+		"google verified": {
+			kind: "google",
+			info: `{"sub": "1", "email": "jane@example.com", "email_verified": true}`,
+			want: true,
+		},
+		"google verified as a string": {
+			kind: "google",
+			info: `{"sub": "1", "email": "jane@example.com", "email_verified": "true"}`,
+			want: true,
+		},
+		"google not verified": {
+			kind: "google",
+			info: `{"sub": "1", "email": "jane@example.com", "email_verified": false}`,
+		},
+		"kakao verified": {
+			kind: "kakao",
+			info: `{"id": 1, "kakao_account": {"email": "jane@example.com", "is_email_verified": true}}`,
+			want: true,
+		},
+		"kakao not verified": {
+			kind: "kakao",
+			info: `{"id": 1, "kakao_account": {"email": "jane@example.com", "is_email_verified": false}}`,
+		},
+		// Naver and Facebook do not tell whether the email is verified
+		"naver": {
+			kind: "naver",
+			info: `{"response": {"id": "1", "email": "jane@example.com"}}`,
+		},
+		"facebook": {
+			kind: "facebook",
+			info: `{"id": "1", "email": "jane@example.com", "verified": true}`,
+		},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			decoder := json.NewDecoder(strings.NewReader(tc.info))
+			decoder.UseNumber()
+			info := map[string]interface{}{}
+			if err := decoder.Decode(&info); err != nil {
+				t.Fatal(err)
+			}
+
+			user, err := mapUser(info, kinds[tc.kind].mapping)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if user.Email != "jane@example.com" || user.EmailVerified != tc.want {
+				t.Fatalf("want a verified email %v, got %+v", tc.want, user)
+			}
+		})
+	}
+}
+
+func TestGitHubEmailVerified(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(`[{"email": "public@example.com", "primary": false, "verified": false},
+			{"email": "primary@example.com", "primary": true, "verified": true}]`))
+	}))
+	defer server.Close()
+	client := &http.Client{Transport: rewriteTransport{target: server.URL}}
+
+	user := &User{ID: "1", Email: "public@example.com"}
+	if err := completeGitHubEmail(context.Background(), client, user); err != nil {
+		t.Fatal(err)
+	}
+	if user.Email != "public@example.com" || user.EmailVerified {
+		t.Fatalf("the unverified public email must be kept unverified, got %+v", user)
+	}
+
+	user = &User{ID: "1"}
+	if err := completeGitHubEmail(context.Background(), client, user); err != nil {
+		t.Fatal(err)
+	}
+	if user.Email != "primary@example.com" || !user.EmailVerified {
+		t.Fatalf("expected the primary verified email, got %+v", user)
+	}
+}
+
+// rewriteTransport sends every request to the target server
+type rewriteTransport struct {
+	target string
+}
+
+func (t rewriteTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	target, err := url.Parse(t.target)
+	if err != nil {
+		return nil, err
+	}
+	req = req.Clone(req.Context())
+	req.URL.Scheme, req.URL.Host = target.Scheme, target.Host
+	return http.DefaultTransport.RoundTrip(req)
+}
+
+func TestNewProviderClaimID(t *testing.T) {
+	t.Setenv("OAUTH_CORP_TYPE", KindOIDC)
+	t.Setenv("OAUTH_CORP_ISSUER", "https://idp.example.com")
+	t.Setenv("OAUTH_CORP_CLAIM_ID", "employee_id")
+	if _, err := newProvider("corp"); err == nil {
+		t.Fatal("CLAIM_ID is accepted for a provider keyed on the subject of its ID tokens")
+	}
+
+	t.Setenv("OAUTH_KAKAO_CLAIM_ID", "kakao_account.id")
+	p, err := newProvider("kakao")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id := p.(*oauthProvider).mapping.ID; id != "kakao_account.id" {
+		t.Fatalf("expected the configured claim, got %q", id)
+	}
+}
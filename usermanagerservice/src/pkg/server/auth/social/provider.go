@@ -0,0 +1,184 @@
+/*
+ Copyright 2021 The 110 billion Authors
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package social
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"golang.org/x/oauth2"
+)
+
+// Provider is an OAuth 2.0 identity provider users can log in with
+type Provider interface {
+	// Name identifies the provider. Its routes are mounted at /auth/{name}/login and /auth/{name}/callback
+	Name() string
+	// OAuthConfig returns the OAuth 2.0 client configuration for the provider
+	OAuthConfig(ctx context.Context) (*oauth2.Config, error)
+	// User returns the info of the user who authorized the token.
+	// idToken is the verified ID token if the provider is an IDTokenVerifier, or nil otherwise
+	User(ctx context.Context, token *oauth2.Token, idToken *IDToken) (*User, error)
+}
+
+// httpClientProvider is implemented by providers talking to their endpoints with their own HTTP client
+type httpClientProvider interface {
+	HTTPClient() *http.Client
+}
+
+// providerContext returns the context for the OAuth 2.0 requests to the provider,
+// carrying the HTTP client of the provider if it has one
+func providerContext(ctx context.Context, p Provider) context.Context {
+	if cp, ok := p.(httpClientProvider); ok && cp.HTTPClient() != nil {
+		return context.WithValue(ctx, oauth2.HTTPClient, cp.HTTPClient())
+	}
+	return ctx
+}
+
+// ClaimMapping maps the user info of a provider into User.
+// Each field is a dot-separated path to the value in the user info JSON, e.g., kakao_account.email
+type ClaimMapping struct {
+	ID    string
+	Name  string
+	Email string
+	// EmailVerified is the flag telling whether the provider verified the email, if the provider has one
+	EmailVerified string
+}
+
+// oauthProvider is a Provider fetching the user info from a JSON endpoint
+type oauthProvider struct {
+	name        string
+	config      *oauth2.Config
+	userInfoURL string
+	mapping     ClaimMapping
+
+	// complete fills the user info the user info endpoint does not return, if set
+	complete func(ctx context.Context, client *http.Client, user *User) error
+}
+
+// Name returns the name of the provider
+func (p *oauthProvider) Name() string {
+	return p.name
+}
+
+// OAuthConfig returns the OAuth 2.0 client configuration for the provider
+func (p *oauthProvider) OAuthConfig(_ context.Context) (*oauth2.Config, error) {
+	return p.config, nil
+}
+
+// User fetches the user info from the user info endpoint and maps it into User
+func (p *oauthProvider) User(ctx context.Context, token *oauth2.Token, _ *IDToken) (*User, error) {
+	client := p.config.Client(ctx, token)
+	user, err := fetchUser(client, p.userInfoURL, p.mapping)
+	if err != nil {
+		return nil, err
+	}
+
+	if p.complete != nil {
+		if err := p.complete(ctx, client, user); err != nil {
+			return nil, err
+		}
+	}
+	return user, nil
+}
+
+// idTokenProvider is an oauthProvider issuing OpenID Connect ID tokens
+type idTokenProvider struct {
+	*oauthProvider
+
+	issuers []string
+	keys    *remoteKeySet
+}
+
+// VerifyIDToken verifies the ID token with the published keys of the provider
+func (p *idTokenProvider) VerifyIDToken(ctx context.Context, rawIDToken, nonce string) (*IDToken, error) {
+	return verifyIDToken(ctx, p.keys, rawIDToken, p.issuers, p.config.ClientID, nonce, nil)
+}
+
+// fetchUser gets the user info JSON from the endpoint and maps it into User
+func fetchUser(client *http.Client, endpoint string, mapping ClaimMapping) (*User, error) {
+	info, err := fetchClaims(client, endpoint)
+	if err != nil {
+		return nil, err
+	}
+	return mapUser(info, mapping)
+}
+
+// fetchClaims gets the user info JSON from the endpoint
+func fetchClaims(client *http.Client, endpoint string) (map[string]interface{}, error) {
+	resp, err := client.Get(endpoint)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("user info endpoint responded with status %d", resp.StatusCode)
+	}
+
+	info := map[string]interface{}{}
+	decoder := json.NewDecoder(resp.Body)
+	decoder.UseNumber()
+	if err := decoder.Decode(&info); err != nil {
+		return nil, err
+	}
+	return info, nil
+}
+
+// mapUser maps the claims into User
+func mapUser(claims map[string]interface{}, mapping ClaimMapping) (*User, error) {
+	user := &User{
+		ID:    claim(claims, mapping.ID),
+		Name:  claim(claims, mapping.Name),
+		Email: claim(claims, mapping.Email),
+		// Providers may tell the flag as a string
+		EmailVerified: claim(claims, mapping.EmailVerified) == "true",
+	}
+	if user.ID == "" {
+		return nil, fmt.Errorf("user info does not have %s", mapping.ID)
+	}
+	return user, nil
+}
+
+// claim returns the string or number at the dot-separated path of the JSON object, or an empty string
+func claim(obj map[string]interface{}, path string) string {
+	if path == "" {
+		return ""
+	}
+
+	keys := strings.Split(path, ".")
+	for _, key := range keys[:len(keys)-1] {
+		child, ok := obj[key].(map[string]interface{})
+		if !ok {
+			return ""
+		}
+		obj = child
+	}
+
+	switch v := obj[keys[len(keys)-1]].(type) {
+	case string:
+		return v
+	case json.Number:
+		return v.String()
+	case bool:
+		return strconv.FormatBool(v)
+	default:
+		return ""
+	}
+}
@@ -0,0 +1,222 @@
+/*
+ Copyright 2021 The 110 billion Authors
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package social
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+
+	"golang.org/x/oauth2"
+)
+
+const (
+	defaultProviders       = "google,facebook"
+	defaultRedirectBaseURL = "https://heychangju.shop"
+)
+
+var (
+	providerNameRegexp = regexp.MustCompile(`^[a-z0-9][a-z0-9-]*$`)
+	// reservedProviderNames are the other routes under /auth, which providers cannot shadow
+	reservedProviderNames = []string{"signup", "login", "logout", "token", "userinfo", "verify", "password", "mfa", "sessions", "identities"}
+
+	registryLock sync.RWMutex
+	registry     = map[string]Provider{}
+)
+
+// Register registers the provider, so that its routes are mounted by NewHandler
+func Register(p Provider) error {
+	if !providerNameRegexp.MatchString(p.Name()) {
+		return fmt.Errorf("provider name %q is not valid", p.Name())
+	}
+	if contains(reservedProviderNames, p.Name()) {
+		return fmt.Errorf("provider name %q is reserved", p.Name())
+	}
+
+	registryLock.Lock()
+	defer registryLock.Unlock()
+
+	if _, exists := registry[p.Name()]; exists {
+		return fmt.Errorf("provider %s is already registered", p.Name())
+	}
+	registry[p.Name()] = p
+	return nil
+}
+
+// GetProvider returns the registered provider with the name
+func GetProvider(name string) (Provider, bool) {
+	registryLock.RLock()
+	defer registryLock.RUnlock()
+
+	p, ok := registry[name]
+	return p, ok
+}
+
+// Providers returns the registered providers, sorted by their names
+func Providers() []Provider {
+	registryLock.RLock()
+	defer registryLock.RUnlock()
+
+	providers := make([]Provider, 0, len(registry))
+	for _, p := range registry {
+		providers = append(providers, p)
+	}
+	sort.Slice(providers, func(i, j int) bool {
+		return providers[i].Name() < providers[j].Name()
+	})
+	return providers
+}
+
+// LoadProviders registers the providers enabled by OAUTH_PROVIDERS, a comma-separated list of provider names.
+// Each provider {NAME} is configured by the environment variables below
+//   - OAUTH_{NAME}_TYPE: kind of the provider, i.e., google, facebook, github, kakao, naver or oidc. Defaults to the name
+//   - OAUTH_{NAME}_CLIENT_ID, OAUTH_{NAME}_CLIENT_SECRET: client credentials
+//   - OAUTH_{NAME}_REDIRECT_URL: defaults to {OAUTH_REDIRECT_BASE_URL}/auth/{name}/callback
+//   - OAUTH_{NAME}_SCOPES: comma-separated scopes, overriding the defaults of the kind
+//   - OAUTH_{NAME}_ISSUER: issuer of an oidc provider
+//   - OAUTH_{NAME}_REQUIRE_VERIFIED_EMAIL: if true, an oidc provider must assert email_verified
+//   - OAUTH_{NAME}_CLAIM_ID, OAUTH_{NAME}_CLAIM_NAME, OAUTH_{NAME}_CLAIM_EMAIL, OAUTH_{NAME}_CLAIM_EMAIL_VERIFIED: user info mapping,
+//     overriding the defaults of the kind. Providers issuing ID tokens are keyed on sub, so CLAIM_ID is refused for them.
+//     Accounts are created with an unverified email if the provider does not have CLAIM_EMAIL_VERIFIED
+func LoadProviders() error {
+	names := os.Getenv("OAUTH_PROVIDERS")
+	if names == "" {
+		names = defaultProviders
+	}
+
+	for _, name := range strings.Split(names, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+
+		p, err := newProvider(name)
+		if err != nil {
+			return err
+		}
+		if err := Register(p); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// newProvider builds the provider from its configuration
+func newProvider(name string) (Provider, error) {
+	prefix := "OAUTH_" + strings.ToUpper(strings.ReplaceAll(name, "-", "_")) + "_"
+	env := func(key string) string {
+		return os.Getenv(prefix + key)
+	}
+
+	kindName := env("TYPE")
+	if kindName == "" {
+		kindName = name
+	}
+
+	redirectURL := env("REDIRECT_URL")
+	if redirectURL == "" {
+		base := os.Getenv("OAUTH_REDIRECT_BASE_URL")
+		if base == "" {
+			base = defaultRedirectBaseURL
+		}
+		redirectURL = strings.TrimSuffix(base, "/") + "/auth/" + name + "/callback"
+	}
+
+	config := oauth2.Config{
+		ClientID:     env("CLIENT_ID"),
+		ClientSecret: env("CLIENT_SECRET"),
+		RedirectURL:  redirectURL,
+	}
+	// Environment variables preceding the provider registry
+	switch name {
+	case "google":
+		config.ClientID = firstNonEmpty(config.ClientID, os.Getenv("GOOGLE_ID"))
+		config.ClientSecret = firstNonEmpty(config.ClientSecret, os.Getenv("GOOGLE_SECRET"))
+	case "facebook":
+		config.ClientID = firstNonEmpty(config.ClientID, os.Getenv("FACEBOOK_ID"))
+		config.ClientSecret = firstNonEmpty(config.ClientSecret, os.Getenv("FACEBOOK_SECRET"))
+	}
+
+	var scopes []string
+	if s := env("SCOPES"); s != "" {
+		scopes = strings.Split(s, ",")
+	}
+
+	overrideMapping := func(mapping ClaimMapping) ClaimMapping {
+		mapping.ID = firstNonEmpty(env("CLAIM_ID"), mapping.ID)
+		mapping.Name = firstNonEmpty(env("CLAIM_NAME"), mapping.Name)
+		mapping.Email = firstNonEmpty(env("CLAIM_EMAIL"), mapping.Email)
+		mapping.EmailVerified = firstNonEmpty(env("CLAIM_EMAIL_VERIFIED"), mapping.EmailVerified)
+		return mapping
+	}
+
+	// The subject of the ID token is what identifies the user, and the user info is checked to be of the same subject
+	k, known := kinds[kindName]
+	if env("CLAIM_ID") != "" && (kindName == KindOIDC || (known && k.jwksURL != "")) {
+		return nil, fmt.Errorf("%sCLAIM_ID is not supported by provider %s, which issues id tokens keyed on sub", prefix, name)
+	}
+
+	if kindName == KindOIDC {
+		issuer := env("ISSUER")
+		if issuer == "" {
+			return nil, fmt.Errorf("%sISSUER is required for an oidc provider", prefix)
+		}
+		if scopes == nil {
+			scopes = []string{"openid", "email", "profile"}
+		}
+		config.Scopes = scopes
+		return NewOIDCProvider(OIDCConfig{
+			Name:                 name,
+			Issuer:               issuer,
+			OAuth:                config,
+			Mapping:              overrideMapping(ClaimMapping{}),
+			RequireVerifiedEmail: env("REQUIRE_VERIFIED_EMAIL") == "true",
+		}), nil
+	}
+
+	if !known {
+		return nil, fmt.Errorf("unknown type %s of provider %s", kindName, name)
+	}
+	if scopes == nil {
+		scopes = k.scopes
+	}
+	config.Scopes = scopes
+	config.Endpoint = k.endpoint
+	p := &oauthProvider{
+		name:        name,
+		config:      &config,
+		userInfoURL: k.userInfoURL,
+		mapping:     overrideMapping(k.mapping),
+		complete:    k.complete,
+	}
+	if k.jwksURL != "" {
+		return &idTokenProvider{oauthProvider: p, issuers: k.issuers, keys: newRemoteKeySet(nil, k.jwksURL)}, nil
+	}
+	return p, nil
+}
+
+func firstNonEmpty(values ...string) string {
+	for _, v := range values {
+		if v != "" {
+			return v
+		}
+	}
+	return ""
+}
@@ -17,103 +17,282 @@
 package social
 
 import (
-	"context"
-	"encoding/base64"
-	"encoding/json"
-	"github.com/go-logr/logr"
+	"crypto/subtle"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+
+	"github.com/110billion/sellfie/usermanagerservice/src/internal/utils"
+	"github.com/110billion/sellfie/usermanagerservice/src/pkg/server/auth/mfa"
+	"github.com/110billion/sellfie/usermanagerservice/src/pkg/server/auth/token"
+	"github.com/110billion/sellfie/usermanagerservice/src/pkg/session"
 	"github.com/gorilla/sessions"
 	"golang.org/x/oauth2"
-	"io/ioutil"
-	"math/rand"
-	"net/http"
+	logf "sigs.k8s.io/controller-runtime/pkg/log"
 )
 
-var (
-	// store return cookie store
-	store = sessions.NewCookieStore([]byte("secret"))
-	log   logr.Logger
-)
+const sessionName = "session"
+
+var log = logf.Log.WithName("social")
 
-// User is user info name & email
+// User is user info of the provider, i.e., the subject id, name & email
 type User struct {
+	ID    string `json:"id"`
 	Name  string `json:"name"`
 	Email string `json:"email"`
+	// EmailVerified is true if the provider vouches for the email. Emails of providers which do not tell are not verified
+	EmailVerified bool `json:"email_verified"`
 }
 
-// getLoginURL returns login url
-func getLoginURL(oauthConf *oauth2.Config, state string) string {
-	return oauthConf.AuthCodeURL(state)
+// sessionOptions returns the options of the cookie binding a login in progress to the browser.
+// The cookie is SameSite=Lax, as the callback is a top-level navigation from the provider
+func sessionOptions(maxAge int) *sessions.Options {
+	options := session.DefaultOptions()
+	options.Path = "/auth"
+	options.MaxAge = maxAge
+	return options
 }
 
-// randToken returns random string for token
-func randToken() string {
-	b := make([]byte, 32)
-	rand.Read(b)
-	return base64.StdEncoding.EncodeToString(b)
+// Login handles redirection to login page.
+// The state, the PKCE code verifier and the nonce of the login are kept server-side, and the state is bound to the browser by the session
+func Login(w http.ResponseWriter, r *http.Request, provider Provider) {
+	oauthConfig, err := provider.OAuthConfig(r.Context())
+	if err != nil {
+		log.Error(err, "cannot configure provider", "provider", provider.Name())
+		_ = utils.RespondError(w, http.StatusBadGateway, "provider is not available")
+		return
+	}
+
+	loginURL, err := authCodeURL(w, r, provider, oauthConfig, "")
+	if err != nil {
+		log.Error(err, "cannot start login", "provider", provider.Name())
+		_ = utils.RespondError(w, http.StatusInternalServerError, "cannot start login")
+		return
+	}
+	http.Redirect(w, r, loginURL, http.StatusTemporaryRedirect)
 }
 
-// Login handles redirection to login page
-func Login(w http.ResponseWriter, r *http.Request, oauthConfig *oauth2.Config) {
-	session, _ := store.Get(r, "session")
-	session.Options = &sessions.Options{
-		MaxAge: 300,
+// authCodeURL starts a login, binding its state to the browser, and returns the login page URL of the provider.
+// linkUserUUID is the user_uuid of the account to link the identity to, or empty to sign in
+func authCodeURL(w http.ResponseWriter, r *http.Request, provider Provider, oauthConfig *oauth2.Config, linkUserUUID string) (string, error) {
+	state, authState, err := newAuthState(provider.Name(), linkUserUUID)
+	if err != nil {
+		return "", err
 	}
-	state := randToken()
-	session.Values["state"] = state
-	if err := session.Save(r, w); err != nil {
-		log.Error(err, "")
-		return
+
+	loginSession, _ := session.Get(r, sessionName)
+	loginSession.Options = sessionOptions(int(stateLifetime.Seconds()))
+	loginSession.Values["state"] = state
+	if err := loginSession.Save(r, w); err != nil {
+		return "", err
 	}
-	http.Redirect(w, r, getLoginURL(oauthConfig, state), http.StatusTemporaryRedirect)
+
+	return oauthConfig.AuthCodeURL(state,
+		oauth2.SetAuthURLParam("code_challenge", codeChallenge(authState.CodeVerifier)),
+		oauth2.SetAuthURLParam("code_challenge_method", "S256"),
+		oauth2.SetAuthURLParam("nonce", authState.Nonce)), nil
 }
 
-// Callback handles login check and redirection to main page
-func Callback(w http.ResponseWriter, r *http.Request, oauthConfig *oauth2.Config, apiEndpoint string) {
-	session, err := store.Get(r, "session")
+// Callback handles login check, signs the user in to the account linked to the external identity and issues tokens.
+// The account is created on the first login. If the login is started to link the identity, it is linked to the account instead
+func Callback(w http.ResponseWriter, r *http.Request, provider Provider) {
+	if errCode := r.FormValue("error"); errCode != "" {
+		respondError(w, r, http.StatusUnauthorized, "login is not authorized by the provider: "+errCode)
+		return
+	}
+
+	// The state must be the one issued to this browser, and is usable only once
+	loginSession, _ := session.Get(r, sessionName)
+	sessionState, _ := loginSession.Values["state"].(string)
+	delete(loginSession.Values, "state")
+	loginSession.Options = sessionOptions(-1)
+	_ = loginSession.Save(r, w)
+
+	state := r.FormValue("state")
+	if sessionState == "" || subtle.ConstantTimeCompare([]byte(sessionState), []byte(state)) != 1 {
+		respondError(w, r, http.StatusUnauthorized, ErrInvalidState.Error())
+		return
+	}
+
+	authState, err := consumeState(state, provider.Name())
+	if err == ErrInvalidState {
+		respondError(w, r, http.StatusUnauthorized, err.Error())
+		return
+	}
 	if err != nil {
-		log.Error(err, "")
+		log.Error(err, "cannot look up login state", "provider", provider.Name())
+		respondError(w, r, http.StatusInternalServerError, "cannot sign in")
 		return
 	}
 
-	state := session.Values["state"]
-	delete(session.Values, "state")
-	_ = session.Save(r, w)
-	if state != r.FormValue("state") {
-		http.Error(w, "Invalid session state", http.StatusUnauthorized)
+	ctx := providerContext(r.Context(), provider)
+	oauthConfig, err := provider.OAuthConfig(ctx)
+	if err != nil {
+		log.Error(err, "cannot configure provider", "provider", provider.Name())
+		respondError(w, r, http.StatusBadGateway, "provider is not available")
 		return
 	}
 
-	token, err := oauthConfig.Exchange(context.Background(), r.FormValue("code"))
+	token, err := oauthConfig.Exchange(ctx, r.FormValue("code"), oauth2.SetAuthURLParam("code_verifier", authState.CodeVerifier))
+	if err != nil {
+		log.Error(err, "cannot exchange code", "provider", provider.Name())
+		respondError(w, r, http.StatusBadRequest, "cannot exchange authorization code")
+		return
+	}
+
+	// Providers issuing ID tokens must return a valid one for the nonce of this login
+	var idToken *IDToken
+	if verifier, ok := provider.(IDTokenVerifier); ok {
+		rawIDToken, _ := token.Extra("id_token").(string)
+		if rawIDToken == "" {
+			respondError(w, r, http.StatusBadGateway, "provider did not return an id token")
+			return
+		}
+		idToken, err = verifier.VerifyIDToken(ctx, rawIDToken, authState.Nonce)
+		if err != nil {
+			log.Error(err, "invalid id token", "provider", provider.Name())
+			respondError(w, r, http.StatusUnauthorized, "id token is not valid")
+			return
+		}
+	}
+
+	authUser, err := provider.User(ctx, token, idToken)
+	if err == ErrEmailNotVerified {
+		respondError(w, r, http.StatusForbidden, err.Error())
+		return
+	}
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
+		log.Error(err, "cannot read user info", "provider", provider.Name())
+		respondError(w, r, http.StatusBadGateway, "cannot read user info of the provider")
+		return
+	}
+	if idToken != nil && idToken.Subject != authUser.ID {
+		respondError(w, r, http.StatusUnauthorized, "id token does not match the user info")
+		return
+	}
+
+	if authState.LinkUserUUID != "" {
+		link(w, r, provider.Name(), authState.LinkUserUUID, authUser)
+		return
+	}
+	signIn(w, r, provider.Name(), authUser)
+}
+
+// link links the external identity to the account, which started linking it
+func link(w http.ResponseWriter, r *http.Request, provider, userUUID string, user *User) {
+	switch err := linkIdentity(provider, userUUID, user); err {
+	case nil:
+	case ErrIdentityLinked, ErrProviderLinked:
+		respondError(w, r, http.StatusConflict, err.Error())
+		return
+	default:
+		log.Error(err, "cannot link identity", "provider", provider)
+		respondError(w, r, http.StatusInternalServerError, "cannot link identity")
+		return
+	}
+
+	redirectURL := os.Getenv("SOCIAL_LOGIN_REDIRECT_URL")
+	if redirectURL == "" {
+		_ = utils.RespondJSON(w, LinkResponse{Ok: true, Provider: provider})
+		return
+	}
+
+	fragment := url.Values{}
+	fragment.Set("ok", "true")
+	fragment.Set("linked", provider)
+	http.Redirect(w, r, redirectURL+"#"+fragment.Encode(), http.StatusFound)
+}
+
+// signIn issues tokens for the account linked to the external identity
+func signIn(w http.ResponseWriter, r *http.Request, provider string, user *User) {
+	account, err := upsertAccount(provider, user)
+	switch err {
+	case nil:
+	case ErrEmailRegistered:
+		respondError(w, r, http.StatusConflict, err.Error())
+		return
+	case ErrNoEmail:
+		respondError(w, r, http.StatusBadRequest, err.Error())
+		return
+	default:
+		log.Error(err, "cannot sign in", "provider", provider)
+		respondError(w, r, http.StatusInternalServerError, "cannot sign in")
 		return
 	}
 
-	cli := oauthConfig.Client(context.Background(), token)
-	userInfoResp, err := cli.Get(apiEndpoint)
+	// Two-factor authentication applies to social logins as well
+	mfaEnabled, err := mfa.Enabled(account.UUID)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
+		log.Error(err, "cannot check two-factor authentication", "provider", provider)
+		respondError(w, r, http.StatusInternalServerError, "cannot sign in")
+		return
+	}
+	if mfaEnabled {
+		challengeToken, err := mfa.NewChallenge(account.UUID, account.Email)
+		if err != nil {
+			log.Error(err, "cannot issue challenge", "provider", provider)
+			respondError(w, r, http.StatusInternalServerError, "cannot sign in")
+			return
+		}
+		respondChallenge(w, r, mfa.ChallengeResponse{Ok: true, ID: account.ID, MFARequired: true, ChallengeToken: challengeToken})
+		return
+	}
+
+	pair, id, err := token.Issue(account.UUID, token.ClientFromRequest(r))
+	if err == token.ErrAccountSuspended {
+		respondError(w, r, http.StatusForbidden, err.Error())
 		return
 	}
-	defer userInfoResp.Body.Close()
-	userInfo, err := ioutil.ReadAll(userInfoResp.Body)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
+		log.Error(err, "cannot issue token", "provider", provider)
+		respondError(w, r, http.StatusInternalServerError, "jwt token error")
 		return
 	}
-	var authUser User
-	if err := json.Unmarshal(userInfo, &authUser); err != nil {
-		log.Error(err, "")
+
+	resp := token.Response{Ok: true, ID: id, Pair: *pair}
+	redirectURL := os.Getenv("SOCIAL_LOGIN_REDIRECT_URL")
+	if redirectURL == "" {
+		_ = utils.RespondJSON(w, resp)
 		return
 	}
 
-	session.Options = &sessions.Options{
-		Path:   "/",
-		MaxAge: 86400,
+	// Tokens are passed in the fragment, so that they are neither sent to the server nor logged
+	fragment := url.Values{}
+	fragment.Set("ok", "true")
+	fragment.Set("id", resp.ID)
+	fragment.Set("token", resp.Token)
+	fragment.Set("refresh_token", resp.RefreshToken)
+	fragment.Set("expires_in", strconv.FormatInt(resp.ExpiresIn, 10))
+	http.Redirect(w, r, redirectURL+"#"+fragment.Encode(), http.StatusFound)
+}
+
+// respondChallenge responds with the two-factor authentication challenge, or redirects to the post-login page with it
+func respondChallenge(w http.ResponseWriter, r *http.Request, resp mfa.ChallengeResponse) {
+	redirectURL := os.Getenv("SOCIAL_LOGIN_REDIRECT_URL")
+	if redirectURL == "" {
+		_ = utils.RespondJSON(w, resp)
+		return
+	}
+
+	fragment := url.Values{}
+	fragment.Set("ok", "true")
+	fragment.Set("id", resp.ID)
+	fragment.Set("mfa_required", "true")
+	fragment.Set("challenge_token", resp.ChallengeToken)
+	http.Redirect(w, r, redirectURL+"#"+fragment.Encode(), http.StatusFound)
+}
+
+// respondError responds with the error, or redirects to the post-login page with the error if it is configured
+func respondError(w http.ResponseWriter, r *http.Request, code int, msg string) {
+	redirectURL := os.Getenv("SOCIAL_LOGIN_REDIRECT_URL")
+	if redirectURL == "" {
+		_ = utils.RespondError(w, code, msg)
+		return
 	}
-	session.Values["user"] = authUser.Email
-	session.Values["username"] = authUser.Name
-	_ = session.Save(r, w)
 
-	http.Redirect(w, r, "https://heychangju.shop", http.StatusFound)
+	fragment := url.Values{}
+	fragment.Set("ok", "false")
+	fragment.Set("error", msg)
+	http.Redirect(w, r, redirectURL+"#"+fragment.Encode(), http.StatusFound)
 }
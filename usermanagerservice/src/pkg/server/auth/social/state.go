@@ -0,0 +1,122 @@
+/*
+ Copyright 2021 The 110 billion Authors
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package social
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"time"
+
+	"github.com/110billion/sellfie/usermanagerservice/src/pkg/database"
+)
+
+// stateLifetime is how long a login may take, from the redirection to the provider until the callback
+const stateLifetime = 10 * time.Minute
+
+// ErrInvalidState is returned if the state is unknown, expired, already used or issued for another provider
+var ErrInvalidState = errors.New("invalid session state")
+
+// authState is the server-side record of a login in progress, keyed by the state parameter
+type authState struct {
+	Provider     string
+	CodeVerifier string
+	Nonce        string
+	// LinkUserUUID is the user_uuid of the account the identity is linked to, if the login links an identity instead of signing in
+	LinkUserUUID string
+}
+
+// newAuthState generates the state, the PKCE code verifier and the nonce of a new login and stores them.
+// linkUserUUID is the user_uuid of the account to link the identity to, or empty to sign in. The state is returned
+func newAuthState(provider, linkUserUUID string) (string, *authState, error) {
+	state, err := randToken()
+	if err != nil {
+		return "", nil, err
+	}
+	verifier, err := randToken()
+	if err != nil {
+		return "", nil, err
+	}
+	nonce, err := randToken()
+	if err != nil {
+		return "", nil, err
+	}
+	s := &authState{Provider: provider, CodeVerifier: verifier, Nonce: nonce, LinkUserUUID: linkUserUUID}
+
+	db, err := database.Connect()
+	if err != nil {
+		return "", nil, err
+	}
+	defer db.Close()
+
+	if _, err := db.Exec("DELETE FROM OAUTH_STATE WHERE expires_at < NOW()"); err != nil {
+		return "", nil, err
+	}
+	if _, err := db.Exec("INSERT INTO OAUTH_STATE (state_hash, provider, code_verifier, nonce, expires_at, link_user_uuid) VALUES($1, $2, $3, $4, $5, NULLIF($6, '')::uuid)",
+		hashState(state), s.Provider, s.CodeVerifier, s.Nonce, time.Now().Add(stateLifetime), s.LinkUserUUID); err != nil {
+		return "", nil, err
+	}
+	return state, s, nil
+}
+
+// consumeState looks the login up by its state and deletes it, so that the state cannot be replayed
+func consumeState(state, provider string) (*authState, error) {
+	db, err := database.Connect()
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+
+	s := &authState{}
+	var expiresAt time.Time
+	err = db.QueryRow("DELETE FROM OAUTH_STATE WHERE state_hash = $1 RETURNING provider, code_verifier, nonce, expires_at, COALESCE(link_user_uuid::text, '')", hashState(state)).
+		Scan(&s.Provider, &s.CodeVerifier, &s.Nonce, &expiresAt, &s.LinkUserUUID)
+	if err == sql.ErrNoRows {
+		return nil, ErrInvalidState
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if s.Provider != provider || time.Now().After(expiresAt) {
+		return nil, ErrInvalidState
+	}
+	return s, nil
+}
+
+// codeChallenge derives the S256 PKCE code challenge from the code verifier
+func codeChallenge(verifier string) string {
+	sum := sha256.Sum256([]byte(verifier))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// randToken returns a random URL-safe string, for the state, the code verifier and the nonce
+func randToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+func hashState(state string) string {
+	sum := sha256.Sum256([]byte(state))
+	return hex.EncodeToString(sum[:])
+}
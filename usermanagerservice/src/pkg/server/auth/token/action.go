@@ -0,0 +1,87 @@
+/*
+ Copyright 2021 The 110 billion Authors
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package token
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/110billion/sellfie/usermanagerservice/src/internal/utils"
+	"github.com/dgrijalva/jwt-go"
+)
+
+// ActionClaims is the claim set of a token authorizing a single action of the user, e.g., verifying the email.
+// The action is the audience (aud) of the token, so that it is neither usable for another action nor as an access token.
+// Subject (sub) is the user_uuid of the user
+type ActionClaims struct {
+	Email string `json:"email"`
+	jwt.StandardClaims
+}
+
+// Valid validates the time-based claims and checks that the token identifies a user
+func (c *ActionClaims) Valid() error {
+	if err := c.StandardClaims.Valid(); err != nil {
+		return err
+	}
+	if !utils.IsUUID(c.Subject) || c.Id == "" {
+		return fmt.Errorf("token does not identify a user")
+	}
+	if c.Issuer != Issuer {
+		return fmt.Errorf("unexpected issuer %q", c.Issuer)
+	}
+	return nil
+}
+
+// IssueActionToken issues a signed token authorizing the action for the user identified by userUUID, valid for lifetime.
+// The claims are returned as well, for the caller to record the token id (jti), e.g., to make the token single-use
+func IssueActionToken(action, userUUID, email string, lifetime time.Duration) (string, *ActionClaims, error) {
+	jti, err := randomString(16)
+	if err != nil {
+		return "", nil, err
+	}
+
+	now := time.Now()
+	claims := &ActionClaims{
+		Email: email,
+		StandardClaims: jwt.StandardClaims{
+			Id:        jti,
+			Subject:   userUUID,
+			Audience:  action,
+			Issuer:    Issuer,
+			IssuedAt:  now.Unix(),
+			ExpiresAt: now.Add(lifetime).Unix(),
+		},
+	}
+
+	signed, err := sign(claims)
+	if err != nil {
+		return "", nil, err
+	}
+	return signed, claims, nil
+}
+
+// ParseActionToken verifies the signature and the claims of the token, which must authorize the action
+func ParseActionToken(action, tokenString string) (*ActionClaims, error) {
+	claims := &ActionClaims{}
+	if _, err := jwt.ParseWithClaims(tokenString, claims, verificationKey); err != nil {
+		return nil, err
+	}
+	if claims.Audience != action {
+		return nil, fmt.Errorf("token is not issued for %s", action)
+	}
+	return claims, nil
+}
@@ -0,0 +1,132 @@
+/*
+ Copyright 2021 The 110 billion Authors
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package token
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/110billion/sellfie/usermanagerservice/src/internal/apiserver"
+	"github.com/110billion/sellfie/usermanagerservice/src/internal/utils"
+	"github.com/110billion/sellfie/usermanagerservice/src/internal/wrapper"
+	"github.com/go-logr/logr"
+)
+
+// Response is common struct for responding requests issuing tokens
+type Response struct {
+	Ok bool   `json:"ok"`
+	ID string `json:"id"`
+	Pair
+}
+
+type handler struct {
+	log logr.Logger
+}
+
+type refreshReqBody struct {
+	RefreshToken string `json:"refresh_token"`
+}
+
+// IntrospectResponse tells whether an access token is active, i.e., valid and not revoked
+type IntrospectResponse struct {
+	Active bool `json:"active"`
+}
+
+type introspectReqBody struct {
+	Token string `json:"token"`
+}
+
+// NewHandler instantiates a new token api handler
+func NewHandler(parent wrapper.RouterWrapper, logger logr.Logger) (apiserver.APIHandler, error) {
+	handler := &handler{log: logger}
+
+	// /token
+	tokenWrapper := wrapper.New("/token", nil, nil)
+	if err := parent.Add(tokenWrapper); err != nil {
+		return nil, err
+	}
+
+	// /token/refresh
+	refreshWrapper := wrapper.New("/refresh", []string{http.MethodPost}, handler.refreshHandler)
+	if err := tokenWrapper.Add(refreshWrapper); err != nil {
+		return nil, err
+	}
+
+	// /token/introspect
+	introspectWrapper := wrapper.New("/introspect", []string{http.MethodPost}, handler.introspectHandler)
+	if err := tokenWrapper.Add(introspectWrapper); err != nil {
+		return nil, err
+	}
+
+	return handler, nil
+}
+
+func (h *handler) refreshHandler(w http.ResponseWriter, req *http.Request) {
+	// Decode request body
+	refreshReq := &refreshReqBody{}
+	decoder := json.NewDecoder(req.Body)
+	if err := decoder.Decode(refreshReq); err != nil || refreshReq.RefreshToken == "" {
+		_ = utils.RespondError(w, http.StatusBadRequest, "request body is not in json form or is malformed")
+		return
+	}
+
+	pair, id, err := Refresh(refreshReq.RefreshToken, ClientFromRequest(req))
+	switch err {
+	case nil:
+	case ErrRefreshTokenReused:
+		h.log.Info("refresh token reuse detected, token family is revoked")
+		_ = utils.RespondError(w, http.StatusUnauthorized, ErrInvalidRefreshToken.Error())
+		return
+	case ErrInvalidRefreshToken:
+		_ = utils.RespondError(w, http.StatusUnauthorized, err.Error())
+		return
+	case ErrAccountSuspended, ErrAccountDeletionScheduled:
+		_ = utils.RespondError(w, http.StatusForbidden, err.Error())
+		return
+	default:
+		h.log.Error(err, "refresh token error")
+		_ = utils.RespondError(w, http.StatusInternalServerError, "cannot refresh token")
+		return
+	}
+
+	_ = utils.RespondJSON(w, Response{Ok: true, ID: id, Pair: *pair})
+}
+
+// introspectHandler tells the other services whether an access token is revoked, as they verify its signature but cannot tell
+func (h *handler) introspectHandler(w http.ResponseWriter, req *http.Request) {
+	// Decode request body
+	introspectReq := &introspectReqBody{}
+	decoder := json.NewDecoder(req.Body)
+	if err := decoder.Decode(introspectReq); err != nil || introspectReq.Token == "" {
+		_ = utils.RespondError(w, http.StatusBadRequest, "request body is not in json form or is malformed")
+		return
+	}
+
+	claims, err := Parse(introspectReq.Token)
+	if err != nil {
+		_ = utils.RespondJSON(w, IntrospectResponse{Active: false})
+		return
+	}
+	revoked, err := IsRevoked(claims)
+	if err != nil {
+		h.log.Error(err, "introspect token error")
+		_ = utils.RespondError(w, http.StatusInternalServerError, "cannot verify token")
+		return
+	}
+
+	_ = utils.RespondJSON(w, IntrospectResponse{Active: !revoked})
+}
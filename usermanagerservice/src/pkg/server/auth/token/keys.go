@@ -0,0 +1,362 @@
+/*
+ Copyright 2021 The 110 billion Authors
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package token
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"database/sql"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/110billion/sellfie/usermanagerservice/src/internal/utils"
+	"github.com/110billion/sellfie/usermanagerservice/src/pkg/database"
+	"github.com/dgrijalva/jwt-go"
+	"gopkg.in/robfig/cron.v2"
+)
+
+const (
+	// AlgHS256 signs tokens with the shared secret JWT_SECRET_KEY. No keys are published via JWKS
+	AlgHS256 = "HS256"
+	// AlgRS256 signs tokens with RSA keys
+	AlgRS256 = "RS256"
+	// AlgEdDSA signs tokens with Ed25519 keys
+	AlgEdDSA = "EdDSA"
+
+	rsaKeyBits = 2048
+
+	// keyReloadInterval limits how often an unknown kid triggers reloading keys from the database
+	keyReloadInterval = 30 * time.Second
+)
+
+var (
+	// keyRotationPeriod is how long a key is used for signing
+	keyRotationPeriod = utils.DurationFromEnv("JWT_KEY_ROTATION_PERIOD", 30*24*time.Hour)
+	// keyOverlap is how long a key is published before it is used for signing, and is kept after it is replaced.
+	// It should be longer than the access token lifetime and the time verifiers cache the JWKS
+	keyOverlap = utils.DurationFromEnv("JWT_KEY_OVERLAP", 24*time.Hour)
+
+	keys = &keySet{}
+)
+
+// signingAlg returns the configured signing algorithm
+func signingAlg() string {
+	switch alg := os.Getenv("JWT_SIGNING_ALG"); alg {
+	case AlgHS256, AlgEdDSA:
+		return alg
+	default:
+		return AlgRS256
+	}
+}
+
+// signingKey is a key pair identified by its kid
+type signingKey struct {
+	id      string
+	alg     string
+	private crypto.Signer
+	public  crypto.PublicKey
+
+	activeAt time.Time
+}
+
+func (k *signingKey) method() jwt.SigningMethod {
+	if k.alg == AlgEdDSA {
+		return SigningMethodEdDSA
+	}
+	return jwt.SigningMethodRS256
+}
+
+// keySet holds the keys published via JWKS, sorted by the time they become active
+type keySet struct {
+	lock sync.RWMutex
+
+	keys     []*signingKey
+	loadedAt time.Time
+}
+
+// InitKeys loads the signing keys, creating one if there is none, and schedules the key rotation.
+// If tokens are signed with the shared secret, it only checks that the secret is set
+func InitKeys() error {
+	if signingAlg() == AlgHS256 {
+		// Tokens signed with an empty secret can be forged by anyone
+		if len(secretKey()) == 0 {
+			return fmt.Errorf("JWT_SECRET_KEY is required to sign tokens with %s", AlgHS256)
+		}
+		return nil
+	}
+
+	if err := rotateKeys(); err != nil {
+		return err
+	}
+	if err := keys.load(); err != nil {
+		return err
+	}
+
+	rotator := cron.New()
+	if _, err := rotator.AddFunc("@every 10m", func() {
+		if err := rotateKeys(); err != nil {
+			log.Error(err, "key rotation error")
+			return
+		}
+		if err := keys.load(); err != nil {
+			log.Error(err, "key load error")
+		}
+	}); err != nil {
+		return err
+	}
+	rotator.Start()
+	return nil
+}
+
+// rotateKeys creates the next signing key once the current one is about to be replaced, and drops retired keys.
+// Replicas serialize the rotation with an advisory lock, so that only one of them creates the key
+func rotateKeys() error {
+	db, err := database.Connect()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = tx.Rollback()
+	}()
+
+	if _, err := tx.Exec("SELECT pg_advisory_xact_lock(hashtext('SIGNING_KEY'))"); err != nil {
+		return err
+	}
+
+	if _, err := tx.Exec("DELETE FROM SIGNING_KEY WHERE retire_at < NOW()"); err != nil {
+		return err
+	}
+
+	now := time.Now()
+	alg := signingAlg()
+
+	var latestAlg string
+	var latestActiveAt time.Time
+	err = tx.QueryRow("SELECT alg, active_at FROM SIGNING_KEY ORDER BY active_at DESC LIMIT 1").Scan(&latestAlg, &latestActiveAt)
+	switch {
+	case err == sql.ErrNoRows || (err == nil && latestAlg != alg):
+		// Start signing with a new key right away, if there is no key or the algorithm is changed
+		if err := createKey(tx, alg, now); err != nil {
+			return err
+		}
+	case err != nil:
+		return err
+	case !now.Before(latestActiveAt.Add(keyRotationPeriod - keyOverlap)):
+		// Publish the next key keyOverlap ahead of using it, so that verifiers caching the JWKS know it already
+		next := latestActiveAt.Add(keyRotationPeriod)
+		if next.Before(now) {
+			next = now
+		}
+		if err := createKey(tx, alg, next); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// createKey stores a new key becoming active at activeAt, and retires the other keys keyOverlap after it
+func createKey(tx *sql.Tx, alg string, activeAt time.Time) error {
+	var private crypto.Signer
+	var err error
+	if alg == AlgEdDSA {
+		_, private, err = ed25519.GenerateKey(rand.Reader)
+	} else {
+		private, err = rsa.GenerateKey(rand.Reader, rsaKeyBits)
+	}
+	if err != nil {
+		return err
+	}
+
+	der, err := x509.MarshalPKCS8PrivateKey(private)
+	if err != nil {
+		return err
+	}
+
+	id, err := randomString(12)
+	if err != nil {
+		return err
+	}
+
+	if _, err := tx.Exec("UPDATE SIGNING_KEY SET retire_at = $1 WHERE retire_at IS NULL", activeAt.Add(keyOverlap)); err != nil {
+		return err
+	}
+
+	if _, err := tx.Exec("INSERT INTO SIGNING_KEY (kid, alg, private_key, active_at, created_at) VALUES($1, $2, $3, $4, NOW())",
+		id, alg, string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})), activeAt); err != nil {
+		return err
+	}
+
+	log.Info(fmt.Sprintf("Signing key %s is created, active from %s", id, activeAt.Format(time.RFC3339)))
+	return nil
+}
+
+// load reloads the published keys from the database
+func (s *keySet) load() error {
+	db, err := database.Connect()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	rows, err := db.Query("SELECT kid, alg, private_key, active_at FROM SIGNING_KEY WHERE retire_at IS NULL OR retire_at > NOW() ORDER BY active_at")
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	var loaded []*signingKey
+	for rows.Next() {
+		key := &signingKey{}
+		var privatePEM string
+		if err := rows.Scan(&key.id, &key.alg, &privatePEM, &key.activeAt); err != nil {
+			return err
+		}
+
+		block, _ := pem.Decode([]byte(privatePEM))
+		if block == nil {
+			return fmt.Errorf("key %s is not in PEM form", key.id)
+		}
+		private, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			return err
+		}
+		signer, ok := private.(crypto.Signer)
+		if !ok {
+			return fmt.Errorf("key %s is not a signing key", key.id)
+		}
+		key.private = signer
+		key.public = signer.Public()
+
+		loaded = append(loaded, key)
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.keys = loaded
+	s.loadedAt = time.Now()
+	return nil
+}
+
+// current returns the key to sign tokens with, i.e., the latest active key
+func (s *keySet) current() (*signingKey, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	now := time.Now()
+	for i := len(s.keys) - 1; i >= 0; i-- {
+		if !s.keys[i].activeAt.After(now) {
+			return s.keys[i], nil
+		}
+	}
+	return nil, fmt.Errorf("no active signing key")
+}
+
+// get returns the published key with the kid. Unknown kids reload the keys, at most once per keyReloadInterval
+func (s *keySet) get(id string) (*signingKey, error) {
+	if key := s.find(id); key != nil {
+		return key, nil
+	}
+
+	s.lock.RLock()
+	stale := time.Since(s.loadedAt) > keyReloadInterval
+	s.lock.RUnlock()
+	if stale {
+		if err := s.load(); err != nil {
+			return nil, err
+		}
+		if key := s.find(id); key != nil {
+			return key, nil
+		}
+	}
+	return nil, fmt.Errorf("unknown key %q", id)
+}
+
+func (s *keySet) find(id string) *signingKey {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	for _, key := range s.keys {
+		if key.id == id {
+			return key
+		}
+	}
+	return nil
+}
+
+// JSONWebKey is a public key in the JWK form (RFC 7517)
+type JSONWebKey struct {
+	KeyType string `json:"kty"`
+	KeyID   string `json:"kid"`
+	Use     string `json:"use"`
+	Alg     string `json:"alg"`
+
+	// RSA public key
+	N string `json:"n,omitempty"`
+	E string `json:"e,omitempty"`
+
+	// Ed25519 public key
+	Curve string `json:"crv,omitempty"`
+	X     string `json:"x,omitempty"`
+}
+
+// JSONWebKeySet is a set of JWKs, served at /.well-known/jwks.json
+type JSONWebKeySet struct {
+	Keys []JSONWebKey `json:"keys"`
+}
+
+// JWKS returns the public keys verifiers should accept, including the ones about to be used or just replaced
+func JWKS() JSONWebKeySet {
+	keys.lock.RLock()
+	defer keys.lock.RUnlock()
+
+	set := JSONWebKeySet{Keys: []JSONWebKey{}}
+	for _, key := range keys.keys {
+		jwk := JSONWebKey{KeyID: key.id, Use: "sig", Alg: key.alg}
+		switch public := key.public.(type) {
+		case *rsa.PublicKey:
+			jwk.KeyType = "RSA"
+			jwk.N = base64.RawURLEncoding.EncodeToString(public.N.Bytes())
+			jwk.E = base64.RawURLEncoding.EncodeToString(big.NewInt(int64(public.E)).Bytes())
+		case ed25519.PublicKey:
+			jwk.KeyType = "OKP"
+			jwk.Curve = "Ed25519"
+			jwk.X = base64.RawURLEncoding.EncodeToString(public)
+		default:
+			continue
+		}
+		set.Keys = append(set.Keys, jwk)
+	}
+	return set
+}
@@ -0,0 +1,204 @@
+/*
+ Copyright 2021 The 110 billion Authors
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package token
+
+import (
+	"errors"
+	"net/http"
+	"time"
+	"unicode/utf8"
+
+	"github.com/110billion/sellfie/usermanagerservice/src/internal/utils"
+	"github.com/110billion/sellfie/usermanagerservice/src/pkg/database"
+)
+
+const (
+	maxDeviceNameLength = 255
+	maxUserAgentLength  = 512
+)
+
+// ErrSessionNotFound is returned if a session does not exist, is not of the user or is already revoked
+var ErrSessionNotFound = errors.New("session is not found")
+
+// Client is the device a login session is used from
+type Client struct {
+	// DeviceName is the name the app gives to the device, e.g., Galaxy S21. Optional
+	DeviceName string
+	UserAgent  string
+	IP         string
+}
+
+// ClientFromRequest returns the client of the request. The app names the device with the X-Device-Name header
+func ClientFromRequest(req *http.Request) Client {
+	return Client{
+		DeviceName: truncate(req.Header.Get("X-Device-Name"), maxDeviceNameLength),
+		UserAgent:  truncate(req.UserAgent(), maxUserAgentLength),
+		IP:         utils.ClientIP(req),
+	}
+}
+
+// Session is a login of the user on a device, i.e., a refresh token family
+type Session struct {
+	ID         string    `json:"id"`
+	DeviceName string    `json:"device_name"`
+	UserAgent  string    `json:"user_agent"`
+	IP         string    `json:"ip"`
+	CreatedAt  time.Time `json:"created_at"`
+	// LastSeenAt is when the session last logged in or refreshed its tokens
+	LastSeenAt time.Time `json:"last_seen_at"`
+	// Current is true for the session of the request
+	Current bool `json:"current"`
+}
+
+// ListSessions returns the active sessions of the user identified by userUUID, the most recently seen first.
+// currentSessionID is the session of the request, which is marked as current
+func ListSessions(userUUID, currentSessionID string) ([]Session, error) {
+	db, err := database.Connect()
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+
+	rows, err := db.Query(`SELECT session_id, device_name, user_agent, ip, created_at, last_seen_at FROM LOGIN_SESSION
+		WHERE user_uuid = $1 AND revoked_at IS NULL AND expires_at > NOW() ORDER BY last_seen_at DESC`, userUUID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	sessions := []Session{}
+	for rows.Next() {
+		s := Session{}
+		if err := rows.Scan(&s.ID, &s.DeviceName, &s.UserAgent, &s.IP, &s.CreatedAt, &s.LastSeenAt); err != nil {
+			return nil, err
+		}
+		s.Current = s.ID == currentSessionID
+		sessions = append(sessions, s)
+	}
+	return sessions, rows.Err()
+}
+
+// RevokeSession revokes the session of the user. Its refresh tokens cannot be used anymore,
+// and its access tokens are rejected by Authenticate
+func RevokeSession(userUUID, sessionID string) error {
+	db, err := database.Connect()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = tx.Rollback()
+	}()
+
+	result, err := tx.Exec("UPDATE LOGIN_SESSION SET revoked_at = NOW() WHERE session_id = $1 AND user_uuid = $2 AND revoked_at IS NULL", sessionID, userUUID)
+	if err != nil {
+		return err
+	}
+	if n, err := result.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return ErrSessionNotFound
+	}
+	if err := revokeFamily(tx, sessionID); err != nil {
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	return nil
+}
+
+// RevokeOtherSessions revokes every session of the user but the current one, and returns how many are revoked
+func RevokeOtherSessions(userUUID, currentSessionID string) (int, error) {
+	db, err := database.Connect()
+	if err != nil {
+		return 0, err
+	}
+	defer db.Close()
+
+	rows, err := db.Query("SELECT session_id FROM LOGIN_SESSION WHERE user_uuid = $1 AND session_id <> $2 AND revoked_at IS NULL", userUUID, currentSessionID)
+	if err != nil {
+		return 0, err
+	}
+	var sessionIDs []string
+	for rows.Next() {
+		var sessionID string
+		if err := rows.Scan(&sessionID); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		sessionIDs = append(sessionIDs, sessionID)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	revoked := 0
+	for _, sessionID := range sessionIDs {
+		// Sessions revoked concurrently, e.g., by their own logout, are skipped
+		if err := RevokeSession(userUUID, sessionID); err == ErrSessionNotFound {
+			continue
+		} else if err != nil {
+			return revoked, err
+		}
+		revoked++
+	}
+	return revoked, nil
+}
+
+// upsertSession records the session of the user, starting at createdAt, as seen from the client now
+func upsertSession(db execer, sessionID, userUUID string, client Client, createdAt time.Time) error {
+	now := time.Now()
+	_, err := db.Exec(`INSERT INTO LOGIN_SESSION (session_id, user_uuid, device_name, user_agent, ip, created_at, last_seen_at, expires_at)
+		VALUES($1, $2, $3, $4, $5, $6, $7, $8)
+		ON CONFLICT (session_id) DO UPDATE SET
+			device_name = COALESCE(NULLIF(EXCLUDED.device_name, ''), LOGIN_SESSION.device_name),
+			user_agent = EXCLUDED.user_agent, ip = EXCLUDED.ip,
+			last_seen_at = EXCLUDED.last_seen_at, expires_at = EXCLUDED.expires_at`,
+		sessionID, userUUID, client.DeviceName, client.UserAgent, client.IP, createdAt, now, now.Add(refreshTokenLifetime))
+	return err
+}
+
+// revokeFamily revokes the refresh tokens of the family and its session
+func revokeFamily(db execer, familyID string) error {
+	if _, err := db.Exec("UPDATE REFRESH_TOKEN SET revoked_at = NOW() WHERE family_id = $1 AND revoked_at IS NULL", familyID); err != nil {
+		return err
+	}
+	if _, err := db.Exec("UPDATE LOGIN_SESSION SET revoked_at = NOW() WHERE session_id = $1 AND revoked_at IS NULL", familyID); err != nil {
+		return err
+	}
+	revocations.invalidate(sessionKey(familyID))
+	return nil
+}
+
+// truncate cuts s to at most n bytes, on a rune boundary
+func truncate(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	for n > 0 && !utf8.RuneStart(s[n]) {
+		n--
+	}
+	return s[:n]
+}
@@ -0,0 +1,91 @@
+/*
+ Copyright 2021 The 110 billion Authors
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package token
+
+import (
+	"context"
+	"net/http"
+	"strings"
+
+	"github.com/110billion/sellfie/usermanagerservice/src/internal/apiserver"
+	"github.com/110billion/sellfie/usermanagerservice/src/internal/utils"
+	"github.com/110billion/sellfie/usermanagerservice/src/pkg/role"
+	logf "sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+const bearerPrefix = "Bearer "
+
+var log = logf.Log.WithName("token")
+
+type contextKey struct{}
+
+// NewContext returns a copy of ctx carrying the claims of the authenticated user
+func NewContext(ctx context.Context, claims *Claims) context.Context {
+	return context.WithValue(ctx, contextKey{}, claims)
+}
+
+// FromContext returns the claims of the authenticated user, stored by Authenticate
+func FromContext(ctx context.Context) (*Claims, bool) {
+	claims, ok := ctx.Value(contextKey{}).(*Claims)
+	return claims, ok
+}
+
+// FromRequest extracts the bearer token from the Authorization header of the request
+func FromRequest(req *http.Request) (string, bool) {
+	header := req.Header.Get("Authorization")
+	if len(header) < len(bearerPrefix) || !strings.EqualFold(header[:len(bearerPrefix)], bearerPrefix) {
+		return "", false
+	}
+	tokenString := strings.TrimSpace(header[len(bearerPrefix):])
+	return tokenString, tokenString != ""
+}
+
+// Authenticate is a wrapper middleware which rejects requests without a valid bearer token.
+// Claims of the token are available to the next handler via FromContext, and the user and the roles implied by the role of the token
+// are set in X-Remote-User and X-Remote-Group, which wrapper.Wrapper checks the required roles against
+func Authenticate(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		tokenString, ok := FromRequest(req)
+		if !ok {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="sellfie"`)
+			_ = utils.RespondError(w, http.StatusUnauthorized, "bearer token is required")
+			return
+		}
+
+		claims, err := Parse(tokenString)
+		if err != nil {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="sellfie", error="invalid_token"`)
+			_ = utils.RespondError(w, http.StatusUnauthorized, "token is invalid or expired")
+			return
+		}
+
+		revoked, err := IsRevoked(claims)
+		if err != nil {
+			log.Error(err, "cannot check token revocation")
+			_ = utils.RespondError(w, http.StatusInternalServerError, "cannot verify token")
+			return
+		}
+		if revoked {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="sellfie", error="invalid_token"`)
+			_ = utils.RespondError(w, http.StatusUnauthorized, "token is revoked")
+			return
+		}
+
+		apiserver.SetUser(req.Header, claims.Subject, role.Implied(claims.Role))
+		next(w, req.WithContext(NewContext(req.Context(), claims)))
+	}
+}
@@ -0,0 +1,249 @@
+/*
+ Copyright 2021 The 110 billion Authors
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package token
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"time"
+
+	"github.com/110billion/sellfie/usermanagerservice/src/pkg/database"
+)
+
+var (
+	// ErrInvalidRefreshToken is returned if a refresh token is unknown, expired or revoked
+	ErrInvalidRefreshToken = errors.New("refresh token is invalid or expired")
+	// ErrRefreshTokenReused is returned if an already rotated refresh token is presented again.
+	// The whole token family is revoked when it happens
+	ErrRefreshTokenReused = errors.New("refresh token is reused")
+	// ErrAccountSuspended is returned if tokens are requested for a suspended account
+	ErrAccountSuspended = errors.New("account is suspended")
+	// ErrAccountDeletionScheduled is returned on refreshing the tokens of an account whose deletion is scheduled.
+	// The user logs in again to restore the account
+	ErrAccountDeletionScheduled = errors.New("deletion of the account is scheduled, log in to restore it")
+)
+
+// suspendedCondition holds for the accounts whose suspension has not expired
+const suspendedCondition = "suspended_at IS NOT NULL AND (suspended_until IS NULL OR suspended_until > NOW())"
+
+// Pair is a pair of an access token and a refresh token, issued on login and on refresh
+type Pair struct {
+	Token        string `json:"token"`
+	RefreshToken string `json:"refresh_token"`
+	ExpiresIn    int64  `json:"expires_in"`
+}
+
+// Issue issues a pair of tokens for the user identified by userUUID, starting a new login session on the client,
+// and returns the current handle of the user as well.
+// The session is the refresh token family, whose id is the sid of the access tokens.
+// ErrAccountSuspended is returned if the account is suspended. Logging in to an account whose deletion is scheduled
+// restores the account, which is kept until it is purged
+func Issue(userUUID string, client Client) (*Pair, string, error) {
+	familyID, err := randomString(16)
+	if err != nil {
+		return nil, "", err
+	}
+
+	db, err := database.Connect()
+	if err != nil {
+		return nil, "", err
+	}
+	defer db.Close()
+
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, "", err
+	}
+	defer func() {
+		_ = tx.Rollback()
+	}()
+
+	// Locking the account keeps it from being purged while its deletion is canceled
+	var id, email, userRole string
+	var suspended, deletionScheduled bool
+	if err := tx.QueryRow("SELECT user_id, user_email, role, "+suspendedCondition+", deletion_scheduled_at IS NOT NULL FROM USER_TABLE WHERE user_uuid = $1 FOR UPDATE", userUUID).
+		Scan(&id, &email, &userRole, &suspended, &deletionScheduled); err != nil {
+		return nil, "", err
+	}
+	if suspended {
+		return nil, "", ErrAccountSuspended
+	}
+	if deletionScheduled {
+		if _, err := tx.Exec("UPDATE USER_TABLE SET deletion_scheduled_at = NULL WHERE user_uuid = $1", userUUID); err != nil {
+			return nil, "", err
+		}
+		log.Info("deletion of the account is canceled by logging in", "user", userUUID)
+	}
+
+	now := time.Now()
+	if err := upsertSession(tx, familyID, userUUID, client, now); err != nil {
+		return nil, "", err
+	}
+	refreshToken, err := insertRefreshToken(tx, familyID, userUUID)
+	if err != nil {
+		return nil, "", err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, "", err
+	}
+
+	pair, err := newPair(userUUID, id, email, userRole, refreshToken, now, familyID)
+	if err != nil {
+		return nil, "", err
+	}
+	return pair, id, nil
+}
+
+// Refresh rotates the refresh token and issues a new pair of tokens, recording the client as the last one seen in the session.
+// The current handle of the user is returned as well, which the new access token carries even if the user changed it since.
+// The presented refresh token can never be used again; presenting it again revokes every token of its family
+func Refresh(refreshToken string, client Client) (*Pair, string, error) {
+	db, err := database.Connect()
+	if err != nil {
+		return nil, "", err
+	}
+	defer db.Close()
+
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, "", err
+	}
+	defer func() {
+		_ = tx.Rollback()
+	}()
+
+	var familyID, userUUID string
+	var expiresAt time.Time
+	var rotatedAt, revokedAt sql.NullTime
+	err = tx.QueryRow("SELECT family_id, user_uuid, expires_at, rotated_at, revoked_at FROM REFRESH_TOKEN WHERE token_hash = $1 FOR UPDATE", hashToken(refreshToken)).
+		Scan(&familyID, &userUUID, &expiresAt, &rotatedAt, &revokedAt)
+	if err == sql.ErrNoRows {
+		return nil, "", ErrInvalidRefreshToken
+	}
+	if err != nil {
+		return nil, "", err
+	}
+
+	if revokedAt.Valid || time.Now().After(expiresAt) {
+		return nil, "", ErrInvalidRefreshToken
+	}
+
+	if rotatedAt.Valid {
+		if err := revokeFamily(tx, familyID); err != nil {
+			return nil, "", err
+		}
+		if err := tx.Commit(); err != nil {
+			return nil, "", err
+		}
+		return nil, "", ErrRefreshTokenReused
+	}
+
+	if _, err := tx.Exec("UPDATE REFRESH_TOKEN SET rotated_at = NOW() WHERE token_hash = $1", hashToken(refreshToken)); err != nil {
+		return nil, "", err
+	}
+
+	// The handle and the role are looked up again, so that changes are applied on refresh
+	var id, email, userRole string
+	var suspended, deletionScheduled bool
+	if err := tx.QueryRow("SELECT user_id, user_email, role, "+suspendedCondition+", deletion_scheduled_at IS NOT NULL FROM USER_TABLE WHERE user_uuid = $1", userUUID).
+		Scan(&id, &email, &userRole, &suspended, &deletionScheduled); err == sql.ErrNoRows {
+		return nil, "", ErrInvalidRefreshToken
+	} else if err != nil {
+		return nil, "", err
+	}
+	if suspended {
+		return nil, "", ErrAccountSuspended
+	}
+	if deletionScheduled {
+		return nil, "", ErrAccountDeletionScheduled
+	}
+
+	// The family starts when the user logs in
+	var authTime time.Time
+	if err := tx.QueryRow("SELECT MIN(issued_at) FROM REFRESH_TOKEN WHERE family_id = $1", familyID).Scan(&authTime); err != nil {
+		return nil, "", err
+	}
+
+	// Sessions started before they were recorded are recorded on their first refresh
+	if err := upsertSession(tx, familyID, userUUID, client, authTime); err != nil {
+		return nil, "", err
+	}
+	newRefreshToken, err := insertRefreshToken(tx, familyID, userUUID)
+	if err != nil {
+		return nil, "", err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, "", err
+	}
+
+	pair, err := newPair(userUUID, id, email, userRole, newRefreshToken, authTime, familyID)
+	if err != nil {
+		return nil, "", err
+	}
+	return pair, id, nil
+}
+
+type execer interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+}
+
+// insertRefreshToken stores a new refresh token of the family and returns it.
+// Only the hash of the token is stored
+func insertRefreshToken(db execer, familyID, userUUID string) (string, error) {
+	refreshToken, err := randomString(32)
+	if err != nil {
+		return "", err
+	}
+
+	now := time.Now()
+	if _, err := db.Exec("INSERT INTO REFRESH_TOKEN (token_hash, family_id, user_uuid, issued_at, expires_at) VALUES($1, $2, $3, $4, $5)",
+		hashToken(refreshToken), familyID, userUUID, now, now.Add(refreshTokenLifetime)); err != nil {
+		return "", err
+	}
+	return refreshToken, nil
+}
+
+func newPair(userUUID, id, email, userRole, refreshToken string, authTime time.Time, sessionID string) (*Pair, error) {
+	accessToken, err := newAccessToken(userUUID, id, email, userRole, authTime, sessionID)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Pair{
+		Token:        accessToken,
+		RefreshToken: refreshToken,
+		ExpiresIn:    int64(accessTokenLifetime / time.Second),
+	}, nil
+}
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+func randomString(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
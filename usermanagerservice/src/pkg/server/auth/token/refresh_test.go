@@ -0,0 +1,110 @@
+/*
+ Copyright 2021 The 110 billion Authors
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package token
+
+import "testing"
+
+var testClient = Client{DeviceName: "Test device", UserAgent: "token-test", IP: "192.0.2.1"}
+
+// TestRefreshReused presents a rotated refresh token again, against the database at DB_HOST.
+// The whole family is revoked, including the tokens rotated from it and their access tokens
+func TestRefreshReused(t *testing.T) {
+	userUUID := createTestUser(t)
+
+	first, id, err := Issue(userUUID, testClient)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, gotID, err := Refresh(first.RefreshToken, testClient)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if gotID != id {
+		t.Fatalf("want id %s, got %s", id, gotID)
+	}
+
+	if _, _, err := Refresh(first.RefreshToken, testClient); err != ErrRefreshTokenReused {
+		t.Fatalf("want %v, got %v", ErrRefreshTokenReused, err)
+	}
+	if _, _, err := Refresh(second.RefreshToken, testClient); err != ErrInvalidRefreshToken {
+		t.Fatalf("want %v for the token rotated from the reused one, got %v", ErrInvalidRefreshToken, err)
+	}
+	checkAccessToken(t, second.Token, true)
+
+	sessions, err := ListSessions(userUUID, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sessions) != 0 {
+		t.Fatalf("want the session revoked, got %+v", sessions)
+	}
+}
+
+// TestRevokeSession revokes one of the sessions of the user, against the database at DB_HOST
+func TestRevokeSession(t *testing.T) {
+	userUUID := createTestUser(t)
+
+	revoked, _, err := Issue(userUUID, testClient)
+	if err != nil {
+		t.Fatal(err)
+	}
+	kept, _, err := Issue(userUUID, testClient)
+	if err != nil {
+		t.Fatal(err)
+	}
+	claims, err := Parse(revoked.Token)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := RevokeSession(userUUID, claims.SessionID); err != nil {
+		t.Fatal(err)
+	}
+	if err := RevokeSession(userUUID, claims.SessionID); err != ErrSessionNotFound {
+		t.Fatalf("want %v on revoking it again, got %v", ErrSessionNotFound, err)
+	}
+
+	if _, _, err := Refresh(revoked.RefreshToken, testClient); err != ErrInvalidRefreshToken {
+		t.Fatalf("want %v, got %v", ErrInvalidRefreshToken, err)
+	}
+	checkAccessToken(t, revoked.Token, true)
+	checkAccessToken(t, kept.Token, false)
+	if _, _, err := Refresh(kept.RefreshToken, testClient); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// checkAccessToken checks if the access token is revoked, with an empty cache as another replica would
+func checkAccessToken(t *testing.T, accessToken string, want bool) {
+	t.Helper()
+	claims, err := Parse(accessToken)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	previous := revocations
+	revocations = newRevocationCache()
+	defer func() { revocations = previous }()
+
+	revoked, err := IsRevoked(claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if revoked != want {
+		t.Fatalf("want revoked %v, got %v", want, revoked)
+	}
+}
@@ -0,0 +1,266 @@
+/*
+ Copyright 2021 The 110 billion Authors
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package token
+
+import (
+	"database/sql"
+	"sync"
+	"time"
+
+	"github.com/110billion/sellfie/usermanagerservice/src/internal/utils"
+	"github.com/110billion/sellfie/usermanagerservice/src/pkg/database"
+)
+
+// revocationCacheTTL is how long a revocation lookup is trusted, whether the token is revoked or not.
+// A token revoked by another replica keeps working on this replica for at most this long
+var revocationCacheTTL = utils.DurationFromEnv("REVOCATION_CACHE_TTL", 5*time.Second)
+
+var revocations = newRevocationCache()
+
+// Revoke revokes the access token, i.e., adds its jti to the denylist until it expires
+func Revoke(claims *Claims) error {
+	db, err := database.Connect()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	expiresAt := time.Unix(claims.ExpiresAt, 0)
+	if _, err := db.Exec("INSERT INTO REVOKED_TOKEN (jti, expires_at) VALUES($1, $2) ON CONFLICT (jti) DO NOTHING", claims.Id, expiresAt); err != nil {
+		return err
+	}
+	revocations.set(tokenKey(claims.Id), revocationEntry{revoked: true}, expiresAt)
+
+	// Expired entries are useless, as expired tokens are rejected anyway
+	if _, err := db.Exec("DELETE FROM REVOKED_TOKEN WHERE expires_at < NOW()"); err != nil {
+		return err
+	}
+	return nil
+}
+
+// RevokeRefreshToken revokes the family of the refresh token and its session, if the token belongs to the user
+func RevokeRefreshToken(refreshToken, userUUID string) error {
+	db, err := database.Connect()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	var familyID string
+	err = db.QueryRow("SELECT family_id FROM REFRESH_TOKEN WHERE token_hash = $1 AND user_uuid = $2", hashToken(refreshToken), userUUID).Scan(&familyID)
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	return revokeFamily(db, familyID)
+}
+
+// RevokeAll revokes every access token and refresh token issued to the user identified by userUUID so far
+func RevokeAll(userUUID string) error {
+	db, err := database.Connect()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = tx.Rollback()
+	}()
+
+	if err := RevokeAllTx(tx, userUUID); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// RevokeAllTx revokes every access token and refresh token issued to the user so far within the transaction,
+// so that the revocation commits or rolls back together with the change that requires it
+func RevokeAllTx(tx *sql.Tx, userUUID string) error {
+	if err := RevokeAccessTokensTx(tx, userUUID); err != nil {
+		return err
+	}
+
+	if _, err := tx.Exec("UPDATE REFRESH_TOKEN SET revoked_at = NOW() WHERE user_uuid = $1 AND revoked_at IS NULL", userUUID); err != nil {
+		return err
+	}
+	if _, err := tx.Exec("UPDATE LOGIN_SESSION SET revoked_at = NOW() WHERE user_uuid = $1 AND revoked_at IS NULL", userUUID); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// RevokeAccessTokensTx revokes every access token issued to the user so far within the transaction, keeping the sessions.
+// The clients refresh their tokens, e.g., to get the new handle of the user after it is changed
+func RevokeAccessTokensTx(tx *sql.Tx, userUUID string) error {
+	// The database keeps microseconds, which tokens tell their issue time in
+	revokedBefore := time.Now().Truncate(time.Microsecond)
+	if _, err := tx.Exec(`INSERT INTO USER_REVOCATION (user_uuid, revoked_before) VALUES($1, $2)
+		ON CONFLICT (user_uuid) DO UPDATE SET revoked_before = EXCLUDED.revoked_before`, userUUID, revokedBefore); err != nil {
+		return err
+	}
+	revocations.invalidate(userKey(userUUID))
+	return nil
+}
+
+// IsRevoked checks if the access token is revoked, either by its jti, by revoking its session or by revoking every token of the user.
+// Lookups are cached in memory for revocationCacheTTL, so that most requests do not hit the database
+func IsRevoked(claims *Claims) (bool, error) {
+	tokenEntry, tokenCached := revocations.get(tokenKey(claims.Id))
+	sessionEntry, sessionCached := revocations.get(sessionKey(claims.SessionID))
+	userEntry, userCached := revocations.get(userKey(claims.Subject))
+	if (tokenCached && tokenEntry.revoked) || (sessionCached && sessionEntry.revoked) {
+		return true, nil
+	}
+	if tokenCached && sessionCached && userCached {
+		return claims.IssuedAtTime().Before(userEntry.revokedBefore), nil
+	}
+
+	db, err := database.Connect()
+	if err != nil {
+		return false, err
+	}
+	defer db.Close()
+
+	// Tokens without a session are issued by GetJwtToken
+	var revoked, sessionRevoked bool
+	var userRevokedBefore sql.NullTime
+	if err := db.QueryRow(`SELECT EXISTS(SELECT 1 FROM REVOKED_TOKEN WHERE jti = $1),
+		(SELECT revoked_before FROM USER_REVOCATION WHERE user_uuid = $2),
+		EXISTS(SELECT 1 FROM LOGIN_SESSION WHERE session_id = $3 AND revoked_at IS NOT NULL)`, claims.Id, claims.Subject, claims.SessionID).
+		Scan(&revoked, &userRevokedBefore, &sessionRevoked); err != nil {
+		return false, err
+	}
+
+	// Revoked tokens and sessions stay revoked, so they are trusted until the token expires
+	expiresAt := time.Unix(claims.ExpiresAt, 0)
+	revocations.set(tokenKey(claims.Id), revocationEntry{revoked: revoked}, expiresAt)
+	revocations.set(sessionKey(claims.SessionID), revocationEntry{revoked: sessionRevoked}, expiresAt)
+	revocations.set(userKey(claims.Subject), revocationEntry{revokedBefore: userRevokedBefore.Time}, expiresAt)
+
+	return revoked || sessionRevoked || claims.IssuedAtTime().Before(userRevokedBefore.Time), nil
+}
+
+func tokenKey(jti string) string {
+	return "token/" + jti
+}
+
+func sessionKey(sessionID string) string {
+	return "session/" + sessionID
+}
+
+func userKey(userUUID string) string {
+	return "user/" + userUUID
+}
+
+// revocationEntry is a cached revocation lookup of a token, a session or a user
+type revocationEntry struct {
+	// revoked is whether the token or the session is revoked
+	revoked bool
+	// revokedBefore is when every token of the user issued before is revoked
+	revokedBefore time.Time
+}
+
+type cachedRevocation struct {
+	entry revocationEntry
+	until time.Time
+}
+
+// revocationCache caches revocation lookups. Revocations on this replica invalidate the cache, so they take effect right away here.
+// An invalidated key is not cached for revocationCacheTTL, as the revocation may be in a transaction which is not committed yet,
+// so that its lookups see the revocation as soon as it commits
+type revocationCache struct {
+	lock sync.Mutex
+
+	entries     map[string]cachedRevocation
+	invalidated map[string]time.Time
+	lastSweep   time.Time
+}
+
+func newRevocationCache() *revocationCache {
+	return &revocationCache{
+		entries:     map[string]cachedRevocation{},
+		invalidated: map[string]time.Time{},
+		lastSweep:   time.Now(),
+	}
+}
+
+// get returns the cached entry of the key, if it is cached
+func (c *revocationCache) get(key string) (revocationEntry, bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	cached, ok := c.entries[key]
+	if !ok || time.Now().After(cached.until) {
+		return revocationEntry{}, false
+	}
+	return cached.entry, true
+}
+
+// set caches the entry of the key. Revoked tokens and sessions are cached until expiresAt, and anything else for revocationCacheTTL
+func (c *revocationCache) set(key string, entry revocationEntry, expiresAt time.Time) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	now := time.Now()
+	if until, ok := c.invalidated[key]; ok && now.Before(until) {
+		return
+	}
+	until := now.Add(revocationCacheTTL)
+	if entry.revoked {
+		until = expiresAt
+	}
+	c.entries[key] = cachedRevocation{entry: entry, until: until}
+	c.sweep(now)
+}
+
+// invalidate forgets the entry of the key, and keeps the key from being cached for revocationCacheTTL
+func (c *revocationCache) invalidate(key string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	now := time.Now()
+	delete(c.entries, key)
+	c.invalidated[key] = now.Add(revocationCacheTTL)
+	c.sweep(now)
+}
+
+// sweep drops the expired entries once in a while. The lock must be held
+func (c *revocationCache) sweep(now time.Time) {
+	if now.Sub(c.lastSweep) < time.Minute {
+		return
+	}
+	for key, cached := range c.entries {
+		if now.After(cached.until) {
+			delete(c.entries, key)
+		}
+	}
+	for key, until := range c.invalidated {
+		if now.After(until) {
+			delete(c.invalidated, key)
+		}
+	}
+	c.lastSweep = now
+}
@@ -0,0 +1,225 @@
+/*
+ Copyright 2021 The 110 billion Authors
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package token
+
+import (
+	"os"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/110billion/sellfie/usermanagerservice/src/pkg/database"
+	"github.com/dgrijalva/jwt-go"
+)
+
+const testUserUUID = "8c4f3c1e-0a5b-4d0c-9e57-3f1f7b0d2a61"
+
+func newTestClaims(issuedAt time.Time) *Claims {
+	return &Claims{
+		UserID:        "jane",
+		SessionID:     "session-1",
+		IssuedAtMicro: issuedAt.UnixMicro(),
+		StandardClaims: jwt.StandardClaims{
+			Id:        "token-1",
+			Subject:   testUserUUID,
+			IssuedAt:  issuedAt.Unix(),
+			ExpiresAt: issuedAt.Add(accessTokenLifetime).Unix(),
+		},
+	}
+}
+
+// useRevocationCache replaces the revocation cache for the test, filled with the lookups of the claims
+func useRevocationCache(t *testing.T, claims *Claims, tokenRevoked, sessionRevoked bool, revokedBefore time.Time) {
+	previous := revocations
+	revocations = newRevocationCache()
+	t.Cleanup(func() { revocations = previous })
+
+	expiresAt := time.Unix(claims.ExpiresAt, 0)
+	revocations.set(tokenKey(claims.Id), revocationEntry{revoked: tokenRevoked}, expiresAt)
+	revocations.set(sessionKey(claims.SessionID), revocationEntry{revoked: sessionRevoked}, expiresAt)
+	revocations.set(userKey(claims.Subject), revocationEntry{revokedBefore: revokedBefore}, expiresAt)
+}
+
+// TestIsRevokedCached checks tokens against cached lookups, which must not hit the database
+func TestIsRevokedCached(t *testing.T) {
+	issuedAt := time.Now().Truncate(time.Microsecond)
+	tests := map[string]struct {
+		tokenRevoked   bool
+		sessionRevoked bool
+		revokedBefore  time.Time
+		want           bool
+	}{
+		"active":                              {},
+		"token revoked":                       {tokenRevoked: true, want: true},
+		"session revoked":                     {sessionRevoked: true, want: true},
+		"every token of the user revoked":     {revokedBefore: issuedAt.Add(time.Microsecond), want: true},
+		"issued right after the user revoked": {revokedBefore: issuedAt},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			claims := newTestClaims(issuedAt)
+			useRevocationCache(t, claims, tc.tokenRevoked, tc.sessionRevoked, tc.revokedBefore)
+
+			revoked, err := IsRevoked(claims)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if revoked != tc.want {
+				t.Fatalf("want revoked %v, got %v", tc.want, revoked)
+			}
+		})
+	}
+}
+
+func TestRevocationCacheTTL(t *testing.T) {
+	c := newRevocationCache()
+	expiresAt := time.Now().Add(time.Hour)
+
+	c.set("active", revocationEntry{}, expiresAt)
+	c.set("revoked", revocationEntry{revoked: true}, expiresAt)
+	// Lookups of tokens which are not revoked are trusted for revocationCacheTTL only, as another replica may revoke them
+	for key, cached := range c.entries {
+		want := time.Now().Add(revocationCacheTTL)
+		if cached.entry.revoked {
+			want = expiresAt
+		}
+		if cached.until.After(want) {
+			t.Errorf("%s is cached until %v, after %v", key, cached.until, want)
+		}
+	}
+
+	c.entries["active"] = cachedRevocation{until: time.Now().Add(-time.Second)}
+	if _, ok := c.get("active"); ok {
+		t.Fatal("an expired entry is used")
+	}
+}
+
+// TestRevocationCacheInvalidate checks that a revocation on this replica is not hidden by the cache,
+// even if a lookup racing with the revocation transaction caches the state before it commits
+func TestRevocationCacheInvalidate(t *testing.T) {
+	c := newRevocationCache()
+	expiresAt := time.Now().Add(time.Hour)
+
+	c.set("user", revocationEntry{}, expiresAt)
+	c.invalidate("user")
+	if _, ok := c.get("user"); ok {
+		t.Fatal("an invalidated entry is used")
+	}
+
+	c.set("user", revocationEntry{}, expiresAt)
+	if _, ok := c.get("user"); ok {
+		t.Fatal("an entry is cached right after the key is invalidated")
+	}
+}
+
+// TestRevoke revokes tokens against the database at DB_HOST, and checks them with an empty cache each time,
+// as another replica which did not revoke them would
+func TestRevoke(t *testing.T) {
+	userUUID := createTestUser(t)
+	useEmptyRevocationCache := func() {
+		previous := revocations
+		revocations = newRevocationCache()
+		t.Cleanup(func() { revocations = previous })
+	}
+	checkRevoked := func(claims *Claims, want bool) {
+		t.Helper()
+		useEmptyRevocationCache()
+		revoked, err := IsRevoked(claims)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if revoked != want {
+			t.Fatalf("want revoked %v, got %v", want, revoked)
+		}
+	}
+
+	claims := newUserClaims(userUUID, time.Now())
+	other := newUserClaims(userUUID, time.Now())
+	checkRevoked(claims, false)
+
+	// Logging out revokes the token only
+	if err := Revoke(claims); err != nil {
+		t.Fatal(err)
+	}
+	checkRevoked(claims, true)
+	checkRevoked(other, false)
+
+	// Logging out everywhere revokes the tokens issued so far, but not the ones issued right after
+	if err := RevokeAll(userUUID); err != nil {
+		t.Fatal(err)
+	}
+	checkRevoked(other, true)
+	checkRevoked(newUserClaims(userUUID, time.Now()), false)
+}
+
+// createTestUser creates a user in the database at DB_HOST, deleted with the records of the user after the test,
+// and returns the user_uuid of the user. The test is skipped without the database
+func createTestUser(t *testing.T) string {
+	if os.Getenv("DB_HOST") == "" {
+		t.Skip("DB_HOST is not set")
+	}
+	if err := database.Migrate(); err != nil {
+		t.Fatal(err)
+	}
+	// Access tokens are signed with the shared secret, so that no signing key is created
+	t.Setenv("JWT_SIGNING_ALG", AlgHS256)
+	t.Setenv("JWT_SECRET_KEY", "token-test-secret")
+
+	db, err := database.Connect()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	id := "token_" + strconv.FormatInt(time.Now().UnixNano()%1e12, 36)
+	var userUUID string
+	if err := db.QueryRow("INSERT INTO USER_TABLE (user_email, name, password, user_id) VALUES($1, 'Token', '', $2) RETURNING user_uuid",
+		id+"@example.com", id).Scan(&userUUID); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() {
+		db, err := database.Connect()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer db.Close()
+
+		for _, stmt := range []string{
+			"DELETE FROM REFRESH_TOKEN WHERE user_uuid = $1",
+			"DELETE FROM LOGIN_SESSION WHERE user_uuid = $1",
+			"DELETE FROM USER_REVOCATION WHERE user_uuid = $1",
+			"DELETE FROM USER_TABLE WHERE user_uuid = $1",
+		} {
+			if _, err := db.Exec(stmt, userUUID); err != nil {
+				t.Error(err)
+			}
+		}
+	})
+	return userUUID
+}
+
+// newUserClaims returns the claims of a token of the user issued at issuedAt, with a jti of its own
+func newUserClaims(userUUID string, issuedAt time.Time) *Claims {
+	claims := newTestClaims(issuedAt)
+	claims.Subject = userUUID
+	claims.SessionID = ""
+	claims.Id, _ = randomString(16)
+	return claims
+}
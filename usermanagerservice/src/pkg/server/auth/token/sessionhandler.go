@@ -0,0 +1,105 @@
+/*
+ Copyright 2021 The 110 billion Authors
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package token
+
+import (
+	"net/http"
+
+	"github.com/110billion/sellfie/usermanagerservice/src/internal/apiserver"
+	"github.com/110billion/sellfie/usermanagerservice/src/internal/utils"
+	"github.com/110billion/sellfie/usermanagerservice/src/internal/wrapper"
+	"github.com/go-logr/logr"
+	"github.com/gorilla/mux"
+)
+
+// SessionsResponse is the response listing the active login sessions of the user
+type SessionsResponse struct {
+	Ok       bool      `json:"ok"`
+	Sessions []Session `json:"sessions"`
+}
+
+// RevokeSessionsResponse is the response of revoking login sessions
+type RevokeSessionsResponse struct {
+	Ok      bool `json:"ok"`
+	Revoked int  `json:"revoked"`
+}
+
+type sessionHandler struct {
+	log logr.Logger
+}
+
+// NewSessionHandler instantiates a new api handler listing and revoking the login sessions of the user
+func NewSessionHandler(parent wrapper.RouterWrapper, logger logr.Logger) (apiserver.APIHandler, error) {
+	handler := &sessionHandler{log: logger}
+
+	// /sessions
+	sessionsWrapper := wrapper.New("/sessions", []string{http.MethodGet, http.MethodDelete}, handler.sessionsHandler)
+	sessionsWrapper.Use(Authenticate)
+	if err := parent.Add(sessionsWrapper); err != nil {
+		return nil, err
+	}
+
+	// /sessions/{session_id}
+	sessionWrapper := wrapper.New("/{session_id}", []string{http.MethodDelete}, handler.revokeHandler)
+	if err := sessionsWrapper.Add(sessionWrapper); err != nil {
+		return nil, err
+	}
+
+	return handler, nil
+}
+
+// sessionsHandler lists the sessions, or revokes every session but the current one on DELETE
+func (h *sessionHandler) sessionsHandler(w http.ResponseWriter, req *http.Request) {
+	claims, _ := FromContext(req.Context())
+
+	if req.Method == http.MethodDelete {
+		revoked, err := RevokeOtherSessions(claims.Subject, claims.SessionID)
+		if err != nil {
+			h.log.Error(err, "revoke sessions error")
+			_ = utils.RespondError(w, http.StatusInternalServerError, "cannot revoke sessions")
+			return
+		}
+		_ = utils.RespondJSON(w, RevokeSessionsResponse{Ok: true, Revoked: revoked})
+		return
+	}
+
+	sessions, err := ListSessions(claims.Subject, claims.SessionID)
+	if err != nil {
+		h.log.Error(err, "list sessions error")
+		_ = utils.RespondError(w, http.StatusInternalServerError, "cannot list sessions")
+		return
+	}
+	_ = utils.RespondJSON(w, SessionsResponse{Ok: true, Sessions: sessions})
+}
+
+// revokeHandler revokes a session of the user. Revoking the current session logs the request out
+func (h *sessionHandler) revokeHandler(w http.ResponseWriter, req *http.Request) {
+	claims, _ := FromContext(req.Context())
+
+	switch err := RevokeSession(claims.Subject, mux.Vars(req)["session_id"]); err {
+	case nil:
+	case ErrSessionNotFound:
+		_ = utils.RespondError(w, http.StatusNotFound, err.Error())
+		return
+	default:
+		h.log.Error(err, "revoke session error")
+		_ = utils.RespondError(w, http.StatusInternalServerError, "cannot revoke session")
+		return
+	}
+
+	_ = utils.RespondJSON(w, RevokeSessionsResponse{Ok: true, Revoked: 1})
+}
@@ -17,30 +17,165 @@
 package token
 
 import (
-	"github.com/dgrijalva/jwt-go"
+	"fmt"
 	"os"
 	"time"
+
+	"github.com/110billion/sellfie/usermanagerservice/src/internal/utils"
+	"github.com/110billion/sellfie/usermanagerservice/src/pkg/role"
+	"github.com/dgrijalva/jwt-go"
 )
 
-type claims struct {
-	userEmail string
+const (
+	// Issuer is the issuer (iss) of the tokens minted by the user manager
+	Issuer = "sellfie-user-manager"
+)
+
+var (
+	accessTokenLifetime  = utils.DurationFromEnv("ACCESS_TOKEN_TTL", 15*time.Minute)
+	refreshTokenLifetime = utils.DurationFromEnv("REFRESH_TOKEN_TTL", 30*24*time.Hour)
+	// reauthMaxAge is how recently the user must have logged in for sensitive operations not asking the password again
+	reauthMaxAge = utils.DurationFromEnv("REAUTH_MAX_AGE", 5*time.Minute)
+)
+
+// Claims is the claim set of an access token.
+// Subject (sub) is the user_uuid identifying the user for good, while UserID (uid) is the handle of the user when the token is issued,
+// which is only for display as the user can change it. IssuedAt (iat) is the time the token is issued and Id (jti) is used to revoke the token.
+// AuthTime (auth_time) is the time the user logged in, which is kept when the token is refreshed.
+// SessionID (sid) is the login session the token is issued in, which revokes the token when the session is revoked.
+// Role is the role of the user when the token is issued.
+// IssuedAtMicro (iat_us) is the issue time in microseconds, as iat is in seconds and cannot tell tokens issued
+// right after revoking every token of the user from those revoked
+type Claims struct {
+	UserID        string `json:"uid"`
+	Email         string `json:"email"`
+	Role          string `json:"role,omitempty"`
+	AuthTime      int64  `json:"auth_time,omitempty"`
+	SessionID     string `json:"sid,omitempty"`
+	IssuedAtMicro int64  `json:"iat_us,omitempty"`
 	jwt.StandardClaims
 }
 
-func GetJwtToken(email string) (string, error) {
-	expirationTime := time.Now().Add(5 * time.Hour)
-	jwtKey := os.Getenv("JWT_SECRET_KEY")
-	claims := &claims{
-		userEmail: email,
+// Valid validates the time-based claims and checks that the token identifies a user
+func (c *Claims) Valid() error {
+	if err := c.StandardClaims.Valid(); err != nil {
+		return err
+	}
+	if !utils.IsUUID(c.Subject) || c.UserID == "" {
+		return fmt.Errorf("token does not identify a user")
+	}
+	if c.Id == "" {
+		return fmt.Errorf("token does not have an id")
+	}
+	if c.Issuer != Issuer {
+		return fmt.Errorf("unexpected issuer %q", c.Issuer)
+	}
+	// Tokens with an audience authorize a single action, and are not access tokens
+	if c.Audience != "" {
+		return fmt.Errorf("token is not an access token")
+	}
+	return nil
+}
+
+// IssuedAtTime returns when the token is issued, in microseconds if the token tells
+func (c *Claims) IssuedAtTime() time.Time {
+	if c.IssuedAtMicro != 0 {
+		return time.UnixMicro(c.IssuedAtMicro)
+	}
+	return time.Unix(c.IssuedAt, 0)
+}
+
+// AuthenticatedWithin returns whether the user logged in within d
+func (c *Claims) AuthenticatedWithin(d time.Duration) bool {
+	return c.AuthTime != 0 && time.Since(time.Unix(c.AuthTime, 0)) <= d
+}
+
+// RecentlyAuthenticated returns whether the user logged in within REAUTH_MAX_AGE,
+// e.g., to allow sensitive operations without asking the password again
+func (c *Claims) RecentlyAuthenticated() bool {
+	return c.AuthenticatedWithin(reauthMaxAge)
+}
+
+// GetJwtToken issues a signed access token for the user, who has just logged in.
+// The token is not bound to a login session and has the user role only; use Issue to start a session
+func GetJwtToken(userUUID, id, email string) (string, error) {
+	return newAccessToken(userUUID, id, email, role.User, time.Now(), "")
+}
+
+// newAccessToken issues a signed access token for the user with the role, who logged in at authTime in the session.
+// id is the handle of the user, and userUUID identifies the user
+func newAccessToken(userUUID, id, email, userRole string, authTime time.Time, sessionID string) (string, error) {
+	jti, err := randomString(16)
+	if err != nil {
+		return "", err
+	}
+
+	now := time.Now()
+	claims := &Claims{
+		UserID:        id,
+		Email:         email,
+		Role:          userRole,
+		AuthTime:      authTime.Unix(),
+		SessionID:     sessionID,
+		IssuedAtMicro: now.UnixMicro(),
 		StandardClaims: jwt.StandardClaims{
-			ExpiresAt: expirationTime.Unix(),
+			Id:        jti,
+			Subject:   userUUID,
+			Issuer:    Issuer,
+			IssuedAt:  now.Unix(),
+			ExpiresAt: now.Add(accessTokenLifetime).Unix(),
 		},
 	}
 
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-	tokenString, err := token.SignedString([]byte(jwtKey))
+	return sign(claims)
+}
+
+// sign signs the claims with the current signing key
+func sign(claims jwt.Claims) (string, error) {
+	if signingAlg() == AlgHS256 {
+		return jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString(secretKey())
+	}
+
+	key, err := keys.current()
 	if err != nil {
 		return "", err
 	}
-	return tokenString, nil
+
+	token := jwt.NewWithClaims(key.method(), claims)
+	token.Header["kid"] = key.id
+	return token.SignedString(key.private)
+}
+
+// Parse verifies the signature and the claims of the token and returns its claims
+func Parse(tokenString string) (*Claims, error) {
+	claims := &Claims{}
+	if _, err := jwt.ParseWithClaims(tokenString, claims, verificationKey); err != nil {
+		return nil, err
+	}
+	return claims, nil
+}
+
+// verificationKey looks up the key to verify the token with.
+// The signing method of the token must match the key, so that a public key is never used as an HMAC secret
+func verificationKey(t *jwt.Token) (interface{}, error) {
+	if signingAlg() == AlgHS256 {
+		if t.Method != jwt.SigningMethodHS256 {
+			return nil, fmt.Errorf("unexpected signing method %s", t.Header["alg"])
+		}
+		return secretKey(), nil
+	}
+
+	id, _ := t.Header["kid"].(string)
+	key, err := keys.get(id)
+	if err != nil {
+		return nil, err
+	}
+	if t.Method != key.method() {
+		return nil, fmt.Errorf("unexpected signing method %s", t.Header["alg"])
+	}
+	return key.public, nil
+}
+
+func secretKey() []byte {
+	return []byte(os.Getenv("JWT_SECRET_KEY"))
 }
@@ -0,0 +1,187 @@
+/*
+ Copyright 2021 The 110 billion Authors
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package userinfo
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/110billion/sellfie/usermanagerservice/src/internal/utils"
+	"github.com/110billion/sellfie/usermanagerservice/src/pkg/database"
+	"github.com/lib/pq"
+)
+
+// maxBatchSize is how many users are looked up at most in a request
+var maxBatchSize = utils.IntFromEnv("USERINFO_BATCH_MAX", 100)
+
+// Fields of a card, which are selected by the fields query parameter
+const (
+	fieldName    = "name"
+	fieldURL     = "image_url"
+	fieldComment = "comment"
+)
+
+// Card is the public profile of a user.
+// ID and UUID are always set, while the other fields are set only if they are selected
+type Card struct {
+	ID      string  `json:"id"`
+	UUID    string  `json:"uuid"`
+	Name    *string `json:"name,omitempty"`
+	URL     *string `json:"image_url,omitempty"`
+	Comment *string `json:"comment,omitempty"`
+}
+
+// Missing lists the requested users which are not found
+type Missing struct {
+	IDs   []string `json:"ids"`
+	UUIDs []string `json:"uuids"`
+}
+
+// BatchResponse is the response of looking up users in a batch
+type BatchResponse struct {
+	Ok bool `json:"ok"`
+	// Users are in the order of the request, the ids before the uuids
+	Users   []*Card `json:"users"`
+	Missing Missing `json:"missing"`
+}
+
+// batchHandler looks up the cards of the users in the ids and uuids query parameters in a query.
+// Parameters are comma separated lists, and may be repeated. ids are the current handles; old handles are reported missing,
+// so references outliving a handle change should be uuids
+func (h *handler) batchHandler(w http.ResponseWriter, req *http.Request) {
+	query := req.URL.Query()
+	ids := splitList(query["ids"])
+	uuids := splitList(query["uuids"])
+
+	if len(ids)+len(uuids) == 0 {
+		_ = utils.RespondError(w, http.StatusBadRequest, "ids or uuids are required")
+		return
+	}
+	if len(ids)+len(uuids) > maxBatchSize {
+		_ = utils.RespondErrorDetails(w, http.StatusBadRequest, "too many users are requested", []utils.ErrorDetail{{
+			Rule: "max_batch_size", Message: "at most " + strconv.Itoa(maxBatchSize) + " ids and uuids can be requested at once",
+		}})
+		return
+	}
+
+	var violations []utils.ErrorDetail
+	for _, uuid := range uuids {
+		if !utils.IsUUID(uuid) {
+			violations = append(violations, utils.ErrorDetail{Field: "uuids", Rule: "format", Message: uuid + " is not a uuid"})
+		}
+	}
+	fields := map[string]bool{fieldName: true, fieldURL: true, fieldComment: true}
+	if selected := splitList(query["fields"]); len(selected) > 0 {
+		fields = map[string]bool{}
+		for _, field := range selected {
+			switch field {
+			case "id", "uuid":
+			case fieldName, fieldURL, fieldComment:
+				fields[field] = true
+			default:
+				violations = append(violations, utils.ErrorDetail{Field: "fields", Rule: "unknown", Message: field + " is not a field of a user"})
+			}
+		}
+	}
+	if len(violations) > 0 {
+		_ = utils.RespondErrorDetails(w, http.StatusBadRequest, "query is not valid", violations)
+		return
+	}
+
+	cards, err := lookUp(ids, uuids)
+	if err != nil {
+		h.log.Error(err, "get userinfo batch error")
+		_ = utils.RespondError(w, http.StatusInternalServerError, "cannot get user info")
+		return
+	}
+
+	resp := BatchResponse{Ok: true, Users: []*Card{}, Missing: Missing{IDs: []string{}, UUIDs: []string{}}}
+	for i, card := range cards {
+		if card == nil {
+			if i < len(ids) {
+				resp.Missing.IDs = append(resp.Missing.IDs, ids[i])
+			} else {
+				resp.Missing.UUIDs = append(resp.Missing.UUIDs, uuids[i-len(ids)])
+			}
+			continue
+		}
+		if !fields[fieldName] {
+			card.Name = nil
+		}
+		if !fields[fieldURL] {
+			card.URL = nil
+		}
+		if !fields[fieldComment] {
+			card.Comment = nil
+		}
+		resp.Users = append(resp.Users, card)
+	}
+
+	_ = utils.RespondJSON(w, resp)
+}
+
+// lookUp returns the cards of the users of the ids followed by those of the uuids, in order, with nil for the users not found
+func lookUp(ids, uuids []string) ([]*Card, error) {
+	db, err := database.Connect()
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+
+	// ord is the position of the user in the request, and the uuids are numbered after the ids
+	rows, err := db.Query(`SELECT t.ord, u.user_id, u.user_uuid, i.name, i.profile_url, i.profile_comment
+		FROM unnest($1::text[]) WITH ORDINALITY AS t(key, ord)
+		JOIN USER_TABLE u ON u.user_id = t.key JOIN USER_INFO i ON i.user_id = u.user_id
+		UNION ALL
+		SELECT t.ord + $3, u.user_id, u.user_uuid, i.name, i.profile_url, i.profile_comment
+		FROM unnest($2::uuid[]) WITH ORDINALITY AS t(key, ord)
+		JOIN USER_TABLE u ON u.user_uuid = t.key JOIN USER_INFO i ON i.user_id = u.user_id`,
+		pq.Array(ids), pq.Array(uuids), len(ids))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	cards := make([]*Card, len(ids)+len(uuids))
+	for rows.Next() {
+		var ord int
+		card := &Card{Name: new(string), URL: new(string), Comment: new(string)}
+		if err := rows.Scan(&ord, &card.ID, &card.UUID, card.Name, card.URL, card.Comment); err != nil {
+			return nil, err
+		}
+		cards[ord-1] = card
+	}
+	return cards, rows.Err()
+}
+
+// splitList splits the comma separated values of a query parameter, skipping empty and repeated ones
+func splitList(values []string) []string {
+	list := []string{}
+	seen := map[string]bool{}
+	for _, value := range values {
+		for _, v := range strings.Split(value, ",") {
+			v = strings.TrimSpace(v)
+			if v == "" || seen[v] {
+				continue
+			}
+			seen[v] = true
+			list = append(list, v)
+		}
+	}
+	return list
+}
@@ -5,6 +5,7 @@ import (
 	"github.com/110billion/sellfie/usermanagerservice/src/internal/utils"
 	"github.com/110billion/sellfie/usermanagerservice/src/internal/wrapper"
 	"github.com/110billion/sellfie/usermanagerservice/src/pkg/database"
+	"github.com/110billion/sellfie/usermanagerservice/src/pkg/handle"
 	"github.com/go-logr/logr"
 	"github.com/gorilla/mux"
 	"net/http"
@@ -15,7 +16,9 @@ type handler struct {
 }
 
 type userInfoRespBody struct {
-	Id      string `json:"id"`
+	Id string `json:"id"`
+	// UUID identifies the user for good, while Id is the handle the user can change
+	UUID    string `json:"uuid"`
 	Name    string `json:"name"`
 	URL     string `json:"image_url"`
 	Comment string `json:"comment"`
@@ -27,10 +30,17 @@ func NewHandler(parent wrapper.RouterWrapper, logger logr.Logger) (apiserver.API
 
 	// /userinfo
 	userInfoWrapper := wrapper.New("/userinfo/{id}", []string{http.MethodGet}, handler.userInfoHandler)
+	userInfoWrapper.Use(handle.Redirect("id"))
 	if err := parent.Add(userInfoWrapper); err != nil {
 		return nil, err
 	}
 
+	// /userinfo, added after /userinfo/{id} so that it does not shadow it
+	batchWrapper := wrapper.New("/userinfo", []string{http.MethodGet}, handler.batchHandler)
+	if err := parent.Add(batchWrapper); err != nil {
+		return nil, err
+	}
+
 	return handler, nil
 }
 
@@ -53,8 +63,9 @@ func (h *handler) userInfoHandler(w http.ResponseWriter, req *http.Request) {
 	}
 	defer db.Close()
 
-	var url, name, comment string
-	if err = db.QueryRow("SELECT profile_url, name, profile_comment FROM USER_INFO WHERE user_id = $1", id).Scan(&url, &name, &comment); err != nil {
+	var url, name, comment, uuid string
+	if err = db.QueryRow(`SELECT i.profile_url, i.name, i.profile_comment, u.user_uuid FROM USER_INFO i JOIN USER_TABLE u ON u.user_id = i.user_id
+		WHERE i.user_id = $1`, id).Scan(&url, &name, &comment, &uuid); err != nil {
 		h.log.Error(err, "get userinfo error")
 		_ = utils.RespondError(w, http.StatusBadRequest, "cannot get user info")
 		return
@@ -62,6 +73,7 @@ func (h *handler) userInfoHandler(w http.ResponseWriter, req *http.Request) {
 
 	_ = utils.RespondJSON(w, userInfoRespBody{
 		Id:      id,
+		UUID:    uuid,
 		Name:    name,
 		URL:     url,
 		Comment: comment,
@@ -0,0 +1,112 @@
+/*
+ Copyright 2021 The 110 billion Authors
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package verify
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+
+	"github.com/110billion/sellfie/usermanagerservice/src/internal/apiserver"
+	"github.com/110billion/sellfie/usermanagerservice/src/internal/utils"
+	"github.com/110billion/sellfie/usermanagerservice/src/internal/wrapper"
+	"github.com/go-logr/logr"
+)
+
+// Response is common struct for responding verification requests
+type Response struct {
+	Ok bool   `json:"ok"`
+	ID string `json:"id,omitempty"`
+}
+
+type handler struct {
+	log logr.Logger
+}
+
+type verifyReqBody struct {
+	Token string `json:"token"`
+}
+
+type resendReqBody struct {
+	Email string `json:"email"`
+}
+
+// NewHandler instantiates a new email verification api handler
+func NewHandler(parent wrapper.RouterWrapper, logger logr.Logger) (apiserver.APIHandler, error) {
+	handler := &handler{log: logger}
+
+	// /verify
+	verifyWrapper := wrapper.New("/verify", []string{http.MethodPost}, handler.verifyHandler)
+	if err := parent.Add(verifyWrapper); err != nil {
+		return nil, err
+	}
+
+	// /verify/resend
+	resendWrapper := wrapper.New("/resend", []string{http.MethodPost}, handler.resendHandler)
+	if err := verifyWrapper.Add(resendWrapper); err != nil {
+		return nil, err
+	}
+
+	return handler, nil
+}
+
+func (h *handler) verifyHandler(w http.ResponseWriter, req *http.Request) {
+	// Decode request body
+	verifyReq := &verifyReqBody{}
+	decoder := json.NewDecoder(req.Body)
+	if err := decoder.Decode(verifyReq); err != nil || verifyReq.Token == "" {
+		_ = utils.RespondError(w, http.StatusBadRequest, "request body is not in json form or is malformed")
+		return
+	}
+
+	id, err := Verify(verifyReq.Token)
+	if err == ErrInvalidToken {
+		_ = utils.RespondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if err != nil {
+		h.log.Error(err, "verify error")
+		_ = utils.RespondError(w, http.StatusInternalServerError, "cannot verify email")
+		return
+	}
+
+	_ = utils.RespondJSON(w, Response{Ok: true, ID: id})
+}
+
+func (h *handler) resendHandler(w http.ResponseWriter, req *http.Request) {
+	// Decode request body
+	resendReq := &resendReqBody{}
+	decoder := json.NewDecoder(req.Body)
+	if err := decoder.Decode(resendReq); err != nil || resendReq.Email == "" {
+		_ = utils.RespondError(w, http.StatusBadRequest, "request body is not in json form or is malformed")
+		return
+	}
+
+	err := Resend(resendReq.Email)
+	if throttled, ok := err.(*ThrottledError); ok {
+		w.Header().Set("Retry-After", strconv.Itoa(int(throttled.RetryAfter.Seconds())+1))
+		_ = utils.RespondError(w, http.StatusTooManyRequests, err.Error())
+		return
+	}
+	if err != nil {
+		h.log.Error(err, "resend verification error")
+		_ = utils.RespondError(w, http.StatusInternalServerError, "cannot send verification mail")
+		return
+	}
+
+	_ = utils.RespondJSON(w, Response{Ok: true})
+}
@@ -0,0 +1,71 @@
+/*
+ Copyright 2021 The 110 billion Authors
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package verify
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/110billion/sellfie/usermanagerservice/src/internal/utils"
+	logf "sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+const (
+	// PolicyAllow lets unverified accounts log in
+	PolicyAllow = "allow"
+	// PolicyDeny refuses logins of unverified accounts
+	PolicyDeny = "deny"
+	// PolicyGrace lets unverified accounts log in for UNVERIFIED_LOGIN_GRACE after they sign up
+	PolicyGrace = "grace"
+)
+
+var (
+	log = logf.Log.WithName("verify")
+
+	loginPolicy     = policyFromEnv()
+	unverifiedGrace = utils.DurationFromEnv("UNVERIFIED_LOGIN_GRACE", 72*time.Hour)
+)
+
+// LoginAllowed returns whether an account may log in under UNVERIFIED_LOGIN_POLICY, i.e., allow, deny or grace
+func LoginAllowed(emailVerified bool, createdAt time.Time) bool {
+	if emailVerified {
+		return true
+	}
+
+	switch loginPolicy {
+	case PolicyAllow:
+		return true
+	case PolicyDeny:
+		return false
+	default:
+		return time.Since(createdAt) < unverifiedGrace
+	}
+}
+
+func policyFromEnv() string {
+	policy := os.Getenv("UNVERIFIED_LOGIN_POLICY")
+	switch policy {
+	case PolicyAllow, PolicyDeny, PolicyGrace:
+		return policy
+	case "":
+		return PolicyGrace
+	default:
+		log.Error(fmt.Errorf("invalid policy %q", policy), "falling back to the default", "env", "UNVERIFIED_LOGIN_POLICY", "default", PolicyGrace)
+		return PolicyGrace
+	}
+}
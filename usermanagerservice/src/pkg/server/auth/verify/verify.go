@@ -0,0 +1,234 @@
+/*
+ Copyright 2021 The 110 billion Authors
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package verify
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/110billion/sellfie/usermanagerservice/src/internal/utils"
+	"github.com/110billion/sellfie/usermanagerservice/src/pkg/database"
+	"github.com/110billion/sellfie/usermanagerservice/src/pkg/mail"
+	"github.com/110billion/sellfie/usermanagerservice/src/pkg/server/auth/token"
+)
+
+const (
+	// ActionVerifyEmail is the action of the verification tokens
+	ActionVerifyEmail = "verify_email"
+
+	defaultVerificationURL = "https://heychangju.shop/verify"
+	// maxSendsPerDay limits the verification resends requested for an email in 24 hours
+	maxSendsPerDay = 5
+)
+
+var (
+	verificationLifetime = utils.DurationFromEnv("EMAIL_VERIFICATION_TTL", 24*time.Hour)
+	// resendInterval is how long one waits before another verification mail is requested for the same email
+	resendInterval = utils.DurationFromEnv("EMAIL_VERIFICATION_RESEND_INTERVAL", time.Minute)
+
+	// ErrInvalidToken is returned if a verification token is invalid, expired, already used or issued for an old email
+	ErrInvalidToken = errors.New("verification token is invalid, expired or already used")
+)
+
+// ThrottledError is returned if a verification mail is requested too often
+type ThrottledError struct {
+	RetryAfter time.Duration
+}
+
+func (e *ThrottledError) Error() string {
+	return fmt.Sprintf("verification mail is requested too often, retry after %s", e.RetryAfter.Round(time.Second))
+}
+
+// SendVerification issues a single-use verification token for the email of the user and mails the verification link.
+// userUUID identifies the user, and id is the handle the mail greets the user by
+func SendVerification(ctx context.Context, userUUID, id, email string) error {
+	msg, err := newVerification(userUUID, id, email)
+	if err != nil {
+		return err
+	}
+	return mail.Send(ctx, msg)
+}
+
+// newVerification issues a single-use verification token for the email of the user and returns the mail of its link
+func newVerification(userUUID, id, email string) (*mail.Message, error) {
+	verificationToken, claims, err := token.IssueActionToken(ActionVerifyEmail, userUUID, email, verificationLifetime)
+	if err != nil {
+		return nil, err
+	}
+
+	db, err := database.Connect()
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+
+	if _, err := db.Exec("DELETE FROM EMAIL_VERIFICATION WHERE expires_at < NOW()"); err != nil {
+		return nil, err
+	}
+	if _, err := db.Exec("INSERT INTO EMAIL_VERIFICATION (jti, user_uuid, email, created_at, expires_at) VALUES($1, $2, $3, $4, $5)",
+		claims.Id, userUUID, email, time.Unix(claims.IssuedAt, 0), time.Unix(claims.ExpiresAt, 0)); err != nil {
+		return nil, err
+	}
+
+	link := os.Getenv("EMAIL_VERIFICATION_URL")
+	if link == "" {
+		link = defaultVerificationURL
+	}
+	link += "?token=" + url.QueryEscape(verificationToken)
+
+	return &mail.Message{
+		To:      email,
+		Subject: "Verify your Sellfie email",
+		Body: fmt.Sprintf("Hello %s,\n\nOpen the link below to verify your email. The link expires in %s.\n\n%s\n\n"+
+			"If you did not sign up for Sellfie, ignore this mail.\n", id, verificationLifetime, link),
+	}, nil
+}
+
+// Resend sends another verification mail to the unverified account of the email.
+// Resends are throttled per submitted email whether it is registered or not, and the mail is sent in the background.
+// Nothing is sent, without an error, if no unverified account has the email, so that registered emails are not disclosed
+func Resend(email string) error {
+	if err := throttleResend(email); err != nil {
+		return err
+	}
+
+	db, err := database.Connect()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	var userUUID, id string
+	var verified bool
+	err = db.QueryRow("SELECT user_uuid, user_id, email_verified FROM USER_TABLE WHERE user_email = $1", email).Scan(&userUUID, &id, &verified)
+	if err == sql.ErrNoRows || (err == nil && verified) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	msg, err := newVerification(userUUID, id, email)
+	if err != nil {
+		return err
+	}
+	mail.SendAsync(msg)
+	return nil
+}
+
+// throttleResend records a resend request for the email, or returns a ThrottledError if the email is requested too often
+func throttleResend(email string) error {
+	key := strings.ToLower(strings.TrimSpace(email))
+
+	db, err := database.Connect()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = tx.Rollback()
+	}()
+
+	// Concurrent requests for the same email are serialized, so that none of them slips through the limits
+	if _, err := tx.Exec("SELECT pg_advisory_xact_lock(hashtext('verification_resend:' || $1))", key); err != nil {
+		return err
+	}
+
+	var sent int
+	var first, last sql.NullTime
+	if err := tx.QueryRow("SELECT COUNT(*), MIN(requested_at), MAX(requested_at) FROM VERIFICATION_RESEND WHERE email = $1 AND requested_at > NOW() - INTERVAL '1 day'", key).
+		Scan(&sent, &first, &last); err != nil {
+		return err
+	}
+	if sent >= maxSendsPerDay {
+		return &ThrottledError{RetryAfter: time.Until(first.Time.Add(24 * time.Hour))}
+	}
+	if last.Valid && time.Since(last.Time) < resendInterval {
+		return &ThrottledError{RetryAfter: resendInterval - time.Since(last.Time)}
+	}
+
+	if _, err := tx.Exec("DELETE FROM VERIFICATION_RESEND WHERE requested_at < NOW() - INTERVAL '1 day'"); err != nil {
+		return err
+	}
+	if _, err := tx.Exec("INSERT INTO VERIFICATION_RESEND (email, requested_at) VALUES($1, NOW())", key); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// Verify consumes the verification token and marks the email of its user verified. The current handle of the user is returned
+func Verify(verificationToken string) (string, error) {
+	claims, err := token.ParseActionToken(ActionVerifyEmail, verificationToken)
+	if err != nil {
+		return "", ErrInvalidToken
+	}
+
+	db, err := database.Connect()
+	if err != nil {
+		return "", err
+	}
+	defer db.Close()
+
+	tx, err := db.Begin()
+	if err != nil {
+		return "", err
+	}
+	defer func() {
+		_ = tx.Rollback()
+	}()
+
+	var email string
+	err = tx.QueryRow("UPDATE EMAIL_VERIFICATION SET used_at = NOW() WHERE jti = $1 AND user_uuid = $2 AND used_at IS NULL RETURNING email",
+		claims.Id, claims.Subject).Scan(&email)
+	if err == sql.ErrNoRows {
+		return "", ErrInvalidToken
+	}
+	if err != nil {
+		return "", err
+	}
+
+	// The token is void if the email is changed after it is issued
+	var id string
+	err = tx.QueryRow("UPDATE USER_TABLE SET email_verified = TRUE WHERE user_uuid = $1 AND user_email = $2 RETURNING user_id", claims.Subject, email).Scan(&id)
+	if err == sql.ErrNoRows || (err == nil && email != claims.Email) {
+		return "", ErrInvalidToken
+	}
+	if err != nil {
+		return "", err
+	}
+
+	// The other tokens of the user are of no use anymore
+	if _, err := tx.Exec("UPDATE EMAIL_VERIFICATION SET used_at = NOW() WHERE user_uuid = $1 AND used_at IS NULL", claims.Subject); err != nil {
+		return "", err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return "", err
+	}
+	return id, nil
+}
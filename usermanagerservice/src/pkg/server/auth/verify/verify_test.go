@@ -0,0 +1,162 @@
+/*
+ Copyright 2021 The 110 billion Authors
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package verify
+
+import (
+	"errors"
+	"net/url"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/110billion/sellfie/usermanagerservice/src/pkg/database"
+	"github.com/110billion/sellfie/usermanagerservice/src/pkg/server/auth/token"
+)
+
+var verificationTokenPattern = regexp.MustCompile(`token=(\S+)`)
+
+// TestVerify verifies the email of a new account with the mailed link, against the database at DB_HOST
+func TestVerify(t *testing.T) {
+	userUUID, id, email := createTestUser(t)
+
+	msg, err := newVerification(userUUID, id, email)
+	if err != nil {
+		t.Fatal(err)
+	}
+	match := verificationTokenPattern.FindStringSubmatch(msg.Body)
+	if match == nil {
+		t.Fatalf("no verification link in %q", msg.Body)
+	}
+	verificationToken, err := url.QueryUnescape(match[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := Verify("not-a-token"); err != ErrInvalidToken {
+		t.Fatalf("want %v, got %v", ErrInvalidToken, err)
+	}
+	got, err := Verify(verificationToken)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != id {
+		t.Fatalf("want id %s, got %s", id, got)
+	}
+
+	db, err := database.Connect()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	var verified bool
+	if err := db.QueryRow("SELECT email_verified FROM USER_TABLE WHERE user_uuid = $1", userUUID).Scan(&verified); err != nil {
+		t.Fatal(err)
+	}
+	if !verified {
+		t.Fatal("want the email verified")
+	}
+
+	if _, err := Verify(verificationToken); err != ErrInvalidToken {
+		t.Fatalf("want %v on reusing the token, got %v", ErrInvalidToken, err)
+	}
+}
+
+// TestResendThrottled requests verification mails for an email which is not registered, against the database at DB_HOST.
+// Requests are throttled per submitted email all the same, regardless of its case
+func TestResendThrottled(t *testing.T) {
+	useDatabase(t)
+	email := "resend_" + strconv.FormatInt(time.Now().UnixNano()%1e12, 36) + "@example.com"
+	t.Cleanup(func() { deleteResends(t, email) })
+
+	if err := Resend(email); err != nil {
+		t.Fatal(err)
+	}
+	var throttled *ThrottledError
+	if err := Resend(" " + strings.ToUpper(email)); !errors.As(err, &throttled) {
+		t.Fatalf("want a throttled error, got %v", err)
+	}
+	if throttled.RetryAfter <= 0 || throttled.RetryAfter > resendInterval {
+		t.Fatalf("want to retry within %v, got %v", resendInterval, throttled.RetryAfter)
+	}
+}
+
+// useDatabase skips the test without the database at DB_HOST, and migrates it otherwise
+func useDatabase(t *testing.T) {
+	if os.Getenv("DB_HOST") == "" {
+		t.Skip("DB_HOST is not set")
+	}
+	if err := database.Migrate(); err != nil {
+		t.Fatal(err)
+	}
+	// Verification tokens are signed with the shared secret, so that no signing key is created
+	t.Setenv("JWT_SIGNING_ALG", token.AlgHS256)
+	t.Setenv("JWT_SECRET_KEY", "verify-test-secret")
+}
+
+// createTestUser creates a user whose email is not verified, deleted with the records of the user after the test,
+// and returns the user_uuid, the handle and the email of the user
+func createTestUser(t *testing.T) (string, string, string) {
+	useDatabase(t)
+	db, err := database.Connect()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	id := "verify_" + strconv.FormatInt(time.Now().UnixNano()%1e12, 36)
+	email := id + "@example.com"
+	var userUUID string
+	if err := db.QueryRow("INSERT INTO USER_TABLE (user_email, name, password, user_id, email_verified) VALUES($1, 'Verify', '', $2, FALSE) RETURNING user_uuid",
+		email, id).Scan(&userUUID); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() {
+		db, err := database.Connect()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer db.Close()
+
+		for _, stmt := range []string{
+			"DELETE FROM EMAIL_VERIFICATION WHERE user_uuid = $1",
+			"DELETE FROM USER_TABLE WHERE user_uuid = $1",
+		} {
+			if _, err := db.Exec(stmt, userUUID); err != nil {
+				t.Error(err)
+			}
+		}
+	})
+	return userUUID, id, email
+}
+
+func deleteResends(t *testing.T, email string) {
+	db, err := database.Connect()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer db.Close()
+
+	if _, err := db.Exec("DELETE FROM VERIFICATION_RESEND WHERE email = $1", email); err != nil {
+		t.Error(err)
+	}
+}
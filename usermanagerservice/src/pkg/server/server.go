@@ -21,14 +21,26 @@ import (
 	"github.com/110billion/sellfie/usermanagerservice/src/internal/apiserver"
 	"github.com/110billion/sellfie/usermanagerservice/src/internal/utils"
 	"github.com/110billion/sellfie/usermanagerservice/src/internal/wrapper"
+	"github.com/110billion/sellfie/usermanagerservice/src/pkg/blob"
+	"github.com/110billion/sellfie/usermanagerservice/src/pkg/database"
+	"github.com/110billion/sellfie/usermanagerservice/src/pkg/deletion"
+	"github.com/110billion/sellfie/usermanagerservice/src/pkg/export"
+	"github.com/110billion/sellfie/usermanagerservice/src/pkg/lockout"
+	"github.com/110billion/sellfie/usermanagerservice/src/pkg/mail"
+	"github.com/110billion/sellfie/usermanagerservice/src/pkg/server/admin"
 	"github.com/110billion/sellfie/usermanagerservice/src/pkg/server/auth"
-	"github.com/110billion/sellfie/usermanagerservice/src/pkg/server/auth/social/facebook"
-	"github.com/110billion/sellfie/usermanagerservice/src/pkg/server/auth/social/google"
+	"github.com/110billion/sellfie/usermanagerservice/src/pkg/server/auth/password"
+	"github.com/110billion/sellfie/usermanagerservice/src/pkg/server/auth/social"
+	"github.com/110billion/sellfie/usermanagerservice/src/pkg/server/auth/token"
+	"github.com/110billion/sellfie/usermanagerservice/src/pkg/server/users"
+	"github.com/110billion/sellfie/usermanagerservice/src/pkg/server/wellknown"
+	"github.com/110billion/sellfie/usermanagerservice/src/pkg/session"
 	"github.com/gorilla/mux"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"net/http"
 	"os"
 	logf "sigs.k8s.io/controller-runtime/pkg/log"
+	"strings"
 )
 
 var (
@@ -46,20 +58,55 @@ type Server interface {
 
 // UserManagingServer is HTTP server for login API
 type server struct {
-	wrapper     wrapper.RouterWrapper
-	authHandler apiserver.APIHandler
+	wrapper          wrapper.RouterWrapper
+	authHandler      apiserver.APIHandler
+	wellKnownHandler apiserver.APIHandler
+	usersHandler     apiserver.APIHandler
+	adminHandler     apiserver.APIHandler
 }
 
 // New is a constructor of Server
 func New() (Server, error) {
-	google.InitGoogleOauthConfig()
-	facebook.InitFacebookOauthConfig()
+	if err := database.Migrate(); err != nil {
+		return nil, err
+	}
+	if err := token.InitKeys(); err != nil {
+		return nil, err
+	}
+	if err := social.LoadProviders(); err != nil {
+		return nil, err
+	}
+	if err := mail.Init(); err != nil {
+		return nil, err
+	}
+	if err := lockout.Init(); err != nil {
+		return nil, err
+	}
+	if err := password.Init(); err != nil {
+		return nil, err
+	}
+	if err := session.Init(); err != nil {
+		return nil, err
+	}
+	if err := blob.Init(); err != nil {
+		return nil, err
+	}
+	if err := deletion.Init(); err != nil {
+		return nil, err
+	}
+	if err := export.Init(); err != nil {
+		return nil, err
+	}
 
 	srv := &server{}
 	srv.wrapper = wrapper.New("/", nil, srv.rootHandler)
 
 	srv.wrapper.SetRouter(mux.NewRouter())
 	srv.wrapper.Router().HandleFunc("/", srv.rootHandler)
+	// Blobs of a store which cannot serve them, e.g., a bucket, are served at BLOB_BASE_URL by others
+	if files, ok := blob.Default().(http.Handler); ok {
+		srv.wrapper.Router().PathPrefix(blob.ServePath).Handler(http.StripPrefix(strings.TrimSuffix(blob.ServePath, "/"), files))
+	}
 
 	// Set apisHandler
 	authHandler, err := auth.NewHandler(srv.wrapper, log)
@@ -68,6 +115,27 @@ func New() (Server, error) {
 	}
 	srv.authHandler = authHandler
 
+	// Set wellKnownHandler
+	wellKnownHandler, err := wellknown.NewHandler(srv.wrapper, log)
+	if err != nil {
+		return nil, err
+	}
+	srv.wellKnownHandler = wellKnownHandler
+
+	// Set usersHandler
+	usersHandler, err := users.NewHandler(srv.wrapper, log)
+	if err != nil {
+		return nil, err
+	}
+	srv.usersHandler = usersHandler
+
+	// Set adminHandler
+	adminHandler, err := admin.NewHandler(srv.wrapper, log)
+	if err != nil {
+		return nil, err
+	}
+	srv.adminHandler = adminHandler
+
 	return srv, nil
 }
 
@@ -75,7 +143,8 @@ func (s *server) Start() {
 	addr := fmt.Sprintf("0.0.0.0:%d", port)
 
 	log.Info(fmt.Sprintf("Server is running on %s", addr))
-	if err := http.ListenAndServe(addr, s.wrapper.Router()); err != nil { // TODO: TLS
+	// Only the authenticating middlewares set the user headers, which authorize the requests
+	if err := http.ListenAndServe(addr, apiserver.StripUserHeaders(s.wrapper.Router())); err != nil { // TODO: TLS
 		log.Error(err, "cannot launch http server")
 		os.Exit(1)
 	}
@@ -0,0 +1,171 @@
+/*
+ Copyright 2021 The 110 billion Authors
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package users
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/110billion/sellfie/usermanagerservice/src/internal/utils"
+	"github.com/110billion/sellfie/usermanagerservice/src/pkg/database"
+	"github.com/110billion/sellfie/usermanagerservice/src/pkg/deletion"
+	"github.com/110billion/sellfie/usermanagerservice/src/pkg/lockout"
+	"github.com/110billion/sellfie/usermanagerservice/src/pkg/mail"
+	"github.com/110billion/sellfie/usermanagerservice/src/pkg/server/auth/token"
+	"github.com/gorilla/mux"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// DeletionResponse is the response of deleting an account
+type DeletionResponse struct {
+	Ok bool `json:"ok"`
+	// ScheduledAt is when the account is purged, unless it is restored before
+	ScheduledAt time.Time `json:"scheduled_at"`
+}
+
+type deleteReqBody struct {
+	// Password re-authenticates the user. It is required if the account has a password
+	Password string `json:"password"`
+}
+
+// deleteHandler schedules the deletion of the account of the user, who is logged out everywhere.
+// The account can be restored by logging in again until the grace period ends
+func (h *handler) deleteHandler(w http.ResponseWriter, req *http.Request) {
+	id := mux.Vars(req)["user_id"]
+
+	// Admins delete accounts through the admin api, which does not wait for the grace period
+	claims, _ := token.FromContext(req.Context())
+	if !h.authorizeHandle(w, claims, id, "cannot delete the account of another user") {
+		return
+	}
+
+	// Decode request body, which is optional for accounts without a password
+	deleteReq := &deleteReqBody{}
+	decoder := json.NewDecoder(req.Body)
+	if err := decoder.Decode(deleteReq); err != nil && err != io.EOF {
+		_ = utils.RespondError(w, http.StatusBadRequest, "request body is not in json form or is malformed")
+		return
+	}
+
+	// Open DB
+	db, err := database.Connect()
+	if err != nil {
+		h.log.Error(err, "delete account error")
+		_ = utils.RespondError(w, http.StatusInternalServerError, "db connection error")
+		return
+	}
+	defer db.Close()
+
+	var password, email string
+	if err := db.QueryRow("SELECT password, user_email FROM USER_TABLE WHERE user_uuid = $1", claims.Subject).Scan(&password, &email); err != nil {
+		h.log.Error(err, "delete account error")
+		_ = utils.RespondError(w, http.StatusInternalServerError, "cannot get account")
+		return
+	}
+
+	// Deleting is destructive, so the user must prove to be the owner of the account again
+	if password != "" {
+		if deleteReq.Password == "" {
+			_ = utils.RespondError(w, http.StatusUnauthorized, "password is required to delete the account")
+			return
+		}
+
+		// A stolen token must not be enough to guess the password, so the guesses count as failed logins
+		ip := utils.ClientIP(req)
+		wait, err := lockout.CheckLogin(email, ip)
+		if err != nil {
+			h.log.Error(err, "delete account error")
+			_ = utils.RespondError(w, http.StatusInternalServerError, "cannot check login attempts")
+			return
+		}
+		if wait > 0 {
+			w.Header().Set("Retry-After", strconv.Itoa(int(wait.Seconds())+1))
+			_ = utils.RespondError(w, http.StatusTooManyRequests, "too many failed attempts, retry later")
+			return
+		}
+		if err := bcrypt.CompareHashAndPassword([]byte(password), []byte(deleteReq.Password)); err != nil {
+			if err := lockout.FailLogin(email, ip); err != nil {
+				h.log.Error(err, "delete account error")
+			}
+			_ = utils.RespondError(w, http.StatusUnauthorized, "password doesn't match")
+			return
+		}
+	} else if !claims.RecentlyAuthenticated() {
+		_ = utils.RespondError(w, http.StatusUnauthorized, "log in again to delete the account")
+		return
+	}
+
+	scheduledAt, err := deletion.Schedule(claims.Subject)
+	if err == deletion.ErrUserNotFound {
+		_ = utils.RespondError(w, http.StatusNotFound, err.Error())
+		return
+	}
+	if err != nil {
+		h.log.Error(err, "delete account error", "id", id)
+		_ = utils.RespondError(w, http.StatusInternalServerError, "cannot delete account")
+		return
+	}
+
+	// The deletion is scheduled even if the mail is not sent
+	if err := sendDeletionNotice(req.Context(), email, scheduledAt); err != nil {
+		h.log.Error(err, "delete account error", "id", id)
+	}
+
+	_ = utils.RespondJSON(w, DeletionResponse{Ok: true, ScheduledAt: scheduledAt})
+}
+
+// restoreHandler cancels the scheduled deletion of the account of the user
+func (h *handler) restoreHandler(w http.ResponseWriter, req *http.Request) {
+	id := mux.Vars(req)["user_id"]
+
+	claims, _ := token.FromContext(req.Context())
+	if !h.authorizeHandle(w, claims, id, "cannot restore the account of another user") {
+		return
+	}
+
+	switch err := deletion.Restore(claims.Subject); err {
+	case nil:
+	case deletion.ErrUserNotFound:
+		_ = utils.RespondError(w, http.StatusNotFound, err.Error())
+		return
+	case deletion.ErrNotScheduled:
+		_ = utils.RespondError(w, http.StatusConflict, err.Error())
+		return
+	default:
+		h.log.Error(err, "restore account error", "id", id)
+		_ = utils.RespondError(w, http.StatusInternalServerError, "cannot restore account")
+		return
+	}
+
+	_ = utils.RespondJSON(w, Response{Ok: true})
+}
+
+func sendDeletionNotice(ctx context.Context, email string, scheduledAt time.Time) error {
+	return mail.Send(ctx, &mail.Message{
+		To:      email,
+		Subject: "Your Sellfie account will be deleted",
+		Body: fmt.Sprintf("Your Sellfie account is scheduled to be deleted on %s.\n\n"+
+			"Your profile and postings will be removed for good then. "+
+			"If you change your mind, log in and restore your account before that.\n",
+			scheduledAt.UTC().Format("January 2, 2006 15:04 MST")),
+	})
+}
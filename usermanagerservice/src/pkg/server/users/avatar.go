@@ -0,0 +1,209 @@
+/*
+ Copyright 2021 The 110 billion Authors
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package users
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"image"
+	"io"
+	"net/http"
+	"strconv"
+
+	"github.com/110billion/sellfie/usermanagerservice/src/internal/utils"
+	"github.com/110billion/sellfie/usermanagerservice/src/pkg/blob"
+	"github.com/110billion/sellfie/usermanagerservice/src/pkg/database"
+	"github.com/gorilla/mux"
+)
+
+const avatarField = "image"
+
+var (
+	// avatarSizes are the sides of the squares an avatar is stored in. profile_url is the largest one
+	avatarSizes = []int{64, 128, 256, 512}
+	// maxAvatarBytes bounds the size of an uploaded image
+	maxAvatarBytes = int64(utils.IntFromEnv("AVATAR_MAX_BYTES", 5<<20))
+)
+
+// AvatarResponse is the response of uploading an avatar
+type AvatarResponse struct {
+	Ok  bool   `json:"ok"`
+	URL string `json:"image_url"`
+	// Sizes are the URLs of the avatar by the side of the square
+	Sizes map[string]string `json:"sizes"`
+}
+
+// avatarHandler replaces the avatar of the user with the uploaded image on PUT, or removes it on DELETE
+func (h *handler) avatarHandler(w http.ResponseWriter, req *http.Request) {
+	id := mux.Vars(req)["user_id"]
+	if !h.authorizeOwner(w, req, id) {
+		return
+	}
+
+	if req.Method == http.MethodDelete {
+		profile, err := h.setAvatar(req.Context(), id, "", "")
+		if err == ErrProfileNotFound {
+			_ = utils.RespondError(w, http.StatusNotFound, err.Error())
+			return
+		}
+		if err != nil {
+			h.log.Error(err, "remove avatar error", "id", id)
+			_ = utils.RespondError(w, http.StatusInternalServerError, "cannot remove avatar")
+			return
+		}
+		w.Header().Set("ETag", profile.ETag())
+		_ = utils.RespondJSON(w, ProfileResponse{Ok: true, Profile: profile})
+		return
+	}
+
+	// Read the multipart image, bounded by the max size with room for the headers of the part
+	req.Body = http.MaxBytesReader(w, req.Body, maxAvatarBytes+64<<10)
+	file, _, err := req.FormFile(avatarField)
+	if err != nil {
+		_ = utils.RespondError(w, http.StatusBadRequest, "multipart form with the image field is required, up to "+strconv.FormatInt(maxAvatarBytes>>20, 10)+"MiB")
+		return
+	}
+	defer file.Close()
+	defer func() {
+		_ = req.MultipartForm.RemoveAll()
+	}()
+
+	data, err := io.ReadAll(io.LimitReader(file, maxAvatarBytes+1))
+	if err != nil {
+		_ = utils.RespondError(w, http.StatusBadRequest, "cannot read image")
+		return
+	}
+	if int64(len(data)) > maxAvatarBytes {
+		_ = utils.RespondError(w, http.StatusRequestEntityTooLarge, ErrImageSize.Error())
+		return
+	}
+
+	square, err := squareImage(data)
+	switch err {
+	case nil:
+	case ErrImageType:
+		_ = utils.RespondError(w, http.StatusUnsupportedMediaType, err.Error())
+		return
+	case ErrImageSize:
+		_ = utils.RespondError(w, http.StatusRequestEntityTooLarge, err.Error())
+		return
+	default:
+		h.log.Error(err, "upload avatar error", "id", id)
+		_ = utils.RespondError(w, http.StatusInternalServerError, "cannot process image")
+		return
+	}
+
+	prefix, sizes, err := storeAvatar(req.Context(), square)
+	if err != nil {
+		h.log.Error(err, "upload avatar error", "id", id)
+		_ = utils.RespondError(w, http.StatusInternalServerError, "cannot store avatar")
+		return
+	}
+
+	largest := sizes[strconv.Itoa(avatarSizes[len(avatarSizes)-1])]
+	profile, err := h.setAvatar(req.Context(), id, largest, prefix)
+	if err != nil {
+		h.deleteAvatar(req.Context(), prefix)
+		if err == ErrProfileNotFound {
+			_ = utils.RespondError(w, http.StatusNotFound, err.Error())
+			return
+		}
+		h.log.Error(err, "upload avatar error", "id", id)
+		_ = utils.RespondError(w, http.StatusInternalServerError, "cannot set avatar")
+		return
+	}
+
+	w.Header().Set("ETag", profile.ETag())
+	_ = utils.RespondJSON(w, AvatarResponse{Ok: true, URL: largest, Sizes: sizes})
+}
+
+// storeAvatar stores the square in every size under a new random prefix, so that the URLs of an avatar never serve another one.
+// It returns the prefix and the URLs by the sizes
+func storeAvatar(ctx context.Context, square *image.RGBA) (string, map[string]string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", nil, err
+	}
+	prefix := "avatars/" + hex.EncodeToString(b)
+
+	store := blob.Default()
+	sizes := map[string]string{}
+	for _, side := range avatarSizes {
+		data, err := encodeJPEG(resize(square, side))
+		if err != nil {
+			return "", nil, err
+		}
+		key := prefix + "/" + strconv.Itoa(side) + ".jpg"
+		if err := store.Put(ctx, key, "image/jpeg", bytes.NewReader(data)); err != nil {
+			_ = store.DeletePrefix(ctx, prefix)
+			return "", nil, err
+		}
+		sizes[strconv.Itoa(side)] = store.URL(key)
+	}
+	return prefix, sizes, nil
+}
+
+// setAvatar sets profile_url of the user to the url of the avatar stored under the prefix, and deletes the previous avatar.
+// Empty url and prefix remove the avatar
+func (h *handler) setAvatar(ctx context.Context, id, url, prefix string) (*Profile, error) {
+	db, err := database.Connect()
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = tx.Rollback()
+	}()
+
+	var previous string
+	if err := tx.QueryRow("SELECT avatar_key FROM USER_INFO WHERE user_id = $1 FOR UPDATE", id).Scan(&previous); err == sql.ErrNoRows {
+		return nil, ErrProfileNotFound
+	} else if err != nil {
+		return nil, err
+	}
+
+	p := &Profile{ID: id}
+	if err := tx.QueryRow(`UPDATE USER_INFO SET profile_url = $2, avatar_key = $3, updated_at = NOW(), version = version + 1
+		WHERE user_id = $1 RETURNING name, profile_url, profile_comment, updated_at, version`, id, url, prefix).
+		Scan(&p.Name, &p.URL, &p.Comment, &p.UpdatedAt, &p.version); err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	h.deleteAvatar(ctx, previous)
+	return p, nil
+}
+
+// deleteAvatar deletes the avatar stored under the prefix, if any. A failure leaves unreferenced blobs, and is only logged
+func (h *handler) deleteAvatar(ctx context.Context, prefix string) {
+	if prefix == "" {
+		return
+	}
+	if err := blob.Default().DeletePrefix(ctx, prefix); err != nil {
+		h.log.Error(err, "cannot delete avatar", "prefix", prefix)
+	}
+}
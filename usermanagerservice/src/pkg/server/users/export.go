@@ -0,0 +1,127 @@
+/*
+ Copyright 2021 The 110 billion Authors
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package users
+
+import (
+	"io"
+	"net/http"
+
+	"github.com/110billion/sellfie/usermanagerservice/src/internal/utils"
+	"github.com/110billion/sellfie/usermanagerservice/src/pkg/export"
+	"github.com/110billion/sellfie/usermanagerservice/src/pkg/server/auth/token"
+	"github.com/gorilla/mux"
+)
+
+// ExportResponse is the response of requesting an export and of getting its status
+type ExportResponse struct {
+	Ok  bool        `json:"ok"`
+	Job *export.Job `json:"job"`
+	// DownloadURL is a link to the archive of a done export, which expires shortly
+	DownloadURL string `json:"download_url,omitempty"`
+}
+
+// createExportHandler queues an export of the data of the user, whose status is polled at /users/{user_id}/exports/{job_id}
+func (h *handler) createExportHandler(w http.ResponseWriter, req *http.Request) {
+	id := mux.Vars(req)["user_id"]
+	userUUID, ok := h.authorizeSelf(w, req, id)
+	if !ok {
+		return
+	}
+
+	job, err := export.Create(userUUID)
+	if err == export.ErrUserNotFound {
+		_ = utils.RespondError(w, http.StatusNotFound, err.Error())
+		return
+	}
+	if err != nil {
+		h.log.Error(err, "create export error", "id", id)
+		_ = utils.RespondError(w, http.StatusInternalServerError, "cannot create export")
+		return
+	}
+
+	// Headers set after WriteHeader are not sent
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Location", req.URL.Path+"/"+job.ID)
+	w.WriteHeader(http.StatusAccepted)
+	_ = utils.RespondJSON(w, ExportResponse{Ok: true, Job: job})
+}
+
+func (h *handler) exportHandler(w http.ResponseWriter, req *http.Request) {
+	vars := mux.Vars(req)
+	id := vars["user_id"]
+	userUUID, ok := h.authorizeSelf(w, req, id)
+	if !ok {
+		return
+	}
+
+	job, err := export.Get(userUUID, vars["job_id"])
+	if err == export.ErrJobNotFound {
+		_ = utils.RespondError(w, http.StatusNotFound, err.Error())
+		return
+	}
+	if err != nil {
+		h.log.Error(err, "get export error", "id", id)
+		_ = utils.RespondError(w, http.StatusInternalServerError, "cannot get export")
+		return
+	}
+
+	resp := ExportResponse{Ok: true, Job: job}
+	if job.Status == export.StatusDone {
+		if resp.DownloadURL, err = export.DownloadURL(job); err != nil {
+			h.log.Error(err, "get export error", "id", id)
+			_ = utils.RespondError(w, http.StatusInternalServerError, "cannot sign download link")
+			return
+		}
+	}
+	_ = utils.RespondJSON(w, resp)
+}
+
+// downloadHandler serves the archive of the signed download link, which is the only credential of the request
+func (h *handler) downloadHandler(w http.ResponseWriter, req *http.Request) {
+	archive, err := export.OpenArchive(req.Context(), mux.Vars(req)["job_id"], req.URL.Query().Get("token"))
+	switch err {
+	case nil:
+	case export.ErrInvalidLink:
+		_ = utils.RespondError(w, http.StatusForbidden, err.Error())
+		return
+	case export.ErrNotReady:
+		_ = utils.RespondError(w, http.StatusGone, err.Error())
+		return
+	default:
+		h.log.Error(err, "download export error")
+		_ = utils.RespondError(w, http.StatusInternalServerError, "cannot open archive")
+		return
+	}
+	defer archive.Close()
+
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", `attachment; filename="sellfie-export.zip"`)
+	w.Header().Set("Cache-Control", "private, no-store")
+	if _, err := io.Copy(w, archive); err != nil {
+		h.log.Error(err, "download export error")
+	}
+}
+
+// authorizeSelf responds with an error unless the user of the request is the user of the id, and returns the user_uuid of the user.
+// Unlike editing a profile, admins cannot act on behalf of the user
+func (h *handler) authorizeSelf(w http.ResponseWriter, req *http.Request, id string) (string, bool) {
+	claims, _ := token.FromContext(req.Context())
+	if !h.authorizeHandle(w, claims, id, "cannot access the data of another user") {
+		return "", false
+	}
+	return claims.Subject, true
+}
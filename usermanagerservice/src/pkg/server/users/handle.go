@@ -0,0 +1,82 @@
+/*
+ Copyright 2021 The 110 billion Authors
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package users
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+
+	"github.com/110billion/sellfie/usermanagerservice/src/internal/utils"
+	"github.com/110billion/sellfie/usermanagerservice/src/pkg/handle"
+	"github.com/110billion/sellfie/usermanagerservice/src/pkg/server/auth/token"
+	"github.com/gorilla/mux"
+)
+
+// HandleResponse is the response of changing a handle
+type HandleResponse struct {
+	Ok bool `json:"ok"`
+	*handle.Changed
+}
+
+type handleReqBody struct {
+	Handle string `json:"handle"`
+}
+
+// handleHandler changes the handle of the user, i.e., the user_id other users know the user by.
+// Access tokens naming the old handle are revoked, and the client refreshes them to get ones naming the new handle
+func (h *handler) handleHandler(w http.ResponseWriter, req *http.Request) {
+	id := mux.Vars(req)["user_id"]
+
+	claims, _ := token.FromContext(req.Context())
+	if !h.authorizeHandle(w, claims, id, "cannot change the handle of another user") {
+		return
+	}
+
+	// Decode request body
+	handleReq := &handleReqBody{}
+	decoder := json.NewDecoder(req.Body)
+	if err := decoder.Decode(handleReq); err != nil || handleReq.Handle == "" {
+		_ = utils.RespondError(w, http.StatusBadRequest, "request body is not in json form or is malformed")
+		return
+	}
+
+	changed, err := handle.Change(claims.Subject, handleReq.Handle)
+	if cooldownErr, ok := err.(*handle.CooldownError); ok {
+		w.Header().Set("Retry-After", strconv.Itoa(int(cooldownErr.RetryAfter.Seconds())+1))
+		_ = utils.RespondError(w, http.StatusTooManyRequests, err.Error())
+		return
+	}
+	switch err {
+	case nil:
+	case handle.ErrInvalid, handle.ErrUnchanged:
+		_ = utils.RespondError(w, http.StatusBadRequest, err.Error())
+		return
+	case handle.ErrTaken:
+		_ = utils.RespondError(w, http.StatusConflict, err.Error())
+		return
+	case handle.ErrUserNotFound:
+		_ = utils.RespondError(w, http.StatusNotFound, err.Error())
+		return
+	default:
+		h.log.Error(err, "change handle error", "id", id)
+		_ = utils.RespondError(w, http.StatusInternalServerError, "cannot change handle")
+		return
+	}
+
+	_ = utils.RespondJSON(w, HandleResponse{Ok: true, Changed: changed})
+}
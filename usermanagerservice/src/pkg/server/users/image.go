@@ -0,0 +1,217 @@
+/*
+ Copyright 2021 The 110 billion Authors
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package users
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"image"
+	"image/color"
+	"image/draw"
+	_ "image/gif" // Registers the GIF decoder
+	"image/jpeg"
+	_ "image/png" // Registers the PNG decoder
+	"net/http"
+)
+
+// maxImagePixels bounds the images decoded, which take 4 bytes per pixel in memory
+const maxImagePixels = 40 * 1000 * 1000
+
+var (
+	// ErrImageType is returned if the content is not an image of a supported type
+	ErrImageType = errors.New("image must be a jpeg, png or gif")
+	// ErrImageSize is returned if the image is too large to decode
+	ErrImageSize = errors.New("image is too large")
+
+	// imageTypes are the content types of the images which can be decoded, as sniffed by http.DetectContentType
+	imageTypes = map[string]bool{"image/jpeg": true, "image/png": true, "image/gif": true}
+)
+
+// squareImage decodes the image, which is of a type sniffed from its content rather than the one the client claims,
+// and returns its center square, upright as its EXIF orientation says, over a white background.
+// The metadata of the image, e.g., EXIF, is not carried over to the returned pixels
+func squareImage(data []byte) (*image.RGBA, error) {
+	if !imageTypes[http.DetectContentType(data)] {
+		return nil, ErrImageType
+	}
+
+	config, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, ErrImageType
+	}
+	if config.Width <= 0 || config.Height <= 0 || config.Width*config.Height > maxImagePixels {
+		return nil, ErrImageSize
+	}
+
+	src, format, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, ErrImageType
+	}
+
+	bounds := src.Bounds()
+	side := bounds.Dx()
+	if bounds.Dy() < side {
+		side = bounds.Dy()
+	}
+	origin := image.Pt(bounds.Min.X+(bounds.Dx()-side)/2, bounds.Min.Y+(bounds.Dy()-side)/2)
+
+	square := image.NewRGBA(image.Rect(0, 0, side, side))
+	draw.Draw(square, square.Bounds(), image.NewUniform(color.White), image.Point{}, draw.Src)
+	draw.Draw(square, square.Bounds(), src, origin, draw.Over)
+
+	// The center square of the image turned upright is the center square turned upright
+	if format == "jpeg" {
+		return orient(square, jpegOrientation(data)), nil
+	}
+	return square, nil
+}
+
+// orient flips and rotates the square as the EXIF orientation, 1 to 8, says to display it upright
+func orient(src *image.RGBA, orientation int) *image.RGBA {
+	if orientation < 2 || orientation > 8 {
+		return src
+	}
+
+	n := src.Bounds().Dx()
+	dst := image.NewRGBA(src.Bounds())
+	for y := 0; y < n; y++ {
+		for x := 0; x < n; x++ {
+			var sx, sy int
+			switch orientation {
+			case 2:
+				sx, sy = n-1-x, y
+			case 3:
+				sx, sy = n-1-x, n-1-y
+			case 4:
+				sx, sy = x, n-1-y
+			case 5:
+				sx, sy = y, x
+			case 6:
+				sx, sy = y, n-1-x
+			case 7:
+				sx, sy = n-1-y, n-1-x
+			case 8:
+				sx, sy = n-1-y, x
+			}
+			copy(dst.Pix[dst.PixOffset(x, y):dst.PixOffset(x, y)+4], src.Pix[src.PixOffset(sx, sy):src.PixOffset(sx, sy)+4])
+		}
+	}
+	return dst
+}
+
+// jpegOrientation returns the orientation tag of the EXIF of the JPEG, or 1 if it does not have one
+func jpegOrientation(data []byte) int {
+	const (
+		markerSOS         = 0xda
+		markerAPP1        = 0xe1
+		tagOrientation    = 0x0112
+		exifHeaderLength  = 6
+		ifdEntryLength    = 12
+		tiffHeaderLength  = 8
+		segmentLengthSize = 2
+	)
+
+	// Segments follow the SOI marker, up to the start of the scan
+	for i := 2; i+4 <= len(data) && data[i] == 0xff; {
+		marker := data[i+1]
+		length := int(binary.BigEndian.Uint16(data[i+2:]))
+		if marker == markerSOS || length < segmentLengthSize || i+2+length > len(data) {
+			break
+		}
+		segment := data[i+2+segmentLengthSize : i+2+length]
+		i += 2 + length
+
+		if marker != markerAPP1 || !bytes.HasPrefix(segment, []byte("Exif\x00\x00")) {
+			continue
+		}
+		tiff := segment[exifHeaderLength:]
+		if len(tiff) < tiffHeaderLength {
+			return 1
+		}
+		var order binary.ByteOrder
+		switch string(tiff[:2]) {
+		case "II":
+			order = binary.LittleEndian
+		case "MM":
+			order = binary.BigEndian
+		default:
+			return 1
+		}
+
+		ifd := int(order.Uint32(tiff[4:]))
+		if ifd < tiffHeaderLength || ifd+2 > len(tiff) {
+			return 1
+		}
+		entries := int(order.Uint16(tiff[ifd:]))
+		for e := 0; e < entries; e++ {
+			entry := ifd + 2 + e*ifdEntryLength
+			if entry+ifdEntryLength > len(tiff) {
+				return 1
+			}
+			if order.Uint16(tiff[entry:]) == tagOrientation {
+				return int(order.Uint16(tiff[entry+8:]))
+			}
+		}
+		return 1
+	}
+	return 1
+}
+
+// resize scales the square to the side, averaging the source pixels each pixel covers
+func resize(src *image.RGBA, side int) *image.RGBA {
+	n := src.Bounds().Dx()
+	dst := image.NewRGBA(image.Rect(0, 0, side, side))
+
+	for dy := 0; dy < side; dy++ {
+		y0, y1 := dy*n/side, (dy+1)*n/side
+		if y1 == y0 {
+			y1 = y0 + 1
+		}
+		for dx := 0; dx < side; dx++ {
+			x0, x1 := dx*n/side, (dx+1)*n/side
+			if x1 == x0 {
+				x1 = x0 + 1
+			}
+
+			var sum [4]int
+			for y := y0; y < y1; y++ {
+				for x := x0; x < x1; x++ {
+					p := src.Pix[src.PixOffset(x, y):]
+					for c := 0; c < 4; c++ {
+						sum[c] += int(p[c])
+					}
+				}
+			}
+			count := (y1 - y0) * (x1 - x0)
+			p := dst.Pix[dst.PixOffset(dx, dy):]
+			for c := 0; c < 4; c++ {
+				p[c] = uint8(sum[c] / count)
+			}
+		}
+	}
+	return dst
+}
+
+// encodeJPEG encodes the image as a JPEG without any metadata
+func encodeJPEG(img image.Image) ([]byte, error) {
+	buf := &bytes.Buffer{}
+	if err := jpeg.Encode(buf, img, &jpeg.Options{Quality: 85}); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
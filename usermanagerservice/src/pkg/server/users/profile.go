@@ -0,0 +1,219 @@
+/*
+ Copyright 2021 The 110 billion Authors
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package users
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/110billion/sellfie/usermanagerservice/src/internal/utils"
+	"github.com/110billion/sellfie/usermanagerservice/src/pkg/database"
+)
+
+// Limits of the profile fields, in characters
+const (
+	maxNameLength     = 50
+	maxCommentLength  = 300
+	maxImageURLLength = 2048
+)
+
+// Rules of the profile fields, reported in the details of a rejected update
+const (
+	RuleRequired  = "required"
+	RuleMaxLength = "max_length"
+	RuleCharacter = "character"
+	RuleURL       = "url"
+)
+
+var (
+	// ErrProfileNotFound is returned if the user does not have a profile
+	ErrProfileNotFound = errors.New("profile is not found")
+	// ErrProfileModified is returned if the profile is modified since the version the update is based on
+	ErrProfileModified = errors.New("profile is modified by another request, get it again and retry")
+)
+
+// Profile is the public profile of a user, stored in USER_INFO
+type Profile struct {
+	ID        string    `json:"id"`
+	Name      string    `json:"name"`
+	URL       string    `json:"image_url"`
+	Comment   string    `json:"comment"`
+	UpdatedAt time.Time `json:"updated_at"`
+
+	version int64
+}
+
+// ETag returns the entity tag of the version of the profile
+func (p *Profile) ETag() string {
+	return strconv.Quote(strconv.FormatInt(p.version, 10))
+}
+
+// ProfilePatch is the fields of the profile to update. Nil fields are left as they are
+type ProfilePatch struct {
+	Name    *string `json:"name"`
+	URL     *string `json:"image_url"`
+	Comment *string `json:"comment"`
+}
+
+// Empty returns whether the patch does not update any field
+func (p *ProfilePatch) Empty() bool {
+	return p.Name == nil && p.URL == nil && p.Comment == nil
+}
+
+// Normalize trims the spaces around the fields
+func (p *ProfilePatch) Normalize() {
+	for _, field := range []*string{p.Name, p.URL, p.Comment} {
+		if field != nil {
+			*field = strings.TrimSpace(*field)
+		}
+	}
+}
+
+// Validate returns the rules the fields of the patch break
+func (p *ProfilePatch) Validate() []utils.ErrorDetail {
+	var violations []utils.ErrorDetail
+	violate := func(field, rule, format string, args ...interface{}) {
+		violations = append(violations, utils.ErrorDetail{Field: field, Rule: rule, Message: fmt.Sprintf(format, args...)})
+	}
+
+	if p.Name != nil {
+		switch {
+		case *p.Name == "":
+			violate("name", RuleRequired, "name must not be empty")
+		case utf8.RuneCountInString(*p.Name) > maxNameLength:
+			violate("name", RuleMaxLength, "name must be at most %d characters long", maxNameLength)
+		case strings.IndexFunc(*p.Name, unicode.IsControl) >= 0:
+			violate("name", RuleCharacter, "name must not contain control characters")
+		}
+	}
+
+	if p.Comment != nil {
+		switch {
+		case utf8.RuneCountInString(*p.Comment) > maxCommentLength:
+			violate("comment", RuleMaxLength, "comment must be at most %d characters long", maxCommentLength)
+		case strings.IndexFunc(*p.Comment, func(r rune) bool { return unicode.IsControl(r) && r != '\n' }) >= 0:
+			violate("comment", RuleCharacter, "comment must not contain control characters but line feeds")
+		}
+	}
+
+	// An empty url removes the image
+	if p.URL != nil && *p.URL != "" {
+		if len(*p.URL) > maxImageURLLength {
+			violate("image_url", RuleMaxLength, "image_url must be at most %d characters long", maxImageURLLength)
+		} else if u, err := url.Parse(*p.URL); err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+			violate("image_url", RuleURL, "image_url must be an absolute http or https url")
+		}
+	}
+
+	return violations
+}
+
+// getProfile returns the profile of the user
+func getProfile(id string) (*Profile, error) {
+	db, err := database.Connect()
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+
+	p := &Profile{ID: id}
+	err = db.QueryRow("SELECT name, profile_url, profile_comment, updated_at, version FROM USER_INFO WHERE user_id = $1", id).
+		Scan(&p.Name, &p.URL, &p.Comment, &p.UpdatedAt, &p.version)
+	if err == sql.ErrNoRows {
+		return nil, ErrProfileNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// updateProfile applies the patch to the profile of the user, if its version is still one of the etags.
+// Nil etags update any version. The name is kept in USER_TABLE as well.
+// If the patch sets image_url, the prefix of the uploaded avatar it replaces is returned to be deleted
+func updateProfile(id string, etags []string, patch *ProfilePatch) (*Profile, string, error) {
+	db, err := database.Connect()
+	if err != nil {
+		return nil, "", err
+	}
+	defer db.Close()
+
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, "", err
+	}
+	defer func() {
+		_ = tx.Rollback()
+	}()
+
+	p := &Profile{ID: id}
+	var avatarKey string
+	err = tx.QueryRow("SELECT name, profile_url, profile_comment, updated_at, version, avatar_key FROM USER_INFO WHERE user_id = $1 FOR UPDATE", id).
+		Scan(&p.Name, &p.URL, &p.Comment, &p.UpdatedAt, &p.version, &avatarKey)
+	if err == sql.ErrNoRows {
+		return nil, "", ErrProfileNotFound
+	}
+	if err != nil {
+		return nil, "", err
+	}
+	if etags != nil && !contains(etags, p.ETag()) {
+		return nil, "", ErrProfileModified
+	}
+
+	if patch.Name != nil {
+		p.Name = *patch.Name
+	}
+	staleAvatar := ""
+	if patch.URL != nil {
+		p.URL = *patch.URL
+		staleAvatar, avatarKey = avatarKey, ""
+	}
+	if patch.Comment != nil {
+		p.Comment = *patch.Comment
+	}
+
+	if err := tx.QueryRow(`UPDATE USER_INFO SET name = $2, profile_url = $3, profile_comment = $4, avatar_key = $5, updated_at = NOW(), version = version + 1
+		WHERE user_id = $1 RETURNING updated_at, version`, id, p.Name, p.URL, p.Comment, avatarKey).Scan(&p.UpdatedAt, &p.version); err != nil {
+		return nil, "", err
+	}
+	if patch.Name != nil {
+		if _, err := tx.Exec("UPDATE USER_TABLE SET name = $2 WHERE user_id = $1", id, p.Name); err != nil {
+			return nil, "", err
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, "", err
+	}
+	return p, staleAvatar, nil
+}
+
+func contains(values []string, s string) bool {
+	for _, v := range values {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
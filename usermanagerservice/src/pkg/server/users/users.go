@@ -0,0 +1,217 @@
+/*
+ Copyright 2021 The 110 billion Authors
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package users
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"github.com/110billion/sellfie/usermanagerservice/src/internal/apiserver"
+	"github.com/110billion/sellfie/usermanagerservice/src/internal/utils"
+	"github.com/110billion/sellfie/usermanagerservice/src/internal/wrapper"
+	"github.com/110billion/sellfie/usermanagerservice/src/pkg/handle"
+	"github.com/110billion/sellfie/usermanagerservice/src/pkg/role"
+	"github.com/110billion/sellfie/usermanagerservice/src/pkg/server/auth/token"
+	"github.com/go-logr/logr"
+	"github.com/gorilla/mux"
+)
+
+// Response is common struct for responding actions on an account
+type Response struct {
+	Ok bool `json:"ok"`
+}
+
+// ProfileResponse is the response of getting and updating a profile
+type ProfileResponse struct {
+	Ok      bool     `json:"ok"`
+	Profile *Profile `json:"profile"`
+}
+
+type handler struct {
+	log logr.Logger
+}
+
+// NewHandler instantiates a new users api handler
+func NewHandler(parent wrapper.RouterWrapper, logger logr.Logger) (apiserver.APIHandler, error) {
+	handler := &handler{log: logger}
+
+	// /users
+	usersWrapper := wrapper.New("/users", nil, nil)
+	// Old handles of a user keep working for a while
+	usersWrapper.Use(handle.Redirect("user_id"))
+	if err := parent.Add(usersWrapper); err != nil {
+		return nil, err
+	}
+
+	// /users/{user_id}
+	accountWrapper := wrapper.New("/{user_id}", []string{http.MethodDelete}, handler.deleteHandler)
+	accountWrapper.Use(token.Authenticate)
+	if err := usersWrapper.Add(accountWrapper); err != nil {
+		return nil, err
+	}
+
+	// /users/{user_id}/restore
+	restoreWrapper := wrapper.New("/restore", []string{http.MethodPost}, handler.restoreHandler)
+	if err := accountWrapper.Add(restoreWrapper); err != nil {
+		return nil, err
+	}
+
+	// /users/{user_id}/handle
+	handleWrapper := wrapper.New("/handle", []string{http.MethodPut}, handler.handleHandler)
+	if err := accountWrapper.Add(handleWrapper); err != nil {
+		return nil, err
+	}
+
+	// /users/{user_id}/exports
+	exportsWrapper := wrapper.New("/exports", []string{http.MethodPost}, handler.createExportHandler)
+	if err := accountWrapper.Add(exportsWrapper); err != nil {
+		return nil, err
+	}
+
+	// /users/{user_id}/exports/{job_id}
+	exportWrapper := wrapper.New("/{job_id}", []string{http.MethodGet}, handler.exportHandler)
+	if err := exportsWrapper.Add(exportWrapper); err != nil {
+		return nil, err
+	}
+
+	// /exports/{job_id}/download
+	downloadWrapper := wrapper.New("/exports/{job_id}/download", []string{http.MethodGet}, handler.downloadHandler)
+	if err := parent.Add(downloadWrapper); err != nil {
+		return nil, err
+	}
+
+	// /users/{user_id}/profile
+	profileWrapper := wrapper.New("/{user_id}/profile", []string{http.MethodGet, http.MethodPatch}, handler.profileHandler)
+	profileWrapper.Use(token.Authenticate)
+	if err := usersWrapper.Add(profileWrapper); err != nil {
+		return nil, err
+	}
+
+	// /users/{user_id}/avatar
+	avatarWrapper := wrapper.New("/{user_id}/avatar", []string{http.MethodPut, http.MethodDelete}, handler.avatarHandler)
+	avatarWrapper.Use(token.Authenticate)
+	if err := usersWrapper.Add(avatarWrapper); err != nil {
+		return nil, err
+	}
+
+	return handler, nil
+}
+
+func (h *handler) profileHandler(w http.ResponseWriter, req *http.Request) {
+	if req.Method == http.MethodPatch {
+		h.updateHandler(w, req)
+		return
+	}
+
+	profile, err := getProfile(mux.Vars(req)["user_id"])
+	if err == ErrProfileNotFound {
+		_ = utils.RespondError(w, http.StatusNotFound, err.Error())
+		return
+	}
+	if err != nil {
+		h.log.Error(err, "get profile error")
+		_ = utils.RespondError(w, http.StatusInternalServerError, "cannot get profile")
+		return
+	}
+
+	w.Header().Set("ETag", profile.ETag())
+	_ = utils.RespondJSON(w, ProfileResponse{Ok: true, Profile: profile})
+}
+
+// updateHandler updates the fields of the profile in the request body.
+// The request must be conditional on the ETag of the profile it is based on, so that it does not overwrite another update
+func (h *handler) updateHandler(w http.ResponseWriter, req *http.Request) {
+	id := mux.Vars(req)["user_id"]
+
+	if !h.authorizeOwner(w, req, id) {
+		return
+	}
+
+	ifMatch := req.Header.Get("If-Match")
+	if ifMatch == "" {
+		_ = utils.RespondError(w, http.StatusPreconditionRequired, "If-Match header with the ETag of the profile is required")
+		return
+	}
+	var etags []string
+	if strings.TrimSpace(ifMatch) != "*" {
+		etags = []string{}
+		for _, etag := range strings.Split(ifMatch, ",") {
+			etags = append(etags, strings.TrimSpace(etag))
+		}
+	}
+
+	// Decode request body
+	patch := &ProfilePatch{}
+	decoder := json.NewDecoder(req.Body)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(patch); err != nil || patch.Empty() {
+		_ = utils.RespondError(w, http.StatusBadRequest, "request body is not in json form or is malformed")
+		return
+	}
+	patch.Normalize()
+	if violations := patch.Validate(); len(violations) > 0 {
+		_ = utils.RespondErrorDetails(w, http.StatusBadRequest, "profile is not valid", violations)
+		return
+	}
+
+	profile, staleAvatar, err := updateProfile(id, etags, patch)
+	switch err {
+	case nil:
+	case ErrProfileNotFound:
+		_ = utils.RespondError(w, http.StatusNotFound, err.Error())
+		return
+	case ErrProfileModified:
+		_ = utils.RespondError(w, http.StatusPreconditionFailed, err.Error())
+		return
+	default:
+		h.log.Error(err, "update profile error", "id", id)
+		_ = utils.RespondError(w, http.StatusInternalServerError, "cannot update profile")
+		return
+	}
+
+	// An image_url set by the user replaces the uploaded avatar
+	h.deleteAvatar(req.Context(), staleAvatar)
+
+	w.Header().Set("ETag", profile.ETag())
+	_ = utils.RespondJSON(w, ProfileResponse{Ok: true, Profile: profile})
+}
+
+// authorizeOwner responds with an error unless the user of the request owns the profile of the id or is an admin
+func (h *handler) authorizeOwner(w http.ResponseWriter, req *http.Request, id string) bool {
+	claims, _ := token.FromContext(req.Context())
+	if claims.Role == role.Admin {
+		return true
+	}
+	return h.authorizeHandle(w, claims, id, "cannot edit the profile of another user")
+}
+
+// authorizeHandle responds with an error unless id is the current handle of the user of the claims.
+// Handles are looked up, as the token identifies the user by user_uuid and carries the handle only for display
+func (h *handler) authorizeHandle(w http.ResponseWriter, claims *token.Claims, id, forbidden string) bool {
+	owns, err := handle.Owns(id, claims.Subject)
+	if err != nil {
+		h.log.Error(err, "cannot look up handle", "id", id)
+		_ = utils.RespondError(w, http.StatusInternalServerError, "cannot look up user")
+		return false
+	}
+	if !owns {
+		_ = utils.RespondError(w, http.StatusForbidden, forbidden)
+		return false
+	}
+	return true
+}
@@ -0,0 +1,61 @@
+/*
+ Copyright 2021 The 110 billion Authors
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package wellknown
+
+import (
+	"net/http"
+
+	"github.com/110billion/sellfie/usermanagerservice/src/internal/apiserver"
+	"github.com/110billion/sellfie/usermanagerservice/src/internal/utils"
+	"github.com/110billion/sellfie/usermanagerservice/src/internal/wrapper"
+	"github.com/110billion/sellfie/usermanagerservice/src/pkg/server/auth/token"
+	"github.com/go-logr/logr"
+)
+
+// jwksMaxAge is how long verifiers may cache the JWKS. It must be shorter than the key overlap window
+const jwksMaxAge = "300"
+
+type handler struct {
+	log logr.Logger
+}
+
+// NewHandler instantiates a new well-known api handler
+func NewHandler(parent wrapper.RouterWrapper, logger logr.Logger) (apiserver.APIHandler, error) {
+	handler := &handler{log: logger}
+
+	// /.well-known
+	wellKnownWrapper := wrapper.New("/.well-known", nil, nil)
+	if err := parent.Add(wellKnownWrapper); err != nil {
+		return nil, err
+	}
+
+	// /.well-known/jwks.json
+	jwksWrapper := wrapper.New("/jwks.json", []string{http.MethodGet}, handler.jwksHandler)
+	if err := wellKnownWrapper.Add(jwksWrapper); err != nil {
+		return nil, err
+	}
+
+	return handler, nil
+}
+
+// jwksHandler serves the public keys verifying the tokens issued by the user manager
+func (h *handler) jwksHandler(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Cache-Control", "public, max-age="+jwksMaxAge)
+	if err := utils.RespondJSON(w, token.JWKS()); err != nil {
+		h.log.Error(err, "jwks error")
+	}
+}
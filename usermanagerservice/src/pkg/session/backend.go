@@ -0,0 +1,95 @@
+/*
+ Copyright 2021 The 110 billion Authors
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package session
+
+import (
+	"sync"
+	"time"
+)
+
+// Backend keeps the values of the sessions server-side, keyed by the hash of the session id
+type Backend interface {
+	// Load returns the encoded values of the session, or found=false if it does not exist or is expired
+	Load(key string) (data []byte, found bool, err error)
+	// Save stores the encoded values of the session until expiresAt
+	Save(key string, data []byte, expiresAt time.Time) error
+	// Delete deletes the session
+	Delete(key string) error
+	// Cleanup deletes the sessions expired before now, and returns how many are deleted
+	Cleanup(now time.Time) (int64, error)
+}
+
+// MemoryBackend is a Backend in memory, for a single replica and tests
+type MemoryBackend struct {
+	lock     sync.Mutex
+	sessions map[string]memorySession
+}
+
+type memorySession struct {
+	data      []byte
+	expiresAt time.Time
+}
+
+// NewMemoryBackend returns an empty MemoryBackend
+func NewMemoryBackend() *MemoryBackend {
+	return &MemoryBackend{sessions: map[string]memorySession{}}
+}
+
+// Load returns the encoded values of the session
+func (b *MemoryBackend) Load(key string) ([]byte, bool, error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	s, ok := b.sessions[key]
+	if !ok || !s.expiresAt.After(time.Now()) {
+		return nil, false, nil
+	}
+	return s.data, true, nil
+}
+
+// Save stores the encoded values of the session
+func (b *MemoryBackend) Save(key string, data []byte, expiresAt time.Time) error {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	b.sessions[key] = memorySession{data: data, expiresAt: expiresAt}
+	return nil
+}
+
+// Delete deletes the session
+func (b *MemoryBackend) Delete(key string) error {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	delete(b.sessions, key)
+	return nil
+}
+
+// Cleanup deletes the expired sessions
+func (b *MemoryBackend) Cleanup(now time.Time) (int64, error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	var n int64
+	for k, s := range b.sessions {
+		if !s.expiresAt.After(now) {
+			delete(b.sessions, k)
+			n++
+		}
+	}
+	return n, nil
+}
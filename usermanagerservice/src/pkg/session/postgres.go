@@ -0,0 +1,86 @@
+/*
+ Copyright 2021 The 110 billion Authors
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package session
+
+import (
+	"database/sql"
+	"time"
+
+	"github.com/110billion/sellfie/usermanagerservice/src/pkg/database"
+)
+
+// PostgresBackend is a Backend in the HTTP_SESSION table, shared by every replica
+type PostgresBackend struct{}
+
+// Load returns the encoded values of the session
+func (b *PostgresBackend) Load(key string) ([]byte, bool, error) {
+	db, err := database.Connect()
+	if err != nil {
+		return nil, false, err
+	}
+	defer db.Close()
+
+	var data []byte
+	err = db.QueryRow("SELECT data FROM HTTP_SESSION WHERE session_hash = $1 AND expires_at > NOW()", key).Scan(&data)
+	if err == sql.ErrNoRows {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	return data, true, nil
+}
+
+// Save stores the encoded values of the session
+func (b *PostgresBackend) Save(key string, data []byte, expiresAt time.Time) error {
+	db, err := database.Connect()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	_, err = db.Exec(`INSERT INTO HTTP_SESSION (session_hash, data, expires_at) VALUES($1, $2, $3)
+		ON CONFLICT (session_hash) DO UPDATE SET data = EXCLUDED.data, expires_at = EXCLUDED.expires_at`, key, data, expiresAt)
+	return err
+}
+
+// Delete deletes the session
+func (b *PostgresBackend) Delete(key string) error {
+	db, err := database.Connect()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	_, err = db.Exec("DELETE FROM HTTP_SESSION WHERE session_hash = $1", key)
+	return err
+}
+
+// Cleanup deletes the expired sessions
+func (b *PostgresBackend) Cleanup(now time.Time) (int64, error) {
+	db, err := database.Connect()
+	if err != nil {
+		return 0, err
+	}
+	defer db.Close()
+
+	result, err := db.Exec("DELETE FROM HTTP_SESSION WHERE expires_at <= $1", now)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
@@ -0,0 +1,153 @@
+/*
+ Copyright 2021 The 110 billion Authors
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package session
+
+import (
+	"crypto/rand"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/110billion/sellfie/usermanagerservice/src/internal/utils"
+	"github.com/gorilla/sessions"
+	logf "sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+const (
+	// BackendPostgres keeps the sessions in Postgres, shared by every replica
+	BackendPostgres = "postgres"
+	// BackendMemory keeps the sessions in memory, for a single replica and tests
+	BackendMemory = "memory"
+)
+
+var (
+	log = logf.Log.WithName("session")
+
+	// maxAge is how long a session lasts, if its cookie does not set MaxAge
+	maxAge = utils.DurationFromEnv("SESSION_MAX_AGE", 24*time.Hour)
+	// cleanupInterval is how often the expired sessions are deleted
+	cleanupInterval = utils.DurationFromEnv("SESSION_CLEANUP_INTERVAL", 10*time.Minute)
+
+	storeLock   sync.RWMutex
+	store       = NewStore(NewMemoryBackend(), randomKey())
+	cleanupOnce sync.Once
+)
+
+// Init configures the session store by the environment variables below, and starts deleting the expired sessions
+//   - SESSION_STORE: postgres or memory. Defaults to postgres
+//   - SESSION_KEYS: comma-separated keys, the newest first. Cookies are encoded with the first key, and decoded with any of them.
+//     To rotate the keys, prepend a new key, and drop the oldest one once the sessions encoded with it expired
+//   - SESSION_SECRET: the key, if SESSION_KEYS is not set
+//   - SESSION_COOKIE_INSECURE: if true, cookies are sent over plain HTTP too, for local development
+func Init() error {
+	kind := os.Getenv("SESSION_STORE")
+	if kind == "" {
+		kind = BackendPostgres
+	}
+
+	var backend Backend
+	switch kind {
+	case BackendPostgres:
+		backend = &PostgresBackend{}
+	case BackendMemory:
+		backend = NewMemoryBackend()
+	default:
+		return fmt.Errorf("unknown session store %s", kind)
+	}
+
+	SetStore(NewStore(backend, keysFromEnv()...))
+	cleanupOnce.Do(func() {
+		go cleanup()
+	})
+	return nil
+}
+
+// SetStore replaces the session store, e.g., with a store of a MemoryBackend in tests
+func SetStore(s *Store) {
+	storeLock.Lock()
+	defer storeLock.Unlock()
+	store = s
+}
+
+// Get returns the session of the name of the request
+func Get(r *http.Request, name string) (*sessions.Session, error) {
+	storeLock.RLock()
+	defer storeLock.RUnlock()
+	return store.Get(r, name)
+}
+
+// DefaultOptions returns the default options of the session cookies, which are Secure, HttpOnly and SameSite=Lax
+func DefaultOptions() *sessions.Options {
+	return &sessions.Options{
+		Path:     "/",
+		MaxAge:   int(maxAge.Seconds()),
+		Secure:   os.Getenv("SESSION_COOKIE_INSECURE") != "true",
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	}
+}
+
+// keysFromEnv returns the keys of SESSION_KEYS or SESSION_SECRET.
+// A random key is used if neither is set, which does not work with multiple replicas
+func keysFromEnv() [][]byte {
+	var keys [][]byte
+	for _, key := range strings.Split(os.Getenv("SESSION_KEYS"), ",") {
+		if key = strings.TrimSpace(key); key != "" {
+			keys = append(keys, []byte(key))
+		}
+	}
+	if len(keys) == 0 && os.Getenv("SESSION_SECRET") != "" {
+		keys = append(keys, []byte(os.Getenv("SESSION_SECRET")))
+	}
+	if len(keys) == 0 {
+		log.Info("SESSION_KEYS is not set, sessions are signed with a random key")
+		keys = append(keys, randomKey())
+	}
+	return keys
+}
+
+// cleanup deletes the expired sessions every cleanupInterval
+func cleanup() {
+	ticker := time.NewTicker(cleanupInterval)
+	defer ticker.Stop()
+
+	for now := range ticker.C {
+		storeLock.RLock()
+		backend := store.Backend
+		storeLock.RUnlock()
+
+		n, err := backend.Cleanup(now)
+		if err != nil {
+			log.Error(err, "cannot delete expired sessions")
+			continue
+		}
+		if n > 0 {
+			log.Info("deleted expired sessions", "count", n)
+		}
+	}
+}
+
+func randomKey() []byte {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		panic(err)
+	}
+	return key
+}
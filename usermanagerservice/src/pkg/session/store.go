@@ -0,0 +1,150 @@
+/*
+ Copyright 2021 The 110 billion Authors
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package session
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/securecookie"
+	"github.com/gorilla/sessions"
+)
+
+// Store is a sessions.Store keeping the values of the sessions server-side.
+// The cookie only carries the session id, signed and encrypted with the keys of the store,
+// so that the values cannot be forged and a session is revoked by deleting it from the backend
+type Store struct {
+	Codecs  []securecookie.Codec
+	Options *sessions.Options
+	Backend Backend
+}
+
+// NewStore returns the store of the sessions in the backend, whose cookies are encoded with the first key.
+// The other keys are only used to decode the cookies, so that the keys can be rotated without logging everyone out
+func NewStore(backend Backend, keys ...[]byte) *Store {
+	codecs := make([]securecookie.Codec, 0, len(keys))
+	for _, key := range keys {
+		hashKey, blockKey := deriveKeys(key)
+		codecs = append(codecs, securecookie.New(hashKey, blockKey))
+	}
+	return &Store{Codecs: codecs, Options: DefaultOptions(), Backend: backend}
+}
+
+// Get returns the session of the name, cached in the registry of the request
+func (s *Store) Get(r *http.Request, name string) (*sessions.Session, error) {
+	return sessions.GetRegistry(r).Get(s, name)
+}
+
+// New returns the session of the name loaded from the backend, or a new one if the request does not have it.
+// As with the other gorilla stores, a new session is returned along with the error if the cookie cannot be decoded
+func (s *Store) New(r *http.Request, name string) (*sessions.Session, error) {
+	session := sessions.NewSession(s, name)
+	options := *s.Options
+	session.Options = &options
+	session.IsNew = true
+
+	c, err := r.Cookie(name)
+	if err != nil {
+		return session, nil
+	}
+	var id string
+	if err := securecookie.DecodeMulti(name, c.Value, &id, s.Codecs...); err != nil {
+		return session, err
+	}
+
+	data, found, err := s.Backend.Load(hashID(id))
+	if err != nil {
+		return session, err
+	}
+	// The session expired or is revoked
+	if !found {
+		return session, nil
+	}
+	if err := (securecookie.GobEncoder{}).Deserialize(data, &session.Values); err != nil {
+		return session, err
+	}
+	session.ID = id
+	session.IsNew = false
+	return session, nil
+}
+
+// Save stores the values of the session in the backend and sets its cookie.
+// A session with a negative MaxAge is deleted from the backend and its cookie is cleared
+func (s *Store) Save(_ *http.Request, w http.ResponseWriter, session *sessions.Session) error {
+	if session.Options.MaxAge < 0 {
+		if session.ID != "" {
+			if err := s.Backend.Delete(hashID(session.ID)); err != nil {
+				return err
+			}
+		}
+		http.SetCookie(w, sessions.NewCookie(session.Name(), "", session.Options))
+		return nil
+	}
+
+	if session.ID == "" {
+		id, err := newID()
+		if err != nil {
+			return err
+		}
+		session.ID = id
+	}
+
+	data, err := securecookie.GobEncoder{}.Serialize(session.Values)
+	if err != nil {
+		return err
+	}
+	// A cookie without MaxAge lasts until the browser is closed, which the server cannot tell
+	lifetime := time.Duration(session.Options.MaxAge) * time.Second
+	if lifetime == 0 {
+		lifetime = maxAge
+	}
+	if err := s.Backend.Save(hashID(session.ID), data, time.Now().Add(lifetime)); err != nil {
+		return err
+	}
+
+	encoded, err := securecookie.EncodeMulti(session.Name(), session.ID, s.Codecs...)
+	if err != nil {
+		return err
+	}
+	http.SetCookie(w, sessions.NewCookie(session.Name(), encoded, session.Options))
+	return nil
+}
+
+// deriveKeys derives the HMAC key and the AES-256 key of the cookies from the key
+func deriveKeys(key []byte) (hashKey, blockKey []byte) {
+	hash := sha256.Sum256(append([]byte("session-hash-key:"), key...))
+	block := sha256.Sum256(append([]byte("session-block-key:"), key...))
+	return hash[:], block[:]
+}
+
+func newID() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// hashID returns the key of the session in the backend. Only the hash of the id is stored
+func hashID(id string) string {
+	sum := sha256.Sum256([]byte(id))
+	return hex.EncodeToString(sum[:])
+}